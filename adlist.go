@@ -165,6 +165,19 @@ func listIndex(l *list, index int64) *listNode {
 	return n
 }
 
+func listSearchKey(l *list, key interface{}) *listNode {
+	//Walk the list from the head and return the first node whose value equals the key.
+	n := l.head
+	for n != nil {
+		if *n.value == key {
+			return n
+		}
+		n = n.next
+	}
+	//Return nil if no node matches the key.
+	return nil
+}
+
 func listLength(l *list) int64 {
 	return l.len
 }
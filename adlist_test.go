@@ -206,3 +206,25 @@ func TestListInsertNode(t *testing.T) {
 	}
 
 }
+
+func TestListSearchKey(t *testing.T) {
+	l := listCreate()
+
+	firstNode := "first node"
+	firstV := interface{}(&firstNode)
+	listAddNodeTail(l, &firstV)
+
+	secondNode := "second node"
+	secV := interface{}(&secondNode)
+	listAddNodeTail(l, &secV)
+
+	node := listSearchKey(l, &secondNode)
+	if node == nil || node != l.tail {
+		t.Fatal("listSearchKey failed to locate the tail node.")
+	}
+
+	missingNode := "second node"
+	if listSearchKey(l, &missingNode) != nil {
+		t.Fatal("listSearchKey matched a different pointer with the same content.")
+	}
+}
@@ -0,0 +1,996 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	/* Append only defines */
+	AOF_FSYNC_NO       = 0
+	AOF_FSYNC_ALWAYS   = 1
+	AOF_FSYNC_EVERYSEC = 2
+
+	/* AOF states */
+	REDIS_AOF_OFF          = 0 /* AOF is off */
+	REDIS_AOF_ON           = 1 /* AOF is on */
+	REDIS_AOF_WAIT_REWRITE = 2 /* AOF waits rewrite to start appending */
+
+	REDIS_AOF_REWRITE_ITEMS_PER_CMD = 64
+
+	/* AOF manifest definition */
+	AOF_FILE_TYPE_BASE = 'b' /* BASE file */
+	AOF_FILE_TYPE_HIST = 'h' /* HISTORY file */
+	AOF_FILE_TYPE_INCR = 'i' /* INCR file */
+
+	BASE_FILE_SUFFIX      = ".base"
+	INCR_FILE_SUFFIX      = ".incr"
+	AOF_FORMAT_SUFFIX     = ".aof"
+	MANIFEST_NAME_SUFFIX  = ".manifest"
+	TEMP_FILE_NAME_PREFIX = "temp-"
+)
+
+var errAofTruncated = errors.New("unexpected end of file")
+
+/*
+*
+the AOF is made of several files stored in the appenddirname directory: the BASE
+file written by the last rewrite, and the INCR files the commands executed after
+the rewrite are appended to. the manifest lists the files in the order they are
+loaded, one per line:
+
+	file appendonly.aof.1.base.aof seq 1 type b
+	file appendonly.aof.1.incr.aof seq 1 type i
+*/
+type aofInfo struct {
+	fileName string
+	fileSeq  int64
+	fileType byte
+}
+
+type aofManifest struct {
+	baseAofInfo     *aofInfo   /* BASE file information. nil if there is no BASE file. */
+	incrAofList     []*aofInfo /* INCR AOFs list. We may have multiple INCR AOF when rewrite fails. */
+	currBaseFileSeq int64      /* The sequence number used by the current BASE file. */
+	currIncrFileSeq int64      /* The sequence number used by the current INCR file. */
+}
+
+func aofManifestDup(am *aofManifest) *aofManifest {
+	dup := *am
+	dup.incrAofList = append([]*aofInfo(nil), am.incrAofList...)
+	return &dup
+}
+
+func getAofManifestFileName() string {
+	return server.aofFilename + MANIFEST_NAME_SUFFIX
+}
+
+func getNewBaseAofName(seq int64) string {
+	return fmt.Sprintf("%s.%d%s%s", server.aofFilename, seq, BASE_FILE_SUFFIX, AOF_FORMAT_SUFFIX)
+}
+
+func getNewIncrAofName(seq int64) string {
+	return fmt.Sprintf("%s.%d%s%s", server.aofFilename, seq, INCR_FILE_SUFFIX, AOF_FORMAT_SUFFIX)
+}
+
+// the file names containing spaces or quotes are quoted, so that the line can be split again.
+func aofInfoFormat(ai *aofInfo) string {
+	name := ai.fileName
+	if strings.ContainsAny(name, " \t\r\n\"'\\") {
+		name = sdscatrepr(name)
+	}
+	return fmt.Sprintf("file %s seq %d type %c\n", name, ai.fileSeq, ai.fileType)
+}
+
+func getAofManifestAsString(am *aofManifest) string {
+	var b strings.Builder
+	if am.baseAofInfo != nil {
+		b.WriteString(aofInfoFormat(am.baseAofInfo))
+	}
+	for _, ai := range am.incrAofList {
+		b.WriteString(aofInfoFormat(ai))
+	}
+	return b.String()
+}
+
+// parse the content of a manifest file.
+func aofLoadManifestFromString(content string) (*aofManifest, error) {
+	am := &aofManifest{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		argv, ok := sdssplitargs(line)
+		if !ok || len(argv) < 6 || len(argv)%2 != 0 {
+			return nil, errors.New("Invalid AOF manifest file format")
+		}
+		ai := &aofInfo{}
+		for i := 0; i < len(argv); i += 2 {
+			switch argv[i] {
+			case "file":
+				ai.fileName = argv[i+1]
+			case "seq":
+				ai.fileSeq, _ = strconv.ParseInt(argv[i+1], 10, 64)
+			case "type":
+				if len(argv[i+1]) == 1 {
+					ai.fileType = argv[i+1][0]
+				}
+			}
+			//unknown keys are ignored, for forward compatibility.
+		}
+		if ai.fileName == "" || ai.fileSeq <= 0 || ai.fileType == 0 || filepath.Base(ai.fileName) != ai.fileName {
+			return nil, errors.New("Invalid AOF manifest file format")
+		}
+
+		switch ai.fileType {
+		case AOF_FILE_TYPE_BASE:
+			if am.baseAofInfo != nil {
+				return nil, errors.New("Found duplicate base file information")
+			}
+			am.baseAofInfo = ai
+			am.currBaseFileSeq = ai.fileSeq
+		case AOF_FILE_TYPE_INCR:
+			if ai.fileSeq <= am.currIncrFileSeq {
+				return nil, errors.New("Found a non-monotonic sequence number")
+			}
+			am.incrAofList = append(am.incrAofList, ai)
+			am.currIncrFileSeq = ai.fileSeq
+		case AOF_FILE_TYPE_HIST:
+			//the history files are removed once a rewrite is installed, nothing to load.
+		default:
+			return nil, errors.New("Unknown AOF file type")
+		}
+	}
+	return am, nil
+}
+
+// load the manifest at startup, an empty manifest is used if it does not exist yet.
+func aofLoadManifestFromDisk() error {
+	content, err := os.ReadFile(filepath.Join(server.aofDirname, getAofManifestFileName()))
+	if os.IsNotExist(err) {
+		server.aofManifest = &aofManifest{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	am, err := aofLoadManifestFromString(string(content))
+	if err != nil {
+		return err
+	}
+	server.aofManifest = am
+	return nil
+}
+
+// write the manifest into a temp file that replaces the manifest atomically.
+func persistAofManifest(am *aofManifest) error {
+	manifestPath := filepath.Join(server.aofDirname, getAofManifestFileName())
+	tmpPath := filepath.Join(server.aofDirname, TEMP_FILE_NAME_PREFIX+getAofManifestFileName())
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(getAofManifestAsString(am))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, manifestPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("Can't persist the AOF manifest file %s: %s", manifestPath, err)
+	}
+	//make sure the rename is persisted.
+	if dir, err := os.Open(server.aofDirname); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
+
+/*
+*
+move the AOF written in the single file layout into the AOF directory,
+it becomes the BASE file of the new manifest.
+*/
+func aofUpgradePrepare() error {
+	if err := os.MkdirAll(server.aofDirname, 0755); err != nil {
+		return err
+	}
+	am := &aofManifest{currBaseFileSeq: 1}
+	am.baseAofInfo = &aofInfo{fileName: server.aofFilename, fileSeq: 1, fileType: AOF_FILE_TYPE_BASE}
+	if err := os.Rename(server.aofFilename, filepath.Join(server.aofDirname, server.aofFilename)); err != nil {
+		return err
+	}
+	if err := persistAofManifest(am); err != nil {
+		return err
+	}
+	server.aofManifest = am
+	redisLog(REDIS_NOTICE, "Successfully migrated an old-style AOF into the AOF directory %s", server.aofDirname)
+	return nil
+}
+
+/*
+*
+create the RESP representation of a command, the format used by the append only file
+is the same of the multi bulk requests sent by the clients.
+*/
+func catAppendOnlyGenericCommand(dst []byte, argv []string) []byte {
+	dst = append(dst, '*')
+	dst = strconv.AppendInt(dst, int64(len(argv)), 10)
+	dst = append(dst, '\r', '\n')
+	for _, arg := range argv {
+		dst = append(dst, '$')
+		dst = strconv.AppendInt(dst, int64(len(arg)), 10)
+		dst = append(dst, '\r', '\n')
+		dst = append(dst, arg...)
+		dst = append(dst, '\r', '\n')
+	}
+	return dst
+}
+
+/*
+*
+translate EXPIRE, PEXPIRE and EXPIREAT into PEXPIREAT, the relative times are converted
+to absolute ones so that the key expires at the same time when the file is loaded.
+*/
+func catAppendOnlyExpireAtCommand(dst []byte, cmdName string, key *robj, seconds *robj) []byte {
+	when, err := strconv.ParseInt(seconds.String(), 10, 64)
+	if err != nil {
+		panic("the expire time of a propagated command is not an integer")
+	}
+	//convert the seconds to milliseconds.
+	if cmdName == "EXPIRE" || cmdName == "EXPIREAT" {
+		when *= 1000
+	}
+	//convert the relative times into absolute ones.
+	if cmdName == "EXPIRE" || cmdName == "PEXPIRE" {
+		when += time.Now().UnixMilli()
+	}
+	return catAppendOnlyGenericCommand(dst, []string{"PEXPIREAT", key.String(), strconv.FormatInt(when, 10)})
+}
+
+// append a command executed against the DB dictid to the AOF buffer, flushed by beforeSleep.
+func feedAppendOnlyFile(cmd *redisCommand, dictid int, argv []*robj) {
+	buf := make([]byte, 0)
+	//the DB this command was targeting is not the same as the last command we appended, emit a SELECT.
+	if dictid != server.aofSelectedDb {
+		buf = catAppendOnlyGenericCommand(buf, []string{"SELECT", strconv.Itoa(dictid)})
+		server.aofSelectedDb = dictid
+	}
+
+	args := make([]string, len(argv))
+	for j, o := range argv {
+		args[j] = o.String()
+	}
+	switch cmd.name {
+	case "EXPIRE", "PEXPIRE", "EXPIREAT":
+		buf = catAppendOnlyExpireAtCommand(buf, cmd.name, argv[1], argv[2])
+	case "SET":
+		//translate SET [EX seconds][PX milliseconds] to SET and PEXPIREAT.
+		buf = catAppendOnlyGenericCommand(buf, args[:3])
+		for j := 3; j < len(args)-1; j++ {
+			option := strings.ToLower(args[j])
+			if option == "ex" {
+				buf = catAppendOnlyExpireAtCommand(buf, "EXPIRE", argv[1], argv[j+1])
+			} else if option == "px" {
+				buf = catAppendOnlyExpireAtCommand(buf, "PEXPIRE", argv[1], argv[j+1])
+			}
+		}
+	default:
+		buf = catAppendOnlyGenericCommand(buf, args)
+	}
+
+	if server.aofState == REDIS_AOF_ON {
+		server.aofBuf = append(server.aofBuf, buf...)
+	}
+	//if a background rewrite is in progress, the differences between the dataset and the rewritten AOF are accumulated.
+	if server.aofChildRunning {
+		server.aofRewriteBuf = append(server.aofRewriteBuf, buf...)
+	}
+}
+
+/*
+*
+write the AOF buffer on disk: with the always policy the file is fsynced before the
+replies are sent, with everysec a background fsync is started at most once per second.
+when a background fsync is still in progress the write is postponed for up to two
+seconds, as the write would block on the busy disk anyway.
+*/
+func flushAppendOnlyFile(force bool) {
+	now := time.Now().Unix()
+	if len(server.aofBuf) == 0 {
+		//with everysec the data written during the last second may still need a fsync.
+		if server.aofFsync == AOF_FSYNC_EVERYSEC && server.aofFsyncOffset != server.aofCurrentSize &&
+			now > server.aofLastFsync && !server.aofFsyncInProgress.Load() {
+			aofBackgroundFsync(server.aofFd)
+			server.aofLastFsync = now
+		}
+		return
+	}
+
+	if server.aofFsync == AOF_FSYNC_EVERYSEC && !force && server.aofFsyncInProgress.Load() {
+		if server.aofFlushPostponedStart == 0 {
+			server.aofFlushPostponedStart = now
+			return
+		} else if now-server.aofFlushPostponedStart < 2 {
+			return
+		}
+		//otherwise fall through, and go write since we can't wait over two seconds.
+		server.aofDelayedFsync++
+		redisLog(REDIS_NOTICE, "Asynchronous AOF fsync is taking too long (disk is busy?). Writing the AOF buffer without waiting for fsync to complete, this may slow down Redis.")
+	}
+	server.aofFlushPostponedStart = 0
+
+	n, err := server.aofFd.Write(server.aofBuf)
+	if err != nil {
+		redisLog(REDIS_WARNING, "Error writing to the AOF file: %s", err)
+		//a partial write is removed, the whole buffer is written again at the next attempt.
+		if n > 0 {
+			if truncErr := server.aofFd.Truncate(server.aofLastIncrSize); truncErr != nil {
+				redisLog(REDIS_WARNING, "Could not remove short write from the append-only file. Redis may refuse to load the AOF the next time it starts. ftruncate: %s", truncErr)
+				server.aofCurrentSize += int64(n)
+				server.aofLastIncrSize += int64(n)
+				server.aofBuf = server.aofBuf[n:]
+			}
+		}
+		//we can't recover when the fsync policy is always, the replies would lie about the durability.
+		if server.aofFsync == AOF_FSYNC_ALWAYS {
+			redisLog(REDIS_WARNING, "Can't recover from AOF write error when the AOF fsync policy is 'always'. Exiting...")
+			os.Exit(1)
+		}
+		server.aofLastWriteStatus = REDIS_ERR
+		server.aofLastWriteErr = err.Error()
+		return
+	}
+	if server.aofLastWriteStatus == REDIS_ERR {
+		redisLog(REDIS_WARNING, "AOF write error looks solved, Redis can write again.")
+		server.aofLastWriteStatus = REDIS_OK
+	}
+	server.aofCurrentSize += int64(n)
+	server.aofLastIncrSize += int64(n)
+	//re-use the AOF buffer when it is small enough, the larger ones are released.
+	if cap(server.aofBuf) < 4000 {
+		server.aofBuf = server.aofBuf[:0]
+	} else {
+		server.aofBuf = nil
+	}
+
+	if server.aofFsync == AOF_FSYNC_ALWAYS {
+		if err := server.aofFd.Sync(); err != nil {
+			redisLog(REDIS_WARNING, "Can't persist AOF for fsync error when the AOF fsync policy is 'always': %s. Exiting...", err)
+			os.Exit(1)
+		}
+		server.aofFsyncOffset = server.aofCurrentSize
+		server.aofLastFsync = now
+	} else if server.aofFsync == AOF_FSYNC_EVERYSEC && now > server.aofLastFsync {
+		if !server.aofFsyncInProgress.Load() {
+			aofBackgroundFsync(server.aofFd)
+		}
+		server.aofLastFsync = now
+	}
+}
+
+// fsync the AOF file in a goroutine, so that the event loop is never blocked by a slow disk.
+func aofBackgroundFsync(f *os.File) {
+	server.aofFsyncInProgress.Store(true)
+	server.aofFsyncOffset = server.aofCurrentSize
+	go func() {
+		if err := f.Sync(); err != nil {
+			redisLog(REDIS_WARNING, "Error in background fsync of the AOF file: %s", err)
+		}
+		server.aofFsyncInProgress.Store(false)
+	}()
+}
+
+/*
+*
+open the last INCR AOF for appending at startup when appendonly is enabled, a new
+INCR AOF is created and added to the manifest when there is none.
+*/
+func aofOpenIfNeededOnServerStart() error {
+	if !server.aofEnabled {
+		return nil
+	}
+	if err := os.MkdirAll(server.aofDirname, 0755); err != nil {
+		return fmt.Errorf("Can't open or create append-only dir %s: %s", server.aofDirname, err)
+	}
+
+	am := server.aofManifest
+	if len(am.incrAofList) == 0 {
+		newAm := aofManifestDup(am)
+		newAm.currIncrFileSeq++
+		ai := &aofInfo{fileName: getNewIncrAofName(newAm.currIncrFileSeq), fileSeq: newAm.currIncrFileSeq, fileType: AOF_FILE_TYPE_INCR}
+		newAm.incrAofList = append(newAm.incrAofList, ai)
+		//create the file before the manifest references it.
+		f, err := os.OpenFile(filepath.Join(server.aofDirname, ai.fileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		_ = f.Close()
+		if err := persistAofManifest(newAm); err != nil {
+			return err
+		}
+		server.aofManifest = newAm
+		am = newAm
+	}
+
+	incr := am.incrAofList[len(am.incrAofList)-1]
+	f, err := os.OpenFile(filepath.Join(server.aofDirname, incr.fileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	server.aofFd = f
+	server.aofState = REDIS_AOF_ON
+	server.aofSelectedDb = -1
+	server.aofLastIncrSize = fi.Size()
+	server.aofLastFsync = time.Now().Unix()
+	server.aofLastWriteStatus = REDIS_OK
+	return nil
+}
+
+/*
+*
+called when the user switches from "appendonly no" to "appendonly yes" at runtime:
+the AOF is written by a background rewrite, the new commands are collected in the
+rewrite buffer until it is done, then the server starts appending to the new AOF.
+*/
+func startAppendOnly() error {
+	if err := os.MkdirAll(server.aofDirname, 0755); err != nil {
+		redisLog(REDIS_WARNING, "Can't open or create append-only dir %s: %s", server.aofDirname, err)
+		return err
+	}
+	//a rewrite started while the AOF was off has not collected the new commands.
+	killAppendOnlyChild()
+	server.aofState = REDIS_AOF_WAIT_REWRITE
+	if hasActiveChildProcess() {
+		server.aofRewriteScheduled = true
+		redisLog(REDIS_NOTICE, "AOF was enabled but there is already another background operation. An AOF background was scheduled to start when possible.")
+	} else if err := rewriteAppendOnlyFileBackground(); err != nil {
+		server.aofState = REDIS_AOF_OFF
+		redisLog(REDIS_WARNING, "Redis needs to enable the AOF but can't trigger a background AOF rewrite operation. Check the above logs for more info about the error.")
+		return err
+	}
+	server.aofLastFsync = time.Now().Unix()
+	return nil
+}
+
+// called when the user switches from "appendonly yes" to "appendonly no" at runtime.
+func stopAppendOnly() {
+	if server.aofState == REDIS_AOF_ON {
+		flushAppendOnlyFile(true)
+		_ = server.aofFd.Sync()
+		_ = server.aofFd.Close()
+	}
+	server.aofFd = nil
+	killAppendOnlyChild()
+	server.aofState = REDIS_AOF_OFF
+	server.aofRewriteScheduled = false
+	server.aofBuf = nil
+	server.aofFlushPostponedStart = 0
+	server.aofLastWriteStatus = REDIS_OK
+}
+
+// the appendonly config takes effect immediately when changed with CONFIG SET.
+func updateAppendonly() error {
+	if server.aofEnabled && server.aofState == REDIS_AOF_OFF {
+		if startAppendOnly() != nil {
+			return errors.New("Unable to turn on AOF. Check server logs.")
+		}
+	} else if !server.aofEnabled && server.aofState != REDIS_AOF_OFF {
+		stopAppendOnly()
+	}
+	return nil
+}
+
+/*
+*
+read a command from the AOF, the number of bytes read is added to offset.
+io.EOF is returned only if the file ends before the command, a command cut
+in the middle returns errAofTruncated.
+*/
+func readAppendOnlyCommand(reader *bufio.Reader, offset *int64) ([]string, error) {
+	readLine := func() (string, error) {
+		line, err := reader.ReadString('\n')
+		*offset += int64(len(line))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(line[:len(line)-1], "\r"), nil
+	}
+
+	line, err := readLine()
+	if err == io.EOF && *offset == 0 {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, errAofTruncated
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, errors.New("Bad file format reading the append only file")
+	}
+	argc, err := strconv.Atoi(line[1:])
+	if err != nil || argc < 1 {
+		return nil, errors.New("Bad file format reading the append only file")
+	}
+
+	argv := make([]string, argc)
+	for j := 0; j < argc; j++ {
+		line, err = readLine()
+		if err != nil {
+			return nil, errAofTruncated
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.New("Bad file format reading the append only file")
+		}
+		l, err := strconv.Atoi(line[1:])
+		if err != nil || l < 0 || l > REDIS_BULK_MAX_LEN {
+			return nil, errors.New("Bad file format reading the append only file")
+		}
+		//read the argument and the trailing CRLF.
+		buf := make([]byte, l+2)
+		n, err := io.ReadFull(reader, buf)
+		*offset += int64(n)
+		if err != nil {
+			return nil, errAofTruncated
+		}
+		argv[j] = string(buf[:l])
+	}
+	return argv, nil
+}
+
+/*
+*
+replay an AOF file at startup, the commands are executed by a fake client without
+a connection, so that their replies are discarded. when the last file ends in the
+middle of a command and aof-load-truncated is enabled, the incomplete command is
+removed from the file and the server starts with the data loaded so far.
+the size of the loaded file is returned.
+*/
+func loadSingleAppendOnlyFile(filename string, last bool) (int64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fakeClient := createClient(nil)
+	server.loading = true
+	defer func() {
+		server.loading = false
+	}()
+
+	reader := bufio.NewReader(f)
+	//the offset of the end of the last command correctly loaded, and the one before the last MULTI.
+	var validUpTo, validBeforeMulti int64
+	for {
+		offset := int64(0)
+		argv, err := readAppendOnlyCommand(reader, &offset)
+		if err == io.EOF {
+			if fakeClient.flags&REDIS_MULTI == 0 {
+				break
+			}
+			//the file ends in the middle of a transaction, handle it as a short read to remove the unprocessed tail.
+			redisLog(REDIS_WARNING, "Revert incomplete MULTI/EXEC transaction in AOF file %s", filename)
+			err = errAofTruncated
+		}
+		if err == errAofTruncated {
+			//the commands of the incomplete transaction are removed as well.
+			if fakeClient.flags&REDIS_MULTI > 0 {
+				validUpTo = validBeforeMulti
+			}
+			if !last {
+				return 0, fmt.Errorf("Unexpected end of file reading the append only file %s, the truncated file is not the last file", filename)
+			}
+			if !server.aofLoadTruncated {
+				return 0, errors.New("Unexpected end of file reading the append only file. You can: " +
+					"1) Make a backup of your AOF file, then use ./redis-check-aof --fix <filename>. " +
+					"2) Alternatively you can set the 'aof-load-truncated' configuration option to yes and restart the server")
+			}
+			redisLog(REDIS_WARNING, "!!! Warning: short read while loading the AOF file %s!!!", filename)
+			redisLog(REDIS_WARNING, "!!! Truncating the AOF at offset %d !!!", validUpTo)
+			if err := os.Truncate(filename, validUpTo); err != nil {
+				return 0, fmt.Errorf("Error truncating the AOF file: %s", err)
+			}
+			redisLog(REDIS_WARNING, "AOF loaded anyway because aof-load-truncated is enabled")
+			break
+		} else if err != nil {
+			return 0, err
+		}
+
+		//command lookup
+		cmd := lookupCommand(argv[0])
+		if cmd == nil {
+			return 0, fmt.Errorf("Unknown command '%s' reading the append only file %s", argv[0], filename)
+		}
+		fakeClient.argv = make([]*robj, len(argv))
+		for j := range argv {
+			fakeClient.argv[j] = createStringObject(&argv[j], len(argv[j]))
+		}
+		fakeClient.argc = uint64(len(argv))
+		fakeClient.cmd = cmd
+		if cmd.name == "MULTI" {
+			validBeforeMulti = validUpTo
+		}
+		//run the command in the context of a fake client, the commands of a transaction are queued until EXEC.
+		if fakeClient.flags&REDIS_MULTI > 0 && cmd.name != "EXEC" {
+			queueMultiCommand(fakeClient)
+		} else {
+			cmd.proc(fakeClient)
+		}
+		validUpTo += offset
+	}
+	return validUpTo, nil
+}
+
+/*
+*
+load the BASE and the INCR files listed in the manifest, in order. an AOF
+written in the single file layout is first moved into the AOF directory.
+*/
+func loadAppendOnlyFiles() error {
+	am := server.aofManifest
+	if am.baseAofInfo == nil && len(am.incrAofList) == 0 {
+		if _, err := os.Stat(server.aofFilename); err != nil {
+			//nothing to load, the AOF is created empty.
+			return nil
+		}
+		if err := aofUpgradePrepare(); err != nil {
+			return err
+		}
+		am = server.aofManifest
+	}
+
+	files := make([]*aofInfo, 0, len(am.incrAofList)+1)
+	if am.baseAofInfo != nil {
+		files = append(files, am.baseAofInfo)
+	}
+	files = append(files, am.incrAofList...)
+	var total int64
+	for i, ai := range files {
+		size, err := loadSingleAppendOnlyFile(filepath.Join(server.aofDirname, ai.fileName), i == len(files)-1)
+		if err != nil {
+			return err
+		}
+		total += size
+		if ai == am.baseAofInfo {
+			server.aofRewriteBaseSize = size
+		}
+	}
+	server.aofCurrentSize = total
+	server.aofFsyncOffset = total
+	return nil
+}
+
+/*
+*
+write a sequence of commands able to reconstruct the snapshot, the big values are
+emitted with several commands of at most REDIS_AOF_REWRITE_ITEMS_PER_CMD items.
+*/
+func rewriteAppendOnlyFileRio(w *bufio.Writer, snapshot []rdbSnapshotDb) error {
+	now := time.Now().UnixMilli()
+	buf := make([]byte, 0)
+	for _, sdb := range snapshot {
+		buf = catAppendOnlyGenericCommand(buf[:0], []string{"SELECT", strconv.Itoa(sdb.id)})
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		for i, key := range sdb.keys {
+			expire := sdb.expires[i]
+			//skip the keys already expired.
+			if expire != -1 && expire < now {
+				continue
+			}
+			buf = catAppendOnlyKeyValuePair(buf[:0], key, sdb.vals[i])
+			if expire != -1 {
+				buf = catAppendOnlyGenericCommand(buf, []string{"PEXPIREAT", key.String(), strconv.FormatInt(expire, 10)})
+			}
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// emit the commands rebuilding the value, holding snapshotLock.
+func catAppendOnlyKeyValuePair(buf []byte, key *robj, o *robj) []byte {
+	server.snapshotLock.Lock()
+	defer server.snapshotLock.Unlock()
+	switch o.robjType {
+	case REDIS_STRING:
+		buf = catAppendOnlyGenericCommand(buf, []string{"SET", key.String(), o.String()})
+	case REDIS_LIST:
+		items := make([]string, 0)
+		var entry listTypeEntry
+		li := listTypeInitIterator(o, 0, REDIS_TAIL)
+		for listTypeNext(li, &entry) {
+			items = append(items, listTypeGet(&entry).String())
+		}
+		listTypeReleaseIterator(li)
+		buf = catAppendOnlyBatchedCommand(buf, "RPUSH", key.String(), items)
+	case REDIS_SET:
+		items := make([]string, 0)
+		si := setTypeInitIterator(o)
+		for element := setTypeNextObject(si); element != nil; element = setTypeNextObject(si) {
+			items = append(items, element.String())
+		}
+		setTypeReleaseIterator(si)
+		buf = catAppendOnlyBatchedCommand(buf, "SADD", key.String(), items)
+	case REDIS_HASH:
+		items := make([]string, 0)
+		hi := hashTypeInitIterator(o)
+		for hashTypeNext(hi) {
+			items = append(items, hashTypeCurrentObject(hi, REDIS_HASH_KEY).String(),
+				hashTypeCurrentObject(hi, REDIS_HASH_VALUE).String())
+		}
+		hashTypeReleaseIterator(hi)
+		buf = catAppendOnlyBatchedCommand(buf, "HMSET", key.String(), items)
+		//the expires of the fields follow the fields, as absolute unix times in milliseconds.
+		if fe := hashTypeFieldExpires(o); fe != nil {
+			di := dictGetSafeIterator(fe.expires)
+			for de := dictNext(di); de != nil; de = dictNext(di) {
+				buf = catAppendOnlyGenericCommand(buf, []string{"HPEXPIREAT", key.String(),
+					strconv.FormatInt((*de.val.ptr).(int64), 10), "FIELDS", "1", de.key.String()})
+			}
+			dictReleaseIterator(di)
+		}
+	case REDIS_ZSET:
+		items := make([]string, 0)
+		for x := (*o.ptr).(*zset).zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+			items = append(items, strconv.FormatFloat(x.score, 'g', 17, 64), x.obj.String())
+		}
+		buf = catAppendOnlyBatchedCommand(buf, "ZADD", key.String(), items)
+	default:
+		panic("Unknown object type")
+	}
+	return buf
+}
+
+/*
+*
+emit the items of a collection with as many commands as needed, the field-value and
+score-member pairs are never split between two commands.
+*/
+func catAppendOnlyBatchedCommand(dst []byte, name string, key string, items []string) []byte {
+	step := REDIS_AOF_REWRITE_ITEMS_PER_CMD
+	if name == "HMSET" || name == "ZADD" {
+		step *= 2
+	}
+	for start := 0; start < len(items); start += step {
+		end := start + step
+		if end > len(items) {
+			end = len(items)
+		}
+		argv := append([]string{name, key}, items[start:end]...)
+		dst = catAppendOnlyGenericCommand(dst, argv)
+	}
+	return dst
+}
+
+// write the commands able to rebuild the snapshot into filename, the file is fsynced before returning.
+func rewriteAppendOnlyFile(filename string, snapshot []rdbSnapshotDb) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err = rewriteAppendOnlyFileRio(w, snapshot); err == nil {
+		err = w.Flush()
+	}
+	//make sure data will not remain on the OS's output buffers.
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+/*
+*
+rewrite the AOF in background: the event loop takes a snapshot of the dataset,
+and a goroutine writes the shortest sequence of commands needed to rebuild it.
+the commands executed in the meantime are accumulated in the rewrite buffer,
+appended to the new file by backgroundRewriteDoneHandler before it is installed.
+*/
+func rewriteAppendOnlyFileBackground() error {
+	if hasActiveChildProcess() {
+		return errors.New("Background save or AOF rewrite already in progress")
+	}
+	if err := os.MkdirAll(server.aofDirname, 0755); err != nil {
+		redisLog(REDIS_WARNING, "Can't open or create append-only dir %s: %s", server.aofDirname, err)
+		return err
+	}
+	server.aofChildRunning = true
+	server.aofRewriteScheduled = false
+	server.aofRewriteTimeStart = time.Now().Unix()
+	server.aofRewriteBuf = make([]byte, 0)
+	//the next command appended to the AOF and to the rewrite buffer will emit a SELECT.
+	server.aofSelectedDb = -1
+	server.aofRewriteId++
+	server.aofRewriteTmpfile = filepath.Join(server.aofDirname, fmt.Sprintf("temp-rewriteaof-bg-%d-%d.aof", os.Getpid(), server.aofRewriteId))
+
+	id, snapshot := rdbSnapshotShared()
+	tmpfile := server.aofRewriteTmpfile
+	redisLog(REDIS_NOTICE, "Background append only file rewriting started")
+	go func() {
+		err := rewriteAppendOnlyFile(tmpfile, snapshot)
+		server.eventCh <- func() {
+			rdbReleaseSnapshot(id)
+			backgroundRewriteDoneHandler(tmpfile, err)
+		}
+	}()
+	return nil
+}
+
+// abandon the running rewrite, its temp file is removed and its result is ignored.
+func killAppendOnlyChild() {
+	if !server.aofChildRunning {
+		return
+	}
+	redisLog(REDIS_NOTICE, "Killing running AOF rewrite child")
+	_ = os.Remove(server.aofRewriteTmpfile)
+	server.aofChildRunning = false
+	server.aofRewriteTmpfile = ""
+	server.aofRewriteBuf = nil
+}
+
+// called by the event loop when the background AOF rewrite is terminated.
+func backgroundRewriteDoneHandler(tmpfile string, err error) {
+	if !server.aofChildRunning || tmpfile != server.aofRewriteTmpfile {
+		//the rewrite was killed.
+		_ = os.Remove(tmpfile)
+		return
+	}
+	server.aofChildRunning = false
+	server.aofRewriteTmpfile = ""
+	server.aofRewriteTimeLastSec = time.Now().Unix() - server.aofRewriteTimeStart
+
+	//flush the differences accumulated by the parent to the rewritten AOF, then install it.
+	if err == nil {
+		err = aofRewriteBufferWrite(tmpfile)
+	}
+	if err == nil {
+		err = aofInstallRewrite(tmpfile)
+	}
+	server.aofRewriteBuf = nil
+	if err != nil {
+		redisLog(REDIS_WARNING, "Background AOF rewrite failed: %s", err)
+		_ = os.Remove(tmpfile)
+		server.aofLastbgrewriteStatus = REDIS_ERR
+		//the AOF can't be enabled until it is written, serverCron retries the rewrite.
+		if server.aofState == REDIS_AOF_WAIT_REWRITE {
+			server.aofRewriteScheduled = true
+		}
+		return
+	}
+	server.aofLastbgrewriteStatus = REDIS_OK
+	redisLog(REDIS_NOTICE, "Background AOF rewrite finished successfully")
+}
+
+// append the rewrite buffer to the rewritten AOF.
+func aofRewriteBufferWrite(tmpfile string) error {
+	f, err := os.OpenFile(tmpfile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(server.aofRewriteBuf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		redisLog(REDIS_NOTICE, "Residual parent diff successfully flushed to the rewritten AOF (%.2f MB)",
+			float64(len(server.aofRewriteBuf))/(1024*1024))
+	}
+	return err
+}
+
+/*
+*
+install the rewritten AOF as the new BASE file: when the AOF is enabled a new
+empty INCR file is created, then the new manifest replaces the old one, that
+is the point where the rewrite becomes effective, and the old files are removed.
+*/
+func aofInstallRewrite(tmpfile string) error {
+	am := server.aofManifest
+	newAm := &aofManifest{currBaseFileSeq: am.currBaseFileSeq + 1, currIncrFileSeq: am.currIncrFileSeq}
+	newAm.baseAofInfo = &aofInfo{fileName: getNewBaseAofName(newAm.currBaseFileSeq), fileSeq: newAm.currBaseFileSeq, fileType: AOF_FILE_TYPE_BASE}
+	basePath := filepath.Join(server.aofDirname, newAm.baseAofInfo.fileName)
+	if err := os.Rename(tmpfile, basePath); err != nil {
+		return err
+	}
+
+	var newFd *os.File
+	var incrPath string
+	if server.aofState != REDIS_AOF_OFF {
+		newAm.currIncrFileSeq++
+		ai := &aofInfo{fileName: getNewIncrAofName(newAm.currIncrFileSeq), fileSeq: newAm.currIncrFileSeq, fileType: AOF_FILE_TYPE_INCR}
+		newAm.incrAofList = append(newAm.incrAofList, ai)
+		incrPath = filepath.Join(server.aofDirname, ai.fileName)
+		f, err := os.OpenFile(incrPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			_ = os.Remove(basePath)
+			return err
+		}
+		newFd = f
+	}
+	if err := persistAofManifest(newAm); err != nil {
+		if newFd != nil {
+			_ = newFd.Close()
+			_ = os.Remove(incrPath)
+		}
+		_ = os.Remove(basePath)
+		return err
+	}
+
+	//the commands still in the AOF buffer are part of the new BASE file, thanks to the rewrite buffer.
+	if newFd != nil {
+		if server.aofFd != nil {
+			_ = server.aofFd.Close()
+		}
+		server.aofFd = newFd
+		server.aofSelectedDb = -1
+		server.aofBuf = nil
+		server.aofFlushPostponedStart = 0
+		server.aofLastWriteStatus = REDIS_OK
+		server.aofLastIncrSize = 0
+		server.aofLastFsync = time.Now().Unix()
+		if server.aofState == REDIS_AOF_WAIT_REWRITE {
+			server.aofState = REDIS_AOF_ON
+		}
+	}
+	if fi, err := os.Stat(basePath); err == nil {
+		server.aofRewriteBaseSize = fi.Size()
+		server.aofCurrentSize = fi.Size()
+		server.aofFsyncOffset = fi.Size()
+	}
+
+	//the files of the old manifest are no longer used.
+	if am.baseAofInfo != nil {
+		_ = os.Remove(filepath.Join(server.aofDirname, am.baseAofInfo.fileName))
+	}
+	for _, ai := range am.incrAofList {
+		_ = os.Remove(filepath.Join(server.aofDirname, ai.fileName))
+	}
+	server.aofManifest = newAm
+	return nil
+}
+
+/*
+*
+BGREWRITEAOF
+*/
+func bgrewriteaofCommand(c *redisClient) {
+	if server.aofChildRunning {
+		reply := "Background append only file rewriting already in progress"
+		addReplyError(c, &reply)
+	} else if hasActiveChildProcess() {
+		server.aofRewriteScheduled = true
+		addReplyStatus(c, "Background append only file rewriting scheduled")
+	} else if rewriteAppendOnlyFileBackground() == nil {
+		addReplyStatus(c, "Background append only file rewriting started")
+	} else {
+		reply := "Can't execute an AOF background rewriting. Please check the server logs for more information."
+		addReplyError(c, &reply)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCatAppendOnlyGenericCommand(t *testing.T) {
+	buf := catAppendOnlyGenericCommand(nil, []string{"SET", "key", ""})
+	if string(buf) != "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$0\r\n\r\n" {
+		t.Errorf("unexpected command %q", buf)
+	}
+
+	now := time.Now().UnixMilli()
+	buf = catAppendOnlyExpireAtCommand(nil, "EXPIRE", testStringObject("key"), testStringObject("10"))
+	argv, err := readAppendOnlyCommand(bufio.NewReader(bytes.NewReader(buf)), new(int64))
+	if err != nil || len(argv) != 3 || argv[0] != "PEXPIREAT" {
+		t.Fatal("unexpected command", argv, err)
+	}
+	if when, _ := strconv.ParseInt(argv[2], 10, 64); when < now+10000 || when > now+11000 {
+		t.Error("the relative expire was not converted:", argv[2])
+	}
+}
+
+func TestAofRewriteAndLoad(t *testing.T) {
+	if server.commands == nil {
+		server.commands = make(map[string]*redisCommand)
+		populateCommandTable()
+	}
+	resetTestDbs(2)
+	db := &server.db[0]
+	dbAdd(db, testStringObject("str"), testStringObject("hello"))
+	l := createListListpackObject()
+	for i := 0; i < REDIS_AOF_REWRITE_ITEMS_PER_CMD+10; i++ {
+		listTypePush(l, createStringObjectFromLongLong(int64(i)), REDIS_TAIL)
+	}
+	dbAdd(db, testStringObject("list"), l)
+	volatile := testStringObject("volatile")
+	dbAdd(db, volatile, testStringObject("v"))
+	setExpire(db, volatile, time.Now().UnixMilli()+100000)
+	h := createHashObject()
+	hashTypeSet(h, testStringObject("f1"), testStringObject("v1"), 0)
+	hashTypeSet(h, testStringObject("f2"), testStringObject("v2"), 0)
+	hashTypeSetExpire(h, testStringObject("f2"), time.Now().UnixMilli()+100000)
+	dbAdd(db, testStringObject("hash"), h)
+	s := createSetObject()
+	for i := 0; i < REDIS_AOF_REWRITE_ITEMS_PER_CMD+10; i++ {
+		setTypeAdd(s, testStringObject("m"+strconv.Itoa(i)))
+	}
+	dbAdd(db, testStringObject("set"), s)
+	dbAdd(&server.db[1], testStringObject("other"), testStringObject("db"))
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof.1.base.aof")
+	if err := rewriteAppendOnlyFile(filename, rdbSnapshot()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	fi, _ := os.Stat(filename)
+	validSize := fi.Size()
+
+	//a command cut in the middle by a crash is removed when aof-load-truncated is enabled.
+	f, _ := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	_, _ = f.WriteString("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nval")
+	_ = f.Close()
+
+	resetTestDbs(2)
+	server.aofLoadTruncated = false
+	if _, err := loadSingleAppendOnlyFile(filename, true); err == nil {
+		t.Fatal("expected an error loading a truncated AOF")
+	}
+
+	//only the last file of the manifest can be truncated.
+	resetTestDbs(2)
+	server.aofLoadTruncated = true
+	if _, err := loadSingleAppendOnlyFile(filename, false); err == nil {
+		t.Fatal("expected an error loading a truncated AOF that is not the last file")
+	}
+
+	resetTestDbs(2)
+	size, err := loadSingleAppendOnlyFile(filename, true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if fi, _ = os.Stat(filename); fi.Size() != validSize || size != validSize {
+		t.Errorf("the AOF was not truncated, size %d instead of %d", fi.Size(), validSize)
+	}
+
+	db = &server.db[0]
+	if o := lookupKey(db, testStringObject("str")); o == nil || o.String() != "hello" {
+		t.Error("the string was not loaded")
+	}
+	if o := lookupKey(db, testStringObject("list")); o == nil || listTypeLength(o) != REDIS_AOF_REWRITE_ITEMS_PER_CMD+10 {
+		t.Error("the list was not loaded")
+	}
+	if getExpire(db, testStringObject("volatile")) == -1 {
+		t.Error("the expire of the volatile key was not loaded")
+	}
+	if o := lookupKey(db, testStringObject("hash")); o == nil || hashTypeLength(o) != 2 ||
+		hashTypeGetExpire(o, testStringObject("f1")) != -1 || hashTypeGetExpire(o, testStringObject("f2")) == -1 ||
+		dictFind(&db.hexpires, "hash") == nil {
+		t.Error("the hash with an expiring field was not loaded")
+	}
+	if o := lookupKey(db, testStringObject("set")); o == nil || setTypeSize(o) != REDIS_AOF_REWRITE_ITEMS_PER_CMD+10 ||
+		!setTypeIsMember(o, testStringObject("m0")) {
+		t.Error("the set was not loaded")
+	}
+	if lookupKey(&server.db[1], testStringObject("other")) == nil {
+		t.Error("the key of the second db was not loaded")
+	}
+	if lookupKey(db, testStringObject("key")) != nil {
+		t.Error("the truncated command was executed")
+	}
+}
+
+func TestAofManifest(t *testing.T) {
+	server.aofFilename = "appendonly.aof"
+	am := &aofManifest{currBaseFileSeq: 2, currIncrFileSeq: 3}
+	am.baseAofInfo = &aofInfo{fileName: getNewBaseAofName(2), fileSeq: 2, fileType: AOF_FILE_TYPE_BASE}
+	am.incrAofList = []*aofInfo{
+		{fileName: getNewIncrAofName(2), fileSeq: 2, fileType: AOF_FILE_TYPE_INCR},
+		{fileName: "with space.aof", fileSeq: 3, fileType: AOF_FILE_TYPE_INCR},
+	}
+	content := getAofManifestAsString(am)
+	if !strings.HasPrefix(content, "file appendonly.aof.2.base.aof seq 2 type b\n") {
+		t.Errorf("unexpected manifest %q", content)
+	}
+
+	loaded, err := aofLoadManifestFromString("# comment\n" + content)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if loaded.baseAofInfo.fileName != "appendonly.aof.2.base.aof" || len(loaded.incrAofList) != 2 ||
+		loaded.incrAofList[1].fileName != "with space.aof" || loaded.currBaseFileSeq != 2 || loaded.currIncrFileSeq != 3 {
+		t.Errorf("unexpected manifest %+v", loaded)
+	}
+
+	invalid := map[string]string{
+		"file a seq 1":                             "Invalid AOF manifest file format",
+		"file a seq 1 type x":                      "Unknown AOF file type",
+		"file ../a seq 1 type b":                   "Invalid AOF manifest file format",
+		"file a seq 1 type b\nfile b seq 2 type b": "Found duplicate base file information",
+		"file a seq 2 type i\nfile b seq 1 type i": "Found a non-monotonic sequence number",
+	}
+	for content, expected := range invalid {
+		if _, err := aofLoadManifestFromString(content); err == nil || err.Error() != expected {
+			t.Errorf("manifest %q: expected error %q, got %v", content, expected, err)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	/* Client block type (btype field in client structure) if REDIS_BLOCKED flag is set. */
+	REDIS_BLOCKED_NONE = 0 /* Not blocked, no REDIS_BLOCKED flag set. */
+	REDIS_BLOCKED_LIST = 1 /* BLPOP & co. */
+	REDIS_BLOCKED_WAIT = 2 /* WAIT for synchronous replication. */
+	REDIS_BLOCKED_ZSET = 3 /* BZPOP et al. */
+)
+
+/*
+*
+the state of a blocked client, the fields used depend on the kind
+of operation the client is blocked on.
+*/
+type blockingState struct {
+	//blocking operation timeout as unix time in milliseconds, 0 means no timeout.
+	timeout int64
+	//REDIS_BLOCKED_LIST and REDIS_BLOCKED_ZSET: the keys the client is waiting for, in the order of the command.
+	keys []*robj
+	//REDIS_BLOCKED_WAIT
+	numreplicas int   /* Number of replicas we are waiting for ACK. */
+	reploffset  int64 /* Replication offset to reach. */
+}
+
+/*
+*
+get a timeout value from an object, the absolute unix time in milliseconds is stored
+in timeout, or zero if the timeout is zero, meaning no timeout.
+*/
+func getTimeoutFromObjectOrReply(c *redisClient, object *robj, timeout *int64, unit int) int {
+	var tval int64
+	if unit == UNIT_SECONDS {
+		//a timeout in seconds may have a decimal part, it is rounded up to the next millisecond.
+		ftval, err := strconv.ParseFloat(object.String(), 64)
+		if err != nil || math.IsNaN(ftval) || math.IsInf(ftval, 0) {
+			errMsg := "timeout is not a float or out of range"
+			addReplyError(c, &errMsg)
+			return REDIS_ERR
+		}
+		ftval = math.Ceil(ftval * 1000)
+		if ftval >= math.MaxInt64 {
+			errMsg := "timeout is out of range"
+			addReplyError(c, &errMsg)
+			return REDIS_ERR
+		}
+		tval = int64(ftval)
+	} else {
+		var err error
+		tval, err = strconv.ParseInt(object.String(), 10, 64)
+		if err != nil {
+			errMsg := "timeout is not an integer or out of range"
+			addReplyError(c, &errMsg)
+			return REDIS_ERR
+		}
+	}
+	if tval < 0 {
+		errMsg := "timeout is negative"
+		addReplyError(c, &errMsg)
+		return REDIS_ERR
+	}
+	if tval > 0 {
+		now := time.Now().UnixMilli()
+		if tval > math.MaxInt64-now {
+			errMsg := "timeout is out of range"
+			addReplyError(c, &errMsg)
+			return REDIS_ERR
+		}
+		tval += now
+	}
+	*timeout = tval
+	return REDIS_OK
+}
+
+/*
+*
+block a client for the specific operation type. the client stops processing new
+requests: its reader is released only once the client is unblocked.
+*/
+func blockClient(c *redisClient, btype int) {
+	c.flags |= REDIS_BLOCKED
+	c.btype = btype
+}
+
+/*
+*
+unblock a client calling the right function depending on the kind of operation
+the client is blocking for, the reader of the client can read the next request.
+*/
+func unblockClient(c *redisClient) {
+	if c.btype == REDIS_BLOCKED_LIST || c.btype == REDIS_BLOCKED_ZSET {
+		unblockClientWaitingData(c)
+	} else if c.btype == REDIS_BLOCKED_WAIT {
+		unblockClientWaitingReplicas(c)
+	}
+	c.flags &^= REDIS_BLOCKED
+	c.btype = REDIS_BLOCKED_NONE
+	c.cmdDone <- struct{}{}
+}
+
+/*
+*
+a key that received new data while clients were blocked on it, queued in
+server.readyKeys by signalKeyAsReady and served by handleClientsBlockedOnKeys.
+*/
+type readyList struct {
+	db  *redisDb
+	key *robj
+}
+
+/*
+*
+set a client in blocking mode for the specified keys, with the specified timeout.
+the client is appended to the clients waiting for each key, so that the clients
+are served in FIFO order once the key receives new data.
+*/
+func blockForKeys(c *redisClient, btype int, keys []*robj, timeout int64) {
+	c.bpop.timeout = timeout
+	for _, key := range keys {
+		k := (*key.ptr).(string)
+		//if the key already exists in the keys of the client, skip it.
+		duplicate := false
+		for _, bkey := range c.bpop.keys {
+			if (*bkey.ptr).(string) == k {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			continue
+		}
+		c.bpop.keys = append(c.bpop.keys, key)
+		//and in the other "side", to map keys -> clients.
+		clients := c.db.blockingKeys[k]
+		if clients == nil {
+			clients = listCreate()
+			c.db.blockingKeys[k] = clients
+		}
+		value := interface{}(c)
+		listAddNodeTail(clients, &value)
+	}
+	blockClient(c, btype)
+}
+
+// unblock a client that's waiting in a blocking operation such as BLPOP or BZPOPMIN, called by unblockClient.
+func unblockClientWaitingData(c *redisClient) {
+	for _, key := range c.bpop.keys {
+		k := (*key.ptr).(string)
+		//remove this client from the list of clients waiting for this key.
+		clients := c.db.blockingKeys[k]
+		if clients == nil {
+			panic("the blocking key is not in the blocking keys of the DB")
+		}
+		listDelNode(clients, listSearchKey(clients, c))
+		//if the list is empty we need to remove it to avoid wasting memory.
+		if listLength(clients) == 0 {
+			delete(c.db.blockingKeys, k)
+		}
+	}
+	c.bpop.keys = nil
+}
+
+/*
+*
+if the specified key has clients blocked waiting for data, add it to the
+server.readyKeys list, so that handleClientsBlockedOnKeys serves them once the
+current command returns. called every time a list or a sorted set is created in the DB.
+*/
+func signalKeyAsReady(db *redisDb, key *robj) {
+	k := (*key.ptr).(string)
+	//no clients blocking for this key? no need to queue it.
+	if db.blockingKeys[k] == nil {
+		return
+	}
+	//key was already signaled? no need to queue it again.
+	if _, exists := db.readyKeys[k]; exists {
+		return
+	}
+	rl := interface{}(&readyList{db: db, key: key})
+	listAddNodeTail(server.readyKeys, &rl)
+	//we also add the key in the db.readyKeys map in order to avoid adding it multiple times into a list with a simple O(1) check.
+	db.readyKeys[k] = struct{}{}
+}
+
+// the blocking operation type served by a key of the specified type.
+func getBlockedTypeByType(otype int) int {
+	if otype == REDIS_LIST {
+		return REDIS_BLOCKED_LIST
+	} else if otype == REDIS_ZSET {
+		return REDIS_BLOCKED_ZSET
+	}
+	return REDIS_BLOCKED_NONE
+}
+
+/*
+*
+serve the clients blocked on the keys that received new data, called after every
+command is executed. the clients waiting for a key are served in FIFO order: the
+blocking command of each client is executed again, it finds the data this time and
+replies, and is propagated as its non blocking version. we stop serving the clients
+of a key once it is deleted or its type is changed, the others stay blocked.
+since serving a client may create new lists (BLMOVE), we iterate until no keys are
+left to serve.
+*/
+func handleClientsBlockedOnKeys() {
+	for listLength(server.readyKeys) > 0 {
+		//point server.readyKeys to a fresh list and save the current one locally, the served clients may signal new keys.
+		l := server.readyKeys
+		server.readyKeys = listCreate()
+
+		for ln := listFirst(l); ln != nil; ln = ln.next {
+			rl := (*ln.value).(*readyList)
+			k := (*rl.key.ptr).(string)
+			//first of all remove this key from db.readyKeys so that we can safely signal it again if needed.
+			delete(rl.db.readyKeys, k)
+			clients := rl.db.blockingKeys[k]
+			if clients == nil {
+				continue
+			}
+			//serve the clients in the order they blocked, the node may be removed by the served client.
+			for cn := listFirst(clients); cn != nil; {
+				next := cn.next
+				receiver := (*cn.value).(*redisClient)
+				o := lookupKeyWrite(rl.db, rl.key)
+				if o == nil || getBlockedTypeByType(o.robjType) != receiver.btype {
+					break
+				}
+				unblockClientOnKey(receiver)
+				cn = next
+			}
+		}
+	}
+}
+
+/*
+*
+unblock a client blocked on a key that is ready to serve it: the command of the
+client is executed again, then the reader of the client can read the next request.
+*/
+func unblockClientOnKey(c *redisClient) {
+	unblockClientWaitingData(c)
+	c.flags &^= REDIS_BLOCKED
+	c.btype = REDIS_BLOCKED_NONE
+	c.bpop.timeout = 0
+	//the command was already counted in the stats when the client blocked.
+	call(c, REDIS_CALL_PROPAGATE)
+	if c.flags&REDIS_BLOCKED == 0 {
+		c.cmdDone <- struct{}{}
+	}
+}
+
+// reply to a client whose blocking operation timed out.
+func replyToBlockedClientTimedOut(c *redisClient) {
+	if c.btype == REDIS_BLOCKED_LIST || c.btype == REDIS_BLOCKED_ZSET {
+		addReplyNullArray(c)
+	} else if c.btype == REDIS_BLOCKED_WAIT {
+		addReplyLongLong(c, replicationCountAcksByOffset(c.bpop.reploffset))
+	}
+}
+
+// unblock the client if its timeout is reached, called by clientsCron.
+func clientsCronHandleTimeout(c *redisClient, nowMs int64) {
+	if c.flags&REDIS_BLOCKED > 0 && c.bpop.timeout != 0 && c.bpop.timeout < nowMs {
+		replyToBlockedClientTimedOut(c)
+		unblockClient(c)
+	}
+}
+
+/*
+*
+called by the reader of a blocked client: the connection is watched so that a client
+closing it while blocked is freed, the pipelined requests are read once unblocked.
+false is returned if the connection is closed.
+*/
+func waitUnblocked(c *redisClient, reader *bufio.Reader, closeClientCh chan *redisClient) bool {
+	peek := make(chan error, 1)
+	go func() {
+		_, err := reader.Peek(1)
+		peek <- err
+	}()
+	select {
+	case <-c.cmdDone:
+		//the reader can't be used until the peek returns.
+		if err := <-peek; err != nil {
+			closeClientCh <- c
+			return false
+		}
+		return true
+	case err := <-peek:
+		if err != nil {
+			closeClientCh <- c
+			return false
+		}
+		<-c.cmdDone
+		return true
+	}
+}
@@ -2,10 +2,9 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
-	"fmt"
 	"io"
-	"log"
 	"net"
 	"strconv"
 )
@@ -14,130 +13,324 @@ const (
 	/* Client request types */
 	REDIS_REQ_INLINE    = 1
 	REDIS_REQ_MULTIBULK = 2
+
+	REDIS_INLINE_MAX_SIZE = 1024 * 64         /* Max size of inline reads */
+	REDIS_MBULK_MAX_LEN   = 1024 * 1024       /* Max number of elements of a multi bulk request */
+	REDIS_BULK_MAX_LEN    = 512 * 1024 * 1024 /* Max size of a single bulk argument */
+
+	/* Client flags */
+	REDIS_SLAVE         = 1 << 0  /* This client is a slave server */
+	REDIS_MASTER        = 1 << 1  /* This client is a master server */
+	REDIS_MULTI         = 1 << 3  /* This client is in a MULTI context */
+	REDIS_BLOCKED       = 1 << 4  /* The client is waiting in a blocking operation */
+	REDIS_DIRTY_CAS     = 1 << 5  /* Watched keys modified. EXEC will fail. */
+	REDIS_CLOSE_ASAP    = 1 << 10 /* Close this client ASAP */
+	REDIS_DIRTY_EXEC    = 1 << 12 /* EXEC will fail for errors while queueing */
+	REDIS_FORCE_AOF     = 1 << 14 /* Force AOF propagation of current cmd. */
+	REDIS_FORCE_REPL    = 1 << 15 /* Force replication of current cmd. */
+	REDIS_PRE_PSYNC     = 1 << 16 /* Instance don't understand PSYNC. */
+	REDIS_PUBSUB        = 1 << 18 /* Client is in Pub/Sub mode. */
+	REDIS_PENDING_WRITE = 1 << 21 /* Client has output to send but a write handler is yet not installed. */
+
+	REDIS_MASTER_FORCE_REPLY = 1 << 13 /* Queue replies even if is master */
 )
 
+var errInlineTooBig = errors.New("inline request too big")
+
 type redisClient struct {
 	//redis client connection info
+	id           uint64
 	conn         net.Conn
 	argc         uint64
 	argv         []*robj
 	multibulklen int64
 	reqType      int
 	queryBuf     []byte
-	cmd          redisCommand
-	lastCmd      redisCommand
+	cmd          *redisCommand
+	lastCmd      *redisCommand
 	db           *redisDb
+	//the protocol version negotiated through HELLO, 2 by default.
+	resp int
+	//the client name set by "HELLO ... SETNAME".
+	name string
+	//notified by the command loop once the command handed over by the reader has been processed.
+	cmdDone chan struct{}
+	//notified by the command loop instead of cmdDone when the command blocked the client.
+	blockedCh chan struct{}
+	//blocking operation type and state, valid if the REDIS_BLOCKED flag is set.
+	btype int
+	bpop  blockingState
+	//replication offset of the last write of the client, used by WAIT.
+	woff int64
+	//MULTI/EXEC state, and the keys WATCHed by the client.
+	mstate      multiState
+	watchedKeys *list
+	//channels and patterns the client is subscribed to in Pub/Sub mode.
+	pubsubChannels map[string]*robj
+	pubsubPatterns map[string]*robj
+	//shard level channels the client is subscribed to.
+	pubsubshardChannels map[string]*robj
+	//the commands of the master stream held back until the transaction in progress is terminated.
+	pendingMasterStream [][]*robj
+	//set by the reader when a complete pipelined request is already buffered.
+	pendingInput bool
+	//the protocol error detected by the reader, replied by the command loop before closing.
+	protocolError string
+	flags         int
+	//response buffer and the number of bytes of it already sent.
+	buf     []byte
+	sentlen int
+	//list of reply chunks to send to the client once the static buffer is full.
+	reply      *list
+	replyBytes int64
+	//the time when the output buffer soft limit was reached for the first time.
+	obufSoftLimitReachedTime int64
+	//time of the last interaction, used for timeout.
+	lastinteraction int64
+	//set once the client authenticated with the requirepass password.
+	authenticated bool
+	//replication state and the offset of the RDB sent to the replica by a full resynchronization.
+	replstate          int
+	psyncInitialOffset int64
+	//the port and the capabilities announced by the replica with REPLCONF.
+	slaveListeningPort int
+	slaveCapa          int
+	//replication offset acknowledged by the replica with REPLCONF ACK, and the time of the last ACK.
+	replAckOff  int64
+	replAckTime int64
 }
 
-func readQueryFromClient(c *redisClient, CloseClientCh chan redisClient, commandCh chan redisClient) {
+func readQueryFromClient(c *redisClient, CloseClientCh chan *redisClient, commandCh chan *redisClient) {
 	//get the network reader  through the redis client's connection.
 	reader := bufio.NewReader(c.conn)
 	//parse the string through the reader, and pass the parsing result to commandCh for Redis server to parse and execute.
 	processInputBuffer(c, reader, CloseClientCh, commandCh)
 }
 
-func processInputBuffer(c *redisClient, reader *bufio.Reader, CloseClientCh chan redisClient, commandCh chan redisClient) {
+func processInputBuffer(c *redisClient, reader *bufio.Reader, CloseClientCh chan *redisClient, commandCh chan *redisClient) {
 	for {
 		//initialize the array length to -1.
 		c.multibulklen = -1
-		//split each string by '\n'
-		bytes, err := reader.ReadBytes('\n')
+		c.argc = 0
+		//split each request by '\n', a single line can never be larger than REDIS_INLINE_MAX_SIZE.
+		bytes, err := readLine(reader, REDIS_INLINE_MAX_SIZE)
 		c.queryBuf = bytes
+		if err == errInlineTooBig {
+			if c.queryBuf[0] == '*' {
+				setProtocolError(c, "too big mbulk count string")
+			} else {
+				setProtocolError(c, "too big inline request")
+			}
+			CloseClientCh <- c
+			break
+		} else if err != nil {
+			redisLog(REDIS_VERBOSE, "the redis client has been closed")
+			CloseClientCh <- c
+			break
+		}
+
+		var res int
+		//If it starts with "*", it indicates a multiline string, otherwise it is an inline command.
+		if c.queryBuf[0] == '*' {
+			//set the request type to multiline
+			c.reqType = REDIS_REQ_MULTIBULK
+			res, err = processMultibulkBuffer(c, reader)
+		} else {
+			c.reqType = REDIS_REQ_INLINE
+			res = processInlineBuffer(c)
+		}
+
 		if err != nil {
-			log.Println("the redis client has been closed")
-			CloseClientCh <- *c
+			redisLog(REDIS_VERBOSE, "the redis client has been closed")
+			CloseClientCh <- c
+			break
+		} else if res == REDIS_ERR {
+			//the protocol error has been replied, the rest of the stream can no longer be trusted.
+			CloseClientCh <- c
 			break
 		}
-		//throw an exception if '\n' is not preceded by '\r'.
-		if len(c.queryBuf) == 0 || (len(c.queryBuf) >= 2 && c.queryBuf[len(c.queryBuf)-2] != '\r') {
-			_, _ = c.conn.Write([]byte("-ERR unknown command\r\n"))
-			log.Println("ERR unknown command")
+		//empty requests such as a bare newline or "*0" are simply skipped.
+		if c.argc == 0 {
 			continue
 		}
-		//If it starts with "*", it indicates a multiline string.
-		if c.queryBuf[0] == '*' && c.multibulklen == -1 {
-			//set the request type to multiline
-			c.reqType = REDIS_REQ_MULTIBULK
-			//get the length of the array based on the number following '*'
-			c.multibulklen, err = strconv.ParseInt(string(c.queryBuf[1:len(c.queryBuf)-2]), 10, 32)
-			if err != nil || c.multibulklen < 0 {
-				_, _ = c.conn.Write([]byte("-ERR unknown command\r\n"))
-				log.Println("ERR unknown command")
-				continue
-			}
-			//based on the parsed length, initialize the size of the array.
-			c.argv = make([]*robj, c.multibulklen)
-			//based on the length indicated by "*", start parsing the string.
-			res, e := processMultibulkBuffer(c, reader, CloseClientCh)
-			if res == REDIS_ERR && e != nil {
-				_, _ = c.conn.Write([]byte("-ERR unknown command\r\n"))
-				log.Println("ERR unknown command")
-				continue
-			} else {
-				commandCh <- *c
+		/**
+		hand the client over to the command loop and wait until the command has been processed,
+		so that the argv is never touched by both goroutines at the same time.
+		*/
+		c.pendingInput = requestIsBuffered(reader)
+		commandCh <- c
+		select {
+		case <-c.cmdDone:
+		case <-c.blockedCh:
+			//the command blocked the client, the next request is read once it is unblocked.
+			if !waitUnblocked(c, reader, CloseClientCh) {
+				return
 			}
-		} else if c.queryBuf[0] == '*' && c.multibulklen > -1 {
-			_, _ = c.conn.Write([]byte("-ERR unknown command\r\n"))
-			log.Println("ERR unknown command")
-			continue
-		} else {
-			//todo the processing logic for single-line instructions is to be completed subsequently
-			c.multibulklen = REDIS_REQ_INLINE
-			_, _ = c.conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+
+}
+
+/*
+*
+read a line terminated by '\n' from the reader. if the line grows beyond max bytes
+the partially read content is returned together with errInlineTooBig.
+*/
+func readLine(reader *bufio.Reader, max int) ([]byte, error) {
+	line := make([]byte, 0)
+	for {
+		frag, err := reader.ReadSlice('\n')
+		line = append(line, frag...)
+		if len(line) > max {
+			return line, errInlineTooBig
+		}
+		if err == bufio.ErrBufferFull {
 			continue
 		}
+		return line, err
+	}
+}
 
+/*
+*
+check if a complete request follows in the bytes already buffered by the reader.
+blank lines and empty multibulk requests are skipped, as no reply is due for them.
+a partial request means the reader is about to block on the socket, so the replies
+of the batch must not wait for it.
+*/
+func requestIsBuffered(reader *bufio.Reader) bool {
+	buf, _ := reader.Peek(reader.Buffered())
+	for len(buf) > 0 {
+		nl := bytes.IndexByte(buf, '\n')
+		if nl < 0 {
+			return false
+		}
+		line := buf[:nl]
+		buf = buf[nl+1:]
+		if line[0] != '*' {
+			if len(bytes.TrimSpace(line)) > 0 {
+				return true
+			}
+			continue
+		}
+		//the malformed requests are not checked, the reader replies the protocol error without blocking.
+		ll, err := strconv.ParseInt(string(bytes.TrimSuffix(line[1:], []byte("\r"))), 10, 64)
+		if err != nil {
+			return true
+		}
+		for i := int64(0); i < ll; i++ {
+			nl = bytes.IndexByte(buf, '\n')
+			if nl < 0 {
+				return false
+			}
+			if nl == 0 || buf[0] != '$' {
+				return true
+			}
+			bulklen, err := strconv.ParseInt(string(bytes.TrimSuffix(buf[1:nl], []byte("\r"))), 10, 64)
+			if err != nil || bulklen < 0 {
+				return true
+			}
+			if int64(len(buf)) < int64(nl)+1+bulklen+2 {
+				return false
+			}
+			buf = buf[int64(nl)+1+bulklen+2:]
+		}
+		if ll > 0 {
+			return true
+		}
 	}
+	return false
+}
 
+func processInlineBuffer(c *redisClient) int {
+	//strip the trailing "\r\n", telnet and nc may only send "\n".
+	line := string(c.queryBuf[:len(c.queryBuf)-1])
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	//split the line into arguments, honoring quotes and escape sequences.
+	args, ok := sdssplitargs(line)
+	if !ok {
+		setProtocolError(c, "unbalanced quotes in request")
+		return REDIS_ERR
+	}
+	//create a redis object for each argument.
+	c.argv = make([]*robj, len(args))
+	for i := range args {
+		c.argv[i] = createStringObject(&args[i], len(args[i]))
+	}
+	c.argc = uint64(len(args))
+	return REDIS_OK
 }
 
-func processMultibulkBuffer(c *redisClient, reader *bufio.Reader, CloseClientCh chan redisClient) (int, error) {
-	c.argc = 0
-	//initialize "ll" to record the length following each "$", then fetch the string based on this length.
-	ll := int64(-1)
+func processMultibulkBuffer(c *redisClient, reader *bufio.Reader) (int, error) {
+	//the line must be terminated by "\r\n".
+	if len(c.queryBuf) < 3 || c.queryBuf[len(c.queryBuf)-2] != '\r' {
+		setProtocolError(c, "invalid multibulk length")
+		return REDIS_ERR, nil
+	}
+	//get the length of the array based on the number following '*'
+	ll, err := strconv.ParseInt(string(c.queryBuf[1:len(c.queryBuf)-2]), 10, 64)
+	if err != nil || ll > REDIS_MBULK_MAX_LEN {
+		setProtocolError(c, "invalid multibulk length")
+		return REDIS_ERR, nil
+	}
+	c.multibulklen = ll
+	if c.multibulklen <= 0 {
+		return REDIS_OK, nil
+	}
+	//based on the parsed length, initialize the size of the array.
+	c.argv = make([]*robj, c.multibulklen)
+
 	//perform a for loop based on "multibulklen".
 	for i := 0; i < int(c.multibulklen); i++ {
-		bytes, e := reader.ReadBytes('\n')
+		bytes, e := readLine(reader, REDIS_INLINE_MAX_SIZE)
 		c.queryBuf = bytes
-		if e != nil && e == io.EOF {
-			log.Println("the redis client has been closed")
-			CloseClientCh <- *c
-			break
+		if e == errInlineTooBig {
+			setProtocolError(c, "too big bulk count string")
+			return REDIS_ERR, nil
 		} else if e != nil {
 			return REDIS_ERR, e
 		}
-
-		if len(c.queryBuf) == 0 || !(len(c.queryBuf)-2 >= 0 && c.queryBuf[len(c.queryBuf)-2] == '\r') {
-			return REDIS_ERR, errors.New("ERR unknown command")
+		//every argument must be introduced by "$".
+		if c.queryBuf[0] != '$' {
+			setProtocolError(c, "expected '$', got '"+string(c.queryBuf[0])+"'")
+			return REDIS_ERR, nil
 		}
-		//if a "$" is intercepted in this line, store the following numerical value in "ll".
-		if c.queryBuf[0] == '$' {
-			ll, e = strconv.ParseInt(string(c.queryBuf[1:len(c.queryBuf)-2]), 10, 32)
-			if e != nil || ll <= 0 {
-				return REDIS_ERR, e
-			}
-			strBytes, e := reader.ReadBytes('\n')
-			c.queryBuf = strBytes
-
-			if e != nil {
-				return REDIS_ERR, e
-			}
-
-			if len(c.queryBuf) == 0 || int64(len(c.queryBuf))-2 != ll {
-				return REDIS_ERR, errors.New("ERR unknown command")
-			}
-			//parse and extract a string of specified length based on the value of "ll", store it in "argv", and then increment "argc".
-			str := string(c.queryBuf[0 : len(c.queryBuf)-2])
-			c.argv[c.argc] = createStringObject(&str, len(str))
-			c.argc++
-		} else if c.queryBuf[0] != '$' && ll < 0 { //invalid str
-			return REDIS_ERR, errors.New("ERR unknown command")
+		//store the numerical value following "$" in "ll".
+		if len(c.queryBuf) < 3 || c.queryBuf[len(c.queryBuf)-2] != '\r' {
+			setProtocolError(c, "invalid bulk length")
+			return REDIS_ERR, nil
+		}
+		ll, e = strconv.ParseInt(string(c.queryBuf[1:len(c.queryBuf)-2]), 10, 64)
+		if e != nil || ll < 0 || ll > REDIS_BULK_MAX_LEN {
+			setProtocolError(c, "invalid bulk length")
+			return REDIS_ERR, nil
+		}
+		//read exactly "ll" bytes plus "\r\n", so the payload is allowed to contain any byte.
+		c.queryBuf = make([]byte, ll+2)
+		if _, e = io.ReadFull(reader, c.queryBuf); e != nil {
+			return REDIS_ERR, e
+		}
+		if c.queryBuf[ll] != '\r' || c.queryBuf[ll+1] != '\n' {
+			setProtocolError(c, "invalid bulk length")
+			return REDIS_ERR, nil
 		}
+		//extract the string, store it in "argv", and then increment "argc".
+		str := string(c.queryBuf[0:ll])
+		c.argv[c.argc] = createStringObject(&str, len(str))
+		c.argc++
 	}
 
 	return REDIS_OK, nil
 }
 
-func (c redisClient) string() string {
-	return fmt.Sprintf("%#v", c)
+/*
+*
+record the protocol error, the command loop replies it to the client before closing the
+connection since the remaining data in the stream can not be parsed anymore.
+*/
+func setProtocolError(c *redisClient, errMsg string) {
+	redisLog(REDIS_VERBOSE, "Protocol error from client: %s", errMsg)
+	c.protocolError = "Protocol error: " + errMsg
 }
@@ -0,0 +1,30 @@
+package main
+
+import "strings"
+
+const (
+	CLUSTER_SLOTS = 16384
+)
+
+/*
+*
+we have 16384 hash slots. the hash slot of a given key is obtained as the least
+significant 14 bits of the crc16 of the key. however if the key contains the {...}
+pattern, only the part between { and } is hashed. this may be useful in the future
+to force certain keys to be in the same node (assuming no resharding is in progress).
+*/
+func keyHashSlot(key string) int {
+	s := strings.IndexByte(key, '{')
+	//no '{' ? hash the whole key. this is the base case.
+	if s == -1 {
+		return int(crc16(key) & (CLUSTER_SLOTS - 1))
+	}
+	//'{' found? check if we have the corresponding '}'.
+	e := strings.IndexByte(key[s+1:], '}')
+	//no '}' or nothing between {} ? hash the whole key.
+	if e <= 0 {
+		return int(crc16(key) & (CLUSTER_SLOTS - 1))
+	}
+	//if we are here there is both a { and a } on its right, hash what is in the middle between { and }.
+	return int(crc16(key[s+1:s+1+e]) & (CLUSTER_SLOTS - 1))
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"log"
+	"crypto/subtle"
 	"math"
+	"math/rand"
 	"strconv"
 	"strings"
 	"time"
@@ -16,31 +17,152 @@ type redisCommand struct {
 	arity int64
 	sflag string
 	flag  int
+	//statistics of the command, reset by CONFIG RESETSTAT.
+	microseconds int64
+	calls        int64
 }
 
 var redisCommandTable = []redisCommand{
 	{name: "COMMAND", proc: commandCommand, arity: 0, sflag: "rlt", flag: 0},
 	{name: "PING", proc: pingCommand, arity: 0, sflag: "rtF", flag: 0},
-	{name: "SET", proc: setCommand, sflag: "rtF", flag: 0},
-	{name: "GET", proc: getCommand, sflag: "rtF", flag: 0},
-	{name: "RPUSH", proc: rpushCommand, sflag: "wmF", flag: 0},
-	{name: "LRANGE", proc: lrangeCommand, sflag: "r", flag: 0},
-	{name: "LINDEX", proc: lindexCommand, sflag: "r", flag: 0},
-	{name: "LPOP", proc: lpopCommand, sflag: "wF", flag: 0},
-	{name: "HSET", proc: hsetCommand, arity: 4, sflag: "wmF", flag: 0},
+	{name: "SET", proc: setCommand, arity: -3, sflag: "wm", flag: 0},
+	{name: "GET", proc: getCommand, arity: 2, sflag: "rF", flag: 0},
+	{name: "DEL", proc: delCommand, arity: -2, sflag: "w", flag: 0},
+	{name: "SELECT", proc: selectCommand, arity: 2, sflag: "rlF", flag: 0},
+	{name: "EXPIRE", proc: expireCommand, arity: 3, sflag: "wF", flag: 0},
+	{name: "EXPIREAT", proc: expireatCommand, arity: 3, sflag: "wF", flag: 0},
+	{name: "PEXPIRE", proc: pexpireCommand, arity: 3, sflag: "wF", flag: 0},
+	{name: "PEXPIREAT", proc: pexpireatCommand, arity: 3, sflag: "wF", flag: 0},
+	{name: "TTL", proc: ttlCommand, arity: 2, sflag: "rF", flag: 0},
+	{name: "PTTL", proc: pttlCommand, arity: 2, sflag: "rF", flag: 0},
+	{name: "PERSIST", proc: persistCommand, arity: 2, sflag: "wF", flag: 0},
+	{name: "RPUSH", proc: rpushCommand, arity: -3, sflag: "wmF", flag: 0},
+	{name: "LPUSH", proc: lpushCommand, arity: -3, sflag: "wmF", flag: 0},
+	{name: "RPUSHX", proc: rpushxCommand, arity: -3, sflag: "wmF", flag: 0},
+	{name: "LPUSHX", proc: lpushxCommand, arity: -3, sflag: "wmF", flag: 0},
+	{name: "LINSERT", proc: linsertCommand, arity: 5, sflag: "wm", flag: 0},
+	{name: "LLEN", proc: llenCommand, arity: 2, sflag: "rF", flag: 0},
+	{name: "LSET", proc: lsetCommand, arity: 4, sflag: "wm", flag: 0},
+	{name: "LREM", proc: lremCommand, arity: 4, sflag: "w", flag: 0},
+	{name: "LTRIM", proc: ltrimCommand, arity: 4, sflag: "w", flag: 0},
+	{name: "LPOS", proc: lposCommand, arity: -3, sflag: "r", flag: 0},
+	{name: "RPOPLPUSH", proc: rpoplpushCommand, arity: 3, sflag: "wm", flag: 0},
+	{name: "LMPOP", proc: lmpopCommand, arity: -4, sflag: "w", flag: 0},
+	{name: "LRANGE", proc: lrangeCommand, arity: 4, sflag: "r", flag: 0},
+	{name: "LINDEX", proc: lindexCommand, arity: 3, sflag: "r", flag: 0},
+	{name: "LPOP", proc: lpopCommand, arity: -2, sflag: "wF", flag: 0},
+	{name: "RPOP", proc: rpopCommand, arity: -2, sflag: "wF", flag: 0},
+	{name: "LMOVE", proc: lmoveCommand, arity: 5, sflag: "wm", flag: 0},
+	{name: "BLPOP", proc: blpopCommand, arity: -3, sflag: "ws", flag: 0},
+	{name: "BRPOP", proc: brpopCommand, arity: -3, sflag: "ws", flag: 0},
+	{name: "BLMOVE", proc: blmoveCommand, arity: 6, sflag: "wms", flag: 0},
+	{name: "BLMPOP", proc: blmpopCommand, arity: -5, sflag: "ws", flag: 0},
+	{name: "HSET", proc: hsetCommand, arity: -4, sflag: "wmF", flag: 0},
 	{name: "HMSET", proc: hmsetCommand, arity: -4, sflag: "wm", flag: 0},
 	{name: "HSETNX", proc: hsetnxCommand, arity: 4, sflag: "wm", flag: 0},
 	{name: "HGET", proc: hgetCommand, arity: 3, sflag: "rF", flag: 0},
 	{name: "HMGET", proc: hmgetCommand, arity: -3, sflag: "r", flag: 0},
 	{name: "HGETALL", proc: hgetallCommand, arity: 2, sflag: "r", flag: 0},
 	{name: "HDEL", proc: hdelCommand, arity: -3, sflag: "wF", flag: 0},
+	{name: "HLEN", proc: hlenCommand, arity: 2, sflag: "rF", flag: 0},
+	{name: "HEXISTS", proc: hexistsCommand, arity: 3, sflag: "rF", flag: 0},
+	{name: "HKEYS", proc: hkeysCommand, arity: 2, sflag: "r", flag: 0},
+	{name: "HVALS", proc: hvalsCommand, arity: 2, sflag: "r", flag: 0},
+	{name: "HSTRLEN", proc: hstrlenCommand, arity: 3, sflag: "rF", flag: 0},
+	{name: "HINCRBY", proc: hincrbyCommand, arity: 4, sflag: "wmF", flag: 0},
+	{name: "HINCRBYFLOAT", proc: hincrbyfloatCommand, arity: 4, sflag: "wmF", flag: 0},
+	{name: "HRANDFIELD", proc: hrandfieldCommand, arity: -2, sflag: "rR", flag: 0},
+	{name: "HSCAN", proc: hscanCommand, arity: -3, sflag: "rR", flag: 0},
+	{name: "HEXPIRE", proc: hexpireCommand, arity: -6, sflag: "wF", flag: 0},
+	{name: "HPEXPIRE", proc: hpexpireCommand, arity: -6, sflag: "wF", flag: 0},
+	{name: "HEXPIREAT", proc: hexpireatCommand, arity: -6, sflag: "wF", flag: 0},
+	{name: "HPEXPIREAT", proc: hpexpireatCommand, arity: -6, sflag: "wF", flag: 0},
+	{name: "HTTL", proc: httlCommand, arity: -5, sflag: "rF", flag: 0},
+	{name: "HPTTL", proc: hpttlCommand, arity: -5, sflag: "rF", flag: 0},
+	{name: "HPERSIST", proc: hpersistCommand, arity: -5, sflag: "wF", flag: 0},
+	{name: "HGETEX", proc: hgetexCommand, arity: -5, sflag: "wF", flag: 0},
+	{name: "HSETEX", proc: hsetexCommand, arity: -6, sflag: "wmF", flag: 0},
+	{name: "SADD", proc: saddCommand, arity: -3, sflag: "wmF", flag: 0},
+	{name: "SREM", proc: sremCommand, arity: -3, sflag: "wF", flag: 0},
+	{name: "SMOVE", proc: smoveCommand, arity: 4, sflag: "wF", flag: 0},
+	{name: "SISMEMBER", proc: sismemberCommand, arity: 3, sflag: "rF", flag: 0},
+	{name: "SMISMEMBER", proc: smismemberCommand, arity: -3, sflag: "rF", flag: 0},
+	{name: "SCARD", proc: scardCommand, arity: 2, sflag: "rF", flag: 0},
+	{name: "SPOP", proc: spopCommand, arity: -2, sflag: "wRF", flag: 0},
+	{name: "SRANDMEMBER", proc: srandmemberCommand, arity: -2, sflag: "rR", flag: 0},
+	{name: "SMEMBERS", proc: smembersCommand, arity: 2, sflag: "r", flag: 0},
+	{name: "SSCAN", proc: sscanCommand, arity: -3, sflag: "rR", flag: 0},
+	{name: "SINTER", proc: sinterCommand, arity: -2, sflag: "r", flag: 0},
+	{name: "SINTERSTORE", proc: sinterstoreCommand, arity: -3, sflag: "wm", flag: 0},
+	{name: "SINTERCARD", proc: sintercardCommand, arity: -3, sflag: "r", flag: 0},
+	{name: "SUNION", proc: sunionCommand, arity: -2, sflag: "r", flag: 0},
+	{name: "SUNIONSTORE", proc: sunionstoreCommand, arity: -3, sflag: "wm", flag: 0},
+	{name: "SDIFF", proc: sdiffCommand, arity: -2, sflag: "r", flag: 0},
+	{name: "SDIFFSTORE", proc: sdiffstoreCommand, arity: -3, sflag: "wm", flag: 0},
 	{name: "ZADD", proc: zaddCommand, arity: -4, sflag: "wmF", flag: 0},
+	{name: "ZINCRBY", proc: zincrbyCommand, arity: 4, sflag: "wmF", flag: 0},
 	{name: "ZREM", proc: zremCommand, arity: -3, sflag: "wF", flag: 0},
 	{name: "ZCARD", proc: zcardCommand, arity: 2, sflag: "rF", flag: 0},
 	{name: "ZRANK", proc: zrankCommand, arity: 3, sflag: "rF", flag: 0},
+	{name: "ZSCORE", proc: zscoreCommand, arity: 3, sflag: "rF", flag: 0},
+	{name: "ZRANGE", proc: zrangeCommand, arity: -4, sflag: "r", flag: 0},
+	{name: "ZRANGESTORE", proc: zrangestoreCommand, arity: -5, sflag: "wm", flag: 0},
+	{name: "ZREVRANGE", proc: zrevrangeCommand, arity: -4, sflag: "r", flag: 0},
+	{name: "ZRANGEBYSCORE", proc: zrangebyscoreCommand, arity: -4, sflag: "r", flag: 0},
+	{name: "ZREVRANGEBYSCORE", proc: zrevrangebyscoreCommand, arity: -4, sflag: "r", flag: 0},
+	{name: "ZRANGEBYLEX", proc: zrangebylexCommand, arity: -4, sflag: "r", flag: 0},
+	{name: "ZREVRANGEBYLEX", proc: zrevrangebylexCommand, arity: -4, sflag: "r", flag: 0},
+	{name: "ZCOUNT", proc: zcountCommand, arity: 4, sflag: "rF", flag: 0},
+	{name: "ZLEXCOUNT", proc: zlexcountCommand, arity: 4, sflag: "rF", flag: 0},
+	{name: "ZUNIONSTORE", proc: zunionstoreCommand, arity: -4, sflag: "wm", flag: 0},
+	{name: "ZINTERSTORE", proc: zinterstoreCommand, arity: -4, sflag: "wm", flag: 0},
+	{name: "ZDIFFSTORE", proc: zdiffstoreCommand, arity: -4, sflag: "wm", flag: 0},
+	{name: "ZUNION", proc: zunionCommand, arity: -3, sflag: "r", flag: 0},
+	{name: "ZINTER", proc: zinterCommand, arity: -3, sflag: "r", flag: 0},
+	{name: "ZINTERCARD", proc: zintercardCommand, arity: -3, sflag: "r", flag: 0},
+	{name: "ZDIFF", proc: zdiffCommand, arity: -3, sflag: "r", flag: 0},
+	{name: "ZREMRANGEBYRANK", proc: zremrangebyrankCommand, arity: 4, sflag: "w", flag: 0},
+	{name: "ZREMRANGEBYSCORE", proc: zremrangebyscoreCommand, arity: 4, sflag: "w", flag: 0},
+	{name: "ZREMRANGEBYLEX", proc: zremrangebylexCommand, arity: 4, sflag: "w", flag: 0},
+	{name: "ZPOPMIN", proc: zpopminCommand, arity: -2, sflag: "wF", flag: 0},
+	{name: "ZPOPMAX", proc: zpopmaxCommand, arity: -2, sflag: "wF", flag: 0},
+	{name: "ZMPOP", proc: zmpopCommand, arity: -4, sflag: "w", flag: 0},
+	{name: "BZPOPMIN", proc: bzpopminCommand, arity: -3, sflag: "ws", flag: 0},
+	{name: "BZPOPMAX", proc: bzpopmaxCommand, arity: -3, sflag: "ws", flag: 0},
+	{name: "BZMPOP", proc: bzmpopCommand, arity: -5, sflag: "ws", flag: 0},
 	{name: "INCR", proc: incrCommand, arity: 2, sflag: "wmF", flag: 0},
 	{name: "DECR", proc: decrCommand, arity: 2, sflag: "wmF", flag: 0},
 	{name: "SCAN", proc: scanCommand, arity: -2, sflag: "rR", flag: 0},
+	{name: "HELLO", proc: helloCommand, arity: -1, sflag: "rsltF", flag: 0},
+	{name: "AUTH", proc: authCommand, arity: -2, sflag: "rsltF", flag: 0},
+	{name: "CONFIG", proc: configCommand, arity: -2, sflag: "aslt", flag: 0},
+	{name: "INFO", proc: infoCommand, arity: -1, sflag: "rlt", flag: 0},
+	{name: "SAVE", proc: saveCommand, arity: 1, sflag: "ars", flag: 0},
+	{name: "BGSAVE", proc: bgsaveCommand, arity: -1, sflag: "ar", flag: 0},
+	{name: "LASTSAVE", proc: lastsaveCommand, arity: 1, sflag: "rRF", flag: 0},
+	{name: "BGREWRITEAOF", proc: bgrewriteaofCommand, arity: 1, sflag: "ar", flag: 0},
+	{name: "SYNC", proc: syncCommand, arity: 1, sflag: "ars", flag: 0},
+	{name: "PSYNC", proc: syncCommand, arity: 3, sflag: "ars", flag: 0},
+	{name: "REPLCONF", proc: replconfCommand, arity: -1, sflag: "arslt", flag: 0},
+	{name: "REPLICAOF", proc: replicaofCommand, arity: 3, sflag: "ast", flag: 0},
+	{name: "SLAVEOF", proc: replicaofCommand, arity: 3, sflag: "ast", flag: 0},
+	{name: "WAIT", proc: waitCommand, arity: 3, sflag: "s", flag: 0},
+	{name: "MULTI", proc: multiCommand, arity: 1, sflag: "rsF", flag: 0},
+	{name: "EXEC", proc: execCommand, arity: 1, sflag: "sM", flag: 0},
+	{name: "DISCARD", proc: discardCommand, arity: 1, sflag: "rsF", flag: 0},
+	{name: "WATCH", proc: watchCommand, arity: -2, sflag: "rsF", flag: 0},
+	{name: "UNWATCH", proc: unwatchCommand, arity: 1, sflag: "rsF", flag: 0},
+	{name: "FLUSHDB", proc: flushdbCommand, arity: -1, sflag: "w", flag: 0},
+	{name: "FLUSHALL", proc: flushallCommand, arity: -1, sflag: "w", flag: 0},
+	{name: "SUBSCRIBE", proc: subscribeCommand, arity: -2, sflag: "rpslt", flag: 0},
+	{name: "UNSUBSCRIBE", proc: unsubscribeCommand, arity: -1, sflag: "rpslt", flag: 0},
+	{name: "PSUBSCRIBE", proc: psubscribeCommand, arity: -2, sflag: "rpslt", flag: 0},
+	{name: "PUNSUBSCRIBE", proc: punsubscribeCommand, arity: -1, sflag: "rpslt", flag: 0},
+	{name: "PUBLISH", proc: publishCommand, arity: 3, sflag: "pltrF", flag: 0},
+	{name: "PUBSUB", proc: pubsubCommand, arity: -2, sflag: "pltrR", flag: 0},
+	{name: "SSUBSCRIBE", proc: ssubscribeCommand, arity: -2, sflag: "rpslt", flag: 0},
+	{name: "SUNSUBSCRIBE", proc: sunsubscribeCommand, arity: -1, sflag: "rpslt", flag: 0},
+	{name: "SPUBLISH", proc: spublishCommand, arity: 3, sflag: "pltrF", flag: 0},
 }
 var shared sharedObjectsStruct
 
@@ -50,12 +172,35 @@ type sharedObjectsStruct struct {
 	err            *string
 	pong           *string
 	syntaxerr      *string
-	nullbulk       *string
+	null           [4]*string
+	nullarray      [4]*string
 	wrongtypeerr   *string
+	nokeyerr       *string
+	outofrangeerr  *string
 	czero          *string
 	cone           *string
 	colon          *string
 	emptymultibulk *string
+	emptyscan      *string
+	queued         *string
+	del            *robj
+	multi          *robj
+	lpop           *robj
+	rpop           *robj
+	lmove          *robj
+	zpopmin        *robj
+	zpopmax        *robj
+	hset           *robj
+	hdel           *robj
+	srem           *robj
+	hpexpireat     *robj
+	hpersist       *robj
+	fields         *robj
+	pxat           *robj
+	ping           *robj
+	replconf       *robj
+	getack         *robj
+	star           *robj
 	integers       [REDIS_SHARED_INTEGERS]*robj //通用0~9999常量数值池
 	bulkhdr        [REDIS_SHARED_BULKHDR_LEN]*robj
 }
@@ -69,8 +214,74 @@ func commandCommand(c *redisClient) {
 	addReply(c, &reply)
 }
 
+/*
+*
+AUTH [username] password
+the only user is "default", whose password is set by the requirepass directive.
+*/
+func authCommand(c *redisClient) {
+	if c.argc > 3 {
+		addReply(c, shared.syntaxerr)
+		return
+	}
+
+	username := "default"
+	password := (*c.argv[1].ptr).(string)
+	if c.argc == 3 {
+		username = (*c.argv[1].ptr).(string)
+		password = (*c.argv[2].ptr).(string)
+	} else if server.requirepass == "" {
+		//the single argument form only makes sense when a password is configured.
+		errMsg := "AUTH <password> called without any password configured for the default user. " +
+			"Are you sure your configuration is correct?"
+		addReplyError(c, &errMsg)
+		return
+	}
+
+	if checkPassword(username, password) {
+		c.authenticated = true
+		addReply(c, shared.ok)
+	} else {
+		addReplyErrorWithCode(c, "WRONGPASS invalid username-password pair or user is disabled.")
+	}
+}
+
+// check the credentials of the default user, any password is accepted when requirepass is not set.
+func checkPassword(username string, password string) bool {
+	if username != "default" {
+		return false
+	}
+	if server.requirepass == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(server.requirepass)) == 1
+}
+
+/*
+*
+PING [message]
+a RESP2 client in the context of Pub/Sub receives the reply as a push message.
+*/
 func pingCommand(c *redisClient) {
-	addReply(c, shared.pong)
+	//the command takes zero or one arguments.
+	if c.argc > 2 {
+		reply := "wrong number of arguments for 'ping' command"
+		addReplyError(c, &reply)
+		return
+	}
+	if c.flags&REDIS_PUBSUB > 0 && c.resp == 2 {
+		addReplyMultiBulkLen(c, 2)
+		addReplyBulkCString(c, "pong")
+		if c.argc == 1 {
+			addReplyBulkCString(c, "")
+		} else {
+			addReplyBulk(c, c.argv[1])
+		}
+	} else if c.argc == 1 {
+		addReply(c, shared.pong)
+	} else {
+		addReplyBulk(c, c.argv[1])
+	}
 }
 
 func setCommand(c *redisClient) {
@@ -83,9 +294,8 @@ func setCommand(c *redisClient) {
 		ptr := c.argv[j].ptr
 		a := (*ptr).(string)
 		var next string
-		if j == c.argc-1 {
-			next = ""
-		} else {
+		hasNext := j < c.argc-1
+		if hasNext {
 			nextPtr := c.argv[j+1].ptr
 			next = (*nextPtr).(string)
 		}
@@ -94,11 +304,11 @@ func setCommand(c *redisClient) {
 			flags |= REDIS_SET_NX
 		} else if strings.ToLower(a) == "xx" { //if "xx" is included, mark the flags to indicate that the key can only be set if it already exists.
 			flags |= REDIS_SET_XX
-		} else if strings.ToLower(a) == "ex" { //if it is "ex", set the unit to seconds and read the next parameter.
+		} else if strings.ToLower(a) == "ex" && hasNext { //if it is "ex", set the unit to seconds and read the next parameter.
 			unit = UNIT_SECONDS
 			expire = next
 			j++
-		} else if strings.ToLower(a) == "px" { //if it is "px", set the unit to milliseconds and read the next parameter.
+		} else if strings.ToLower(a) == "px" && hasNext { //if it is "px", set the unit to milliseconds and read the next parameter.
 			unit = UNIT_MILLISECONDS
 			expire = next
 			j++
@@ -121,6 +331,11 @@ func setGenericCommand(c *redisClient, flags int, key *robj, val *robj, expire s
 			return
 		}
 
+		if *milliseconds <= 0 {
+			errMsg := "invalid expire time in 'set' command"
+			addReplyError(c, &errMsg)
+			return
+		}
 		if unit == UNIT_SECONDS {
 			*milliseconds = *milliseconds * 1000
 		}
@@ -132,19 +347,18 @@ func setGenericCommand(c *redisClient, flags int, key *robj, val *robj, expire s
 	*/
 	if (flags&REDIS_SET_NX > 0 && lookupKeyWrite(c.db, key) != nil) ||
 		(flags&REDIS_SET_XX > 0 && lookupKeyWrite(c.db, key) == nil) {
-		addReply(c, shared.nullbulk)
+		addReplyNull(c)
 		return
 	}
+	//store the key-value pair in a dictionary, overwriting the old value and removing its expire.
+	//c.db.dict[(*key.ptr).(string)] = val
+	setKey(c.db, key, val)
+	server.dirty++
 	//if `expire` is not empty, add the converted value to the current time to obtain the expiration time. Then,
 	//use the passed key as the key and the expiration time as the value to store in the `expires` dictionary.
 	if expire != "" {
-		//c.db.expires[(*key.ptr).(string)] =
-		when := createStringObjectFromLongLong(time.Now().UnixMilli() + *milliseconds)
-		dictReplace(&c.db.expires, key, when)
+		setExpire(c.db, key, time.Now().UnixMilli()+*milliseconds)
 	}
-	//store the key-value pair in a dictionary.
-	//c.db.dict[(*key.ptr).(string)] = val
-	dbAdd(c.db, key, val)
 	addReply(c, shared.ok)
 }
 
@@ -197,15 +411,15 @@ func incrDecrCommand(c *redisClient, incr int64) {
 	}
 	//基于incr累加的值生成value
 	value += incr
-	//如果超常量池范围则封装一个对象使用
-	if o != nil &&
-		(value < 0 || value >= REDIS_SHARED_INTEGERS) &&
-		(value > math.MinInt64 || value < math.MaxInt64) {
+	//如果超常量池范围且原对象是非共享的整数对象则原地修改，常量池中的对象被多个键共享，不能修改
+	if o != nil && o.encoding == REDIS_ENCODING_INT &&
+		(oldValue < 0 || oldValue >= REDIS_SHARED_INTEGERS) &&
+		(value < 0 || value >= REDIS_SHARED_INTEGERS) {
 		newObj = o
 
 		i := interface{}(value)
 		o.ptr = &i
-	} else if o != nil { //如果对象存在，且累加结果没超范围则调用createStringObjectFromLongLong获取常量对象
+	} else if o != nil { //如果对象存在但不能原地修改，则调用createStringObjectFromLongLong生成新对象或获取常量对象
 		newObj = createStringObjectFromLongLong(value)
 		//将写入结果覆盖
 		dbOverwrite(c.db, c.argv[1], newObj)
@@ -213,6 +427,8 @@ func incrDecrCommand(c *redisClient, incr int64) {
 		newObj = createStringObjectFromLongLong(value)
 		dbAdd(c.db, c.argv[1], newObj)
 	}
+	signalModifiedKey(c.db, c.argv[1])
+	server.dirty++
 	//将累加后的结果返回给客户端，按照RESP格式即 :数值\r\n,例如返回10 那么格式就是:10\r\n
 	reply := *shared.colon + strconv.FormatInt(value, 10) + *shared.crlf
 	addReply(c, &reply)
@@ -231,11 +447,17 @@ func createSharedObjects() {
 	pong := "+PONG\r\n"
 	syntaxerr := "-ERR syntax error\r\n"
 	nullbulk := "$-1\r\n"
+	nullmultibulk := "*-1\r\n"
+	resp3null := "_\r\n"
 	wrongtypeerr := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	nokeyerr := "-ERR no such key\r\n"
+	outofrangeerr := "-ERR index out of range\r\n"
 	czero := ":0\r\n"
 	cone := ":1\r\n"
 	colon := ":"
 	emptymultibulk := "*0\r\n"
+	emptyscan := "*2\r\n$1\r\n0\r\n*0\r\n"
+	queued := "+QUEUED\r\n"
 
 	shared = sharedObjectsStruct{
 		crlf:           &crlf,
@@ -243,13 +465,45 @@ func createSharedObjects() {
 		err:            &err,
 		pong:           &pong,
 		syntaxerr:      &syntaxerr,
-		nullbulk:       &nullbulk,
+		null:           [4]*string{nil, nil, &nullbulk, &resp3null},
+		nullarray:      [4]*string{nil, nil, &nullmultibulk, &resp3null},
 		wrongtypeerr:   &wrongtypeerr,
+		nokeyerr:       &nokeyerr,
+		outofrangeerr:  &outofrangeerr,
 		czero:          &czero,
 		cone:           &cone,
 		colon:          &colon,
 		emptymultibulk: &emptymultibulk,
+		emptyscan:      &emptyscan,
+		queued:         &queued,
 	}
+	del := "DEL"
+	shared.del = createStringObject(&del, len(del))
+	multi := "MULTI"
+	shared.multi = createStringObject(&multi, len(multi))
+	lpop, rpop, lmove := "LPOP", "RPOP", "LMOVE"
+	shared.lpop = createStringObject(&lpop, len(lpop))
+	shared.rpop = createStringObject(&rpop, len(rpop))
+	shared.lmove = createStringObject(&lmove, len(lmove))
+	zpopmin, zpopmax := "ZPOPMIN", "ZPOPMAX"
+	shared.zpopmin = createStringObject(&zpopmin, len(zpopmin))
+	shared.zpopmax = createStringObject(&zpopmax, len(zpopmax))
+	hset := "HSET"
+	shared.hset = createStringObject(&hset, len(hset))
+	hdel, hpexpireat, hpersist, fields, pxat := "HDEL", "HPEXPIREAT", "HPERSIST", "FIELDS", "PXAT"
+	shared.hdel = createStringObject(&hdel, len(hdel))
+	shared.hpexpireat = createStringObject(&hpexpireat, len(hpexpireat))
+	shared.hpersist = createStringObject(&hpersist, len(hpersist))
+	shared.fields = createStringObject(&fields, len(fields))
+	shared.pxat = createStringObject(&pxat, len(pxat))
+	srem := "SREM"
+	shared.srem = createStringObject(&srem, len(srem))
+	ping := "PING"
+	shared.ping = createStringObject(&ping, len(ping))
+	replconf, getack, star := "REPLCONF", "GETACK", "*"
+	shared.replconf = createStringObject(&replconf, len(replconf))
+	shared.getack = createStringObject(&getack, len(getack))
+	shared.star = createStringObject(&star, len(star))
 
 	var i int64
 	//初始化常量池对象
@@ -279,7 +533,7 @@ func getCommand(c *redisClient) {
 
 func getGenericCommand(c *redisClient) int {
 	//check if the key exists, and if it does not, return a null bulk response from the constant values.
-	o := lookupKeyReadOrReply(c, c.argv[1], shared.nullbulk)
+	o := lookupKeyReadOrReply(c, c.argv[1], shared.null[c.resp])
 	if o == nil {
 		return REDIS_OK
 	}
@@ -293,42 +547,66 @@ func rpushCommand(c *redisClient) {
 	pass in the REDIS_TAIL flag to indicate that
 	the current element should be appended to the tail of the list.
 	*/
-	pushGenericCommand(c, REDIS_TAIL)
+	pushGenericCommand(c, REDIS_TAIL, false)
+}
+
+func lpushCommand(c *redisClient) {
+	//pass in the REDIS_HEAD flag, the elements are inserted one after the other at the head of the list.
+	pushGenericCommand(c, REDIS_HEAD, false)
+}
+
+func lpushxCommand(c *redisClient) {
+	pushGenericCommand(c, REDIS_HEAD, true)
 }
 
-func pushGenericCommand(c *redisClient, where int) {
+func rpushxCommand(c *redisClient) {
+	pushGenericCommand(c, REDIS_TAIL, true)
+}
+
+/*
+*
+LPUSH/RPUSH/LPUSHX/RPUSHX key element [element ...]
+xx means the elements are only pushed if the list already exists.
+*/
+func pushGenericCommand(c *redisClient, where int, xx bool) {
 	//check if the corresponding key exists.
 	o := lookupKeyWrite(c.db, c.argv[1])
 	var lobj *robj
 	//if the key exists, then determine if it is a list.
 	//if it is not, then throw an error exception.
-	if o != nil && o.encoding != REDIS_ENCODING_LINKEDLIST {
-		addReply(c, shared.wrongtypeerr)
+	if o != nil && checkType(c, o, REDIS_LIST) {
 		return
 	} else if o != nil { //if it exists and is a list, then retrieve the Redis object for the list.
 		lobj = o
+	} else if xx { //LPUSHX/RPUSHX don't create the list.
+		addReply(c, shared.czero)
+		return
 	}
+	/**
+	If the list is empty, then initialize it, create it, and store it in the Redis database.
+	*/
+	if lobj == nil {
+		lobj = createListListpackObject()
+		dbAdd(c.db, c.argv[1], lobj)
+	}
+	//convert the listpack to a quicklist if the new elements make it too big.
+	listTypeTryConversionAppend(lobj, c.argv, 2, int(c.argc-1))
 	//foreach element starting from index 2.
 	var j uint64
 	for j = 2; j < c.argc; j++ {
 		//call `tryObjectEncoding` to perform special processing on the elements.
 		c.argv[j] = tryObjectEncoding(c.argv[j])
 
-		/**
-		If the list is empty, then initialize it, create it, and store it in the Redis database.
-		*/
-		if lobj == nil {
-			lobj = createListObject()
-			dbAdd(c.db, c.argv[1], lobj)
-		}
 		/**
 		pass in the list pointer, element pointer,
 		and add flag to append the element to the head or tail of the list.
 		*/
 		listTypePush(lobj, c.argv[j], where)
+		server.dirty++
 	}
+	signalModifiedKey(c.db, c.argv[1])
 	//return the current length of the list.
-	addReplyLongLong(c, (*lobj.ptr).(*list).len)
+	addReplyLongLong(c, listTypeLength(lobj))
 }
 
 func lrangeCommand(c *redisClient) {
@@ -358,11 +636,7 @@ func lrangeCommand(c *redisClient) {
 		return
 	}
 	//get the start and end values of a range query. If they are negative, add the length of the linked list.
-	llen = (*o.ptr).(*list).len
-	if start < 0 {
-		start += llen
-	}
-
+	llen = listTypeLength(o)
 	if start < 0 {
 		start += llen
 	}
@@ -379,69 +653,53 @@ func lrangeCommand(c *redisClient) {
 	If either of these exceptions occurs, respond with an error.
 	*/
 	if start >= llen || start > end {
-		addReplyError(c, shared.emptymultibulk)
+		addReply(c, shared.emptymultibulk)
 		return
 	}
-	//if end is greater than list length, set it to the list length.
-	if end > llen {
+	//if end is beyond the last element, set it to the last element.
+	if end >= llen {
 		end = llen - 1
 	}
 
 	rangelen = end - start + 1
 	addReplyMultiBulkLen(c, rangelen)
 
-	if o.encoding == REDIS_ENCODING_ZIPLIST {
-		//todo
-	} else if o.encoding == REDIS_ENCODING_LINKEDLIST {
-		lobj := (*o.ptr).(*list)
-		node := listIndex(lobj, start)
-		//foreach the linked list starting from "start" based on "rangelen."
-		for rangelen > 0 {
-			rObj := (*node.value).(*robj)
-			addReplyBulk(c, rObj)
-			node = node.next
-			rangelen--
-		}
-
-	} else {
-		log.Panic("List encoding is not LINKEDLIST nor ZIPLIST!")
+	//foreach the list starting from "start" based on "rangelen."
+	var entry listTypeEntry
+	iter := listTypeInitIterator(o, start, REDIS_TAIL)
+	for rangelen > 0 && listTypeNext(iter, &entry) {
+		addReplyBulk(c, listTypeGet(&entry))
+		rangelen--
 	}
-
+	listTypeReleaseIterator(iter)
 }
 
 func lindexCommand(c *redisClient) {
 	/**
 	check if the linked list exists; if it doesn't, return empty.
 	*/
-	o := lookupKeyReadOrReply(c, c.argv[1], shared.nullbulk)
+	o := lookupKeyReadOrReply(c, c.argv[1], shared.null[c.resp])
 
 	//verify if the type is a linked list.
 	if o == nil || checkType(c, o, REDIS_LIST) {
 		return
 	}
 
-	if o.encoding == REDIS_ENCODING_ZIPLIST {
-		//todo
-	} else if o.encoding == REDIS_ENCODING_LINKEDLIST {
-		/**
-		retrieve the parameter at index 2 to obtain the index position,
-		then fetch the element from the linked list at that index and return it.
-		*/
-		lobj := (*o.ptr).(*list)
-		s := (*c.argv[2].ptr).(string)
-		idx, _ := strconv.ParseInt(s, 10, 64)
-		ln := listIndex(lobj, idx)
-
-		if ln != nil {
-			value := (*ln.value).(*robj)
-			addReplyBulk(c, value)
-		} else {
-			addReply(c, shared.nullbulk)
-		}
-	} else {
-		log.Panic("Unknown list encoding")
+	//retrieve the parameter at index 2 to obtain the index position.
+	var idx int64
+	if !getLongFromObjectOrReply(c, c.argv[2], &idx, nil) {
+		return
 	}
 
+	//fetch the element from the list at that index and return it.
+	var entry listTypeEntry
+	iter := listTypeInitIterator(o, idx, REDIS_TAIL)
+	if listTypeNext(iter, &entry) {
+		addReplyBulk(c, listTypeGet(&entry))
+	} else {
+		addReplyNull(c)
+	}
+	listTypeReleaseIterator(iter)
 }
 
 func lpopCommand(c *redisClient) {
@@ -449,83 +707,131 @@ func lpopCommand(c *redisClient) {
 	popGenericCommand(c, REDIS_HEAD)
 }
 
+func rpopCommand(c *redisClient) {
+	// params is REDIS_TAIL, which means to retrieve the tail element.
+	popGenericCommand(c, REDIS_TAIL)
+}
+
+/*
+*
+LPOP/RPOP key [count]
+without count a single element is replied as a bulk, with count up to count
+elements are replied as a multi bulk.
+*/
 func popGenericCommand(c *redisClient, where int) {
+	hascount := c.argc == 3
+	var count int64
+	if c.argc > 3 {
+		reply := "wrong number of arguments for " + c.argv[0].String() + " command"
+		addReplyError(c, &reply)
+		return
+	} else if hascount {
+		//parse the optional count argument.
+		errMsg := "value is out of range, must be positive"
+		if !getPositiveLongFromObjectOrReply(c, c.argv[2], &count, &errMsg) {
+			return
+		}
+	}
+
 	//check if the key exists, and if it doesn't, respond with an empty response.
-	o := lookupKeyReadOrReply(c, c.argv[1], shared.nullbulk)
+	reply := shared.null[c.resp]
+	if hascount {
+		reply = shared.nullarray[c.resp]
+	}
+	o := lookupKeyWriteOrReply(c, c.argv[1], reply)
 
 	//If the type is not a linked list, throw an exception and return.
 	if o == nil || checkType(c, o, REDIS_LIST) {
 		return
 	}
 
-	value := listTypePop(o, where)
-	//retrieve the first element of the linked list based on the WHERE identifier.
-	if value == nil {
-		addReply(c, shared.nullbulk)
-	} else {
-		/**
-		return the element value, and check if the linked list is empty.
-		If it is empty, delete the key-value pair in the Redis database.
-		*/
-		addReplyBulk(c, value)
-		if listTypeLength(o) == 0 {
-			dbDelete(c.db, c.argv[1])
-		}
-	}
-}
-
-func hsetCommand(c *redisClient) {
-	/**
-	check if the dict object exists, and if it does not exist, create hash obj
-	if it exists, then determine whether it is a hash obj. If not, return a type error.
-	*/
-	o := hashTypeLookupWriteOrCreate(c, c.argv[1])
-
-	if o == nil {
+	if hascount && count == 0 {
+		//fast exit path.
+		addReply(c, shared.emptymultibulk)
 		return
 	}
-	//try to convert strings that can be converted to numerical types into numerical types.
-	hashTypeTryObjectEncoding(o, &c.argv[2], &c.argv[3])
-	/**
-	pass the information to the database to find the dictionary object along with the fields and values,
-	return the dict update count
-	*/
-	update := hashTypeSet(o, c.argv[2], c.argv[3])
-	//if it is an update operation, return 0; if it is the first insertion of a field, return 1.
-	if update == 1 {
-		addReply(c, shared.czero)
+
+	if !hascount {
+		//retrieve the first element of the linked list based on the WHERE identifier.
+		value := listTypePop(o, where)
+		addReplyBulk(c, value)
+		listElementsRemoved(c, c.argv[1], o)
 	} else {
-		addReply(c, shared.cone)
+		//pop a range of elements, replied as a multi bulk.
+		llen := listTypeLength(o)
+		rangelen := count
+		if rangelen > llen {
+			rangelen = llen
+		}
+		addReplyMultiBulkLen(c, rangelen)
+		for j := int64(0); j < rangelen; j++ {
+			addReplyBulk(c, listTypePop(o, where))
+		}
+		listElementsRemoved(c, c.argv[1], o)
 	}
 }
 
-func hmsetCommand(c *redisClient) {
+/*
+*
+HSET key field value [field value ...]
+the number of fields that were added is replied, HMSET shares the same logic
+but replies OK.
+*/
+func hsetCommand(c *redisClient) {
 	/**
 	determine if the  command params is singular
 	if it is, respond with wrong number
 	*/
 	if c.argc%2 == 1 {
-		errMsg := "wrong number of arguments for HMSET"
+		errMsg := "wrong number of arguments for " + c.argv[0].String() + " command"
 		addReplyError(c, &errMsg)
 		return
 	}
 	/**
+	check if the dict object exists, and if it does not exist, create hash obj
+	if it exists, then determine whether it is a hash obj. If not, return a type error.
+	*/
+	o := hashTypeLookupWriteOrCreate(c, c.argv[1])
+	if o == nil {
+		return
+	}
+	//convert the listpack to a hash table if there are too many fields, or a field or a value is too long.
+	hashTypeTryConversion(o, c.argv, 2, int(c.argc-1))
+	/**
 	starting from index 2,foreach key-value pair,
 	perform encoding conversion, and save to dict obj
 	*/
+	var created int64
 	var i uint64
-	o := hashTypeLookupWriteOrCreate(c, c.argv[1])
 	for i = 2; i < c.argc; i += 2 {
+		//try to convert strings that can be converted to numerical types into numerical types.
 		hashTypeTryObjectEncoding(o, &c.argv[i], &c.argv[i+1])
-		hashTypeSet(o, c.argv[i], c.argv[i+1])
+		//hashTypeSet returns 0 if the field was added, 1 if it was updated.
+		if hashTypeSet(o, c.argv[i], c.argv[i+1], 0) == 0 {
+			created++
+		}
 	}
+	signalModifiedKey(c.db, c.argv[1])
+	server.dirty += int64((c.argc - 2) / 2)
 
-	addReply(c, shared.ok)
+	//HMSET (deprecated) and HSET share the same code, only the reply is different.
+	if strings.ToLower(c.argv[0].String()) == "hset" {
+		addReplyLongLong(c, created)
+	} else {
+		addReply(c, shared.ok)
+	}
+}
+
+func hmsetCommand(c *redisClient) {
+	hsetCommand(c)
 }
 
 func hsetnxCommand(c *redisClient) {
 	//perform dict lookup, type validation, and creation if it does not exist.
 	o := hashTypeLookupWriteOrCreate(c, c.argv[1])
+	if o == nil {
+		return
+	}
 	//if it does not exist, return 0 and do not perform any operation.
 	if hashTypeExists(o, c.argv[2]) {
 		addReply(c, shared.czero)
@@ -536,14 +842,17 @@ func hsetnxCommand(c *redisClient) {
 	 	2. save field(argv[2])、value(argv[3]) to the dict obj
 		3. respond to the client with the result 1
 	*/
+	hashTypeTryConversion(o, c.argv, 2, 3)
 	hashTypeTryObjectEncoding(o, &c.argv[2], &c.argv[3])
-	hashTypeSet(o, c.argv[2], c.argv[3])
+	hashTypeSet(o, c.argv[2], c.argv[3], 0)
+	signalModifiedKey(c.db, c.argv[1])
+	server.dirty++
 	addReply(c, shared.cone)
 }
 
 func hgetCommand(c *redisClient) {
 	//check if the dictionary exists, and if it does not exist, return null.
-	o := lookupKeyReadOrReply(c, c.argv[1], shared.nullbulk)
+	o := lookupKeyReadOrReply(c, c.argv[1], shared.null[c.resp])
 	//if it is not a hash object, return a type error
 	if o == nil || checkType(c, o, REDIS_HASH) {
 		return
@@ -554,44 +863,24 @@ func hgetCommand(c *redisClient) {
 }
 
 func addHashFieldToReply(c *redisClient, o *robj, field *robj) {
-	//If the dictionary is empty, return nullbulk
+	//If the dictionary is empty, return null
 	if o == nil {
-		addReply(c, shared.nullbulk)
+		addReplyNull(c)
 		return
 	}
 
-	if o.encoding == REDIS_ENCODING_ZIPLIST {
-		//todo something
-	} else if o.encoding == REDIS_ENCODING_HT {
-		value := new(robj)
-		/**
-		pass the secondary pointer of the value to record the value corresponding to the field in the dictionary.
-		if it is not null, return value; otherwise, return nullbulk.
-		*/
-		if hashTypeGetFromHashTable(o, field, &value) {
-			addReplyBulk(c, value)
-		} else {
-			addReply(c, shared.nullbulk)
-		}
+	//if the field exists in the dictionary, return its value; otherwise, return null.
+	if value := hashTypeGetValueObject(o, field); value != nil {
+		addReplyBulk(c, value)
+	} else {
+		addReplyNull(c)
 	}
-
-}
-
-func hashTypeGetFromHashTable(o *robj, field *robj, value **robj) bool {
-	dict := (*o.ptr).(map[string]*robj)
-	key := (*field.ptr).(string)
-	if v, e := dict[key]; e {
-		*value = v
-		return true
-
-	}
-
-	return false
 }
 
 func hmgetCommand(c *redisClient) {
-	o := lookupKeyReadOrReply(c, c.argv[1], shared.nullbulk)
-	if o == nil || checkType(c, o, REDIS_HASH) {
+	//don't abort when the key cannot be found, non existing keys are empty hashes where HMGET replies nulls.
+	o := lookupKeyRead(c.db, c.argv[1])
+	if o != nil && checkType(c, o, REDIS_HASH) {
 		return
 	}
 
@@ -613,6 +902,14 @@ func hgetallCommand(c *redisClient) {
 
 }
 
+func hkeysCommand(c *redisClient) {
+	genericHgetallCommand(c, REDIS_HASH_KEY)
+}
+
+func hvalsCommand(c *redisClient) {
+	genericHgetallCommand(c, REDIS_HASH_VALUE)
+}
+
 func genericHgetallCommand(c *redisClient, flags int) {
 	multiplier := 0
 
@@ -638,21 +935,25 @@ func genericHgetallCommand(c *redisClient, flags int) {
 	response the client to return the value of the dictionary size multiplied by multiplier.
 
 	*/
-	dict := (*o.ptr).(map[string]*robj)
-	l := len(dict)
-	addReplyMultiBulkLen(c, int64(l*multiplier))
+	l := hashTypeLength(o)
+	//RESP3 clients receive a real map when both fields and values are requested.
+	if flags&REDIS_HASH_KEY > 0 && flags&REDIS_HASH_VALUE > 0 {
+		addReplyMapLen(c, l)
+	} else {
+		addReplyMultiBulkLen(c, l*int64(multiplier))
+	}
 	//return the key-value pairs as required.
-	for key, value := range dict {
+	hi := hashTypeInitIterator(o)
+	for hashTypeNext(hi) {
 		if flags&REDIS_HASH_KEY > 0 {
-			i := interface{}(key)
-			object := createObject(REDIS_STRING, &i)
-			addReplyBulk(c, object)
+			addReplyBulk(c, hashTypeCurrentObject(hi, REDIS_HASH_KEY))
 		}
 
 		if flags&REDIS_HASH_VALUE > 0 {
-			addReplyBulk(c, value)
+			addReplyBulk(c, hashTypeCurrentObject(hi, REDIS_HASH_VALUE))
 		}
 	}
+	hashTypeReleaseIterator(hi)
 
 }
 
@@ -667,18 +968,307 @@ func hdelCommand(c *redisClient) {
 	for i = 2; i < c.argc; i++ {
 		if hashTypeDelete(o, c.argv[i]) { //If the deletion is successful, increment the deleted counter.
 			deleted++
+			server.dirty++
 		}
 	}
 	//If the dictionary has no key-value pairs after deletion, delete it directly.
-	dict := (*o.ptr).(map[string]*robj)
-	if len(dict) == 0 {
+	if hashTypeLength(o) == 0 {
 		dbDelete(c.db, c.argv[1])
 	}
+	if deleted > 0 {
+		signalModifiedKey(c.db, c.argv[1])
+	}
 
 	addReplyLongLong(c, deleted)
 
 }
 
+func hlenCommand(c *redisClient) {
+	o := lookupKeyReadOrReply(c, c.argv[1], shared.czero)
+	if o == nil || checkType(c, o, REDIS_HASH) {
+		return
+	}
+	addReplyLongLong(c, hashTypeLength(o))
+}
+
+func hexistsCommand(c *redisClient) {
+	o := lookupKeyReadOrReply(c, c.argv[1], shared.czero)
+	if o == nil || checkType(c, o, REDIS_HASH) {
+		return
+	}
+	if hashTypeExists(o, c.argv[2]) {
+		addReply(c, shared.cone)
+	} else {
+		addReply(c, shared.czero)
+	}
+}
+
+func hstrlenCommand(c *redisClient) {
+	o := lookupKeyReadOrReply(c, c.argv[1], shared.czero)
+	if o == nil || checkType(c, o, REDIS_HASH) {
+		return
+	}
+	addReplyLongLong(c, hashTypeGetValueLength(o, c.argv[2]))
+}
+
+/*
+*
+HINCRBY key field increment
+a missing field is set to the increment, the new value is replied.
+*/
+func hincrbyCommand(c *redisClient) {
+	var value, incr int64
+	if !getLongFromObjectOrReply(c, c.argv[3], &incr, nil) {
+		return
+	}
+	o := hashTypeLookupWriteOrCreate(c, c.argv[1])
+	if o == nil {
+		return
+	}
+	if current := hashTypeGetValueObject(o, c.argv[2]); current != nil {
+		var err error
+		if value, err = strconv.ParseInt(current.String(), 10, 64); err != nil {
+			errMsg := "hash value is not an integer"
+			addReplyError(c, &errMsg)
+			return
+		}
+	}
+
+	oldValue := value
+	if (incr < 0 && oldValue < 0 && incr < (math.MinInt64-oldValue)) ||
+		(incr > 0 && oldValue > 0 && incr > (math.MaxInt64-oldValue)) {
+		errMsg := "increment or decrement would overflow"
+		addReplyError(c, &errMsg)
+		return
+	}
+	value += incr
+	//the value is a small integer, only the field can make the listpack too big.
+	hashTypeTryConversion(o, c.argv, 2, 2)
+	hashTypeSet(o, c.argv[2], createStringObjectFromLongLong(value), REDIS_HASH_SET_KEEP_TTL)
+	signalModifiedKey(c.db, c.argv[1])
+	server.dirty++
+	addReplyLongLong(c, value)
+}
+
+/*
+*
+HINCRBYFLOAT key field increment
+the command is propagated as HSET with the new value, so that the replicas and
+the AOF don't depend on the float precision.
+*/
+func hincrbyfloatCommand(c *redisClient) {
+	var value, incr float64
+	if !getDoubleFromObjectOrReply(c, c.argv[3], &incr, nil) {
+		return
+	}
+	if math.IsNaN(incr) || math.IsInf(incr, 0) {
+		errMsg := "value is NaN or Infinity"
+		addReplyError(c, &errMsg)
+		return
+	}
+	o := hashTypeLookupWriteOrCreate(c, c.argv[1])
+	if o == nil {
+		return
+	}
+	if current := hashTypeGetValueObject(o, c.argv[2]); current != nil {
+		var err error
+		if value, err = strconv.ParseFloat(current.String(), 64); err != nil || math.IsNaN(value) {
+			errMsg := "hash value is not a float"
+			addReplyError(c, &errMsg)
+			return
+		}
+	}
+
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		errMsg := "increment would produce NaN or Infinity"
+		addReplyError(c, &errMsg)
+		return
+	}
+	s := strconv.FormatFloat(value, 'f', -1, 64)
+	newObj := createStringObject(&s, len(s))
+	hashTypeTryConversion(o, c.argv, 2, 2)
+	hashTypeSet(o, c.argv[2], newObj, REDIS_HASH_SET_KEEP_TTL)
+	signalModifiedKey(c.db, c.argv[1])
+	server.dirty++
+	addReplyBulk(c, newObj)
+
+	//always replicate HINCRBYFLOAT as an HSET command with the final value.
+	rewriteClientCommandVector(c, shared.hset, c.argv[1], c.argv[2], newObj)
+}
+
+/*
+*
+HRANDFIELD key [count [WITHVALUES]]
+without count a single random field is replied. a positive count replies
+distinct fields, a negative count may reply the same field multiple times.
+*/
+func hrandfieldCommand(c *redisClient) {
+	if c.argc >= 3 {
+		var l int64
+		withvalues := false
+		if !getRangeLongFromObjectOrReply(c, c.argv[2], -math.MaxInt64, math.MaxInt64, &l, nil) {
+			return
+		}
+		if c.argc > 4 || (c.argc == 4 && strings.ToLower(c.argv[3].String()) != "withvalues") {
+			addReply(c, shared.syntaxerr)
+			return
+		} else if c.argc == 4 {
+			withvalues = true
+			if l < -math.MaxInt64/2 || l > math.MaxInt64/2 {
+				errMsg := "value is out of range"
+				addReplyError(c, &errMsg)
+				return
+			}
+		}
+		hrandfieldWithCountCommand(c, l, withvalues)
+		return
+	}
+
+	//handle variant without <count> argument. reply with simple bulk string.
+	o := lookupKeyReadOrReply(c, c.argv[1], shared.null[c.resp])
+	if o == nil || checkType(c, o, REDIS_HASH) {
+		return
+	}
+	field, _ := hashTypeRandomElement(o)
+	addReplyBulk(c, field)
+}
+
+// reply a field and its value, as a nested pair for RESP3 clients.
+func addHashRandomPairToReply(c *redisClient, field *robj, value *robj, withvalues bool) {
+	if withvalues && c.resp > 2 {
+		addReplyMultiBulkLen(c, 2)
+	}
+	addReplyBulk(c, field)
+	if withvalues {
+		addReplyBulk(c, value)
+	}
+}
+
+func hrandfieldWithCountCommand(c *redisClient, l int64, withvalues bool) {
+	var count int64
+	uniq := true
+	if l >= 0 {
+		count = l
+	} else {
+		count = -l
+		uniq = false
+	}
+
+	o := lookupKeyReadOrReply(c, c.argv[1], shared.emptymultibulk)
+	if o == nil || checkType(c, o, REDIS_HASH) {
+		return
+	}
+	size := hashTypeLength(o)
+
+	//if count is zero, serve it ASAP to avoid special cases later.
+	if count == 0 {
+		addReply(c, shared.emptymultibulk)
+		return
+	}
+
+	//the pairs are nested arrays in RESP3, a flat array of fields and values otherwise.
+	replyLen := func(n int64) {
+		if withvalues && c.resp == 2 {
+			addReplyMultiBulkLen(c, n*2)
+		} else {
+			addReplyMultiBulkLen(c, n)
+		}
+	}
+
+	/**
+	CASE 1: the count was negative, so the extraction method is just:
+	"return N random elements" sampling the whole set every time.
+	this case is trivial and can be served without auxiliary data structures.
+	*/
+	if !uniq || count == 1 {
+		replyLen(count)
+		for ; count > 0; count-- {
+			field, value := hashTypeRandomElement(o)
+			addHashRandomPairToReply(c, field, value, withvalues)
+		}
+		return
+	}
+
+	//CASE 2: the number of requested elements is greater than the number of elements inside the hash: simply return the whole hash.
+	if count >= size {
+		replyLen(size)
+		hi := hashTypeInitIterator(o)
+		for hashTypeNext(hi) {
+			addHashRandomPairToReply(c, hashTypeCurrentObject(hi, REDIS_HASH_KEY),
+				hashTypeCurrentObject(hi, REDIS_HASH_VALUE), withvalues)
+		}
+		hashTypeReleaseIterator(hi)
+		return
+	}
+
+	//CASE 2.5 listpack only. sampling unique elements, in the order they appear in the listpack.
+	if o.encoding == REDIS_ENCODING_LISTPACK {
+		replyLen(count)
+		remaining := count
+		hi := hashTypeInitIterator(o)
+		for available := size; remaining > 0 && hashTypeNext(hi); available-- {
+			//each pair is picked with the probability remaining/available.
+			if rand.Int63n(available) < remaining {
+				addHashRandomPairToReply(c, hashTypeCurrentObject(hi, REDIS_HASH_KEY),
+					hashTypeCurrentObject(hi, REDIS_HASH_VALUE), withvalues)
+				remaining--
+			}
+		}
+		hashTypeReleaseIterator(hi)
+		return
+	}
+
+	d := dictCreate(&hashDictType, nil)
+	if count*3 > size {
+		/**
+		CASE 3: the number of elements inside the hash is not greater than
+		3 times the number of requested elements. in this case we create a
+		dict from scratch with all the elements, and subtract random elements
+		to reach the requested number of elements.
+		*/
+		hi := hashTypeInitIterator(o)
+		for hashTypeNext(hi) {
+			dictAdd(d, hashTypeCurrentObject(hi, REDIS_HASH_KEY), hashTypeCurrentObject(hi, REDIS_HASH_VALUE))
+		}
+		hashTypeReleaseIterator(hi)
+		for int64(dictSize(d)) > count {
+			de := dictGetRandomKey(d)
+			dictDelete(d, de.key.String())
+		}
+	} else {
+		/**
+		CASE 4: we have a big hash compared to the requested number of elements.
+		in this case we can simply get random elements from the hash and add
+		to the temporary dict, trying to eventually get enough unique elements
+		to reach the specified count.
+		*/
+		for int64(dictSize(d)) < count {
+			field, value := hashTypeRandomElement(o)
+			dictAdd(d, field, value)
+		}
+	}
+
+	replyLen(count)
+	di := dictGetIterator(d)
+	for de := dictNext(di); de != nil; de = dictNext(di) {
+		addHashRandomPairToReply(c, de.key, de.val, withvalues)
+	}
+	dictReleaseIterator(di)
+}
+
+func hscanCommand(c *redisClient) {
+	var cursor uint64
+	if !parseScanCursorOrReply(c, c.argv[2], &cursor) {
+		return
+	}
+	o := lookupKeyReadOrReply(c, c.argv[1], shared.emptyscan)
+	if o == nil || checkType(c, o, REDIS_HASH) {
+		return
+	}
+	scanGenericCommand(c, o, &cursor)
+}
+
 func scanCommand(c *redisClient) {
 	var cursor uint64
 	if !parseScanCursorOrReply(c, c.argv[1], &cursor) {
@@ -700,76 +1290,111 @@ func parseScanCursorOrReply(c *redisClient, o *robj, cursor *uint64) bool {
 	return true
 }
 
+/*
+*
+the generic implementation of SCAN, HSCAN and SSCAN, o is nil for SCAN or the
+hash or set to scan. a hash table is scanned with dictScan, so the elements
+present from the start to the end of a full iteration are returned at least
+once; a listpack or an intset is small and replied at once with a zero cursor.
+*/
 func scanGenericCommand(c *redisClient, o *robj, cursor *uint64) {
-	//	keys := listCreate()
-	//	var count int64
-	//	count = 10
-	//	var ht map[string]*robj
-	//
-	//	var i uint64
-	//	//判断是scan还是hscan等标识
-	//	if o == nil {
-	//		i = 2
-	//	} else {
-	//		i = 3
-	//	}
-	//	//参数解析
-	//	for ; i < c.argc; i += 2 {
-	//		j := c.argc - i
-	//		if "count" == (*c.argv[i].ptr).(string) && j >= 2 {
-	//			//解析count的值，若不合法直接执行后置清理
-	//			if !getLongFromObjectOrReply(c, c.argv[i+1], &count, nil) {
-	//				goto cleanup
-	//			}
-	//
-	//			if count < 1 {
-	//				addReply(c, shared.syntaxerr)
-	//				goto cleanup
-	//			}
-	//
-	//		}
-	//	}
-	//	//迭代key值
-	//	ht = c.db.dict
-	//	if ht != nil {
-	//		j := int64(0)
-	//		skip := int64(0)
-	//
-	//		for k := range ht {
-	//			if skip < int64(*cursor) {
-	//				skip++
-	//				continue
-	//			}
-	//			key := interface{}(k)
-	//			listAddNodeTail(keys, &key)
-	//			j++
-	//			if j == count {
-	//				*cursor = uint64(skip + count)
-	//				break
-	//			}
-	//		}
-	//	}
-	//
-	//	addReplyMultiBulkLen(c, 2)
-	//	if listLength(keys) != 0 {
-	//		addReplyLongLong(c, int64(*cursor))
-	//	} else {
-	//		addReplyLongLong(c, 0)
-	//	}
-	//
-	//	addReplyMultiBulkLen(c, listLength(keys))
-	//	for true {
-	//		node := listFirst(keys)
-	//		if node == nil {
-	//			break
-	//		}
-	//		s := (*node.value).(string)
-	//		o := createEmbeddedStringObject(&s, len(s))
-	//		addReplyBulk(c, o)
-	//		listDelNode(keys, node)
-	//	}
-	//
-	//cleanup:
-	//	//清理资源
-	//	listRelease(&keys)
+	var count int64 = 10
+	var pattern string
+	usePattern := false
+	novalues := false
+
+	//step 1: parse options, the options start after the key for HSCAN and SSCAN.
+	i := uint64(2)
+	if o != nil {
+		i = 3
+	}
+	for ; i < c.argc; i++ {
+		j := c.argc - i
+		opt := strings.ToLower(c.argv[i].String())
+		if opt == "count" && j >= 2 {
+			if !getLongFromObjectOrReply(c, c.argv[i+1], &count, nil) {
+				return
+			}
+			if count < 1 {
+				addReply(c, shared.syntaxerr)
+				return
+			}
+			i++
+		} else if opt == "match" && j >= 2 {
+			pattern = c.argv[i+1].String()
+			//the pattern always matches if it is exactly "*", so it is equivalent to disabling it.
+			usePattern = pattern != "*"
+			i++
+		} else if opt == "novalues" && o != nil && o.robjType == REDIS_HASH {
+			novalues = true
+		} else {
+			addReply(c, shared.syntaxerr)
+			return
+		}
+	}
+
+	/**
+	step 2: iterate the collection. the keys of the hash table are collected
+	together with their values, the values are skipped later if not needed.
+	*/
+	var keys, values []*robj
+	var ht *dict
+	if o == nil {
+		ht = &c.db.dict
+	} else if (o.robjType == REDIS_HASH || o.robjType == REDIS_SET) && o.encoding == REDIS_ENCODING_HT {
+		ht = (*o.ptr).(*dict)
+	}
+
+	if ht != nil {
+		//the dict may have many empty buckets, so the number of calls is bounded as well.
+		maxiterations := count * 10
+		for {
+			*cursor = dictScan(ht, *cursor, func(de *dictEntry) {
+				keys = append(keys, de.key)
+				values = append(values, de.val)
+			})
+			maxiterations--
+			if *cursor == 0 || maxiterations <= 0 || int64(len(keys)) >= count {
+				break
+			}
+		}
+	} else if o.robjType == REDIS_HASH {
+		hi := hashTypeInitIterator(o)
+		for hashTypeNext(hi) {
+			keys = append(keys, hashTypeCurrentObject(hi, REDIS_HASH_KEY))
+			values = append(values, hashTypeCurrentObject(hi, REDIS_HASH_VALUE))
+		}
+		hashTypeReleaseIterator(hi)
+		*cursor = 0
+	} else if o.robjType == REDIS_SET {
+		si := setTypeInitIterator(o)
+		for element := setTypeNextObject(si); element != nil; element = setTypeNextObject(si) {
+			keys = append(keys, element)
+		}
+		setTypeReleaseIterator(si)
+		*cursor = 0
+	}
+
+	//step 3: filter elements, by pattern and, for the keyspace, skipping the expired keys.
+	elements := make([]*robj, 0, len(keys)*2)
+	for k, key := range keys {
+		if usePattern && !stringmatchlen(pattern, key.String(), false) {
+			continue
+		}
+		if o == nil && expireIfNeeded(c.db, key) != 0 {
+			continue
+		}
+		elements = append(elements, key)
+		if o != nil && o.robjType == REDIS_HASH && !novalues {
+			elements = append(elements, values[k])
+		}
+	}
+
+	//step 4: reply to the client.
+	addReplyMultiBulkLen(c, 2)
+	addReplyBulkCString(c, strconv.FormatUint(*cursor, 10))
+	addReplyMultiBulkLen(c, int64(len(elements)))
+	for _, element := range elements {
+		addReplyBulk(c, element)
+	}
 }
@@ -0,0 +1,894 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	/* Config types */
+	REDIS_CONFIG_TYPE_BOOL    = 0
+	REDIS_CONFIG_TYPE_INT     = 1
+	REDIS_CONFIG_TYPE_MEMORY  = 2
+	REDIS_CONFIG_TYPE_ENUM    = 3
+	REDIS_CONFIG_TYPE_STRING  = 4
+	REDIS_CONFIG_TYPE_SPECIAL = 5
+
+	/* Log levels */
+	REDIS_DEBUG   = 0
+	REDIS_VERBOSE = 1
+	REDIS_NOTICE  = 2
+	REDIS_WARNING = 3
+
+	REDIS_BINDADDR_MAX = 16
+
+	/* Config flags */
+	REDIS_CONFIG_IMMUTABLE = 1 << 0 /* Can this value only be set at startup? */
+
+	REDIS_CONFIG_REWRITE_SIGNATURE = "# Generated by CONFIG REWRITE"
+)
+
+type configEnum struct {
+	name string
+	val  int
+}
+
+/*
+*
+the definition of a directive accepted in redis.conf, the typed configs point to
+the server field they control, while special configs provide their own setter.
+*/
+type standardConfig struct {
+	name         string
+	ctype        int
+	defaultValue string
+	boolValue    *bool
+	intValue     *int
+	memValue     *int64
+	enumValue    *int
+	enumList     []configEnum
+	strValue     *string
+	//inclusive bounds of int and memory configs.
+	lower int64
+	upper int64
+	flags int
+	//setter of the special configs, argv excludes the directive name.
+	setSpecial func(argv []string) error
+	//getter of the special configs, used by CONFIG GET.
+	getSpecial func() string
+	//the arguments of every line written by CONFIG REWRITE for the special configs.
+	rewriteSpecial func() []string
+	//called by CONFIG SET once the value is set, so that the new value takes effect immediately.
+	apply func() error
+	//the value of the config as returned by CONFIG GET right after the defaults are set.
+	defaultGet string
+}
+
+var loglevelEnum = []configEnum{
+	{"debug", REDIS_DEBUG},
+	{"verbose", REDIS_VERBOSE},
+	{"notice", REDIS_NOTICE},
+	{"warning", REDIS_WARNING},
+}
+
+var aofFsyncEnum = []configEnum{
+	{"everysec", AOF_FSYNC_EVERYSEC},
+	{"always", AOF_FSYNC_ALWAYS},
+	{"no", AOF_FSYNC_NO},
+}
+
+var configs = []*standardConfig{
+	{name: "bind", ctype: REDIS_CONFIG_TYPE_SPECIAL, defaultValue: "localhost", flags: REDIS_CONFIG_IMMUTABLE,
+		setSpecial: setBindConfig, getSpecial: getBindConfig, rewriteSpecial: rewriteBindConfig},
+	{name: "port", ctype: REDIS_CONFIG_TYPE_INT, defaultValue: "6379", intValue: &server.port, lower: 0, upper: 65535, flags: REDIS_CONFIG_IMMUTABLE},
+	{name: "databases", ctype: REDIS_CONFIG_TYPE_INT, defaultValue: strconv.Itoa(REDIS_DEFAULT_DBNUM), intValue: &server.dbnum, lower: 1, upper: math.MaxInt32, flags: REDIS_CONFIG_IMMUTABLE},
+	{name: "timeout", ctype: REDIS_CONFIG_TYPE_INT, defaultValue: "0", intValue: &server.maxidletime, lower: 0, upper: math.MaxInt32},
+	{name: "maxclients", ctype: REDIS_CONFIG_TYPE_INT, defaultValue: "10000", intValue: &server.maxclients, lower: 1, upper: math.MaxInt32},
+	{name: "maxmemory", ctype: REDIS_CONFIG_TYPE_MEMORY, defaultValue: "0", memValue: &server.maxmemory, lower: 0, upper: math.MaxInt64, apply: updateMaxmemory},
+	{name: "hz", ctype: REDIS_CONFIG_TYPE_INT, defaultValue: strconv.Itoa(REDIS_DEFAULT_HZ), intValue: &server.hz, lower: 1, upper: 500, apply: updateHz},
+	{name: "save", ctype: REDIS_CONFIG_TYPE_SPECIAL, defaultValue: "3600 1 300 100 60 10000",
+		setSpecial: setSaveConfig, getSpecial: getSaveConfig, rewriteSpecial: rewriteSaveConfig},
+	{name: "dbfilename", ctype: REDIS_CONFIG_TYPE_SPECIAL, defaultValue: "dump.rdb",
+		setSpecial: setDbfilenameConfig, getSpecial: getDbfilenameConfig, rewriteSpecial: rewriteDbfilenameConfig},
+	{name: "appendonly", ctype: REDIS_CONFIG_TYPE_BOOL, defaultValue: "no", boolValue: &server.aofEnabled, apply: updateAppendonly},
+	{name: "appendfilename", ctype: REDIS_CONFIG_TYPE_STRING, defaultValue: "appendonly.aof", strValue: &server.aofFilename, flags: REDIS_CONFIG_IMMUTABLE},
+	{name: "appenddirname", ctype: REDIS_CONFIG_TYPE_STRING, defaultValue: "appendonlydir", strValue: &server.aofDirname, flags: REDIS_CONFIG_IMMUTABLE},
+	{name: "auto-aof-rewrite-percentage", ctype: REDIS_CONFIG_TYPE_INT, defaultValue: "100", intValue: &server.aofRewritePerc, lower: 0, upper: math.MaxInt32},
+	{name: "auto-aof-rewrite-min-size", ctype: REDIS_CONFIG_TYPE_MEMORY, defaultValue: "64mb", memValue: &server.aofRewriteMinSize, lower: 0, upper: math.MaxInt64},
+	{name: "appendfsync", ctype: REDIS_CONFIG_TYPE_ENUM, defaultValue: "everysec", enumValue: &server.aofFsync, enumList: aofFsyncEnum},
+	{name: "aof-load-truncated", ctype: REDIS_CONFIG_TYPE_BOOL, defaultValue: "yes", boolValue: &server.aofLoadTruncated},
+	{name: "replicaof", ctype: REDIS_CONFIG_TYPE_SPECIAL, defaultValue: "", flags: REDIS_CONFIG_IMMUTABLE,
+		setSpecial: setReplicaofConfig, getSpecial: getReplicaofConfig, rewriteSpecial: rewriteReplicaofConfig},
+	{name: "masterauth", ctype: REDIS_CONFIG_TYPE_STRING, defaultValue: "", strValue: &server.masterauth},
+	{name: "replica-read-only", ctype: REDIS_CONFIG_TYPE_BOOL, defaultValue: "yes", boolValue: &server.replSlaveRo},
+	{name: "repl-backlog-size", ctype: REDIS_CONFIG_TYPE_MEMORY, defaultValue: "1mb", memValue: &server.replBacklogSize,
+		lower: REDIS_REPL_BACKLOG_MIN_SIZE, upper: math.MaxInt32, apply: resizeReplicationBacklog},
+	{name: "repl-timeout", ctype: REDIS_CONFIG_TYPE_INT, defaultValue: "60", intValue: &server.replTimeout, lower: 1, upper: math.MaxInt32},
+	{name: "repl-ping-replica-period", ctype: REDIS_CONFIG_TYPE_INT, defaultValue: "10", intValue: &server.replPingSlavePeriod, lower: 1, upper: math.MaxInt32},
+	{name: "dir", ctype: REDIS_CONFIG_TYPE_SPECIAL, defaultValue: "",
+		setSpecial: setDirConfig, getSpecial: getDirConfig, rewriteSpecial: rewriteDirConfig},
+	{name: "logfile", ctype: REDIS_CONFIG_TYPE_SPECIAL, defaultValue: "", flags: REDIS_CONFIG_IMMUTABLE,
+		setSpecial: setLogfileConfig, getSpecial: getLogfileConfig, rewriteSpecial: rewriteLogfileConfig},
+	{name: "loglevel", ctype: REDIS_CONFIG_TYPE_ENUM, defaultValue: "notice", enumValue: &server.verbosity, enumList: loglevelEnum},
+	{name: "requirepass", ctype: REDIS_CONFIG_TYPE_STRING, defaultValue: "", strValue: &server.requirepass},
+	{name: "hash-max-listpack-entries", ctype: REDIS_CONFIG_TYPE_INT, defaultValue: "128", intValue: &server.hashMaxListpackEntries, lower: 0, upper: math.MaxInt32},
+	{name: "hash-max-listpack-value", ctype: REDIS_CONFIG_TYPE_INT, defaultValue: "64", intValue: &server.hashMaxListpackValue, lower: 0, upper: math.MaxInt32},
+	{name: "list-max-listpack-size", ctype: REDIS_CONFIG_TYPE_INT, defaultValue: "-2", intValue: &server.listMaxListpackSize, lower: math.MinInt32, upper: math.MaxInt32},
+	{name: "list-compress-depth", ctype: REDIS_CONFIG_TYPE_INT, defaultValue: "0", intValue: &server.listCompressDepth, lower: 0, upper: math.MaxInt32},
+	{name: "set-max-intset-entries", ctype: REDIS_CONFIG_TYPE_INT, defaultValue: "512", intValue: &server.setMaxIntsetEntries, lower: 0, upper: math.MaxInt32},
+	{name: "client-output-buffer-limit", ctype: REDIS_CONFIG_TYPE_SPECIAL, defaultValue: "normal 0 0 0 slave 256mb 64mb 60 pubsub 32mb 8mb 60",
+		setSpecial: setClientOutputBufferLimitConfig, getSpecial: getClientOutputBufferLimitConfig, rewriteSpecial: rewriteClientOutputBufferLimitConfig},
+}
+
+// true while the directives of a config file are loaded.
+var readingConfigFile bool
+
+// set once the first save directive of the config file being loaded is seen.
+var saveLoaded bool
+
+func lookupConfig(name string) *standardConfig {
+	for _, config := range configs {
+		if config.name == name {
+			return config
+		}
+	}
+	return nil
+}
+
+// set every config to its default value, called before the config file is loaded.
+func initConfigValues() {
+	for _, config := range configs {
+		argv := []string{config.defaultValue}
+		//the default value of the special configs may hold several arguments.
+		if config.ctype == REDIS_CONFIG_TYPE_SPECIAL && config.defaultValue != "" {
+			argv, _ = sdssplitargs(config.defaultValue)
+		}
+		if err := config.set(argv); err != nil {
+			log.Panicln("invalid default value of config", config.name, err)
+		}
+		config.defaultGet = config.get()
+	}
+}
+
+// return the value of the config as replied by CONFIG GET.
+func (config *standardConfig) get() string {
+	switch config.ctype {
+	case REDIS_CONFIG_TYPE_BOOL:
+		if *config.boolValue {
+			return "yes"
+		}
+		return "no"
+	case REDIS_CONFIG_TYPE_INT:
+		return strconv.Itoa(*config.intValue)
+	case REDIS_CONFIG_TYPE_MEMORY:
+		return strconv.FormatInt(*config.memValue, 10)
+	case REDIS_CONFIG_TYPE_ENUM:
+		for _, e := range config.enumList {
+			if e.val == *config.enumValue {
+				return e.name
+			}
+		}
+		return ""
+	case REDIS_CONFIG_TYPE_STRING:
+		return *config.strValue
+	default:
+		return config.getSpecial()
+	}
+}
+
+// return the lines that CONFIG REWRITE writes for the config.
+func (config *standardConfig) rewriteLines() []string {
+	var args []string
+	switch config.ctype {
+	case REDIS_CONFIG_TYPE_MEMORY:
+		args = []string{formatMemory(*config.memValue)}
+	case REDIS_CONFIG_TYPE_STRING:
+		args = []string{sdscatrepr(*config.strValue)}
+	case REDIS_CONFIG_TYPE_SPECIAL:
+		args = config.rewriteSpecial()
+	default:
+		args = []string{config.get()}
+	}
+	lines := make([]string, 0, len(args))
+	for _, arg := range args {
+		lines = append(lines, config.name+" "+arg)
+	}
+	return lines
+}
+
+func (config *standardConfig) isDefault() bool {
+	return config.get() == config.defaultGet
+}
+
+func (config *standardConfig) set(argv []string) error {
+	if config.ctype == REDIS_CONFIG_TYPE_SPECIAL {
+		return config.setSpecial(argv)
+	}
+	//the typed configs accept exactly one argument.
+	if len(argv) != 1 {
+		return errors.New("wrong number of arguments")
+	}
+	arg := argv[0]
+
+	switch config.ctype {
+	case REDIS_CONFIG_TYPE_BOOL:
+		yes := yesnotoi(arg)
+		if yes == -1 {
+			return errors.New("argument must be 'yes' or 'no'")
+		}
+		*config.boolValue = yes == 1
+	case REDIS_CONFIG_TYPE_INT:
+		ll, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return errors.New("argument couldn't be parsed into an integer")
+		}
+		if ll < config.lower || ll > config.upper {
+			return fmt.Errorf("argument must be between %d and %d inclusive", config.lower, config.upper)
+		}
+		*config.intValue = int(ll)
+	case REDIS_CONFIG_TYPE_MEMORY:
+		ll, ok := memtoll(arg)
+		if !ok {
+			return errors.New("argument must be a memory value")
+		}
+		if ll < config.lower || ll > config.upper {
+			return fmt.Errorf("argument must be between %d and %d inclusive", config.lower, config.upper)
+		}
+		*config.memValue = ll
+	case REDIS_CONFIG_TYPE_ENUM:
+		for _, e := range config.enumList {
+			if strings.EqualFold(e.name, arg) {
+				*config.enumValue = e.val
+				return nil
+			}
+		}
+		names := make([]string, 0, len(config.enumList))
+		for _, e := range config.enumList {
+			names = append(names, e.name)
+		}
+		return errors.New("argument(s) must be one of the following: " + strings.Join(names, ", "))
+	case REDIS_CONFIG_TYPE_STRING:
+		*config.strValue = arg
+	}
+	return nil
+}
+
+func setBindConfig(argv []string) error {
+	if len(argv) < 1 || len(argv) > REDIS_BINDADDR_MAX {
+		return errors.New("Too many bind addresses specified.")
+	}
+	server.bindaddr = append([]string{}, argv...)
+	return nil
+}
+
+func getBindConfig() string {
+	return strings.Join(server.bindaddr, " ")
+}
+
+func rewriteBindConfig() []string {
+	return []string{getBindConfig()}
+}
+
+/*
+*
+every save directive of the config file adds its save points: the first one
+clears the default save points, the next ones are appended to it. CONFIG SET
+replaces all the save points.
+*/
+func setSaveConfig(argv []string) error {
+	appendParams := readingConfigFile && saveLoaded
+	if readingConfigFile {
+		saveLoaded = true
+	}
+	//"save" with a single empty argument removes all the save points.
+	if len(argv) == 1 && argv[0] == "" {
+		server.saveparams = nil
+		return nil
+	}
+	if len(argv) == 0 || len(argv)%2 != 0 {
+		return errors.New("wrong number of arguments")
+	}
+	saveparams := make([]saveparam, 0, len(argv)/2)
+	for i := 0; i < len(argv); i += 2 {
+		seconds, err1 := strconv.ParseInt(argv[i], 10, 64)
+		changes, err2 := strconv.ParseInt(argv[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return errors.New("Invalid save parameters")
+		}
+		saveparams = append(saveparams, saveparam{seconds: seconds, changes: changes})
+	}
+	if appendParams {
+		server.saveparams = append(server.saveparams, saveparams...)
+	} else {
+		server.saveparams = saveparams
+	}
+	return nil
+}
+
+func getSaveConfig() string {
+	params := make([]string, 0, len(server.saveparams)*2)
+	for _, sp := range server.saveparams {
+		params = append(params, strconv.FormatInt(sp.seconds, 10), strconv.FormatInt(sp.changes, 10))
+	}
+	return strings.Join(params, " ")
+}
+
+func rewriteSaveConfig() []string {
+	//no save points are written as 'save ""', otherwise the defaults would be used at the next restart.
+	if len(server.saveparams) == 0 {
+		return []string{`""`}
+	}
+	//a line for every save point, like redis does.
+	lines := make([]string, 0, len(server.saveparams))
+	for _, sp := range server.saveparams {
+		lines = append(lines, strconv.FormatInt(sp.seconds, 10)+" "+strconv.FormatInt(sp.changes, 10))
+	}
+	return lines
+}
+
+func setDbfilenameConfig(argv []string) error {
+	if len(argv) != 1 {
+		return errors.New("wrong number of arguments")
+	}
+	if argv[0] == "" || filepath.Base(argv[0]) != argv[0] {
+		return errors.New("dbfilename can't be a path, just a filename")
+	}
+	server.rdbFilename = argv[0]
+	return nil
+}
+
+func getDbfilenameConfig() string {
+	return server.rdbFilename
+}
+
+func rewriteDbfilenameConfig() []string {
+	return []string{sdscatrepr(server.rdbFilename)}
+}
+
+func setDirConfig(argv []string) error {
+	if len(argv) != 1 {
+		return errors.New("wrong number of arguments")
+	}
+	//an empty dir keeps the current working directory.
+	if argv[0] == "" {
+		return nil
+	}
+	if err := os.Chdir(argv[0]); err != nil {
+		return fmt.Errorf("Can't chdir to '%s': %s", argv[0], err)
+	}
+	return nil
+}
+
+func getDirConfig() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	return dir
+}
+
+func rewriteDirConfig() []string {
+	return []string{sdscatrepr(getDirConfig())}
+}
+
+func setLogfileConfig(argv []string) error {
+	if len(argv) != 1 {
+		return errors.New("wrong number of arguments")
+	}
+	//an empty logfile name means logging to the standard output.
+	if argv[0] == "" {
+		log.SetOutput(os.Stdout)
+		if server.logfileFd != nil {
+			_ = server.logfileFd.Close()
+			server.logfileFd = nil
+		}
+		server.logfile = ""
+		return nil
+	}
+	//test if we are able to open the file, the server will not be able to abort just because a log file can not be opened.
+	f, err := os.OpenFile(argv[0], os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Can't open the log file: %s", err)
+	}
+	log.SetOutput(f)
+	if server.logfileFd != nil {
+		_ = server.logfileFd.Close()
+	}
+	server.logfileFd = f
+	server.logfile = argv[0]
+	return nil
+}
+
+// client-output-buffer-limit <class> <hard> <soft> <soft-seconds> [<class> ...]
+func setClientOutputBufferLimitConfig(argv []string) error {
+	if len(argv) == 0 || len(argv)%4 != 0 {
+		return errors.New("wrong number of arguments")
+	}
+	limits := server.clientObufLimits
+	for i := 0; i < len(argv); i += 4 {
+		class := getClientTypeByName(argv[i])
+		if class == -1 {
+			return errors.New("Invalid client class specified in buffer limit configuration.")
+		}
+		hard, ok1 := memtoll(argv[i+1])
+		soft, ok2 := memtoll(argv[i+2])
+		softSeconds, err := strconv.ParseInt(argv[i+3], 10, 64)
+		if !ok1 || !ok2 || err != nil || hard < 0 || soft < 0 || softSeconds < 0 {
+			return errors.New("Error in hard, soft or soft_seconds setting in buffer limit configuration.")
+		}
+		limits[class] = clientBufferLimitsConfig{hardLimitBytes: hard, softLimitBytes: soft, softLimitSeconds: softSeconds}
+	}
+	server.clientObufLimits = limits
+	return nil
+}
+
+/*
+*
+replicaof <masterip> <masterport>, the connection with the master is established by
+replicationCron once the server is started. an empty value or "no one" means master.
+*/
+func setReplicaofConfig(argv []string) error {
+	if (len(argv) == 1 && argv[0] == "") || (len(argv) == 2 && strings.EqualFold(argv[0], "no") && strings.EqualFold(argv[1], "one")) {
+		server.masterhost = ""
+		server.replState = REDIS_REPL_NONE
+		return nil
+	}
+	if len(argv) != 2 {
+		return errors.New("wrong number of arguments")
+	}
+	port, err := strconv.Atoi(argv[1])
+	if err != nil || port < 0 || port > 65535 {
+		return errors.New("Invalid master port")
+	}
+	server.masterhost = argv[0]
+	server.masterport = port
+	server.replState = REDIS_REPL_CONNECT
+	return nil
+}
+
+func getReplicaofConfig() string {
+	if server.masterhost == "" {
+		return ""
+	}
+	return server.masterhost + " " + strconv.Itoa(server.masterport)
+}
+
+func rewriteReplicaofConfig() []string {
+	if server.masterhost == "" {
+		return nil
+	}
+	return []string{sdscatrepr(server.masterhost) + " " + strconv.Itoa(server.masterport)}
+}
+
+func getLogfileConfig() string {
+	return server.logfile
+}
+
+func rewriteLogfileConfig() []string {
+	return []string{sdscatrepr(server.logfile)}
+}
+
+func getClientOutputBufferLimitConfig() string {
+	classes := make([]string, 0, REDIS_CLIENT_TYPE_COUNT)
+	for class := 0; class < REDIS_CLIENT_TYPE_COUNT; class++ {
+		limit := server.clientObufLimits[class]
+		classes = append(classes, fmt.Sprintf("%s %d %d %d", getClientTypeName(class),
+			limit.hardLimitBytes, limit.softLimitBytes, limit.softLimitSeconds))
+	}
+	return strings.Join(classes, " ")
+}
+
+// every client class is written on its own line, using the "replica" alias of the slave class.
+func rewriteClientOutputBufferLimitConfig() []string {
+	lines := make([]string, 0, REDIS_CLIENT_TYPE_COUNT)
+	for class := 0; class < REDIS_CLIENT_TYPE_COUNT; class++ {
+		limit := server.clientObufLimits[class]
+		name := getClientTypeName(class)
+		if class == REDIS_CLIENT_TYPE_SLAVE {
+			name = "replica"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s %d", name,
+			formatMemory(limit.hardLimitBytes), formatMemory(limit.softLimitBytes), limit.softLimitSeconds))
+	}
+	return lines
+}
+
+// the new maxmemory takes effect at the next command, using a fresh sample of the memory usage.
+func updateMaxmemory() error {
+	server.statUsedMemory = usedMemory()
+	if server.maxmemory > 0 && server.statUsedMemory > server.maxmemory {
+		redisLog(REDIS_WARNING, "WARNING: the new maxmemory value set via CONFIG SET (%d) is smaller than the current memory usage (%d). This will result in commands that may use more memory being refused.",
+			server.maxmemory, server.statUsedMemory)
+	}
+	return nil
+}
+
+func updateHz() error {
+	server.cronTicker.Reset(time.Second / time.Duration(server.hz))
+	return nil
+}
+
+/*
+*
+load the server configuration from the specified filename, the options
+string is appended to the file content and contains the directives passed
+on the command line, so they override the ones in the file.
+*/
+func loadServerConfig(filename string, options string) {
+	config := ""
+	if filename != "" {
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			redisLog(REDIS_WARNING, "Fatal error, can't open config file '%s': %s", filename, err)
+			os.Exit(1)
+		}
+		config = string(content)
+	}
+	//append the additional options
+	if options != "" {
+		config += "\n" + options
+	}
+	if err := loadServerConfigFromString(config); err != nil {
+		fmt.Fprintf(os.Stderr, "\n*** FATAL CONFIG FILE ERROR (Redis %s) ***\n%s\n", REDIS_VERSION, err)
+		os.Exit(1)
+	}
+}
+
+func loadServerConfigFromString(config string) error {
+	readingConfigFile = true
+	saveLoaded = false
+	defer func() { readingConfigFile = false }()
+
+	lines := strings.Split(config, "\n")
+	for i, line := range lines {
+		line = strings.Trim(line, " \t\r\n")
+
+		//skip comments and blank lines
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		//split into arguments
+		argv, ok := sdssplitargs(line)
+		if !ok {
+			return configLoadError(i+1, line, "Unbalanced quotes in configuration line")
+		}
+		//skip this line if the resulting command vector is empty.
+		if len(argv) == 0 {
+			continue
+		}
+
+		config := lookupConfig(strings.ToLower(argv[0]))
+		if config == nil {
+			return configLoadError(i+1, line, "Bad directive or wrong number of arguments")
+		}
+		if err := config.set(argv[1:]); err != nil {
+			return configLoadError(i+1, line, err.Error())
+		}
+	}
+	return nil
+}
+
+func configLoadError(linenum int, line string, err string) error {
+	return fmt.Errorf("Reading the configuration file, at line %d\n>>> '%s'\n%s", linenum, line, err)
+}
+
+/*
+*
+convert a string into a memory value, the following suffixes are accepted:
+1k => 1000 bytes, 1kb => 1024 bytes, 1m => 1000000 bytes, 1mb => 1024*1024 bytes,
+1g => 1000000000 bytes, 1gb => 1024*1024*1024 bytes.
+*/
+func memtoll(s string) (int64, bool) {
+	s = strings.ToLower(s)
+	mul := int64(1)
+	//search the first non digit character.
+	u := 0
+	if u < len(s) && s[u] == '-' {
+		u++
+	}
+	for u < len(s) && s[u] >= '0' && s[u] <= '9' {
+		u++
+	}
+	switch s[u:] {
+	case "", "b":
+		mul = 1
+	case "k":
+		mul = 1000
+	case "kb":
+		mul = 1024
+	case "m":
+		mul = 1000 * 1000
+	case "mb":
+		mul = 1024 * 1024
+	case "g":
+		mul = 1000 * 1000 * 1000
+	case "gb":
+		mul = 1024 * 1024 * 1024
+	default:
+		return 0, false
+	}
+	val, err := strconv.ParseInt(s[:u], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if val != 0 && (val*mul)/mul != val {
+		return 0, false
+	}
+	return val * mul, true
+}
+
+// format a memory value with the largest unit dividing it, the opposite of memtoll.
+func formatMemory(bytes int64) string {
+	const gb = 1024 * 1024 * 1024
+	const mb = 1024 * 1024
+	const kb = 1024
+	if bytes == 0 {
+		return "0"
+	} else if bytes%gb == 0 {
+		return strconv.FormatInt(bytes/gb, 10) + "gb"
+	} else if bytes%mb == 0 {
+		return strconv.FormatInt(bytes/mb, 10) + "mb"
+	} else if bytes%kb == 0 {
+		return strconv.FormatInt(bytes/kb, 10) + "kb"
+	}
+	return strconv.FormatInt(bytes, 10)
+}
+
+func yesnotoi(s string) int {
+	if strings.EqualFold(s, "yes") {
+		return 1
+	} else if strings.EqualFold(s, "no") {
+		return 0
+	}
+	return -1
+}
+
+/*
+*
+CONFIG GET parameter [parameter ...]
+CONFIG SET parameter value [parameter value ...]
+CONFIG RESETSTAT
+CONFIG REWRITE
+*/
+func configCommand(c *redisClient) {
+	subcommand := strings.ToUpper((*c.argv[1].ptr).(string))
+	if subcommand == "GET" && c.argc >= 3 {
+		configGetCommand(c)
+	} else if subcommand == "SET" && c.argc >= 4 {
+		configSetCommand(c)
+	} else if subcommand == "RESETSTAT" && c.argc == 2 {
+		resetServerStats()
+		resetCommandTableStats()
+		addReply(c, shared.ok)
+	} else if subcommand == "REWRITE" && c.argc == 2 {
+		if server.configfile == "" {
+			reply := "The server is running without a config file"
+			addReplyError(c, &reply)
+			return
+		}
+		if err := rewriteConfig(server.configfile); err != nil {
+			redisLog(REDIS_WARNING, "CONFIG REWRITE failed: %s", err)
+			reply := "Rewriting config file: " + err.Error()
+			addReplyError(c, &reply)
+			return
+		}
+		redisLog(REDIS_NOTICE, "CONFIG REWRITE executed with success.")
+		addReply(c, shared.ok)
+	} else {
+		reply := "unknown subcommand or wrong number of arguments for '" + (*c.argv[1].ptr).(string) + "'"
+		addReplyError(c, &reply)
+	}
+}
+
+// reply with a map of the configs whose name matches any of the glob-style patterns.
+func configGetCommand(c *redisClient) {
+	matches := make([]*standardConfig, 0)
+	for _, config := range configs {
+		for j := 2; j < int(c.argc); j++ {
+			if stringmatchlen((*c.argv[j].ptr).(string), config.name, true) {
+				matches = append(matches, config)
+				break
+			}
+		}
+	}
+	addReplyMapLen(c, int64(len(matches)))
+	for _, config := range matches {
+		addReplyBulkCString(c, config.name)
+		addReplyBulkCString(c, config.get())
+	}
+}
+
+/*
+*
+set all the given configs, either every config is set or none of them:
+if a value can not be set, or can not be applied, the previous values are restored.
+*/
+func configSetCommand(c *redisClient) {
+	if c.argc%2 != 0 {
+		reply := "wrong number of arguments for 'config|set' command"
+		addReplyError(c, &reply)
+		return
+	}
+	n := int(c.argc-2) / 2
+	setConfigs := make([]*standardConfig, 0, n)
+	newValues := make([]string, 0, n)
+	for i := 2; i < int(c.argc); i += 2 {
+		name := (*c.argv[i].ptr).(string)
+		config := lookupConfig(strings.ToLower(name))
+		if config == nil {
+			reply := "Unknown option or number of arguments for CONFIG SET - '" + name + "'"
+			addReplyError(c, &reply)
+			return
+		}
+		if config.flags&REDIS_CONFIG_IMMUTABLE > 0 {
+			reply := "CONFIG SET failed (possibly related to argument '" + name + "') - can't set immutable config"
+			addReplyError(c, &reply)
+			return
+		}
+		for _, set := range setConfigs {
+			if set == config {
+				reply := "Duplicate parameter - " + name
+				addReplyError(c, &reply)
+				return
+			}
+		}
+		setConfigs = append(setConfigs, config)
+		newValues = append(newValues, (*c.argv[i+1].ptr).(string))
+	}
+
+	oldValues := make([]string, len(setConfigs))
+	for i, config := range setConfigs {
+		oldValues[i] = config.get()
+	}
+	restore := func(count int) {
+		for i := 0; i < count; i++ {
+			_ = setConfigs[i].set(configSetArgv(setConfigs[i], oldValues[i]))
+		}
+	}
+
+	for i, config := range setConfigs {
+		if err := config.set(configSetArgv(config, newValues[i])); err != nil {
+			restore(i)
+			reply := "CONFIG SET failed (possibly related to argument '" + config.name + "') - " + err.Error()
+			addReplyError(c, &reply)
+			return
+		}
+	}
+	for _, config := range setConfigs {
+		if config.apply == nil {
+			continue
+		}
+		if err := config.apply(); err != nil {
+			restore(len(setConfigs))
+			for _, config := range setConfigs {
+				if config.apply != nil {
+					_ = config.apply()
+				}
+			}
+			reply := "CONFIG SET failed (possibly related to argument '" + config.name + "') - " + err.Error()
+			addReplyError(c, &reply)
+			return
+		}
+	}
+	addReply(c, shared.ok)
+}
+
+// the value of a special config may hold several space separated arguments.
+func configSetArgv(config *standardConfig, value string) []string {
+	if config.ctype != REDIS_CONFIG_TYPE_SPECIAL {
+		return []string{value}
+	}
+	argv, ok := sdssplitargs(value)
+	if !ok || len(argv) == 0 {
+		return []string{value}
+	}
+	return argv
+}
+
+/*
+*
+rewrite the configuration file at path with the current configuration, preserving
+comments and unknown lines: the first line of every config is updated in place, its
+other lines are removed, and the configs missing from the file are appended only if
+they are not set to the default value.
+*/
+func rewriteConfig(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	}
+
+	//map every config name to the indexes of the lines setting it.
+	occurrences := make(map[string][]int)
+	hasSignature := false
+	for i, line := range lines {
+		line = strings.Trim(line, " \t\r")
+		if line == REDIS_CONFIG_REWRITE_SIGNATURE {
+			hasSignature = true
+			continue
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		argv, ok := sdssplitargs(line)
+		if !ok || len(argv) == 0 {
+			continue
+		}
+		name := strings.ToLower(argv[0])
+		if lookupConfig(name) != nil {
+			occurrences[name] = append(occurrences[name], i)
+		}
+	}
+
+	removed := make(map[int]bool)
+	var appended []string
+	for _, config := range configs {
+		indexes := occurrences[config.name]
+		if len(indexes) == 0 && config.isDefault() {
+			continue
+		}
+		newLines := config.rewriteLines()
+		for k, index := range indexes {
+			if k < len(newLines) {
+				lines[index] = newLines[k]
+			} else {
+				removed[index] = true
+			}
+		}
+		if len(newLines) > len(indexes) {
+			appended = append(appended, newLines[len(indexes):]...)
+		}
+	}
+
+	var b strings.Builder
+	for i, line := range lines {
+		if !removed[i] {
+			b.WriteString(line + "\n")
+		}
+	}
+	if len(appended) > 0 {
+		if !hasSignature {
+			b.WriteString(REDIS_CONFIG_REWRITE_SIGNATURE + "\n")
+		}
+		for _, line := range appended {
+			b.WriteString(line + "\n")
+		}
+	}
+
+	//write a temp file in the same directory and rename it, so the config file is never left half written.
+	tmp, err := os.CreateTemp(filepath.Dir(path), "redis.conf.tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.WriteString(b.String()); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		if info, statErr := os.Stat(path); statErr == nil {
+			err = os.Chmod(tmp.Name(), info.Mode())
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMemtoll(t *testing.T) {
+	cases := map[string]int64{
+		"0":     0,
+		"100":   100,
+		"1k":    1000,
+		"1kb":   1024,
+		"5M":    5 * 1000 * 1000,
+		"2gb":   2 * 1024 * 1024 * 1024,
+		"256mb": 256 * 1024 * 1024,
+	}
+	for s, expected := range cases {
+		v, ok := memtoll(s)
+		if !ok || v != expected {
+			t.Errorf("memtoll(%q) = %d, expected %d", s, v, expected)
+		}
+	}
+
+	for _, s := range []string{"", "mb", "10xb", "1.5gb"} {
+		if _, ok := memtoll(s); ok {
+			t.Errorf("memtoll accepted invalid value %q", s)
+		}
+	}
+}
+
+func TestLoadServerConfigFromString(t *testing.T) {
+	initConfigValues()
+
+	err := loadServerConfigFromString("# comment\n\nport 7777\ndatabases 4\nmaxmemory 1mb\nloglevel WARNING\nsave 900 1 300 10\n")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if server.port != 7777 || server.dbnum != 4 || server.maxmemory != 1024*1024 || server.verbosity != REDIS_WARNING {
+		t.Error("directives were not applied")
+	}
+	if len(server.saveparams) != 2 || server.saveparams[1].seconds != 300 || server.saveparams[1].changes != 10 {
+		t.Error("save points were not applied")
+	}
+
+	errorCases := map[string]string{
+		"port 99999":          "argument must be between 0 and 65535 inclusive",
+		"appendonly maybe":    "argument must be 'yes' or 'no'",
+		"loglevel loud":       "argument(s) must be one of the following",
+		"unknown-directive 1": "Bad directive or wrong number of arguments",
+		"requirepass \"foo":   "Unbalanced quotes in configuration line",
+	}
+	for line, msg := range errorCases {
+		err := loadServerConfigFromString("port 6379\n" + line)
+		if err == nil || !strings.Contains(err.Error(), "at line 2") || !strings.Contains(err.Error(), msg) {
+			t.Errorf("config line %q: unexpected error %v", line, err)
+		}
+	}
+
+	initConfigValues()
+}
+
+func TestRewriteConfig(t *testing.T) {
+	initConfigValues()
+	defer initConfigValues()
+
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	original := "# the port\nport 6379\n\n# memory\nmaxmemory 1mb\nmaxmemory 2mb\n"
+	if err := os.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server.maxmemory = 3 * 1024 * 1024
+	server.maxidletime = 300
+	server.saveparams = nil
+
+	if err := rewriteConfig(path); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	content, _ := os.ReadFile(path)
+	expected := "# the port\nport 6379\n\n# memory\nmaxmemory 3mb\n" +
+		REDIS_CONFIG_REWRITE_SIGNATURE + "\ntimeout 300\nsave \"\"\n"
+	if string(content) != expected {
+		t.Errorf("unexpected rewritten config:\n%s", content)
+	}
+
+	//the rewritten file loads back to the same values.
+	initConfigValues()
+	if err := loadServerConfigFromString(string(content)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if server.maxmemory != 3*1024*1024 || server.maxidletime != 300 || len(server.saveparams) != 0 {
+		t.Error("the rewritten config was not loaded back")
+	}
+}
+
+func TestSaveConfigDirectives(t *testing.T) {
+	initConfigValues()
+	defer initConfigValues()
+
+	//every save line of the file adds a save point, the defaults are cleared by the first one.
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	original := "save 900 1\nport 6379\nsave 300 10\n"
+	if err := os.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadServerConfigFromString(original + "\nsave 60 10000"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if getSaveConfig() != "900 1 300 10 60 10000" {
+		t.Errorf("unexpected save points %q", getSaveConfig())
+	}
+
+	//CONFIG SET replaces all the save points.
+	if err := lookupConfig("save").set([]string{"120", "5"}); err != nil || getSaveConfig() != "120 5" {
+		t.Errorf("unexpected save points %q, error %v", getSaveConfig(), err)
+	}
+
+	//the save points survive a rewrite, a line is written for every save point.
+	if err := loadServerConfigFromString(original); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := rewriteConfig(path); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	content, _ := os.ReadFile(path)
+	if string(content) != original {
+		t.Errorf("unexpected rewritten config:\n%s", content)
+	}
+	initConfigValues()
+	if err := loadServerConfigFromString(string(content)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if getSaveConfig() != "900 1 300 10" {
+		t.Errorf("unexpected save points after the rewrite %q", getSaveConfig())
+	}
+
+	//a later 'save ""' removes the save points loaded so far.
+	if err := loadServerConfigFromString("save 900 1\nsave \"\"\nsave 300 10"); err != nil || getSaveConfig() != "300 10" {
+		t.Errorf("unexpected save points %q, error %v", getSaveConfig(), err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+/*
+*
+the crc16 "XMODEM" variant used by the key hash slots: polynomial 0x1021,
+initial value 0, no reflection and no final xor.
+*/
+var crc16Table = makeCrc16Table(0x1021)
+
+func makeCrc16Table(poly uint16) [256]uint16 {
+	var table [256]uint16
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+func crc16(buf string) uint16 {
+	var crc uint16
+	for i := 0; i < len(buf); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^buf[i]]
+	}
+	return crc
+}
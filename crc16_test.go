@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestCrc16(t *testing.T) {
+	if crc := crc16("123456789"); crc != 0x31c3 {
+		t.Fatalf("unexpected crc16 0x%x", crc)
+	}
+}
+
+func TestKeyHashSlot(t *testing.T) {
+	if slot := keyHashSlot("foo"); slot != 12182 {
+		t.Errorf("unexpected slot %d", slot)
+	}
+	//only the hash tag is hashed.
+	if keyHashSlot("{user1000}.following") != keyHashSlot("user1000") || keyHashSlot("a{b}c{d}") != keyHashSlot("b") {
+		t.Error("the hash tag was not used")
+	}
+	//an empty hash tag is not a hash tag.
+	if keyHashSlot("foo{}{bar}") == keyHashSlot("bar") {
+		t.Error("the empty hash tag was used")
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import "hash/crc64"
+
+/*
+*
+the crc64 "Jones" variant used by the RDB checksum: reflected input and output,
+initial value 0 and no final xor. The polynomial is 0xad93d23594c935a9, the
+table is built from its bit-reversed form as required by hash/crc64.
+*/
+var crc64JonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+func crc64Update(crc uint64, p []byte) uint64 {
+	//hash/crc64 inverts the crc before and after the update, cancel both inversions.
+	return ^crc64.Update(^crc, crc64JonesTable, p)
+}
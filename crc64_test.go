@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestCrc64(t *testing.T) {
+	if crc := crc64Update(0, []byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("unexpected crc64 0x%x", crc)
+	}
+	//the crc can be computed incrementally.
+	if crc := crc64Update(crc64Update(0, []byte("1234")), []byte("56789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("unexpected incremental crc64 0x%x", crc)
+	}
+}
@@ -1,13 +1,26 @@
 package main
 
-import "time"
+import (
+	"strconv"
+	"strings"
+	"time"
+)
 
 type redisDb struct {
 	//dict    map[string]*robj
 	//expires map[string]int64
 	dict    dict
 	expires dict
-	id      int
+	//the hashes with expiring fields, and the cursor of the active expire of their fields.
+	hexpires       dict
+	hexpiresCursor uint64
+	id             int
+	//the keys WATCHed for MULTI/EXEC, and the list of clients watching each key.
+	watchedKeys map[string]*list
+	//the keys with clients waiting for data (BLPOP), and the list of clients blocked on each key.
+	blockingKeys map[string]*list
+	//the blocked keys that received new data, the same keys are queued in server.readyKeys.
+	readyKeys map[string]struct{}
 }
 
 func lookupKeyWriteOrReply(c *redisClient, key *robj, reply *string) *robj {
@@ -23,45 +36,94 @@ func lookupKeyWrite(db *redisDb, key *robj) *robj {
 	//check if the key has expired, and if so, delete it.
 	expireIfNeeded(db, key)
 	//query the dictionary for the value corresponding to the key.
-	return lookupKey(db, key)
+	val := lookupKey(db, key)
+	if val != nil && hashTypeExpireIfNeeded(db, key, val) {
+		return nil
+	}
+	return val
 }
 
-func expireIfNeeded(db *redisDb, key *robj) int {
+// check if the key is logically expired, the key is not deleted.
+func keyIsExpired(db *redisDb, key *robj) bool {
 	//get the expiration time of the key.
-	//when, exists := db.expires[(*key.ptr).(string)]
-	entry := dictFind(&db.expires, (*key.ptr).(string))
-
-	if entry == nil {
-		return 0
+	when := getExpire(db, key)
+	if when < 0 {
+		return false
+	}
+	//don't expire anything while loading, it will be done later.
+	if server.loading {
+		return false
 	}
+	//if the current time is less than the expiration time, it means the current key has not expired.
+	return time.Now().UnixMilli() >= when
+}
 
-	when := (*entry.val.ptr).(int64)
-	if when < 0 {
+func expireIfNeeded(db *redisDb, key *robj) int {
+	if !keyIsExpired(db, key) {
 		return 0
 	}
-	now := time.Now().UnixMilli()
-	//if the current time is less than the expiration time, it means the current key has not expired, so return directly.
-	if now < when {
-		return 0
+	/**
+	a replica never expires keys by itself: the master sends a DEL when the key expires,
+	so that the dataset stays consistent. the key is reported as logically expired.
+	*/
+	if server.masterhost != "" {
+		return 1
 	}
-	//delete expired keys.
+	//delete expired keys, the deletion is propagated so that the AOF does not depend on the clock.
+	server.statExpiredkeys++
+	propagateExpire(db, key)
 	dbDelete(db, key)
+	signalModifiedKey(db, key)
 
 	return 1
 
 }
 
+/*
+*
+remove all the keys from the specified DB, or from all the DBs if dbnum is -1.
+the number of removed keys is returned.
+*/
+func emptyDb(dbnum int) int64 {
+	var removed int64
+	for j := 0; j < server.dbnum; j++ {
+		if dbnum != -1 && dbnum != j {
+			continue
+		}
+		//the clients watching a key of the DB will fail their EXEC.
+		touchAllWatchedKeysInDb(&server.db[j])
+		removed += int64(dictSize(&server.db[j].dict))
+		server.db[j].dict = *dictCreate(&dbDictType, nil)
+		server.db[j].expires = *dictCreate(&dbDictType, nil)
+		server.db[j].hexpires = *dictCreate(&dbDictType, nil)
+		server.db[j].hexpiresCursor = 0
+	}
+	return removed
+}
+
 func dbDelete(db *redisDb, key *robj) {
 	//delete(db.expires, (*key.ptr).(string))
 	//delete(db.dict, (*key.ptr).(string))
 	dictDelete(&db.dict, (*key.ptr).(string))
 	dictDelete(&db.expires, (*key.ptr).(string))
+	dictDelete(&db.hexpires, (*key.ptr).(string))
 }
 
 func lookupKeyRead(db *redisDb, key *robj) *robj {
-	//check if the key has expired and delete it.
-	expireIfNeeded(db, key)
-	val := lookupKey(db, key)
+	//check if the key has expired and delete it, the expired keys are still in the dataset of a replica.
+	var val *robj
+	if expireIfNeeded(db, key) == 0 || server.masterhost == "" {
+		val = lookupKey(db, key)
+	}
+	//the expired fields of a hash are deleted as well, and the hash once it's empty.
+	if val != nil && hashTypeExpireIfNeeded(db, key, val) {
+		val = nil
+	}
+	if val == nil {
+		server.statKeyspaceMisses++
+	} else {
+		server.statKeyspaceHits++
+	}
 	return val
 }
 
@@ -71,6 +133,10 @@ func lookupKey(db *redisDb, key *robj) *robj {
 	if de == nil {
 		return nil
 	}
+	//the value is still encoded by a snapshot, the keyspace continues with a copy of it.
+	if rdbSnapshotInUse(de.val) {
+		de.val = rdbCopyObject(de.val)
+	}
 	return de.val
 }
 
@@ -86,6 +152,10 @@ func lookupKeyReadOrReply(c *redisClient, key *robj, reply *string) *robj {
 func dbAdd(db *redisDb, key *robj, val *robj) {
 	//db.dict[(*key.ptr).(string)] = val
 	dictAdd(&db.dict, key, val)
+	//a new list or sorted set may serve the clients blocked on the key.
+	if val.robjType == REDIS_LIST || val.robjType == REDIS_ZSET {
+		signalKeyAsReady(db, key)
+	}
 }
 
 func dbOverwrite(db *redisDb, key *robj, val *robj) {
@@ -95,3 +165,245 @@ func dbOverwrite(db *redisDb, key *robj, val *robj) {
 	}
 	dictReplace(&db.dict, key, val)
 }
+
+/*
+*
+high level Set operation, used to associate a value to a key: the key is
+created if it does not exist, its value is overwritten otherwise, and the
+expire of the key is removed in both cases.
+*/
+func setKey(db *redisDb, key *robj, val *robj) {
+	if lookupKeyWrite(db, key) == nil {
+		dbAdd(db, key, val)
+	} else {
+		dbOverwrite(db, key, val)
+	}
+	removeExpire(db, key)
+	signalModifiedKey(db, key)
+}
+
+/*
+*
+every time a key in the database is modified the function signalModifiedKey()
+is called, the clients WATCHing the key will fail their EXEC.
+*/
+func signalModifiedKey(db *redisDb, key *robj) {
+	touchWatchedKey(db, key)
+}
+
+func removeExpire(db *redisDb, key *robj) bool {
+	return dictDelete(&db.expires, (*key.ptr).(string)) == DICT_OK
+}
+
+// set the unix time in milliseconds at which the key expires.
+func setExpire(db *redisDb, key *robj, when int64) {
+	dictReplace(&db.expires, key, createStringObjectFromLongLong(when))
+}
+
+// return the expire time of the specified key, or -1 if no expire is associated with this key.
+func getExpire(db *redisDb, key *robj) int64 {
+	de := dictFind(&db.expires, (*key.ptr).(string))
+	if de == nil {
+		return -1
+	}
+	return (*de.val.ptr).(int64)
+}
+
+// an expired key is deleted by the server, a DEL is propagated to the AOF and to the replicas.
+func propagateExpire(db *redisDb, key *robj) {
+	argv := []*robj{shared.del, key}
+	propagate(lookupCommand("DEL"), db.id, argv, REDIS_PROPAGATE_AOF|REDIS_PROPAGATE_REPL)
+}
+
+func delCommand(c *redisClient) {
+	var deleted int64
+	var j uint64
+	for j = 1; j < c.argc; j++ {
+		expireIfNeeded(c.db, c.argv[j])
+		if lookupKey(c.db, c.argv[j]) != nil {
+			dbDelete(c.db, c.argv[j])
+			signalModifiedKey(c.db, c.argv[j])
+			server.dirty++
+			deleted++
+		}
+	}
+	addReplyLongLong(c, deleted)
+}
+
+// parse the optional ASYNC or SYNC argument of FLUSHDB and FLUSHALL.
+func getFlushCommandFlags(c *redisClient) bool {
+	if c.argc > 2 {
+		addReply(c, shared.syntaxerr)
+		return false
+	}
+	if c.argc == 2 {
+		option := strings.ToLower((*c.argv[1].ptr).(string))
+		if option != "async" && option != "sync" {
+			addReply(c, shared.syntaxerr)
+			return false
+		}
+	}
+	return true
+}
+
+/*
+*
+FLUSHDB [ASYNC|SYNC]
+the keys are always freed synchronously, the option is accepted for compatibility.
+*/
+func flushdbCommand(c *redisClient) {
+	if !getFlushCommandFlags(c) {
+		return
+	}
+	server.dirty += emptyDb(c.db.id)
+	//propagate the command even if the DB was already empty.
+	server.dirty++
+	addReply(c, shared.ok)
+}
+
+/*
+*
+FLUSHALL [ASYNC|SYNC]
+the background save in progress is abandoned, and the empty dataset is saved
+right now if save points are configured.
+*/
+func flushallCommand(c *redisClient) {
+	if !getFlushCommandFlags(c) {
+		return
+	}
+	server.dirty += emptyDb(-1)
+	if server.rdbChildRunning {
+		killRDBChild()
+	}
+	if len(server.saveparams) > 0 {
+		//rdbSave() resets dirty, but we don't want this here as otherwise FLUSHALL would not be replicated nor put into the AOF.
+		saved := server.dirty
+		_ = rdbSave(server.rdbFilename)
+		server.dirty = saved
+	}
+	server.dirty++
+	addReply(c, shared.ok)
+}
+
+func selectCommand(c *redisClient) {
+	id, err := strconv.Atoi((*c.argv[1].ptr).(string))
+	if err != nil {
+		errMsg := "value is not an integer or out of range"
+		addReplyError(c, &errMsg)
+		return
+	}
+	if id < 0 || id >= server.dbnum {
+		errMsg := "DB index is out of range"
+		addReplyError(c, &errMsg)
+		return
+	}
+	selectDb(c, id)
+	addReply(c, shared.ok)
+}
+
+/*
+*
+this is the generic command implementation for EXPIRE, PEXPIRE, EXPIREAT
+and PEXPIREAT. the basetime is the time the argument is relative to, zero
+for the *AT variants, and the unit is either seconds or milliseconds.
+*/
+func expireGenericCommand(c *redisClient, basetime int64, unit int) {
+	key := c.argv[1]
+	when, err := strconv.ParseInt((*c.argv[2].ptr).(string), 10, 64)
+	if err != nil {
+		errMsg := "value is not an integer or out of range"
+		addReplyError(c, &errMsg)
+		return
+	}
+	if unit == UNIT_SECONDS {
+		when *= 1000
+	}
+	when += basetime
+
+	//no key, return zero.
+	if lookupKeyWrite(c.db, key) == nil {
+		addReply(c, shared.czero)
+		return
+	}
+
+	/**
+	EXPIRE with negative TTL, or EXPIREAT with a timestamp into the past
+	should never be executed as a DEL when load the AOF or in the context
+	of a replica, the key will be expired later instead. otherwise the key is deleted right now, and a
+	DEL is propagated in place of the expire.
+	*/
+	if when <= time.Now().UnixMilli() && !server.loading && server.masterhost == "" {
+		dbDelete(c.db, key)
+		signalModifiedKey(c.db, key)
+		server.dirty++
+		rewriteClientCommandVector(c, shared.del, key)
+		addReply(c, shared.cone)
+		return
+	}
+	setExpire(c.db, key, when)
+	signalModifiedKey(c.db, key)
+	server.dirty++
+	addReply(c, shared.cone)
+}
+
+func expireCommand(c *redisClient) {
+	expireGenericCommand(c, time.Now().UnixMilli(), UNIT_SECONDS)
+}
+
+func expireatCommand(c *redisClient) {
+	expireGenericCommand(c, 0, UNIT_SECONDS)
+}
+
+func pexpireCommand(c *redisClient) {
+	expireGenericCommand(c, time.Now().UnixMilli(), UNIT_MILLISECONDS)
+}
+
+func pexpireatCommand(c *redisClient) {
+	expireGenericCommand(c, 0, UNIT_MILLISECONDS)
+}
+
+// reply -2 if the key does not exist, -1 if it has no expire, the remaining time to live otherwise.
+func ttlGenericCommand(c *redisClient, outputMs bool) {
+	//if the key does not exist at all, return -2
+	if lookupKeyRead(c.db, c.argv[1]) == nil {
+		addReplyLongLong(c, -2)
+		return
+	}
+	//the key exists. return -1 if it has no expire, or the actual TTL value otherwise.
+	expire := getExpire(c.db, c.argv[1])
+	if expire == -1 {
+		addReplyLongLong(c, -1)
+		return
+	}
+	ttl := expire - time.Now().UnixMilli()
+	if ttl < 0 {
+		ttl = 0
+	}
+	if outputMs {
+		addReplyLongLong(c, ttl)
+	} else {
+		addReplyLongLong(c, (ttl+500)/1000)
+	}
+}
+
+func ttlCommand(c *redisClient) {
+	ttlGenericCommand(c, false)
+}
+
+func pttlCommand(c *redisClient) {
+	ttlGenericCommand(c, true)
+}
+
+func persistCommand(c *redisClient) {
+	if lookupKeyWrite(c.db, c.argv[1]) == nil {
+		addReply(c, shared.czero)
+		return
+	}
+	if removeExpire(c.db, c.argv[1]) {
+		signalModifiedKey(c.db, c.argv[1])
+		server.dirty++
+		addReply(c, shared.cone)
+	} else {
+		addReply(c, shared.czero)
+	}
+}
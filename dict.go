@@ -2,6 +2,8 @@ package main
 
 import (
 	"math"
+	"math/bits"
+	"math/rand"
 )
 
 const dict_hash_function_seed = 5381
@@ -46,6 +48,8 @@ type dict struct {
 	ht        *[2]dictht
 	rehashidx int64
 	iterators int
+	//字典的附加数据,例如哈希对象中记录字段过期时间的结构
+	metadata interface{}
 }
 
 /**
@@ -164,11 +168,12 @@ func dictGenericDelete(d *dict, k string, nofree int) int {
 	}
 	//哈希定位bucket
 	h := dictGenHashFunction(k, len(k))
-	var preDe *dictEntry
 
 	for i := 0; i < 2; i++ {
 		idx := h & d.ht[i].sizemask
 		he := (*(d.ht[i].table))[idx]
+		//每个哈希表的链表都需要重新记录前驱节点
+		var preDe *dictEntry
 		//遍历链表直到找到这个key
 		for he != nil {
 			if (*he.key.ptr).(string) == k {
@@ -176,7 +181,7 @@ func dictGenericDelete(d *dict, k string, nofree int) int {
 				if preDe != nil {
 					preDe.next = he.next
 				} else { //否则说明被删除元素he是数组的第一个元素,则直接让数组的第一个元素为he的后继节点
-					(*(d.ht[0].table))[idx] = he.next
+					(*(d.ht[i].table))[idx] = he.next
 				}
 				//减少used告知数组减少一个元素
 				d.ht[i].used--
@@ -198,19 +203,6 @@ func dictGenericDelete(d *dict, k string, nofree int) int {
 	return DICT_ERR
 }
 
-// 原有go map字典操作更新函数,已废弃
-func dictReplace_new(d map[string]*robj, key *robj, val *robj) bool {
-	k := (*key.ptr).(string)
-	if _, e := d[k]; e {
-		d[k] = val
-		return false
-	} else {
-		d[k] = val
-		return true
-	}
-
-}
-
 func dictReplace(d *dict, key *robj, val *robj) bool {
 	//先尝试用dictadd添加键值对,若成功则说明这个key不存在,完成后直接返回
 	if dictAdd(d, key, val) == DICT_OK {
@@ -242,7 +234,7 @@ func dictFind(d *dict, key string) *dictEntry {
 		//基于位运算定位索引
 		idx := h & d.ht[i].sizemask
 		//定位到对应bucket桶,通过遍历定位到本次要检索的key
-		he := (*d.ht[0].table)[idx]
+		he := (*d.ht[i].table)[idx]
 		for he != nil {
 			if (*he.key.ptr).(string) == key {
 				return he
@@ -259,6 +251,73 @@ func dictFind(d *dict, key string) *dictEntry {
 
 }
 
+/**
+ * 字典迭代器定义,安全迭代器在迭代期间会暂停渐进式哈希
+ */
+type dictIterator struct {
+	d *dict
+	//当前遍历的bucket索引和哈希表
+	index int64
+	table int
+	safe  bool
+	//当前遍历的entry及其后继节点,记录后继节点使得迭代过程中可以删除当前entry
+	entry     *dictEntry
+	nextEntry *dictEntry
+}
+
+func dictGetIterator(d *dict) *dictIterator {
+	return &dictIterator{d: d, index: -1, table: 0}
+}
+
+func dictGetSafeIterator(d *dict) *dictIterator {
+	iter := dictGetIterator(d)
+	iter.safe = true
+	return iter
+}
+
+// 返回下一个entry,遍历结束则返回nil
+func dictNext(iter *dictIterator) *dictEntry {
+	for {
+		if iter.entry == nil {
+			//首次迭代时安全迭代器累加iterators,暂停渐进式哈希
+			if iter.index == -1 && iter.table == 0 && iter.safe {
+				iter.d.iterators++
+			}
+			iter.index++
+			ht := &iter.d.ht[iter.table]
+			//当前哈希表遍历完成,若正处于渐进式哈希则继续遍历ht[1]
+			if iter.index >= int64(ht.size) {
+				if dictIsRehashing(iter.d) && iter.table == 0 {
+					iter.table++
+					iter.index = 0
+					ht = &iter.d.ht[1]
+				} else {
+					break
+				}
+			}
+			iter.entry = (*ht.table)[iter.index]
+		} else {
+			iter.entry = iter.nextEntry
+		}
+		if iter.entry != nil {
+			iter.nextEntry = iter.entry.next
+			return iter.entry
+		}
+	}
+	return nil
+}
+
+func dictReleaseIterator(iter *dictIterator) {
+	if iter.safe && !(iter.index == -1 && iter.table == 0) {
+		iter.d.iterators--
+	}
+}
+
+// 返回字典中键值对的数量
+func dictSize(d *dict) uint64 {
+	return d.ht[0].used + d.ht[1].used
+}
+
 func dictIsRehashing(d *dict) bool {
 	return d.rehashidx != -1
 }
@@ -402,3 +461,98 @@ func _dictNextPower(size uint64) uint64 {
 	}
 	return uint64(i)
 }
+
+// 随机返回字典中的一个entry,字典为空则返回nil
+func dictGetRandomKey(d *dict) *dictEntry {
+	if dictSize(d) == 0 {
+		return nil
+	}
+	if dictIsRehashing(d) {
+		_dictRehashStep(d)
+	}
+	var he *dictEntry
+	if dictIsRehashing(d) {
+		//渐进式哈希时ht[0]中rehashidx之前的bucket都已为空,只在剩余的bucket和ht[1]中随机
+		for he == nil {
+			h := d.rehashidx + rand.Int63n(int64(d.ht[0].size+d.ht[1].size)-d.rehashidx)
+			if h >= int64(d.ht[0].size) {
+				he = (*d.ht[1].table)[h-int64(d.ht[0].size)]
+			} else {
+				he = (*d.ht[0].table)[h]
+			}
+		}
+	} else {
+		for he == nil {
+			h := rand.Int() & d.ht[0].sizemask
+			he = (*d.ht[0].table)[h]
+		}
+	}
+	//定位到非空bucket后,计算链表长度并随机选择其中一个元素
+	listlen := 0
+	for orighe := he; orighe != nil; orighe = orighe.next {
+		listlen++
+	}
+	for listele := rand.Intn(listlen); listele > 0; listele-- {
+		he = he.next
+	}
+	return he
+}
+
+/*
+*
+遍历字典的一部分元素,每个元素都会调用fn,返回下一次遍历使用的游标,返回0则说明遍历完成。
+游标采用高位加1的反向二进制迭代,保证在两次调用之间即使字典发生扩容或渐进式哈希,
+遍历开始时就存在且一直未被删除的元素至少会被返回一次,但某些元素可能被返回多次。
+*/
+func dictScan(d *dict, v uint64, fn func(de *dictEntry)) uint64 {
+	if dictSize(d) == 0 {
+		return 0
+	}
+	//遍历期间暂停渐进式哈希
+	d.iterators++
+	defer func() { d.iterators-- }()
+
+	emit := func(ht *dictht, idx uint64) {
+		de := (*ht.table)[idx]
+		for de != nil {
+			next := de.next
+			fn(de)
+			de = next
+		}
+	}
+
+	if !dictIsRehashing(d) {
+		t0 := &d.ht[0]
+		m0 := uint64(t0.sizemask)
+		emit(t0, v&m0)
+		//将游标中未被掩码覆盖的高位置1,反转后加1再反转,即高位加1
+		v |= ^m0
+		v = bits.Reverse64(v)
+		v++
+		v = bits.Reverse64(v)
+	} else {
+		t0 := &d.ht[0]
+		t1 := &d.ht[1]
+		//保证t0是较小的哈希表
+		if t0.size > t1.size {
+			t0, t1 = t1, t0
+		}
+		m0 := uint64(t0.sizemask)
+		m1 := uint64(t1.sizemask)
+		//先遍历小表中游标对应的bucket
+		emit(t0, v&m0)
+		//再遍历大表中所有由小表该bucket扩展出来的bucket
+		for {
+			emit(t1, v&m1)
+			v |= ^m1
+			v = bits.Reverse64(v)
+			v++
+			v = bits.Reverse64(v)
+			//直到小表掩码之外的高位全部遍历完成
+			if v&(m0^m1) == 0 {
+				break
+			}
+		}
+	}
+	return v
+}
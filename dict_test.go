@@ -82,7 +82,7 @@ func TestSameBucketInsertion(t *testing.T) {
 		fmt.Println((*entries.key.ptr).(string))
 		entries = entries.next
 	}
-	k := "9"
+	k := (*bucketMap)[0][0]
 	find := dictFind(d, k)
 	if find == nil {
 		log.Fatal("key is not find ")
@@ -183,12 +183,87 @@ func TestDictRehash(t *testing.T) {
 	k := "1000"
 	dictAdd(d, createStringObject(&k, len(k)), nil)
 
-	//查看19 17 12 9 1000是否存在
-	if dictFind(d, "19") == nil ||
-		dictFind(d, "17") == nil ||
-		dictFind(d, "12") == nil ||
-		dictFind(d, "9") == nil ||
-		dictFind(d, "1000") == nil {
-		log.Fatal("rehash fail")
+	//查看同一个桶中插入的4个元素和1000是否存在
+	for _, v := range []string{(*bucketMap)[0][0], (*bucketMap)[0][1], (*bucketMap)[0][2], (*bucketMap)[0][3], k} {
+		if dictFind(d, v) == nil {
+			log.Fatal("rehash fail")
+		}
+	}
+}
+
+func TestDictHashDistribution(t *testing.T) {
+	//sequential keys differ only in a few bytes, every byte of the key must change the hash.
+	hashes := map[int]struct{}{}
+	for i := 0; i < 10000; i++ {
+		hashes[dictSdsHash(fmt.Sprintf("item%04d", i))] = struct{}{}
+	}
+	if len(hashes) != 10000 {
+		t.Errorf("only %d distinct hashes for 10000 keys", len(hashes))
+	}
+
+	//the keys are spread evenly across the buckets of a table.
+	sizemask := 1023
+	buckets := make([]int, sizemask+1)
+	for i := 0; i < 100000; i++ {
+		buckets[dictSdsHash("key:"+strconv.Itoa(i))&sizemask]++
+	}
+	for idx, n := range buckets {
+		//about 98 keys per bucket are expected.
+		if n < 40 || n > 180 {
+			t.Errorf("bucket %d holds %d keys", idx, n)
+		}
+	}
+
+	//the trailing bytes of a key are part of the hash too.
+	if dictSdsHash("abcde") == dictSdsHash("abcdf") || dictSdsHash("abcdef") == dictSdsHash("abcdeg") ||
+		dictSdsHash("abcdefg") == dictSdsHash("abcdefh") {
+		t.Error("keys differing in the last bytes have the same hash")
+	}
+}
+
+func TestDictScan(t *testing.T) {
+	d := dictCreate(&dbDictType, nil)
+	for i := 0; i < 100; i++ {
+		k := strconv.Itoa(i)
+		dictAdd(d, createStringObject(&k, len(k)), nil)
+	}
+
+	//在两次遍历之间继续添加元素触发扩容和渐进式哈希,遍历开始时就存在的元素都要被返回
+	seen := make(map[string]bool)
+	var cursor uint64
+	added := 100
+	for {
+		cursor = dictScan(d, cursor, func(de *dictEntry) {
+			seen[(*de.key.ptr).(string)] = true
+		})
+		if added < 300 {
+			for j := 0; j < 20; j++ {
+				k := strconv.Itoa(added)
+				dictAdd(d, createStringObject(&k, len(k)), nil)
+				added++
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if !seen[strconv.Itoa(i)] {
+			t.Fatalf("key %d is not scanned", i)
+		}
+	}
+	if d.iterators != 0 {
+		t.Fatal("iterators is not 0")
+	}
+
+	//随机返回的元素必须存在于字典中
+	for i := 0; i < 100; i++ {
+		de := dictGetRandomKey(d)
+		if de == nil || dictFind(d, (*de.key.ptr).(string)) != de {
+			t.Fatal("random key is not in the dict")
+		}
+	}
+	if dictGetRandomKey(dictCreate(&dbDictType, nil)) != nil {
+		t.Fatal("random key of an empty dict is not nil")
 	}
 }
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+)
+
+/*
+*
+intset, a sorted set of integers without duplicates in a single byte slice,
+compatible with the format used by redis:
+
+	<encoding:4> <length:4> <contents>
+
+all the integers are stored with the same encoding, the size in bytes of the
+smallest integer type able to hold every element. when an element that does
+not fit is added, the whole intset is upgraded to the larger encoding, it is
+never downgraded. the elements are kept sorted, so lookups are binary searches.
+*/
+const (
+	INTSET_ENC_INT16 = 2
+	INTSET_ENC_INT32 = 4
+	INTSET_ENC_INT64 = 8
+
+	INTSET_HDR_SIZE = 8
+)
+
+// return the required encoding for the provided value.
+func intsetValueEncoding(v int64) uint32 {
+	if v < math.MinInt32 || v > math.MaxInt32 {
+		return INTSET_ENC_INT64
+	} else if v < math.MinInt16 || v > math.MaxInt16 {
+		return INTSET_ENC_INT32
+	}
+	return INTSET_ENC_INT16
+}
+
+// create an empty intset.
+func intsetNew() []byte {
+	is := make([]byte, INTSET_HDR_SIZE)
+	intsetSetEncoding(is, INTSET_ENC_INT16)
+	intsetSetLength(is, 0)
+	return is
+}
+
+func intsetEncoding(is []byte) uint32 {
+	return binary.LittleEndian.Uint32(is[0:4])
+}
+
+func intsetSetEncoding(is []byte, enc uint32) {
+	binary.LittleEndian.PutUint32(is[0:4], enc)
+}
+
+func intsetSetLength(is []byte, length int) {
+	binary.LittleEndian.PutUint32(is[4:8], uint32(length))
+}
+
+// return the number of elements of the intset.
+func intsetLen(is []byte) int {
+	return int(binary.LittleEndian.Uint32(is[4:8]))
+}
+
+// return the total number of bytes the intset is composed of.
+func intsetBlobLen(is []byte) int {
+	return INTSET_HDR_SIZE + intsetLen(is)*int(intsetEncoding(is))
+}
+
+// return the value at pos, using the provided encoding.
+func intsetGetEncoded(is []byte, pos int, enc uint32) int64 {
+	offset := INTSET_HDR_SIZE + pos*int(enc)
+	switch enc {
+	case INTSET_ENC_INT64:
+		return int64(binary.LittleEndian.Uint64(is[offset:]))
+	case INTSET_ENC_INT32:
+		return int64(int32(binary.LittleEndian.Uint32(is[offset:])))
+	default:
+		return int64(int16(binary.LittleEndian.Uint16(is[offset:])))
+	}
+}
+
+// set the value at pos, using the configured encoding.
+func intsetSet(is []byte, pos int, value int64) {
+	enc := intsetEncoding(is)
+	offset := INTSET_HDR_SIZE + pos*int(enc)
+	switch enc {
+	case INTSET_ENC_INT64:
+		binary.LittleEndian.PutUint64(is[offset:], uint64(value))
+	case INTSET_ENC_INT32:
+		binary.LittleEndian.PutUint32(is[offset:], uint32(int32(value)))
+	default:
+		binary.LittleEndian.PutUint16(is[offset:], uint16(int16(value)))
+	}
+}
+
+// resize the intset so that it can hold length elements.
+func intsetResize(is []byte, length int) []byte {
+	size := INTSET_HDR_SIZE + length*int(intsetEncoding(is))
+	if size <= cap(is) {
+		return is[:size]
+	}
+	n := make([]byte, size, size*2)
+	copy(n, is)
+	return n
+}
+
+/*
+*
+search for the position of value. return true when the value was found and
+pos is its position, otherwise pos is set to the position where the value
+can be inserted.
+*/
+func intsetSearch(is []byte, value int64) (pos int, found bool) {
+	length := intsetLen(is)
+	enc := intsetEncoding(is)
+
+	//the value can never be found when the set is empty.
+	if length == 0 {
+		return 0, false
+	}
+	//check for the case where we know we cannot find the value, but do know the insert position.
+	if value > intsetGetEncoded(is, length-1, enc) {
+		return length, false
+	} else if value < intsetGetEncoded(is, 0, enc) {
+		return 0, false
+	}
+
+	min, max := 0, length-1
+	for max >= min {
+		mid := int(uint(min+max) >> 1)
+		cur := intsetGetEncoded(is, mid, enc)
+		if value > cur {
+			min = mid + 1
+		} else if value < cur {
+			max = mid - 1
+		} else {
+			return mid, true
+		}
+	}
+	return min, false
+}
+
+// upgrades the intset to a larger encoding and inserts the given integer.
+func intsetUpgradeAndAdd(is []byte, value int64) []byte {
+	curenc := intsetEncoding(is)
+	length := intsetLen(is)
+	//the value requires a larger encoding, so it is either the smallest or the largest element.
+	prepend := 0
+	if value < 0 {
+		prepend = 1
+	}
+
+	//first set new encoding and resize.
+	n := make([]byte, INTSET_HDR_SIZE+(length+1)*int(intsetValueEncoding(value)))
+	intsetSetEncoding(n, intsetValueEncoding(value))
+	intsetSetLength(n, length+1)
+
+	//upgrade back-to-front so we don't overwrite values, the old slice is left untouched anyway.
+	for i := length - 1; i >= 0; i-- {
+		intsetSet(n, i+prepend, intsetGetEncoded(is, i, curenc))
+	}
+
+	//set the value at the beginning or the end.
+	if prepend == 1 {
+		intsetSet(n, 0, value)
+	} else {
+		intsetSet(n, length, value)
+	}
+	return n
+}
+
+// move the elements from the position from to the end of the intset to the position to.
+func intsetMoveTail(is []byte, from int, to int) {
+	enc := int(intsetEncoding(is))
+	length := intsetLen(is)
+	copy(is[INTSET_HDR_SIZE+to*enc:], is[INTSET_HDR_SIZE+from*enc:INTSET_HDR_SIZE+length*enc])
+}
+
+// insert an integer in the intset, the new intset is returned with true if the value was added.
+func intsetAdd(is []byte, value int64) ([]byte, bool) {
+	//upgrade encoding if necessary. if we need to upgrade, we know that this value should be either appended or prepended.
+	if intsetValueEncoding(value) > intsetEncoding(is) {
+		return intsetUpgradeAndAdd(is, value), true
+	}
+
+	//abort if the value is already present in the set.
+	pos, found := intsetSearch(is, value)
+	if found {
+		return is, false
+	}
+
+	length := intsetLen(is)
+	is = intsetResize(is, length+1)
+	if pos < length {
+		intsetMoveTail(is, pos, pos+1)
+	}
+	intsetSet(is, pos, value)
+	intsetSetLength(is, length+1)
+	return is, true
+}
+
+// delete an integer from the intset, the new intset is returned with true if the value was removed.
+func intsetRemove(is []byte, value int64) ([]byte, bool) {
+	if intsetValueEncoding(value) > intsetEncoding(is) {
+		return is, false
+	}
+	pos, found := intsetSearch(is, value)
+	if !found {
+		return is, false
+	}
+
+	length := intsetLen(is)
+	//overwrite value with tail and update length.
+	if pos < length-1 {
+		intsetMoveTail(is, pos+1, pos)
+	}
+	is = intsetResize(is, length-1)
+	intsetSetLength(is, length-1)
+	return is, true
+}
+
+// determine whether a value belongs to this set.
+func intsetFind(is []byte, value int64) bool {
+	if intsetValueEncoding(value) > intsetEncoding(is) {
+		return false
+	}
+	_, found := intsetSearch(is, value)
+	return found
+}
+
+// return a random member of a non empty intset.
+func intsetRandom(is []byte) int64 {
+	return intsetGetEncoded(is, rand.Intn(intsetLen(is)), intsetEncoding(is))
+}
+
+// get the value at the given position, false is returned when the position is out of range.
+func intsetGet(is []byte, pos int) (int64, bool) {
+	if pos < 0 || pos >= intsetLen(is) {
+		return 0, false
+	}
+	return intsetGetEncoded(is, pos, intsetEncoding(is)), true
+}
+
+/*
+*
+check that the intset is well formed and that its elements are sorted without
+duplicates: used on the intsets loaded from an RDB file.
+*/
+func intsetValidateIntegrity(is []byte) bool {
+	if len(is) < INTSET_HDR_SIZE {
+		return false
+	}
+	enc := intsetEncoding(is)
+	if enc != INTSET_ENC_INT16 && enc != INTSET_ENC_INT32 && enc != INTSET_ENC_INT64 {
+		return false
+	}
+	if uint64(intsetLen(is))*uint64(enc)+INTSET_HDR_SIZE != uint64(len(is)) {
+		return false
+	}
+	for pos := 1; pos < intsetLen(is); pos++ {
+		if intsetGetEncoded(is, pos-1, enc) >= intsetGetEncoded(is, pos, enc) {
+			return false
+		}
+	}
+	return true
+}
+
+// return a copy of the intset.
+func intsetDup(is []byte) []byte {
+	n := make([]byte, len(is))
+	copy(n, is)
+	return n
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// check the elements of the intset are sorted and match the expected ones.
+func testIntsetElements(t *testing.T, is []byte, expected []int64) {
+	if intsetLen(is) != len(expected) || intsetBlobLen(is) != len(is) {
+		t.Fatalf("bad header: %d elements, %d bytes", intsetLen(is), intsetBlobLen(is))
+	}
+	for i, v := range expected {
+		if got, ok := intsetGet(is, i); !ok || got != v {
+			t.Fatalf("element %d: expected %d, got %d", i, v, got)
+		}
+	}
+	if _, ok := intsetGet(is, len(expected)); ok {
+		t.Fatal("out of range get returned an element")
+	}
+}
+
+func TestIntsetUpgrade(t *testing.T) {
+	is := intsetNew()
+	var added bool
+	for _, v := range []int64{5, -3, 5, 100} {
+		is, _ = intsetAdd(is, v)
+	}
+	if intsetEncoding(is) != INTSET_ENC_INT16 {
+		t.Fatalf("unexpected encoding %d", intsetEncoding(is))
+	}
+	testIntsetElements(t, is, []int64{-3, 5, 100})
+
+	//a value out of the 16 bit range upgrades every element, a negative one is prepended.
+	is, added = intsetAdd(is, -70000)
+	if !added || intsetEncoding(is) != INTSET_ENC_INT32 {
+		t.Fatalf("unexpected encoding %d", intsetEncoding(is))
+	}
+	is, _ = intsetAdd(is, math.MaxInt64)
+	if intsetEncoding(is) != INTSET_ENC_INT64 {
+		t.Fatalf("unexpected encoding %d", intsetEncoding(is))
+	}
+	testIntsetElements(t, is, []int64{-70000, -3, 5, 100, math.MaxInt64})
+
+	//removing the large values never downgrades the encoding.
+	is, _ = intsetRemove(is, math.MaxInt64)
+	is, _ = intsetRemove(is, -70000)
+	if _, removed := intsetRemove(is, 7); removed {
+		t.Fatal("removed a missing value")
+	}
+	if intsetEncoding(is) != INTSET_ENC_INT64 || !intsetFind(is, 100) || intsetFind(is, math.MaxInt64) {
+		t.Fatal("unexpected intset after remove")
+	}
+	testIntsetElements(t, is, []int64{-3, 5, 100})
+}
+
+func TestIntsetRandomized(t *testing.T) {
+	is := intsetNew()
+	members := map[int64]bool{}
+	for i := 0; i < 2000; i++ {
+		v := rand.Int63n(1000) - 500
+		if i%3 == 0 {
+			var removed bool
+			is, removed = intsetRemove(is, v)
+			if removed != members[v] {
+				t.Fatalf("remove of %d returned %v", v, removed)
+			}
+			delete(members, v)
+		} else {
+			var added bool
+			is, added = intsetAdd(is, v)
+			if added == members[v] {
+				t.Fatalf("add of %d returned %v", v, added)
+			}
+			members[v] = true
+		}
+	}
+	expected := make([]int64, 0, len(members))
+	for v := range members {
+		expected = append(expected, v)
+	}
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+	testIntsetElements(t, is, expected)
+	if len(expected) > 0 && !members[intsetRandom(is)] {
+		t.Fatal("random returned a missing value")
+	}
+}
+
+func TestIntsetValidateIntegrity(t *testing.T) {
+	is := intsetNew()
+	for _, v := range []int64{-70000, 3, 5} {
+		is, _ = intsetAdd(is, v)
+	}
+	if !intsetValidateIntegrity(is) || !intsetValidateIntegrity(intsetNew()) {
+		t.Fatal("a valid intset failed the integrity check")
+	}
+
+	unsorted := intsetDup(is)
+	intsetSet(unsorted, 1, 5)
+	badEncoding := intsetDup(is)
+	intsetSetEncoding(badEncoding, 3)
+	badLength := intsetDup(is)
+	intsetSetLength(badLength, 4)
+	for i, c := range [][]byte{is[:4], is[:len(is)-1], unsorted, badEncoding, badLength} {
+		if intsetValidateIntegrity(c) {
+			t.Errorf("corrupted intset %d passed the integrity check", i)
+		}
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+)
+
+/*
+*
+listpack, a compact serialization of a list of strings and integers in a single
+byte slice, compatible with the format used by redis:
+
+	<total bytes:4> <num elements:2> <entry> ... <entry> <EOF:0xFF>
+
+every entry is made of its encoding, the data, and the backlen: the length of the
+encoding and the data, stored so that it can be read backwards in order to walk
+the list from the tail. strings representing an integer are stored as integers.
+
+the elements are addressed by their offset in the slice, -1 means no element.
+*/
+const (
+	LP_HDR_SIZE           = 6
+	LP_HDR_NUMELE_UNKNOWN = 65535
+	LP_EOF                = 0xFF
+
+	LP_ENCODING_7BIT_UINT      = 0
+	LP_ENCODING_7BIT_UINT_MASK = 0x80
+	LP_ENCODING_6BIT_STR       = 0x80
+	LP_ENCODING_6BIT_STR_MASK  = 0xC0
+	LP_ENCODING_13BIT_INT      = 0xC0
+	LP_ENCODING_13BIT_INT_MASK = 0xE0
+	LP_ENCODING_12BIT_STR      = 0xE0
+	LP_ENCODING_12BIT_STR_MASK = 0xF0
+	LP_ENCODING_16BIT_INT      = 0xF1
+	LP_ENCODING_24BIT_INT      = 0xF2
+	LP_ENCODING_32BIT_INT      = 0xF3
+	LP_ENCODING_64BIT_INT      = 0xF4
+	LP_ENCODING_32BIT_STR      = 0xF0
+
+	/* Where to insert an element, relative to the element at the specified offset. */
+	LP_BEFORE  = 0
+	LP_AFTER   = 1
+	LP_REPLACE = 2
+)
+
+// create a new empty listpack.
+func lpNew(capacity int) []byte {
+	if capacity < LP_HDR_SIZE+1 {
+		capacity = LP_HDR_SIZE + 1
+	}
+	lp := make([]byte, LP_HDR_SIZE+1, capacity)
+	lpSetTotalBytes(lp, LP_HDR_SIZE+1)
+	lpSetNumElements(lp, 0)
+	lp[LP_HDR_SIZE] = LP_EOF
+	return lp
+}
+
+func lpSetTotalBytes(lp []byte, v int) {
+	binary.LittleEndian.PutUint32(lp[0:4], uint32(v))
+}
+
+func lpSetNumElements(lp []byte, v int) {
+	binary.LittleEndian.PutUint16(lp[4:6], uint16(v))
+}
+
+func lpGetNumElements(lp []byte) int {
+	return int(binary.LittleEndian.Uint16(lp[4:6]))
+}
+
+// return the total number of bytes the listpack is composed of.
+func lpBytes(lp []byte) int {
+	return int(binary.LittleEndian.Uint32(lp[0:4]))
+}
+
+/*
+*
+return true if the string is the canonical representation of an integer, which
+is stored in the value: no spaces, no '+' sign and no leading zeros, so that
+converting the integer back to a string returns exactly the same string.
+*/
+func lpStringToInt64(s []byte, value *int64) bool {
+	if len(s) == 0 || len(s) > 20 {
+		return false
+	}
+	v, err := strconv.ParseInt(string(s), 10, 64)
+	if err != nil || strconv.FormatInt(v, 10) != string(s) {
+		return false
+	}
+	*value = v
+	return true
+}
+
+// the encoding and the data of an integer element.
+func lpEncodeInteger(v int64) []byte {
+	if v >= 0 && v <= 127 {
+		//single byte 0-127 integer.
+		return []byte{byte(v)}
+	} else if v >= -4096 && v <= 4095 {
+		//13 bit integer.
+		if v < 0 {
+			v = (1 << 13) + v
+		}
+		return []byte{byte(v>>8) | LP_ENCODING_13BIT_INT, byte(v & 0xff)}
+	} else if v >= -32768 && v <= 32767 {
+		//16 bit integer.
+		if v < 0 {
+			v = (1 << 16) + v
+		}
+		return []byte{LP_ENCODING_16BIT_INT, byte(v & 0xff), byte(v >> 8)}
+	} else if v >= -8388608 && v <= 8388607 {
+		//24 bit integer.
+		if v < 0 {
+			v = (1 << 24) + v
+		}
+		return []byte{LP_ENCODING_24BIT_INT, byte(v & 0xff), byte((v >> 8) & 0xff), byte(v >> 16)}
+	} else if v >= -2147483648 && v <= 2147483647 {
+		//32 bit integer.
+		buf := make([]byte, 5)
+		buf[0] = LP_ENCODING_32BIT_INT
+		binary.LittleEndian.PutUint32(buf[1:], uint32(int32(v)))
+		return buf
+	}
+	//64 bit integer.
+	buf := make([]byte, 9)
+	buf[0] = LP_ENCODING_64BIT_INT
+	binary.LittleEndian.PutUint64(buf[1:], uint64(v))
+	return buf
+}
+
+// the encoding and the data of a string element.
+func lpEncodeString(s []byte) []byte {
+	l := len(s)
+	var buf []byte
+	if l < 64 {
+		buf = make([]byte, 1, 1+l)
+		buf[0] = byte(l) | LP_ENCODING_6BIT_STR
+	} else if l < 4096 {
+		buf = make([]byte, 2, 2+l)
+		buf[0] = byte(l>>8) | LP_ENCODING_12BIT_STR
+		buf[1] = byte(l & 0xff)
+	} else {
+		buf = make([]byte, 5, 5+l)
+		buf[0] = LP_ENCODING_32BIT_STR
+		binary.LittleEndian.PutUint32(buf[1:], uint32(l))
+	}
+	return append(buf, s...)
+}
+
+/*
+*
+store the backlen of an entry: the length l of its encoding and data, in a
+variable number of bytes that can be parsed from right to left. every byte holds
+7 bits of the length, the high bit is set when more bytes follow on the left.
+*/
+func lpEncodeBacklen(l int) []byte {
+	if l <= 127 {
+		return []byte{byte(l)}
+	} else if l < 16383 {
+		return []byte{byte(l >> 7), byte(l&127) | 128}
+	} else if l < 2097151 {
+		return []byte{byte(l >> 14), byte((l>>7)&127) | 128, byte(l&127) | 128}
+	} else if l < 268435455 {
+		return []byte{byte(l >> 21), byte((l>>14)&127) | 128, byte((l>>7)&127) | 128, byte(l&127) | 128}
+	}
+	return []byte{byte(l >> 28), byte((l>>21)&127) | 128, byte((l>>14)&127) | 128, byte((l>>7)&127) | 128, byte(l&127) | 128}
+}
+
+// the number of bytes lpEncodeBacklen uses for the length l.
+func lpEncodeBacklenSize(l int) int {
+	if l <= 127 {
+		return 1
+	} else if l < 16383 {
+		return 2
+	} else if l < 2097151 {
+		return 3
+	} else if l < 268435455 {
+		return 4
+	}
+	return 5
+}
+
+// decode the backlen whose last byte is at the offset p.
+func lpDecodeBacklen(lp []byte, p int) int {
+	val := 0
+	shift := 0
+	for {
+		val |= int(lp[p]&127) << shift
+		if lp[p]&128 == 0 {
+			break
+		}
+		shift += 7
+		p--
+	}
+	return val
+}
+
+// the encoded entry of an element: the encoding, the data and the backlen.
+func lpEncodeEntry(ele []byte) []byte {
+	var enc []byte
+	var v int64
+	if lpStringToInt64(ele, &v) {
+		enc = lpEncodeInteger(v)
+	} else {
+		enc = lpEncodeString(ele)
+	}
+	return append(enc, lpEncodeBacklen(len(enc))...)
+}
+
+// the size of the encoding and the data of the entry at the offset p, the backlen excluded.
+func lpCurrentEncodedSize(lp []byte, p int) int {
+	b := lp[p]
+	switch {
+	case b&LP_ENCODING_7BIT_UINT_MASK == LP_ENCODING_7BIT_UINT:
+		return 1
+	case b&LP_ENCODING_6BIT_STR_MASK == LP_ENCODING_6BIT_STR:
+		return 1 + int(b&0x3f)
+	case b&LP_ENCODING_13BIT_INT_MASK == LP_ENCODING_13BIT_INT:
+		return 2
+	case b == LP_ENCODING_16BIT_INT:
+		return 3
+	case b == LP_ENCODING_24BIT_INT:
+		return 4
+	case b == LP_ENCODING_32BIT_INT:
+		return 5
+	case b == LP_ENCODING_64BIT_INT:
+		return 9
+	case b&LP_ENCODING_12BIT_STR_MASK == LP_ENCODING_12BIT_STR:
+		return 2 + (int(b&0x0f)<<8 | int(lp[p+1]))
+	case b == LP_ENCODING_32BIT_STR:
+		return 5 + int(binary.LittleEndian.Uint32(lp[p+1:p+5]))
+	case b == LP_EOF:
+		return 1
+	}
+	panic("Invalid listpack encoding")
+}
+
+// the offset of the entry following the one at the offset p, which may be the EOF.
+func lpSkip(lp []byte, p int) int {
+	entrylen := lpCurrentEncodedSize(lp, p)
+	entrylen += lpEncodeBacklenSize(entrylen)
+	return p + entrylen
+}
+
+// the offset of the next element, or -1 if p is the last one.
+func lpNext(lp []byte, p int) int {
+	p = lpSkip(lp, p)
+	if lp[p] == LP_EOF {
+		return -1
+	}
+	return p
+}
+
+// the offset of the previous element, or -1 if p is the first one.
+func lpPrev(lp []byte, p int) int {
+	if p == LP_HDR_SIZE {
+		return -1
+	}
+	//seek the last byte of the backlen of the previous entry.
+	p--
+	prevlen := lpDecodeBacklen(lp, p)
+	prevlen += lpEncodeBacklenSize(prevlen)
+	return p - prevlen + 1
+}
+
+// the offset of the first element, or -1 if the listpack is empty.
+func lpFirst(lp []byte) int {
+	if lp[LP_HDR_SIZE] == LP_EOF {
+		return -1
+	}
+	return LP_HDR_SIZE
+}
+
+// the offset of the last element, or -1 if the listpack is empty.
+func lpLast(lp []byte) int {
+	//seek EOF element, and the element before it.
+	return lpPrev(lp, lpBytes(lp)-1)
+}
+
+/*
+*
+return the number of elements inside the listpack, when the count is too big
+to be stored in the header, the elements are counted.
+*/
+func lpLength(lp []byte) int {
+	numele := lpGetNumElements(lp)
+	if numele != LP_HDR_NUMELE_UNKNOWN {
+		return numele
+	}
+	count := 0
+	for p := lpFirst(lp); p != -1; p = lpNext(lp, p) {
+		count++
+	}
+	//if the count is again within range of the header numele field, set it.
+	if count < LP_HDR_NUMELE_UNKNOWN {
+		lpSetNumElements(lp, count)
+	}
+	return count
+}
+
+/*
+*
+return the element at the offset p: for a string element the content is returned
+and isInt is false, otherwise the integer is returned in ival.
+*/
+func lpGet(lp []byte, p int) (sval []byte, ival int64, isInt bool) {
+	var uval, negstart, negmax uint64
+	b := lp[p]
+	switch {
+	case b&LP_ENCODING_7BIT_UINT_MASK == LP_ENCODING_7BIT_UINT:
+		uval = uint64(b & 0x7f)
+		negmax = 0
+		negstart = ^uint64(0) //7 bit ints are always positive.
+	case b&LP_ENCODING_6BIT_STR_MASK == LP_ENCODING_6BIT_STR:
+		l := int(b & 0x3f)
+		return lp[p+1 : p+1+l], 0, false
+	case b&LP_ENCODING_13BIT_INT_MASK == LP_ENCODING_13BIT_INT:
+		uval = uint64(b&0x1f)<<8 | uint64(lp[p+1])
+		negstart = 1 << 12
+		negmax = 8191
+	case b == LP_ENCODING_16BIT_INT:
+		uval = uint64(lp[p+1]) | uint64(lp[p+2])<<8
+		negstart = 1 << 15
+		negmax = 65535
+	case b == LP_ENCODING_24BIT_INT:
+		uval = uint64(lp[p+1]) | uint64(lp[p+2])<<8 | uint64(lp[p+3])<<16
+		negstart = 1 << 23
+		negmax = 1<<24 - 1
+	case b == LP_ENCODING_32BIT_INT:
+		return nil, int64(int32(binary.LittleEndian.Uint32(lp[p+1 : p+5]))), true
+	case b == LP_ENCODING_64BIT_INT:
+		return nil, int64(binary.LittleEndian.Uint64(lp[p+1 : p+9])), true
+	case b&LP_ENCODING_12BIT_STR_MASK == LP_ENCODING_12BIT_STR:
+		l := int(b&0x0f)<<8 | int(lp[p+1])
+		return lp[p+2 : p+2+l], 0, false
+	case b == LP_ENCODING_32BIT_STR:
+		l := int(binary.LittleEndian.Uint32(lp[p+1 : p+5]))
+		return lp[p+5 : p+5+l], 0, false
+	default:
+		panic("Invalid listpack encoding")
+	}
+	//we need to perform the conversion from unsigned to signed.
+	if uval >= negstart {
+		uval = negmax - uval
+		return nil, -int64(uval) - 1, true
+	}
+	return nil, int64(uval), true
+}
+
+// return the element at the offset p as a string, integers are converted.
+func lpGetString(lp []byte, p int) string {
+	sval, ival, isInt := lpGet(lp, p)
+	if isInt {
+		return strconv.FormatInt(ival, 10)
+	}
+	return string(sval)
+}
+
+/*
+*
+find the element equal to s starting at the offset p, skipping skip elements
+between every comparison, so that with skip 1 only the fields of a listpack of
+field-value pairs are compared. -1 is returned if the element is not found.
+*/
+func lpFind(lp []byte, p int, s []byte, skip int) int {
+	var vll int64
+	//the integer value of s, converted only once.
+	sIsInt := lpStringToInt64(s, &vll)
+	skipcnt := 0
+	for p != -1 {
+		if skipcnt == 0 {
+			sval, ival, isInt := lpGet(lp, p)
+			if isInt {
+				if sIsInt && ival == vll {
+					return p
+				}
+			} else if bytes.Equal(sval, s) {
+				return p
+			}
+			skipcnt = skip
+		} else {
+			skipcnt--
+		}
+		p = lpNext(lp, p)
+	}
+	return -1
+}
+
+/*
+*
+insert the element before or after the element at the offset p, or replace it
+with LP_REPLACE, a nil element with LP_REPLACE deletes the element.
+the listpack is modified in place when its capacity allows it, so the returned
+listpack must always be used. the offset of the inserted element is returned,
+or for a deletion the offset of the next element, -1 if it was the last one.
+*/
+func lpInsert(lp []byte, ele []byte, p int, where int) ([]byte, int) {
+	var entry []byte
+	if ele != nil {
+		entry = lpEncodeEntry(ele)
+	}
+	//an insertion after an element is an insertion before the next one, which may be the EOF.
+	if where == LP_AFTER {
+		p = lpSkip(lp, p)
+		where = LP_BEFORE
+	}
+	replacedLen := 0
+	if where == LP_REPLACE {
+		replacedLen = lpCurrentEncodedSize(lp, p)
+		replacedLen += lpEncodeBacklenSize(replacedLen)
+	}
+
+	oldLen := len(lp)
+	newLen := oldLen - replacedLen + len(entry)
+	if newLen > oldLen {
+		lp = append(lp, make([]byte, newLen-oldLen)...)
+	}
+	//move the tail of the listpack to make room for the new entry, or to fill the gap.
+	copy(lp[p+len(entry):newLen], lp[p+replacedLen:oldLen])
+	copy(lp[p:], entry)
+	lp = lp[:newLen]
+	lpSetTotalBytes(lp, newLen)
+
+	numele := lpGetNumElements(lp)
+	if numele != LP_HDR_NUMELE_UNKNOWN {
+		if where == LP_BEFORE {
+			numele++
+		} else if ele == nil {
+			numele--
+		}
+		lpSetNumElements(lp, numele)
+	}
+	if ele == nil && lp[p] == LP_EOF {
+		return lp, -1
+	}
+	return lp, p
+}
+
+// append the element at the end of the listpack.
+func lpAppend(lp []byte, ele []byte) []byte {
+	lp, _ = lpInsert(lp, ele, lpBytes(lp)-1, LP_BEFORE)
+	return lp
+}
+
+// insert the element at the head of the listpack.
+func lpPrepend(lp []byte, ele []byte) []byte {
+	lp, _ = lpInsert(lp, ele, LP_HDR_SIZE, LP_BEFORE)
+	return lp
+}
+
+// replace the element at the offset p.
+func lpReplace(lp []byte, p int, ele []byte) ([]byte, int) {
+	return lpInsert(lp, ele, p, LP_REPLACE)
+}
+
+// delete the element at the offset p, the offset of the next element is returned.
+func lpDelete(lp []byte, p int) ([]byte, int) {
+	return lpInsert(lp, nil, p, LP_REPLACE)
+}
+
+// delete a range of num elements starting at the index, a negative index counts from the tail.
+func lpDeleteRange(lp []byte, index int, num int) []byte {
+	if num <= 0 {
+		return lp
+	}
+	first := lpSeek(lp, index)
+	if first == -1 {
+		return lp
+	}
+	//find the offset after the last deleted element.
+	tail := first
+	deleted := 0
+	for deleted < num && lp[tail] != LP_EOF {
+		tail = lpSkip(lp, tail)
+		deleted++
+	}
+	oldLen := len(lp)
+	copy(lp[first:], lp[tail:oldLen])
+	lp = lp[:oldLen-(tail-first)]
+	lpSetTotalBytes(lp, len(lp))
+	numele := lpGetNumElements(lp)
+	if numele != LP_HDR_NUMELE_UNKNOWN {
+		lpSetNumElements(lp, numele-deleted)
+	}
+	return lp
+}
+
+/*
+*
+return the offset of the element at the specified index, a negative index counts
+from the tail, -1 is returned if the index is out of range. the listpack is
+walked from the nearest side.
+*/
+func lpSeek(lp []byte, index int) int {
+	numele := lpLength(lp)
+	if index < 0 {
+		index = numele + index
+	}
+	if index < 0 || index >= numele {
+		return -1
+	}
+	//seek backward from the last element if the index is in the second half.
+	if index > numele/2 {
+		p := lpLast(lp)
+		for j := numele - 1; j > index; j-- {
+			p = lpPrev(lp, p)
+		}
+		return p
+	}
+	p := lpFirst(lp)
+	for j := 0; j < index; j++ {
+		p = lpNext(lp, p)
+	}
+	return p
+}
+
+// merge the second listpack at the end of the first one, the first listpack is reused if possible.
+func lpMerge(first []byte, second []byte) []byte {
+	firstLen, secondLen := lpLength(first), lpLength(second)
+	lp := append(first[:len(first)-1], second[LP_HDR_SIZE:]...)
+	lpSetTotalBytes(lp, len(lp))
+	if firstLen+secondLen < LP_HDR_NUMELE_UNKNOWN {
+		lpSetNumElements(lp, firstLen+secondLen)
+	} else {
+		lpSetNumElements(lp, LP_HDR_NUMELE_UNKNOWN)
+	}
+	return lp
+}
+
+// duplicate the listpack, so that the copy can be modified independently.
+func lpDup(lp []byte) []byte {
+	dup := make([]byte, len(lp))
+	copy(dup, lp)
+	return dup
+}
+
+/*
+*
+check that the listpack is well formed, so that it can be walked without reading
+out of its bounds: used on the listpacks loaded from an RDB file.
+*/
+func lpValidateIntegrity(lp []byte) bool {
+	if len(lp) < LP_HDR_SIZE+1 || lpBytes(lp) != len(lp) || lp[len(lp)-1] != LP_EOF {
+		return false
+	}
+	end := len(lp) - 1
+	count := 0
+	p := LP_HDR_SIZE
+	for p < end {
+		b := lp[p]
+		//the encodings from 0xF5 to 0xFE are unused, and EOF is only the last byte.
+		if b >= 0xF5 ||
+			(b&LP_ENCODING_12BIT_STR_MASK == LP_ENCODING_12BIT_STR && p+2 > end) ||
+			(b == LP_ENCODING_32BIT_STR && p+5 > end) {
+			return false
+		}
+		entrylen := lpCurrentEncodedSize(lp, p)
+		next := p + entrylen + lpEncodeBacklenSize(entrylen)
+		if next > end || !bytes.Equal(lp[p+entrylen:next], lpEncodeBacklen(entrylen)) {
+			return false
+		}
+		p = next
+		count++
+	}
+	numele := lpGetNumElements(lp)
+	return numele == LP_HDR_NUMELE_UNKNOWN || numele == count
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// the elements of the listpack as strings, walked from the head and checked backward from the tail.
+func testListpackElements(t *testing.T, lp []byte) []string {
+	var elements []string
+	for p := lpFirst(lp); p != -1; p = lpNext(lp, p) {
+		elements = append(elements, lpGetString(lp, p))
+	}
+	j := len(elements) - 1
+	for p := lpLast(lp); p != -1; p = lpPrev(lp, p) {
+		if j < 0 || lpGetString(lp, p) != elements[j] {
+			t.Fatalf("the backward walk doesn't match the forward walk at %d", j)
+		}
+		j--
+	}
+	if lpLength(lp) != len(elements) || lpBytes(lp) != len(lp) {
+		t.Fatalf("bad header: %d elements, %d bytes", lpLength(lp), lpBytes(lp))
+	}
+	return elements
+}
+
+func TestListpackEncodings(t *testing.T) {
+	values := []string{"0", "127", "-1", "4095", "-4096", "32767", "-32768", "8388607", "-8388608",
+		"2147483647", "-2147483648", "9223372036854775807", "-9223372036854775808",
+		"", "abc", "007", "1.5", strings.Repeat("x", 63), strings.Repeat("y", 64), strings.Repeat("z", 4096)}
+	lp := lpNew(0)
+	for _, v := range values {
+		lp = lpAppend(lp, []byte(v))
+	}
+	if elements := testListpackElements(t, lp); strings.Join(elements, ",") != strings.Join(values, ",") {
+		t.Fatalf("unexpected elements %v", elements)
+	}
+
+	//the canonical integers are stored as integers, the others as strings.
+	for i, v := range values {
+		_, ival, isInt := lpGet(lp, lpSeek(lp, i))
+		_, err := strconv.ParseInt(v, 10, 64)
+		if canonical := err == nil && v != "007"; isInt != canonical || (isInt && strconv.FormatInt(ival, 10) != v) {
+			t.Errorf("unexpected encoding of %q", v)
+		}
+	}
+	if p := lpSeek(lp, -2); lpGetString(lp, p) != strings.Repeat("y", 64) {
+		t.Error("negative index seek failed")
+	}
+	if lpSeek(lp, len(values)) != -1 || lpSeek(lp, -len(values)-1) != -1 {
+		t.Error("out of range seek returned an element")
+	}
+}
+
+func TestListpackInsertDelete(t *testing.T) {
+	lp := lpNew(0)
+	for _, v := range []string{"b", "d"} {
+		lp = lpAppend(lp, []byte(v))
+	}
+	lp = lpPrepend(lp, []byte("a"))
+	lp, _ = lpInsert(lp, []byte("c"), lpSeek(lp, 2), LP_BEFORE)
+	lp, _ = lpInsert(lp, []byte("e"), lpLast(lp), LP_AFTER)
+	if elements := testListpackElements(t, lp); strings.Join(elements, "") != "abcde" {
+		t.Fatalf("unexpected elements %v", elements)
+	}
+
+	//a replacement of a different size moves the following elements.
+	lp, _ = lpReplace(lp, lpSeek(lp, 1), []byte(strings.Repeat("B", 100)))
+	lp, _ = lpReplace(lp, lpSeek(lp, 1), []byte("b"))
+	var p int
+	lp, p = lpDelete(lp, lpSeek(lp, 2))
+	if lpGetString(lp, p) != "d" {
+		t.Errorf("the deletion returned %q", lpGetString(lp, p))
+	}
+	if _, p = lpDelete(lpDup(lp), lpLast(lp)); p != -1 {
+		t.Error("deleting the last element returned a next element")
+	}
+	lp = lpDeleteRange(lp, -2, 10)
+	if elements := testListpackElements(t, lp); strings.Join(elements, "") != "ab" {
+		t.Fatalf("unexpected elements %v", elements)
+	}
+}
+
+func TestListpackUnknownLength(t *testing.T) {
+	lp := lpNew(0)
+	for i := 0; i < 70000; i++ {
+		lp = lpAppend(lp, []byte(strconv.Itoa(i%100)))
+	}
+	//the count doesn't fit the header anymore and is computed by walking the listpack.
+	if lpGetNumElements(lp) != LP_HDR_NUMELE_UNKNOWN || lpLength(lp) != 70000 {
+		t.Fatalf("unexpected length %d", lpLength(lp))
+	}
+	lp = lpDeleteRange(lp, 0, 10000)
+	if lpLength(lp) != 60000 || lpGetNumElements(lp) != 60000 {
+		t.Fatalf("unexpected length %d", lpLength(lp))
+	}
+	dup := lpDup(lp)
+	dup, _ = lpDelete(dup, lpFirst(dup))
+	if bytes.Equal(dup, lp) || lpLength(lp) != 60000 {
+		t.Error("the duplicated listpack is not independent")
+	}
+}
+
+func TestListpackValidateIntegrity(t *testing.T) {
+	lp := lpNew(0)
+	for _, v := range []string{"1", "-4096", "abc", strings.Repeat("x", 200), strings.Repeat("y", 5000), "9223372036854775807"} {
+		lp = lpAppend(lp, []byte(v))
+	}
+	if !lpValidateIntegrity(lp) || !lpValidateIntegrity(lpNew(0)) {
+		t.Fatal("a valid listpack failed the integrity check")
+	}
+
+	//a truncation, a change of the header, of the EOF or of a backlen is detected.
+	corrupted := [][]byte{lp[:LP_HDR_SIZE], lp[:len(lp)-1]}
+	for _, offset := range []int{0, 4, LP_HDR_SIZE + 1, len(lp) - 1} {
+		c := lpDup(lp)
+		c[offset]++
+		corrupted = append(corrupted, c)
+	}
+	//an unused encoding, and a string whose length doesn't match its backlen.
+	c := lpDup(lp)
+	c[LP_HDR_SIZE] = 0xF5
+	corrupted = append(corrupted, c)
+	c = lpDup(lp)
+	c[lpSeek(c, 2)] = LP_ENCODING_6BIT_STR | 60
+	corrupted = append(corrupted, c)
+	for i, c := range corrupted {
+		if lpValidateIntegrity(c) {
+			t.Errorf("corrupted listpack %d passed the integrity check", i)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import "errors"
+
+/*
+*
+LZF compression, compatible with the liblzf format used by redis for the
+compressed strings of the RDB file and the compressed quicklist nodes.
+*/
+const (
+	LZF_HLOG    = 16
+	LZF_HSIZE   = 1 << LZF_HLOG
+	LZF_MAX_LIT = 1 << 5
+	LZF_MAX_OFF = 1 << 13
+	LZF_MAX_REF = (1 << 8) + (1 << 3)
+)
+
+var errLzfCorrupt = errors.New("invalid LZF compressed data")
+
+func lzfHash(in []byte, ip int) uint32 {
+	v := uint32(in[ip])<<16 | uint32(in[ip+1])<<8 | uint32(in[ip+2])
+	return ((v >> (3*8 - LZF_HLOG)) - v*5) & (LZF_HSIZE - 1)
+}
+
+/*
+*
+compress in, the result is nil if the data can not be compressed into
+less than maxLen bytes, in this case the data should be stored uncompressed.
+*/
+func lzfCompress(in []byte, maxLen int) []byte {
+	inLen := len(in)
+	if inLen == 0 || maxLen <= 0 {
+		return nil
+	}
+	//positions of the last occurrence of every 3 bytes hash, plus one so that zero means empty.
+	htab := make([]int, LZF_HSIZE)
+	out := make([]byte, 0, maxLen)
+	//start a literal run, its length byte is patched once the run ends.
+	lit := 0
+	runStart := 0
+	out = append(out, 0)
+	ip := 0
+
+	for ip < inLen-2 {
+		hval := lzfHash(in, ip)
+		ref := htab[hval] - 1
+		htab[hval] = ip + 1
+		off := ip - ref - 1
+
+		if ref >= 0 && off < LZF_MAX_OFF &&
+			in[ref] == in[ip] && in[ref+1] == in[ip+1] && in[ref+2] == in[ip+2] {
+			//match found, the maximum length must not exceed the input and the max back reference.
+			length := 2
+			maxlen := inLen - ip - length
+			if maxlen > LZF_MAX_REF {
+				maxlen = LZF_MAX_REF
+			}
+			//stop the literal run, removing its length byte if it is empty.
+			if lit == 0 {
+				out = out[:len(out)-1]
+			} else {
+				out[runStart] = byte(lit - 1)
+			}
+			for {
+				length++
+				if length >= maxlen || in[ref+length] != in[ip+length] {
+					break
+				}
+			}
+			//length is now the number of matched bytes minus 2.
+			length -= 2
+			ip++
+			if length < 7 {
+				out = append(out, byte(off>>8)+byte(length<<5))
+			} else {
+				out = append(out, byte(off>>8)+(7<<5), byte(length-7))
+			}
+			out = append(out, byte(off))
+			//start a new literal run.
+			lit = 0
+			runStart = len(out)
+			out = append(out, 0)
+
+			ip += length + 1
+			if ip >= inLen-2 {
+				break
+			}
+			htab[lzfHash(in, ip-1)] = ip
+		} else {
+			lit++
+			out = append(out, in[ip])
+			ip++
+			if lit == LZF_MAX_LIT {
+				out[runStart] = LZF_MAX_LIT - 1
+				lit = 0
+				runStart = len(out)
+				out = append(out, 0)
+			}
+		}
+		if len(out) >= maxLen {
+			return nil
+		}
+	}
+
+	//copy the last bytes as literals.
+	for ip < inLen {
+		lit++
+		out = append(out, in[ip])
+		ip++
+		if lit == LZF_MAX_LIT {
+			out[runStart] = LZF_MAX_LIT - 1
+			lit = 0
+			runStart = len(out)
+			out = append(out, 0)
+		}
+	}
+	if lit == 0 {
+		out = out[:len(out)-1]
+	} else {
+		out[runStart] = byte(lit - 1)
+	}
+	if len(out) >= maxLen {
+		return nil
+	}
+	return out
+}
+
+// decompress in, whose uncompressed length is known to be outLen bytes.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	ip := 0
+	for ip < len(in) {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < 1<<5 {
+			//literal run of ctrl+1 bytes
+			ctrl++
+			if ip+ctrl > len(in) || len(out)+ctrl > outLen {
+				return nil, errLzfCorrupt
+			}
+			out = append(out, in[ip:ip+ctrl]...)
+			ip += ctrl
+		} else {
+			//back reference
+			length := ctrl >> 5
+			ref := len(out) - ((ctrl & 0x1f) << 8) - 1
+			if length == 7 {
+				if ip >= len(in) {
+					return nil, errLzfCorrupt
+				}
+				length += int(in[ip])
+				ip++
+			}
+			if ip >= len(in) {
+				return nil, errLzfCorrupt
+			}
+			ref -= int(in[ip])
+			ip++
+			length += 2
+			if ref < 0 || len(out)+length > outLen {
+				return nil, errLzfCorrupt
+			}
+			//the reference may overlap the bytes being copied, so copy byte by byte.
+			for k := 0; k < length; k++ {
+				out = append(out, out[ref+k])
+			}
+		}
+	}
+	if len(out) != outLen {
+		return nil, errLzfCorrupt
+	}
+	return out, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestLzfRoundTrip(t *testing.T) {
+	inputs := [][]byte{
+		[]byte(strings.Repeat("a", 1000)),
+		[]byte(strings.Repeat("mini-redis ", 200)),
+		[]byte("abcabcabcabcabcabcabcabcabcabcabcabcabcxyz"),
+	}
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	half := append(bytes.Repeat([]byte("0123456789"), 300), random[:1000]...)
+	inputs = append(inputs, half)
+
+	for _, in := range inputs {
+		compressed := lzfCompress(in, len(in)-4)
+		if compressed == nil {
+			t.Fatalf("failed to compress %d bytes", len(in))
+		}
+		out, err := lzfDecompress(compressed, len(in))
+		if err != nil || !bytes.Equal(in, out) {
+			t.Fatalf("round trip failed for %d bytes: %v", len(in), err)
+		}
+	}
+
+	//incompressible data is left uncompressed.
+	if lzfCompress(random, len(random)-4) != nil {
+		t.Fatal("random data should not be compressible")
+	}
+	if _, err := lzfDecompress([]byte{0x05, 'a'}, 6); err == nil {
+		t.Fatal("truncated data decompressed without error")
+	}
+}
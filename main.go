@@ -1,11 +1,13 @@
 package main
 
 import (
-	"log"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 )
@@ -17,68 +19,127 @@ func main() {
 
 	wg.Add(1)
 
-	//initialize redis server and configuration
-	loadServerConfig()
+	//initialize the default configuration and the command table.
 	initServerConfig()
-	initServer()
 
-	//listen to the shutdown signal
-	sigCh := make(chan os.Signal)
-	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
-	go func(server *redisServer) {
-		sig := <-sigCh
-		switch sig {
-		case syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
-			closeRedisServer()
-			//modifying atomic variables means that the server is ready to shut down.
-			server.done.Store(1)
+	//parse the command line: redis-server [/path/to/redis.conf] [--directive value ...]
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if args[0] == "-v" || args[0] == "--version" {
+			fmt.Println("Redis server v=" + REDIS_VERSION)
+			os.Exit(0)
 		}
-	}(&server)
+		if args[0] == "-h" || args[0] == "--help" {
+			usage()
+		}
+	}
+	configfile := ""
+	//the first argument is the config file name, if it does not start with "--".
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		configfile = args[0]
+		args = args[1:]
+	}
+	//all the other options are parsed and conceptually appended to the configuration file.
+	options := ""
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") && len(arg) > 2 {
+			if options != "" {
+				options += "\n"
+			}
+			options += arg[2:] + " "
+		} else {
+			//option argument
+			options += sdscatrepr(arg) + " "
+		}
+	}
+	if configfile != "" {
+		if abs, err := filepath.Abs(configfile); err == nil {
+			server.configfile = abs
+		}
+	} else {
+		redisLog(REDIS_WARNING, "Warning: no config file specified, using the default config. In order to specify a config file use %s /path/to/redis.conf", os.Args[0])
+	}
+	loadServerConfig(configfile, options)
 
-	//parse address information
-	address := server.ip + ":" + strconv.Itoa(server.port)
-	log.Println("this redis server address:", address)
-	//binding port number
-	listen, err := net.Listen("tcp", address)
-	if err != nil {
-		log.Fatal("redis server listen failed,err:", err)
-		return
+	//initialize redis server
+	initServer()
+	if err := aofLoadManifestFromDisk(); err != nil {
+		redisLog(REDIS_WARNING, "Fatal error loading the AOF manifest: %s. Exiting.", err)
+		os.Exit(1)
+	}
+	loadDataFromDisk()
+	if err := aofOpenIfNeededOnServerStart(); err != nil {
+		redisLog(REDIS_WARNING, "Can't open the append-only file: %s", err)
+		os.Exit(1)
 	}
-	server.listen = listen
 
-	//handle client connections that are actively closed
+	//listen to the shutdown signal
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	go func(server *redisServer) {
-		for {
-			c := <-server.closeClientCh
-			log.Println("receive close client signal")
-			_ = c.conn.Close()
-			server.clients.Delete(c.string())
-			log.Println("close client successful ", server.clients)
+		for sig := range sigCh {
+			switch sig {
+			case syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
+				//the shutdown is prepared by the event loop, as the final save reads the keyspace.
+				server.eventCh <- func() {
+					if prepareForShutdown() != REDIS_OK {
+						return
+					}
+					//modifying atomic variables means that the server is ready to shut down.
+					server.done.Store(1)
+					closeRedisServer()
+				}
+			}
 		}
 	}(&server)
 
-	go func(s *redisServer) {
-		//retrieve the Redis client from "commandCh" and call "processCommand" to handle the instructions parsed from the array.
-		for redisClient := range s.commandCh {
-			processCommand(&redisClient)
+	//binding every configured address, a port of 0 disables the TCP listeners.
+	if server.port != 0 {
+		for _, bindaddr := range server.bindaddr {
+			//parse address information
+			address := net.JoinHostPort(bindaddr, strconv.Itoa(server.port))
+			redisLog(REDIS_NOTICE, "this redis server address: %s", address)
+			listen, err := net.Listen("tcp", address)
+			if err != nil {
+				redisLog(REDIS_WARNING, "Creating Server TCP listening socket %s: %s", address, err)
+				os.Exit(1)
+			}
+			server.listeners = append(server.listeners, listen)
 		}
-	}(&server)
+	}
+
+	//process commands, client close requests and timer events in a single goroutine.
+	go aeMain(&server)
 
 	//listen for incoming connections.
-	go func() {
-		for {
-			log.Println("event loop is listening and waiting for client connection.")
-			conn, err := listen.Accept()
-			if err != nil {
-				log.Println("accept conn failed,err:", err)
-				break
+	for _, listen := range server.listeners {
+		go func(listen net.Listener) {
+			for {
+				conn, err := listen.Accept()
+				if err != nil {
+					redisLog(REDIS_WARNING, "accept conn failed,err: %s", err)
+					break
+				}
+				//the connection is registered by the event loop, as it owns the server state.
+				server.acceptCh <- conn
 			}
-			acceptTcpHandler(conn)
-
-		}
-	}()
+		}(listen)
+	}
 
 	wg.Wait()
-	log.Println("redis service is down........................")
+	redisLog(REDIS_NOTICE, "redis service is down........................")
+
+}
 
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: ./redis-server [/path/to/redis.conf] [options]")
+	fmt.Fprintln(os.Stderr, "       ./redis-server -v or --version")
+	fmt.Fprintln(os.Stderr, "       ./redis-server -h or --help")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Examples:")
+	fmt.Fprintln(os.Stderr, "       ./redis-server (run the server with default conf)")
+	fmt.Fprintln(os.Stderr, "       ./redis-server /etc/redis/6379.conf")
+	fmt.Fprintln(os.Stderr, "       ./redis-server --port 7777")
+	fmt.Fprintln(os.Stderr, "       ./redis-server /etc/myredis.conf --loglevel verbose")
+	os.Exit(1)
 }
@@ -0,0 +1,278 @@
+package main
+
+// a command queued by a client in the MULTI context.
+type multiCmd struct {
+	argv []*robj
+	argc uint64
+	cmd  *redisCommand
+}
+
+// the commands queued by a client in the MULTI context, executed by EXEC.
+type multiState struct {
+	commands []multiCmd
+}
+
+/*
+*
+a key watched by a client with WATCH, the same structure is referenced by the
+watched keys list of the client and by the clients list of the key in the DB.
+*/
+type watchedKey struct {
+	key    *robj
+	db     *redisDb
+	client *redisClient
+	//the key was logically expired when it was watched.
+	expired bool
+}
+
+// client state initialization for MULTI/EXEC.
+func initClientMultiState(c *redisClient) {
+	c.mstate = multiState{}
+}
+
+// add a new command into the MULTI commands queue.
+func queueMultiCommand(c *redisClient) {
+	c.mstate.commands = append(c.mstate.commands, multiCmd{argv: c.argv[:c.argc], argc: c.argc, cmd: c.cmd})
+}
+
+func discardTransaction(c *redisClient) {
+	initClientMultiState(c)
+	c.flags &^= REDIS_MULTI | REDIS_DIRTY_CAS | REDIS_DIRTY_EXEC
+	unwatchAllKeys(c)
+}
+
+/*
+*
+flag the transaction as DIRTY_EXEC so that EXEC will fail.
+should be called every time there is an error while queueing a command.
+*/
+func flagTransaction(c *redisClient) {
+	if c.flags&REDIS_MULTI > 0 {
+		c.flags |= REDIS_DIRTY_EXEC
+	}
+}
+
+func multiCommand(c *redisClient) {
+	if c.flags&REDIS_MULTI > 0 {
+		errMsg := "MULTI calls can not be nested"
+		addReplyError(c, &errMsg)
+		return
+	}
+	c.flags |= REDIS_MULTI
+	addReply(c, shared.ok)
+}
+
+func discardCommand(c *redisClient) {
+	if c.flags&REDIS_MULTI == 0 {
+		errMsg := "DISCARD without MULTI"
+		addReplyError(c, &errMsg)
+		return
+	}
+	discardTransaction(c)
+	addReply(c, shared.ok)
+}
+
+/*
+*
+send a MULTI command to all the replicas and AOF file, called before the first
+write command of the transaction is executed.
+*/
+func execCommandPropagateMulti(c *redisClient) {
+	propagate(lookupCommand("MULTI"), c.db.id, []*robj{shared.multi}, REDIS_PROPAGATE_AOF|REDIS_PROPAGATE_REPL)
+}
+
+func execCommand(c *redisClient) {
+	mustPropagate := false //need to propagate MULTI/EXEC to AOF / replicas?
+	if c.flags&REDIS_MULTI == 0 {
+		errMsg := "EXEC without MULTI"
+		addReplyError(c, &errMsg)
+		return
+	}
+	//a watched key that expired in the meantime is considered modified.
+	if isWatchedKeyExpired(c) {
+		c.flags |= REDIS_DIRTY_CAS
+	}
+	/**
+	check if we need to abort the EXEC because:
+	1) some WATCHed key was touched.
+	2) there was a previous error while queueing commands.
+	a failed EXEC in the first case returns a multi bulk nil object, in the
+	second an EXECABORT error is returned.
+	*/
+	if c.flags&(REDIS_DIRTY_CAS|REDIS_DIRTY_EXEC) > 0 {
+		if c.flags&REDIS_DIRTY_EXEC > 0 {
+			addReplyErrorWithCode(c, "EXECABORT Transaction discarded because of previous errors.")
+		} else {
+			addReplyNullArray(c)
+		}
+		discardTransaction(c)
+		return
+	}
+
+	//exec all the queued commands, unwatch ASAP otherwise we'll waste CPU cycles.
+	unwatchAllKeys(c)
+	origArgv, origArgc, origCmd := c.argv, c.argc, c.cmd
+	addReplyMultiBulkLen(c, int64(len(c.mstate.commands)))
+	for j := range c.mstate.commands {
+		mc := &c.mstate.commands[j]
+		c.argv, c.argc, c.cmd = mc.argv, mc.argc, mc.cmd
+		/**
+		propagate a MULTI request once we encounter the first write op,
+		this way we'll deliver the MULTI/..../EXEC block as a whole and
+		both the AOF and the replication link will have the same consistency
+		and atomicity guarantees.
+		*/
+		if !mustPropagate && c.cmd.flag&REDIS_CMD_READONLY == 0 {
+			execCommandPropagateMulti(c)
+			mustPropagate = true
+		}
+		call(c, REDIS_CALL_FULL)
+		//commands may alter argc/argv, restore mstate.
+		mc.argv, mc.argc, mc.cmd = c.argv, c.argc, c.cmd
+	}
+	c.argv, c.argc, c.cmd = origArgv, origArgc, origCmd
+	discardTransaction(c)
+	//make sure the EXEC command will be propagated as well if MULTI was already propagated.
+	if mustPropagate {
+		server.dirty++
+	}
+}
+
+/*
+*
+watch for the specified key, the clients watching a key are stored in the
+watchedKeys map of the DB, the keys watched by a client in its watchedKeys list.
+*/
+func watchForKey(c *redisClient, key *robj) {
+	k := (*key.ptr).(string)
+	//check if we are already watching for this key.
+	for ln := listFirst(c.watchedKeys); ln != nil; ln = ln.next {
+		wk := (*ln.value).(*watchedKey)
+		if wk.db == c.db && (*wk.key.ptr).(string) == k {
+			return
+		}
+	}
+	//this key is not already watched in this DB, let's add it.
+	clients := c.db.watchedKeys[k]
+	if clients == nil {
+		clients = listCreate()
+		c.db.watchedKeys[k] = clients
+	}
+	wk := interface{}(&watchedKey{key: key, db: c.db, client: c, expired: keyIsExpired(c.db, key)})
+	listAddNodeTail(clients, &wk)
+	listAddNodeTail(c.watchedKeys, &wk)
+}
+
+// unwatch all the keys watched by this client, to clean the EXEC dirty flag is up to the caller.
+func unwatchAllKeys(c *redisClient) {
+	if listLength(c.watchedKeys) == 0 {
+		return
+	}
+	for ln := listFirst(c.watchedKeys); ln != nil; ln = ln.next {
+		//remove the client from the list of clients waiting for the key.
+		wk := (*ln.value).(*watchedKey)
+		k := (*wk.key.ptr).(string)
+		clients := wk.db.watchedKeys[k]
+		if clients == nil {
+			panic("the watched key is not in the watched keys of the DB")
+		}
+		listDelNode(clients, listSearchKey(clients, wk))
+		//kill the entry at all if this was the only client.
+		if listLength(clients) == 0 {
+			delete(wk.db.watchedKeys, k)
+		}
+	}
+	c.watchedKeys = listCreate()
+}
+
+// return true if one of the keys watched by the client expired after it was watched.
+func isWatchedKeyExpired(c *redisClient) bool {
+	for ln := listFirst(c.watchedKeys); ln != nil; ln = ln.next {
+		wk := (*ln.value).(*watchedKey)
+		//the key was already expired when WATCH was called.
+		if wk.expired {
+			continue
+		}
+		if keyIsExpired(wk.db, wk.key) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+*
+"touch" a key, so that if this key is being WATCHed by some client the
+next EXEC will fail.
+*/
+func touchWatchedKey(db *redisDb, key *robj) {
+	if len(db.watchedKeys) == 0 {
+		return
+	}
+	clients := db.watchedKeys[(*key.ptr).(string)]
+	if clients == nil {
+		return
+	}
+	//mark all the clients watching this key as REDIS_DIRTY_CAS.
+	for ln := listFirst(clients); ln != nil; ln = ln.next {
+		wk := (*ln.value).(*watchedKey)
+		if wk.expired {
+			//the key was already expired when WATCH was called.
+			if lookupKey(db, key) == nil {
+				/**
+				already expired key is deleted, so logically no change. clear
+				the flag, deleted keys are not flagged as expired.
+				*/
+				wk.expired = false
+				continue
+			}
+		}
+		wk.client.flags |= REDIS_DIRTY_CAS
+	}
+}
+
+/*
+*
+called when the DB is emptied by FLUSHDB, FLUSHALL or a full resynchronization:
+all the clients watching a key that existed in the DB are marked as dirty.
+*/
+func touchAllWatchedKeysInDb(db *redisDb) {
+	for k, clients := range db.watchedKeys {
+		if dictFind(&db.dict, k) == nil {
+			continue
+		}
+		for ln := listFirst(clients); ln != nil; ln = ln.next {
+			wk := (*ln.value).(*watchedKey)
+			if wk.expired {
+				//expired key now deleted, no logical change.
+				wk.expired = false
+				continue
+			}
+			wk.client.flags |= REDIS_DIRTY_CAS
+		}
+	}
+}
+
+func watchCommand(c *redisClient) {
+	if c.flags&REDIS_MULTI > 0 {
+		errMsg := "WATCH inside MULTI is not allowed"
+		addReplyError(c, &errMsg)
+		return
+	}
+	//no point in watching if the client is already dirty.
+	if c.flags&REDIS_DIRTY_CAS > 0 {
+		addReply(c, shared.ok)
+		return
+	}
+	var j uint64
+	for j = 1; j < c.argc; j++ {
+		watchForKey(c, c.argv[j])
+	}
+	addReply(c, shared.ok)
+}
+
+func unwatchCommand(c *redisClient) {
+	unwatchAllKeys(c)
+	c.flags &^= REDIS_DIRTY_CAS
+	addReply(c, shared.ok)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMultiExec(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+
+	if reply := run("EXEC"); reply != "-ERR EXEC without MULTI\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("MULTI"); reply != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if reply := run("MULTI"); reply != "-ERR MULTI calls can not be nested\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	for _, command := range []string{"SET a 1", "INCR a", "GET a"} {
+		if reply := run(command); reply != "+QUEUED\r\n" {
+			t.Fatalf("unexpected reply %q to %s", reply, command)
+		}
+	}
+	//nothing is executed before EXEC.
+	if lookupKey(c.db, testStringObject("a")) != nil {
+		t.Fatal("a queued command was executed")
+	}
+	if reply := run("EXEC"); reply != "*3\r\n+OK\r\n:2\r\n$1\r\n2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if c.flags&REDIS_MULTI > 0 || len(c.mstate.commands) != 0 {
+		t.Error("the transaction was not terminated")
+	}
+
+	//DISCARD throws away the queued commands.
+	run("MULTI")
+	run("DEL a")
+	if reply := run("DISCARD"); reply != "+OK\r\n" || lookupKey(c.db, testStringObject("a")) == nil {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	//an error while queueing aborts the whole transaction.
+	run("MULTI")
+	run("DEL a")
+	if reply := run("SET a"); !strings.HasPrefix(reply, "-ERR wrong number of arguments") {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("EXEC"); reply != "-EXECABORT Transaction discarded because of previous errors.\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if lookupKey(c.db, testStringObject("a")) == nil {
+		t.Error("a command of the aborted transaction was executed")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+	_, other := newTestClient(t)
+
+	//a watched key modified by another client makes EXEC fail.
+	run("WATCH a b")
+	other("SET a 1")
+	run("MULTI")
+	run("SET b 1")
+	if reply := run("EXEC"); reply != "*-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if len(c.db.watchedKeys) != 0 || listLength(c.watchedKeys) != 0 || c.flags&REDIS_DIRTY_CAS > 0 {
+		t.Error("the keys are still watched after EXEC")
+	}
+
+	//an untouched key doesn't abort the transaction.
+	run("WATCH a")
+	other("GET a")
+	run("MULTI")
+	if reply := run("WATCH a"); reply != "-ERR WATCH inside MULTI is not allowed\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	run("SET b 1")
+	if reply := run("EXEC"); reply != "*1\r\n+OK\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	//FLUSHDB touches the existing keys.
+	run("WATCH a")
+	other("FLUSHDB")
+	run("MULTI")
+	if reply := run("EXEC"); reply != "*-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	//UNWATCH forgets the keys.
+	run("WATCH a")
+	other("SET a 2")
+	run("UNWATCH")
+	run("MULTI")
+	if reply := run("EXEC"); reply != "*0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	//a key expiring after WATCH is considered modified.
+	other("SET a 3 PX 10")
+	run("WATCH a")
+	time.Sleep(20 * time.Millisecond)
+	run("MULTI")
+	if reply := run("EXEC"); reply != "*-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
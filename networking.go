@@ -1,25 +1,150 @@
 package main
 
-import "strconv"
+import (
+	"errors"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	REDIS_REPLY_CHUNK_BYTES = 16 * 1024 /* 16k output buffer */
+	/* the write deadline used to emulate a non blocking write, a client that can not
+	accept data within this window keeps the rest in its output buffer. */
+	REDIS_CLIENT_WRITE_TIMEOUT = time.Millisecond
+
+	/* Client classes for client limits */
+	REDIS_CLIENT_TYPE_NORMAL = 0 /* Normal req-reply clients + MONITORs */
+	REDIS_CLIENT_TYPE_SLAVE  = 1 /* Slaves. */
+	REDIS_CLIENT_TYPE_PUBSUB = 2 /* Clients subscribed to PubSub channels. */
+	REDIS_CLIENT_TYPE_COUNT  = 3
+)
+
+type clientBufferLimitsConfig struct {
+	hardLimitBytes   int64
+	softLimitBytes   int64
+	softLimitSeconds int64
+}
+
+/*
+*
+this function is called every time we are going to transmit new data to the client.
+it returns REDIS_OK if the client can receive data, and adds the client to the list of
+clients with pending writes so that beforeSleep flushes it, otherwise REDIS_ERR is returned
+and the reply should not be accumulated, e.g. the client is going to be closed.
+*/
+func prepareClientToWrite(c *redisClient) int {
+	//fake clients such as the one used to load the AOF never receive replies.
+	if c.conn == nil {
+		return REDIS_ERR
+	}
+	if c.flags&REDIS_CLOSE_ASAP > 0 {
+		return REDIS_ERR
+	}
+	//the master never receives the replies of the commands it sends us, except the ACKs.
+	if c.flags&REDIS_MASTER > 0 && c.flags&REDIS_MASTER_FORCE_REPLY == 0 {
+		return REDIS_ERR
+	}
+
+	//a replica waiting for the RDB accumulates the stream, it is flushed once the replica is online.
+	if c.flags&REDIS_SLAVE == 0 || c.replstate == REDIS_REPL_ONLINE {
+		putClientInPendingWriteQueue(c)
+	}
+	return REDIS_OK
+}
+
+// add the client to the list of clients flushed by beforeSleep, if not already there.
+func putClientInPendingWriteQueue(c *redisClient) {
+	if c.flags&REDIS_PENDING_WRITE == 0 {
+		c.flags |= REDIS_PENDING_WRITE
+		i := interface{}(c)
+		listAddNodeTail(server.clientsPendingWrite, &i)
+	}
+}
+
+func _addReplyToBuffer(c *redisClient, s string) int {
+	//if there already are entries in the reply list, we cannot add anything more to the static buffer.
+	if listLength(c.reply) > 0 {
+		return REDIS_ERR
+	}
+	//check that the buffer has enough space available for this string.
+	if len(s) > cap(c.buf)-len(c.buf) {
+		return REDIS_ERR
+	}
+	c.buf = append(c.buf, s...)
+	return REDIS_OK
+}
+
+func _addReplyStringToList(c *redisClient, s string) {
+	//append to the tail chunk if it still has room, otherwise allocate a new chunk.
+	if tail := c.reply.tail; tail != nil {
+		chunk := (*tail.value).(*[]byte)
+		if len(*chunk)+len(s) <= REDIS_REPLY_CHUNK_BYTES {
+			*chunk = append(*chunk, s...)
+			c.replyBytes += int64(len(s))
+			checkClientOutputBufferLimits(c)
+			return
+		}
+	}
+
+	size := REDIS_REPLY_CHUNK_BYTES
+	if len(s) > size {
+		size = len(s)
+	}
+	chunk := make([]byte, 0, size)
+	chunk = append(chunk, s...)
+	v := interface{}(&chunk)
+	listAddNodeTail(c.reply, &v)
+	c.replyBytes += int64(len(s))
+	checkClientOutputBufferLimits(c)
+}
 
 func addReply(c *redisClient, reply *string) {
-	c.conn.Write([]byte(*reply))
+	if prepareClientToWrite(c) != REDIS_OK {
+		return
+	}
+	if _addReplyToBuffer(c, *reply) != REDIS_OK {
+		_addReplyStringToList(c, *reply)
+	}
 }
 
 func addReplyBulk(c *redisClient, obj *robj) {
 	if obj.encoding == REDIS_ENCODING_EMBSTR {
 		value := (*obj.ptr).(string)
-		c.conn.Write([]byte("$" + strconv.Itoa(len(value)) + *shared.crlf + value + *shared.crlf))
+		reply := "$" + strconv.Itoa(len(value)) + *shared.crlf + value + *shared.crlf
+		addReply(c, &reply)
 	} else if obj.encoding == REDIS_ENCODING_INT {
 		num := (*obj.ptr).(int64)
 		numStr := strconv.FormatInt(num, 10)
-		c.conn.Write([]byte("$" + strconv.Itoa(len(numStr)) + *shared.crlf + numStr + *shared.crlf))
+		reply := "$" + strconv.Itoa(len(numStr)) + *shared.crlf + numStr + *shared.crlf
+		addReply(c, &reply)
 	}
 
 }
 
+// add a go string as bulk reply
+func addReplyBulkCString(c *redisClient, s string) {
+	reply := "$" + strconv.Itoa(len(s)) + *shared.crlf + s + *shared.crlf
+	addReply(c, &reply)
+}
+
 func addReplyError(c *redisClient, s *string) {
-	c.conn.Write([]byte("-ERR " + *s + "\r\n"))
+	reply := "-ERR " + *s + *shared.crlf
+	addReply(c, &reply)
+}
+
+// add an error reply whose error code is already part of the message, e.g. "NOPROTO ..."
+func addReplyErrorWithCode(c *redisClient, s string) {
+	reply := "-" + s + *shared.crlf
+	addReply(c, &reply)
+}
+
+func addReplyStatus(c *redisClient, s string) {
+	reply := "+" + s + *shared.crlf
+	addReply(c, &reply)
 }
 
 func addReplyLongLong(c *redisClient, ll int64) {
@@ -33,7 +158,8 @@ func addReplyLongLong(c *redisClient, ll int64) {
 }
 
 func addReplyLongLongWithPrefix(c *redisClient, ll int64, prefix string) {
-	c.conn.Write([]byte(":" + strconv.FormatInt(ll, 10) + "\r\n"))
+	reply := prefix + strconv.FormatInt(ll, 10) + *shared.crlf
+	addReply(c, &reply)
 }
 
 func addReplyMultiBulkLen(c *redisClient, length int64) {
@@ -44,3 +170,451 @@ func addReplyMultiBulkLen(c *redisClient, length int64) {
 		addReplyLongLongWithPrefix(c, length, "*")
 	}
 }
+
+/*
+*
+the following functions emit the RESP3 types, when the client speaks RESP2
+they fall back to the closest RESP2 representation.
+*/
+func addReplyMapLen(c *redisClient, length int64) {
+	if c.resp == 2 {
+		//a map in RESP2 is a flat array of key value pairs.
+		addReplyMultiBulkLen(c, length*2)
+	} else {
+		addReplyLongLongWithPrefix(c, length, "%")
+	}
+}
+
+func addReplySetLen(c *redisClient, length int64) {
+	if c.resp == 2 {
+		addReplyMultiBulkLen(c, length)
+	} else {
+		addReplyLongLongWithPrefix(c, length, "~")
+	}
+}
+
+func addReplyPushLen(c *redisClient, length int64) {
+	if c.resp == 2 {
+		addReplyMultiBulkLen(c, length)
+	} else {
+		addReplyLongLongWithPrefix(c, length, ">")
+	}
+}
+
+func addReplyNull(c *redisClient) {
+	addReply(c, shared.null[c.resp])
+}
+
+func addReplyNullArray(c *redisClient) {
+	addReply(c, shared.nullarray[c.resp])
+}
+
+func addReplyBool(c *redisClient, b bool) {
+	if c.resp == 2 {
+		if b {
+			addReply(c, shared.cone)
+		} else {
+			addReply(c, shared.czero)
+		}
+	} else if b {
+		reply := "#t\r\n"
+		addReply(c, &reply)
+	} else {
+		reply := "#f\r\n"
+		addReply(c, &reply)
+	}
+}
+
+func addReplyDouble(c *redisClient, d float64) {
+	var s string
+	if math.IsInf(d, 1) {
+		s = "inf"
+	} else if math.IsInf(d, -1) {
+		s = "-inf"
+	} else if math.IsNaN(d) {
+		s = "nan"
+	} else {
+		//the shortest representation that can be parsed back to the same value.
+		s = strconv.FormatFloat(d, 'g', -1, 64)
+	}
+
+	if c.resp == 2 {
+		//doubles are sent as bulk strings in RESP2.
+		addReplyBulkCString(c, s)
+	} else {
+		reply := "," + s + *shared.crlf
+		addReply(c, &reply)
+	}
+}
+
+// the number is expected to be a valid integer of arbitrary precision.
+func addReplyBigNum(c *redisClient, num string) {
+	if c.resp == 2 {
+		addReplyBulkCString(c, num)
+	} else {
+		reply := "(" + num + *shared.crlf
+		addReply(c, &reply)
+	}
+}
+
+// ext is the three bytes format of the verbatim string, such as "txt" or "mkd".
+func addReplyVerbatim(c *redisClient, s string, ext string) {
+	if c.resp == 2 {
+		addReplyBulkCString(c, s)
+	} else {
+		reply := "=" + strconv.Itoa(len(s)+4) + *shared.crlf + ext + ":" + s + *shared.crlf
+		addReply(c, &reply)
+	}
+}
+
+/*
+*
+HELLO [protover [AUTH username password] [SETNAME clientname]]
+switch the connection to the given protocol version and reply with the
+server and connection properties.
+*/
+func helloCommand(c *redisClient) {
+	ver := int64(0)
+	var j uint64
+	if c.argc >= 2 {
+		v, err := strconv.ParseInt((*c.argv[1].ptr).(string), 10, 64)
+		if err != nil {
+			errMsg := "Protocol version is not an integer or out of range"
+			addReplyError(c, &errMsg)
+			return
+		}
+		ver = v
+		if ver < 2 || ver > 3 {
+			addReplyErrorWithCode(c, "NOPROTO unsupported protocol version")
+			return
+		}
+	}
+
+	var name *string
+	var username, password *robj
+	for j = 2; j < c.argc; j++ {
+		moreargs := c.argc - 1 - j
+		opt := (*c.argv[j].ptr).(string)
+		if strings.EqualFold(opt, "AUTH") && moreargs >= 2 {
+			username = c.argv[j+1]
+			password = c.argv[j+2]
+			j += 2
+		} else if strings.EqualFold(opt, "SETNAME") && moreargs > 0 {
+			clientName := (*c.argv[j+1].ptr).(string)
+			if !validateClientName(c, clientName) {
+				return
+			}
+			name = &clientName
+			j++
+		} else {
+			errMsg := "Syntax error in HELLO option '" + opt + "'"
+			addReplyError(c, &errMsg)
+			return
+		}
+	}
+
+	//at this point we need to be authenticated to continue.
+	if username != nil {
+		if !checkPassword((*username.ptr).(string), (*password.ptr).(string)) {
+			addReplyErrorWithCode(c, "WRONGPASS invalid username-password pair or user is disabled.")
+			return
+		}
+		c.authenticated = true
+	}
+	if server.requirepass != "" && !c.authenticated {
+		addReplyErrorWithCode(c, "NOAUTH HELLO must be called with the client already authenticated, "+
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate "+
+			"the client and select the RESP protocol version at the same time")
+		return
+	}
+
+	//all the options are valid, apply them to the client.
+	if name != nil {
+		c.name = *name
+	}
+	if ver != 0 {
+		c.resp = int(ver)
+	}
+
+	addReplyMapLen(c, 7)
+
+	addReplyBulkCString(c, "server")
+	addReplyBulkCString(c, "redis")
+
+	addReplyBulkCString(c, "version")
+	addReplyBulkCString(c, REDIS_VERSION)
+
+	addReplyBulkCString(c, "proto")
+	addReplyLongLong(c, int64(c.resp))
+
+	addReplyBulkCString(c, "id")
+	addReplyLongLong(c, int64(c.id))
+
+	addReplyBulkCString(c, "mode")
+	addReplyBulkCString(c, "standalone")
+
+	addReplyBulkCString(c, "role")
+	if server.masterhost == "" {
+		addReplyBulkCString(c, "master")
+	} else {
+		addReplyBulkCString(c, "replica")
+	}
+
+	addReplyBulkCString(c, "modules")
+	addReplyMultiBulkLen(c, 0)
+}
+
+// client names can not contain spaces, newlines or other special characters.
+func validateClientName(c *redisClient, name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			errMsg := "Client names cannot contain spaces, newlines or special characters."
+			addReplyError(c, &errMsg)
+			return false
+		}
+	}
+	return true
+}
+
+/*
+*
+return the number of bytes accumulated in the reply list, the static buffer is not
+accounted since it is always allocated.
+*/
+func getClientOutputBufferMemoryUsage(c *redisClient) int64 {
+	return c.replyBytes
+}
+
+/*
+*
+get the class of a client, used in order to enforce limits to different classes of clients.
+*/
+func getClientTypeByName(name string) int {
+	switch strings.ToLower(name) {
+	case "normal":
+		return REDIS_CLIENT_TYPE_NORMAL
+	case "slave", "replica":
+		return REDIS_CLIENT_TYPE_SLAVE
+	case "pubsub":
+		return REDIS_CLIENT_TYPE_PUBSUB
+	}
+	return -1
+}
+
+func getClientTypeName(class int) string {
+	switch class {
+	case REDIS_CLIENT_TYPE_NORMAL:
+		return "normal"
+	case REDIS_CLIENT_TYPE_SLAVE:
+		return "slave"
+	case REDIS_CLIENT_TYPE_PUBSUB:
+		return "pubsub"
+	}
+	return ""
+}
+
+func getClientType(c *redisClient) int {
+	if c.flags&REDIS_SLAVE > 0 {
+		return REDIS_CLIENT_TYPE_SLAVE
+	}
+	if c.flags&REDIS_PUBSUB > 0 {
+		return REDIS_CLIENT_TYPE_PUBSUB
+	}
+	return REDIS_CLIENT_TYPE_NORMAL
+}
+
+/*
+*
+the function checks if the client reached output buffer soft or hard limit,
+and schedules the client to be closed asynchronously if needed.
+*/
+func checkClientOutputBufferLimits(c *redisClient) {
+	used := getClientOutputBufferMemoryUsage(c)
+	limit := server.clientObufLimits[getClientType(c)]
+
+	hard := limit.hardLimitBytes > 0 && used >= limit.hardLimitBytes
+	soft := limit.softLimitBytes > 0 && used >= limit.softLimitBytes
+
+	/**
+	we need to check if the soft limit is reached continuously for the specified
+	amount of seconds.
+	*/
+	if soft {
+		now := time.Now().Unix()
+		if c.obufSoftLimitReachedTime == 0 {
+			c.obufSoftLimitReachedTime = now
+			soft = false //first time we see the soft limit reached
+		} else if now-c.obufSoftLimitReachedTime <= limit.softLimitSeconds {
+			soft = false //the client still did not reached the max number of seconds for the soft limit to be considered reached.
+		}
+	} else {
+		c.obufSoftLimitReachedTime = 0
+	}
+
+	if (soft || hard) && c.flags&REDIS_CLOSE_ASAP == 0 {
+		redisLog(REDIS_WARNING, "Client id=%d scheduled to be closed ASAP for overcoming of output buffer limits.", c.id)
+		freeClientAsync(c)
+	}
+}
+
+/*
+*
+write the static buffer and the reply list of the client to the socket with a single writev.
+if the socket can not accept all the data within REDIS_CLIENT_WRITE_TIMEOUT the remaining
+bytes are kept and the client stays in the pending write list.
+*/
+func writeToClient(c *redisClient) int {
+	bufs := make(net.Buffers, 0, 1+listLength(c.reply))
+	if c.sentlen < len(c.buf) {
+		bufs = append(bufs, c.buf[c.sentlen:])
+	}
+	for node := c.reply.head; node != nil; node = node.next {
+		bufs = append(bufs, *(*node.value).(*[]byte))
+	}
+	if len(bufs) == 0 {
+		return REDIS_OK
+	}
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(REDIS_CLIENT_WRITE_TIMEOUT))
+	n, err := bufs.WriteTo(c.conn)
+	_ = c.conn.SetWriteDeadline(time.Time{})
+
+	//consume the written bytes, first from the static buffer then from the reply list.
+	written := int(n)
+	if c.sentlen < len(c.buf) {
+		consumed := len(c.buf) - c.sentlen
+		if written < consumed {
+			consumed = written
+		}
+		c.sentlen += consumed
+		written -= consumed
+		if c.sentlen == len(c.buf) {
+			c.buf = c.buf[:0]
+			c.sentlen = 0
+		}
+	}
+	for written > 0 {
+		node := c.reply.head
+		chunk := (*node.value).(*[]byte)
+		if written >= len(*chunk) {
+			written -= len(*chunk)
+			c.replyBytes -= int64(len(*chunk))
+			listDelNode(c.reply, node)
+		} else {
+			*chunk = (*chunk)[written:]
+			c.replyBytes -= int64(written)
+			written = 0
+		}
+	}
+
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		redisLog(REDIS_VERBOSE, "Error writing to client: %s", err)
+		freeClientAsync(c)
+		return REDIS_ERR
+	}
+	return REDIS_OK
+}
+
+func clientHasPendingReplies(c *redisClient) bool {
+	return len(c.buf) > 0 || listLength(c.reply) > 0
+}
+
+/*
+*
+this function is called just before entering the event loop, in the hope
+we can just write the replies to the client output buffer without any need
+to block the command loop. clients whose reader still has pipelined requests
+buffered are flushed after the last command of the batch.
+*/
+func handleClientsWithPendingWrites() {
+	node := server.clientsPendingWrite.head
+	for node != nil {
+		next := node.next
+		c := (*node.value).(*redisClient)
+		if c.flags&REDIS_CLOSE_ASAP > 0 {
+			c.flags &^= REDIS_PENDING_WRITE
+			listDelNode(server.clientsPendingWrite, node)
+		} else if !c.pendingInput {
+			writeToClient(c)
+			//keep the client in the list until the whole output has been transferred.
+			if !clientHasPendingReplies(c) || c.flags&REDIS_CLOSE_ASAP > 0 {
+				c.flags &^= REDIS_PENDING_WRITE
+				listDelNode(server.clientsPendingWrite, node)
+			}
+		}
+		node = next
+	}
+}
+
+/*
+*
+close the client connection and release all the references the server holds to it,
+calling it multiple times for the same client is harmless.
+*/
+func freeClient(c *redisClient) {
+	if _, exists := server.clients.LoadAndDelete(c.id); !exists {
+		return
+	}
+	_ = c.conn.Close()
+	server.connectedClients.Add(-1)
+	c.flags |= REDIS_CLOSE_ASAP
+
+	if c.flags&REDIS_BLOCKED > 0 {
+		unblockClient(c)
+	}
+	if c.flags&REDIS_SLAVE > 0 {
+		replicationFreeSlave(c)
+	}
+	if c == server.master {
+		replicationHandleMasterDisconnection()
+	}
+	//unsubscribe from all the pubsub channels.
+	pubsubUnsubscribeAllChannels(c, false)
+	pubsubUnsubscribeShardAllChannels(c, false)
+	pubsubUnsubscribeAllPatterns(c, false)
+	//deallocate the structures used by WATCH and MULTI.
+	unwatchAllKeys(c)
+	initClientMultiState(c)
+
+	if c.flags&REDIS_PENDING_WRITE > 0 {
+		if ln := listSearchKey(server.clientsPendingWrite, c); ln != nil {
+			listDelNode(server.clientsPendingWrite, ln)
+		}
+		c.flags &^= REDIS_PENDING_WRITE
+	}
+	c.buf = c.buf[:0]
+	c.reply = listCreate()
+	c.replyBytes = 0
+	redisLog(REDIS_VERBOSE, "close client successful")
+}
+
+/*
+*
+schedule a client to free it at a safe time in the beforeSleep() function.
+this function is useful when we need to terminate a client but we are in
+a context where calling freeClient() is not possible.
+*/
+func freeClientAsync(c *redisClient) {
+	if c.flags&REDIS_CLOSE_ASAP > 0 {
+		return
+	}
+	c.flags |= REDIS_CLOSE_ASAP
+	i := interface{}(c)
+	listAddNodeTail(server.clientsToClose, &i)
+}
+
+func freeClientsInAsyncFreeQueue() {
+	for listLength(server.clientsToClose) > 0 {
+		node := listFirst(server.clientsToClose)
+		c := (*node.value).(*redisClient)
+		listDelNode(server.clientsToClose, node)
+		freeClient(c)
+	}
+}
+
+// rewrite the command vector of the client, so that a different command is propagated.
+func rewriteClientCommandVector(c *redisClient, argv ...*robj) {
+	c.argv = argv
+	c.argc = uint64(len(argv))
+	c.cmd = lookupCommand((*argv[0].ptr).(string))
+}
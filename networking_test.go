@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+*
+a connection recording what the server flushes to the client. when limit is not
+negative it accepts at most limit more bytes, then fails as a client too slow to
+read the replies within the write deadline.
+*/
+type testConn struct {
+	net.Conn
+	data   []byte
+	writes int
+	limit  int
+}
+
+func (tc *testConn) Write(p []byte) (int, error) {
+	tc.writes++
+	if tc.limit >= 0 && len(p) > tc.limit {
+		n := tc.limit
+		tc.data = append(tc.data, p[:n]...)
+		tc.limit = 0
+		return n, os.ErrDeadlineExceeded
+	}
+	if tc.limit >= 0 {
+		tc.limit -= len(p)
+	}
+	tc.data = append(tc.data, p...)
+	return len(p), nil
+}
+
+func (tc *testConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (tc *testConn) Close() error {
+	return nil
+}
+
+func setupNetworkingTest() (*redisClient, *testConn) {
+	setupTestServer()
+	server.clientsToClose = listCreate()
+	server.clientObufLimits = [REDIS_CLIENT_TYPE_COUNT]clientBufferLimitsConfig{}
+	conn := &testConn{limit: -1}
+	c := createClient(conn)
+	server.clients.Store(c.id, c)
+	server.connectedClients.Add(1)
+	return c, conn
+}
+
+// execute the command without flushing its reply.
+func testProcessCommand(c *redisClient, command string) {
+	args := strings.Split(command, " ")
+	c.argv = make([]*robj, len(args))
+	for j := range args {
+		c.argv[j] = testStringObject(args[j])
+	}
+	c.argc = uint64(len(args))
+	processCommand(c)
+}
+
+func TestPipelinedRepliesFlush(t *testing.T) {
+	c, conn := setupNetworkingTest()
+
+	//while the reader has pipelined commands buffered, the replies are only accumulated.
+	c.pendingInput = true
+	testProcessCommand(c, "SET k v")
+	testProcessCommand(c, "GET k")
+	testProcessCommand(c, "PING")
+	handleClientsWithPendingWrites()
+	if conn.writes != 0 || c.flags&REDIS_PENDING_WRITE == 0 || listLength(server.clientsPendingWrite) != 1 {
+		t.Fatalf("the replies were flushed before the last command of the batch: %d writes", conn.writes)
+	}
+
+	//after the last command the replies of the whole batch are written at once.
+	c.pendingInput = false
+	testProcessCommand(c, "GET missing")
+	handleClientsWithPendingWrites()
+	if expected := "+OK\r\n$1\r\nv\r\n+PONG\r\n$-1\r\n"; string(conn.data) != expected || conn.writes != 1 {
+		t.Errorf("unexpected flush %q in %d writes", conn.data, conn.writes)
+	}
+	if clientHasPendingReplies(c) || c.flags&REDIS_PENDING_WRITE > 0 || listLength(server.clientsPendingWrite) != 0 {
+		t.Error("the client is still pending after the whole output was written")
+	}
+}
+
+func TestPipelinedPartialRequest(t *testing.T) {
+	tests := []struct {
+		payload string
+		pending bool
+	}{
+		//a blank line or a request split across the TCP segments doesn't hold the replies.
+		{"PING\r\n\r\n", false},
+		{"*1\r\n$4\r\nPING\r\n*1\r\n$4\r\nPI", false},
+		{"*1\r\n$4\r\nPING\r\n*1\r\n$4", false},
+		{"PING\r\n*0\r\n", false},
+		//a complete request after the blank lines does.
+		{"PING\r\n\r\n*1\r\n$4\r\nPING\r\n", true},
+		{"PING\r\nPING\n", true},
+	}
+	for _, test := range tests {
+		c, conn := setupNetworkingTest()
+		closeCh, cmdCh := make(chan *redisClient, 1), make(chan *redisClient)
+		go processInputBuffer(c, bufio.NewReader(strings.NewReader(test.payload)), closeCh, cmdCh)
+
+		<-cmdCh
+		if c.pendingInput != test.pending {
+			t.Errorf("%q: pending input is %v", test.payload, c.pendingInput)
+		}
+		processCommand(c)
+		handleClientsWithPendingWrites()
+		if !test.pending && string(conn.data) != "+PONG\r\n" {
+			t.Errorf("%q: unexpected flush %q", test.payload, conn.data)
+		}
+		c.cmdDone <- struct{}{}
+		if test.pending {
+			<-cmdCh
+			processCommand(c)
+			handleClientsWithPendingWrites()
+			if string(conn.data) != "+PONG\r\n+PONG\r\n" {
+				t.Errorf("%q: unexpected flush %q", test.payload, conn.data)
+			}
+			c.cmdDone <- struct{}{}
+		}
+		<-closeCh
+	}
+}
+
+func TestReplyListSpill(t *testing.T) {
+	c, conn := setupNetworkingTest()
+
+	//the static buffer is filled first, the reply that doesn't fit goes to the reply list.
+	first := strings.Repeat("a", REDIS_REPLY_CHUNK_BYTES-10)
+	addReplyStatus(c, first)
+	addReplyStatus(c, "spilled")
+	if len(c.buf) != REDIS_REPLY_CHUNK_BYTES-7 || listLength(c.reply) != 1 || c.replyBytes != 10 {
+		t.Fatalf("unexpected output buffers: %d bytes in buf, %d chunks, %d bytes in list",
+			len(c.buf), listLength(c.reply), c.replyBytes)
+	}
+	//once the list is used the replies are appended to it even if the buffer has room, to keep the order.
+	addReplyStatus(c, "ok")
+	if len(c.buf) != REDIS_REPLY_CHUNK_BYTES-7 || listLength(c.reply) != 1 || c.replyBytes != 15 {
+		t.Fatal("the reply was not appended to the tail chunk")
+	}
+	//a reply bigger than a chunk gets its own chunk.
+	big := strings.Repeat("b", REDIS_REPLY_CHUNK_BYTES+1)
+	addReplyStatus(c, big)
+	addReplyStatus(c, "last")
+	if listLength(c.reply) != 3 {
+		t.Fatalf("unexpected number of chunks %d", listLength(c.reply))
+	}
+	expected := "+" + first + "\r\n+spilled\r\n+ok\r\n+" + big + "\r\n+last\r\n"
+
+	//a slow client takes the output in several flushes, the client stays pending meanwhile.
+	conn.limit = REDIS_REPLY_CHUNK_BYTES + 100
+	handleClientsWithPendingWrites()
+	if string(conn.data) != expected[:REDIS_REPLY_CHUNK_BYTES+100] || c.flags&REDIS_PENDING_WRITE == 0 ||
+		c.replyBytes != int64(len(expected)-len(c.buf)-REDIS_REPLY_CHUNK_BYTES-100) {
+		t.Fatalf("unexpected partial write of %d bytes", len(conn.data))
+	}
+	conn.limit = -1
+	handleClientsWithPendingWrites()
+	if string(conn.data) != expected {
+		t.Error("the output was not written in order")
+	}
+	if clientHasPendingReplies(c) || c.replyBytes != 0 || c.sentlen != 0 || c.flags&REDIS_PENDING_WRITE > 0 {
+		t.Error("the output buffers were not released")
+	}
+}
+
+func TestClientOutputBufferHardLimit(t *testing.T) {
+	c, conn := setupNetworkingTest()
+	server.clientObufLimits[REDIS_CLIENT_TYPE_NORMAL] = clientBufferLimitsConfig{hardLimitBytes: 2*REDIS_REPLY_CHUNK_BYTES + 100}
+
+	//the static buffer is not accounted, the reply list is.
+	chunk := strings.Repeat("x", REDIS_REPLY_CHUNK_BYTES)
+	addReplyBulkCString(c, chunk)
+	addReplyBulkCString(c, chunk)
+	if c.flags&REDIS_CLOSE_ASAP > 0 {
+		t.Fatal("the client was closed below the hard limit")
+	}
+	addReplyBulkCString(c, chunk)
+	if c.flags&REDIS_CLOSE_ASAP == 0 || listLength(server.clientsToClose) != 1 {
+		t.Fatal("the client was not closed over the hard limit")
+	}
+
+	//the client closed asap accumulates no more replies and is not written.
+	replyBytes := c.replyBytes
+	addReplyBulkCString(c, "more")
+	handleClientsWithPendingWrites()
+	if c.replyBytes != replyBytes || conn.writes != 0 || listLength(server.clientsPendingWrite) != 0 {
+		t.Error("the client closed asap was served")
+	}
+	freeClientsInAsyncFreeQueue()
+	if _, exists := server.clients.Load(c.id); exists || clientHasPendingReplies(c) {
+		t.Error("the client was not freed")
+	}
+
+	//the limits depend on the class of the client.
+	c, _ = setupNetworkingTest()
+	server.clientObufLimits[REDIS_CLIENT_TYPE_NORMAL] = clientBufferLimitsConfig{hardLimitBytes: REDIS_REPLY_CHUNK_BYTES}
+	c.flags |= REDIS_PUBSUB
+	addReplyBulkCString(c, chunk)
+	addReplyBulkCString(c, chunk)
+	if c.flags&REDIS_CLOSE_ASAP > 0 {
+		t.Error("the limit of the normal clients was applied to a pubsub client")
+	}
+}
+
+func TestClientOutputBufferSoftLimit(t *testing.T) {
+	c, _ := setupNetworkingTest()
+	server.clientObufLimits[REDIS_CLIENT_TYPE_NORMAL] = clientBufferLimitsConfig{
+		softLimitBytes: REDIS_REPLY_CHUNK_BYTES, softLimitSeconds: 10}
+
+	//the first time the soft limit is reached the time is recorded, the client is kept.
+	chunk := strings.Repeat("x", REDIS_REPLY_CHUNK_BYTES)
+	addReplyBulkCString(c, chunk)
+	addReplyBulkCString(c, chunk)
+	reached := c.obufSoftLimitReachedTime
+	if reached == 0 || c.flags&REDIS_CLOSE_ASAP > 0 {
+		t.Fatal("the soft limit was not recorded")
+	}
+	addReplyBulkCString(c, "more")
+	if c.obufSoftLimitReachedTime != reached || c.flags&REDIS_CLOSE_ASAP > 0 {
+		t.Fatal("the client was closed before the soft limit time")
+	}
+
+	//going back under the soft limit resets the time.
+	writeToClient(c)
+	half := strings.Repeat("h", REDIS_REPLY_CHUNK_BYTES/2)
+	addReplyStatus(c, half)
+	addReplyStatus(c, half)
+	if listLength(c.reply) != 1 || c.obufSoftLimitReachedTime != 0 {
+		t.Fatal("the soft limit time was not reset")
+	}
+
+	//the client over the soft limit for more than the configured seconds is closed.
+	addReplyBulkCString(c, chunk)
+	c.obufSoftLimitReachedTime = time.Now().Unix() - 11
+	addReplyBulkCString(c, "more")
+	if c.flags&REDIS_CLOSE_ASAP == 0 || listLength(server.clientsToClose) != 1 {
+		t.Error("the client over the soft limit for too long was not closed")
+	}
+}
+
+// flush the replies accumulated by the client and return them.
+func testFlushReplies(c *redisClient, conn *testConn) string {
+	writeToClient(c)
+	reply := string(conn.data)
+	conn.data = nil
+	return reply
+}
+
+func TestTypedReplies(t *testing.T) {
+	c, conn := setupNetworkingTest()
+
+	tests := []struct {
+		name         string
+		reply        func(c *redisClient)
+		resp2, resp3 string
+	}{
+		{"map", func(c *redisClient) { addReplyMapLen(c, 2) }, "*4\r\n", "%2\r\n"},
+		{"set", func(c *redisClient) { addReplySetLen(c, 3) }, "*3\r\n", "~3\r\n"},
+		{"push", func(c *redisClient) { addReplyPushLen(c, 3) }, "*3\r\n", ">3\r\n"},
+		{"null", addReplyNull, "$-1\r\n", "_\r\n"},
+		{"null array", addReplyNullArray, "*-1\r\n", "_\r\n"},
+		{"true", func(c *redisClient) { addReplyBool(c, true) }, ":1\r\n", "#t\r\n"},
+		{"false", func(c *redisClient) { addReplyBool(c, false) }, ":0\r\n", "#f\r\n"},
+		{"double", func(c *redisClient) { addReplyDouble(c, 1.5) }, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{"inf", func(c *redisClient) { addReplyDouble(c, math.Inf(-1)) }, "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{"bignum", func(c *redisClient) { addReplyBigNum(c, "12345678901234567890") },
+			"$20\r\n12345678901234567890\r\n", "(12345678901234567890\r\n"},
+		{"verbatim", func(c *redisClient) { addReplyVerbatim(c, "hello", "txt") },
+			"$5\r\nhello\r\n", "=9\r\ntxt:hello\r\n"},
+	}
+	for _, test := range tests {
+		c.resp = 2
+		test.reply(c)
+		if reply := testFlushReplies(c, conn); reply != test.resp2 {
+			t.Errorf("%s: unexpected RESP2 reply %q", test.name, reply)
+		}
+		c.resp = 3
+		test.reply(c)
+		if reply := testFlushReplies(c, conn); reply != test.resp3 {
+			t.Errorf("%s: unexpected RESP3 reply %q", test.name, reply)
+		}
+	}
+
+	//a push message is framed as an array in RESP2, the elements are the same.
+	for _, resp := range []int{2, 3} {
+		c.resp = resp
+		addReplyPushLen(c, 2)
+		addReplyBulkCString(c, "message")
+		addReplyBulkCString(c, "hi")
+		expected := map[int]string{2: "*2\r\n", 3: ">2\r\n"}[resp] + "$7\r\nmessage\r\n$2\r\nhi\r\n"
+		if reply := testFlushReplies(c, conn); reply != expected {
+			t.Errorf("unexpected RESP%d push message %q", resp, reply)
+		}
+	}
+}
+
+func TestHelloCommand(t *testing.T) {
+	c, conn := setupNetworkingTest()
+
+	//HELLO without the version keeps the protocol of the connection.
+	testProcessCommand(c, "HELLO")
+	if reply := testFlushReplies(c, conn); c.resp != 2 || !strings.HasPrefix(reply, "*14\r\n") ||
+		!strings.Contains(reply, "$5\r\nproto\r\n:2\r\n") {
+		t.Fatalf("unexpected reply %q with protocol %d", reply, c.resp)
+	}
+
+	//HELLO 3 switches the connection to RESP3, the reply is already a map.
+	testProcessCommand(c, "HELLO 3 SETNAME conn1")
+	reply := testFlushReplies(c, conn)
+	if c.resp != 3 || c.name != "conn1" || !strings.HasPrefix(reply, "%7\r\n") ||
+		!strings.Contains(reply, "$5\r\nproto\r\n:3\r\n") || !strings.Contains(reply, "$4\r\nrole\r\n$6\r\nmaster\r\n") {
+		t.Fatalf("unexpected reply %q with protocol %d", reply, c.resp)
+	}
+	testProcessCommand(c, "GET missing")
+	if reply := testFlushReplies(c, conn); reply != "_\r\n" {
+		t.Errorf("unexpected RESP3 null %q", reply)
+	}
+
+	//the unsupported or invalid versions are refused and the protocol is kept.
+	testProcessCommand(c, "HELLO 4")
+	if reply := testFlushReplies(c, conn); !strings.HasPrefix(reply, "-NOPROTO ") || c.resp != 3 {
+		t.Errorf("unexpected reply %q to an unsupported version", reply)
+	}
+	testProcessCommand(c, "HELLO three")
+	if reply := testFlushReplies(c, conn); reply != "-ERR Protocol version is not an integer or out of range\r\n" || c.resp != 3 {
+		t.Errorf("unexpected reply %q to an invalid version", reply)
+	}
+
+	//back to RESP2, the map is a flat array.
+	testProcessCommand(c, "HELLO 2")
+	if reply := testFlushReplies(c, conn); c.resp != 2 || !strings.HasPrefix(reply, "*14\r\n") {
+		t.Errorf("unexpected reply %q with protocol %d", reply, c.resp)
+	}
+
+	//a replica reports its role.
+	server.masterhost = "127.0.0.1"
+	defer func() { server.masterhost = "" }()
+	testProcessCommand(c, "HELLO")
+	if reply := testFlushReplies(c, conn); !strings.Contains(reply, "$4\r\nrole\r\n$7\r\nreplica\r\n") {
+		t.Errorf("unexpected role in %q", reply)
+	}
+}
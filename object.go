@@ -15,7 +15,7 @@ func createStringObjectFromLongLong(value int64) *robj {
 	var o *robj
 	if value >= 0 && value < REDIS_SHARED_INTEGERS {
 		o = shared.integers[value]
-	} else if value >= math.MinInt64 && value < math.MaxInt64 {
+	} else if value >= math.MinInt64 && value <= math.MaxInt64 {
 		o = createObject(REDIS_STRING, nil)
 		o.encoding = REDIS_ENCODING_INT
 		i := interface{}(value)
@@ -24,6 +24,15 @@ func createStringObjectFromLongLong(value int64) *robj {
 	return o
 }
 
+// create the object of an element read from a listpack, the string is copied out of the listpack.
+func createStringObjectFromListpack(sval []byte, ival int64, isInt bool) *robj {
+	if isInt {
+		return createStringObjectFromLongLong(ival)
+	}
+	s := string(sval)
+	return createStringObject(&s, len(s))
+}
+
 func createStringObject(ptr *string, len int) *robj {
 	return createEmbeddedStringObject(ptr, len)
 }
@@ -73,14 +82,51 @@ func createObject(oType int, ptr *interface{}) *robj {
 	return o
 }
 
-func createListObject() *robj {
-	l := listCreate()
+// create a list encoded as a quicklist, with the fill factor and the compression depth of the server.
+func createQuicklistObject() *robj {
+	l := quicklistNew(server.listMaxListpackSize, server.listCompressDepth)
 	i := interface{}(l)
 	o := createObject(REDIS_LIST, &i)
-	o.encoding = REDIS_ENCODING_LINKEDLIST
+	o.encoding = REDIS_ENCODING_QUICKLIST
+	return o
+}
+
+// create an empty list encoded as a listpack, it is converted to a quicklist once it grows.
+func createListListpackObject() *robj {
+	lp := lpNew(0)
+	i := interface{}(lp)
+	o := createObject(REDIS_LIST, &i)
+	o.encoding = REDIS_ENCODING_LISTPACK
+	return o
+}
+
+// create an empty set encoded as a hash table.
+func createSetObject() *robj {
+	d := dictCreate(&setDictType, nil)
+	i := interface{}(d)
+	o := createObject(REDIS_SET, &i)
+	o.encoding = REDIS_ENCODING_HT
 	return o
 }
 
+// create an empty set encoded as an intset, it is converted to a hash table once it grows or gets a non integer member.
+func createIntsetObject() *robj {
+	is := intsetNew()
+	i := interface{}(is)
+	o := createObject(REDIS_SET, &i)
+	o.encoding = REDIS_ENCODING_INTSET
+	return o
+}
+
+// return true if the object is an integer or a string representing exactly an integer, which is stored in llval.
+func isObjectRepresentableAsLongLong(o *robj, llval *int64) bool {
+	if o.encoding == REDIS_ENCODING_INT {
+		*llval = (*o.ptr).(int64)
+		return true
+	}
+	return lpStringToInt64([]byte(o.String()), llval)
+}
+
 func createZsetObject() *robj {
 	zs := new(zset)
 	zs.dict = map[string]*float64{}
@@ -115,12 +161,47 @@ func getLongFromObjectOrReply(c *redisClient, o *robj, target *int64, msg *strin
 	return true
 }
 
+/*
+*
+get an integer in the [min, max] range from the object, msg is replied if the
+value is out of range, or a default message if msg is nil.
+*/
+func getRangeLongFromObjectOrReply(c *redisClient, o *robj, min int64, max int64, target *int64, msg *string) bool {
+	var value int64
+	if !getLongFromObjectOrReply(c, o, &value, nil) {
+		return false
+	}
+	if value < min || value > max {
+		if msg == nil {
+			errMsg := "value is out of range, must be between " + strconv.FormatInt(min, 10) + " and " + strconv.FormatInt(max, 10)
+			msg = &errMsg
+		}
+		addReplyError(c, msg)
+		return false
+	}
+	*target = value
+	return true
+}
+
+// get a non negative integer from the object.
+func getPositiveLongFromObjectOrReply(c *redisClient, o *robj, target *int64, msg *string) bool {
+	if msg == nil {
+		errMsg := "value is out of range, must be positive"
+		msg = &errMsg
+	}
+	return getRangeLongFromObjectOrReply(c, o, 0, math.MaxInt64, target, msg)
+}
+
 func getDoubleFromObjectOrReply(c *redisClient, o *robj, target *float64, msg *string) bool {
 	value, err := strconv.ParseFloat((*o.ptr).(string), 64)
 
-	if err != nil {
-		errMsg := "value is not a valid float"
-		addReplyError(c, &errMsg)
+	//nan不是合法的浮点数
+	if err != nil || math.IsNaN(value) {
+		if msg == nil {
+			errMsg := "value is not a valid float"
+			msg = &errMsg
+		}
+		addReplyError(c, msg)
 		return false
 	}
 
@@ -150,7 +231,10 @@ func getLongLongFromObjectOrReply(c *redisClient, expire string, target *int64,
 		return REDIS_ERR
 	}
 	if value < 0 {
-		*msg = "value is not an integer or out of range"
+		errMsg := "value is not an integer or out of range"
+		if msg == nil {
+			msg = &errMsg
+		}
 		addReplyError(c, msg)
 		return REDIS_ERR
 	}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"strings"
+)
+
+/*
+*
+the kind of Pub/Sub, the global channels and the shard channels share the same
+implementation: the type defines the subscriptions structures and the messages.
+*/
+type pubsubtype struct {
+	shard bool
+	//the channels of the client, and the number of subscriptions reported in the notifications.
+	clientPubSubChannels func(c *redisClient) map[string]*robj
+	subscriptionCount    func(c *redisClient) int
+	//the map of the channels to the list of subscribed clients.
+	serverPubSubChannels func() map[string]*list
+	subscribeMsg         string
+	unsubscribeMsg       string
+	messageBulk          string
+}
+
+// Pub/Sub type for global channels.
+var pubSubType = pubsubtype{
+	shard:                false,
+	clientPubSubChannels: getClientPubSubChannels,
+	subscriptionCount:    clientSubscriptionsCount,
+	serverPubSubChannels: func() map[string]*list { return server.pubsubChannels },
+	subscribeMsg:         "subscribe",
+	unsubscribeMsg:       "unsubscribe",
+	messageBulk:          "message",
+}
+
+/*
+*
+Pub/Sub type for shard level channels bounded to a slot, the channels of a
+command must hash to the same slot.
+*/
+var pubSubShardType = pubsubtype{
+	shard:                true,
+	clientPubSubChannels: getClientPubSubShardChannels,
+	subscriptionCount:    clientShardSubscriptionsCount,
+	serverPubSubChannels: func() map[string]*list { return server.pubsubshardChannels },
+	subscribeMsg:         "ssubscribe",
+	unsubscribeMsg:       "sunsubscribe",
+	messageBulk:          "smessage",
+}
+
+func getClientPubSubChannels(c *redisClient) map[string]*robj {
+	return c.pubsubChannels
+}
+
+func getClientPubSubShardChannels(c *redisClient) map[string]*robj {
+	return c.pubsubshardChannels
+}
+
+/*
+*
+return the number of channels + patterns a client is subscribed to.
+*/
+func clientSubscriptionsCount(c *redisClient) int {
+	return len(c.pubsubChannels) + len(c.pubsubPatterns)
+}
+
+/*
+*
+return the number of shard level channels a client is subscribed to.
+*/
+func clientShardSubscriptionsCount(c *redisClient) int {
+	return len(c.pubsubshardChannels)
+}
+
+// return the number of pubsub + pubsub shard level channels a client is subscribed to.
+func clientTotalPubSubSubscriptionCount(c *redisClient) int {
+	return clientSubscriptionsCount(c) + clientShardSubscriptionsCount(c)
+}
+
+/*
+*
+send the pubsub subscription notification to the client, the notification has
+the kind of subscription, the channel or the pattern, and the number of
+subscriptions of the client.
+*/
+func addReplyPubsubSubscribed(c *redisClient, channel *robj, t pubsubtype) {
+	addReplyPushLen(c, 3)
+	addReplyBulkCString(c, t.subscribeMsg)
+	addReplyBulk(c, channel)
+	addReplyLongLong(c, int64(t.subscriptionCount(c)))
+}
+
+/*
+*
+send the pubsub unsubscription notification to the client, channel can be nil:
+this is useful when the client sends a mass unsubscribe command but there are
+no channels to unsubscribe from.
+*/
+func addReplyPubsubUnsubscribed(c *redisClient, channel *robj, t pubsubtype) {
+	addReplyPushLen(c, 3)
+	addReplyBulkCString(c, t.unsubscribeMsg)
+	if channel != nil {
+		addReplyBulk(c, channel)
+	} else {
+		addReplyNull(c)
+	}
+	addReplyLongLong(c, int64(t.subscriptionCount(c)))
+}
+
+// send the pubsub pattern subscription notification to the client.
+func addReplyPubsubPatSubscribed(c *redisClient, pattern *robj) {
+	addReplyPushLen(c, 3)
+	addReplyBulkCString(c, "psubscribe")
+	addReplyBulk(c, pattern)
+	addReplyLongLong(c, int64(clientSubscriptionsCount(c)))
+}
+
+// send the pubsub pattern unsubscription notification to the client, pattern can be nil.
+func addReplyPubsubPatUnsubscribed(c *redisClient, pattern *robj) {
+	addReplyPushLen(c, 3)
+	addReplyBulkCString(c, "punsubscribe")
+	if pattern != nil {
+		addReplyBulk(c, pattern)
+	} else {
+		addReplyNull(c)
+	}
+	addReplyLongLong(c, int64(clientSubscriptionsCount(c)))
+}
+
+// send a pubsub message of type "message" or "smessage" to the client.
+func addReplyPubsubMessage(c *redisClient, channel *robj, msg *robj, messageBulk string) {
+	addReplyPushLen(c, 3)
+	addReplyBulkCString(c, messageBulk)
+	addReplyBulk(c, channel)
+	addReplyBulk(c, msg)
+}
+
+// send a pubsub message of type "pmessage" to the client, the pattern is the one that matched the channel.
+func addReplyPubsubPatMessage(c *redisClient, pat *robj, channel *robj, msg *robj) {
+	addReplyPushLen(c, 4)
+	addReplyBulkCString(c, "pmessage")
+	addReplyBulk(c, pat)
+	addReplyBulk(c, channel)
+	addReplyBulk(c, msg)
+}
+
+/*
+*
+subscribe a client to a channel. returns true if the operation succeeded, or
+false if the client was already subscribed to that channel.
+*/
+func pubsubSubscribeChannel(c *redisClient, channel *robj, t pubsubtype) bool {
+	retval := false
+	k := channel.String()
+	//add the channel to the client -> channels hash map.
+	if _, exists := t.clientPubSubChannels(c)[k]; !exists {
+		retval = true
+		t.clientPubSubChannels(c)[k] = channel
+		//add the client to the channel -> list of clients hash map.
+		clients := t.serverPubSubChannels()[k]
+		if clients == nil {
+			clients = listCreate()
+			t.serverPubSubChannels()[k] = clients
+		}
+		i := interface{}(c)
+		listAddNodeTail(clients, &i)
+	}
+	//notify the client.
+	addReplyPubsubSubscribed(c, channel, t)
+	return retval
+}
+
+/*
+*
+unsubscribe a client from a channel. returns true if the operation succeeded, or
+false if the client was not subscribed to the specified channel.
+*/
+func pubsubUnsubscribeChannel(c *redisClient, channel *robj, notify bool, t pubsubtype) bool {
+	retval := false
+	k := channel.String()
+	//remove the channel from the client -> channels hash map.
+	if _, exists := t.clientPubSubChannels(c)[k]; exists {
+		retval = true
+		delete(t.clientPubSubChannels(c), k)
+		//remove the client from the channel -> clients list hash map.
+		clients := t.serverPubSubChannels()[k]
+		if clients == nil {
+			panic("the channel is not in the server channels")
+		}
+		listDelNode(clients, listSearchKey(clients, c))
+		//free the list and associated hash entry at all if this was the latest client.
+		if listLength(clients) == 0 {
+			delete(t.serverPubSubChannels(), k)
+		}
+	}
+	//notify the client.
+	if notify {
+		addReplyPubsubUnsubscribed(c, channel, t)
+	}
+	return retval
+}
+
+/*
+*
+subscribe a client to a pattern. returns true if the operation succeeded, or
+false if the client was already subscribed to that pattern.
+*/
+func pubsubSubscribePattern(c *redisClient, pattern *robj) bool {
+	retval := false
+	k := pattern.String()
+	if _, exists := c.pubsubPatterns[k]; !exists {
+		retval = true
+		c.pubsubPatterns[k] = pattern
+		//add the client to the pattern -> list of clients hash map.
+		clients := server.pubsubPatterns[k]
+		if clients == nil {
+			clients = listCreate()
+			server.pubsubPatterns[k] = clients
+		}
+		i := interface{}(c)
+		listAddNodeTail(clients, &i)
+	}
+	//notify the client.
+	addReplyPubsubPatSubscribed(c, pattern)
+	return retval
+}
+
+/*
+*
+unsubscribe a client from a pattern. returns true if the operation succeeded, or
+false if the client was not subscribed to the specified pattern.
+*/
+func pubsubUnsubscribePattern(c *redisClient, pattern *robj, notify bool) bool {
+	retval := false
+	k := pattern.String()
+	if _, exists := c.pubsubPatterns[k]; exists {
+		retval = true
+		delete(c.pubsubPatterns, k)
+		//remove the client from the pattern -> clients list hash map.
+		clients := server.pubsubPatterns[k]
+		if clients == nil {
+			panic("the pattern is not in the server patterns")
+		}
+		listDelNode(clients, listSearchKey(clients, c))
+		if listLength(clients) == 0 {
+			delete(server.pubsubPatterns, k)
+		}
+	}
+	//notify the client.
+	if notify {
+		addReplyPubsubPatUnsubscribed(c, pattern)
+	}
+	return retval
+}
+
+/*
+*
+unsubscribe from all the channels of the given type. return the number of
+channels the client was subscribed to.
+*/
+func pubsubUnsubscribeAllChannelsInternal(c *redisClient, notify bool, t pubsubtype) int {
+	count := 0
+	for _, channel := range t.clientPubSubChannels(c) {
+		if pubsubUnsubscribeChannel(c, channel, notify, t) {
+			count++
+		}
+	}
+	//we were subscribed to nothing? still reply to the client.
+	if notify && count == 0 {
+		addReplyPubsubUnsubscribed(c, nil, t)
+	}
+	return count
+}
+
+// unsubscribe a client from all global channels.
+func pubsubUnsubscribeAllChannels(c *redisClient, notify bool) int {
+	return pubsubUnsubscribeAllChannelsInternal(c, notify, pubSubType)
+}
+
+// unsubscribe a client from all shard subscribed channels.
+func pubsubUnsubscribeShardAllChannels(c *redisClient, notify bool) int {
+	return pubsubUnsubscribeAllChannelsInternal(c, notify, pubSubShardType)
+}
+
+/*
+*
+unsubscribe from all the patterns. return the number of patterns the client
+was subscribed to.
+*/
+func pubsubUnsubscribeAllPatterns(c *redisClient, notify bool) int {
+	count := 0
+	for _, pattern := range c.pubsubPatterns {
+		if pubsubUnsubscribePattern(c, pattern, notify) {
+			count++
+		}
+	}
+	//we were subscribed to nothing? still reply to the client.
+	if notify && count == 0 {
+		addReplyPubsubPatUnsubscribed(c, nil)
+	}
+	return count
+}
+
+/*
+*
+publish a message to the clients subscribed to the channel, the global channels
+are also delivered to the clients subscribed to a pattern matching it.
+the number of receivers is returned.
+*/
+func pubsubPublishMessageInternal(channel *robj, message *robj, t pubsubtype) int64 {
+	var receivers int64
+	k := channel.String()
+	//send to clients listening for that channel.
+	if clients := t.serverPubSubChannels()[k]; clients != nil {
+		for ln := listFirst(clients); ln != nil; ln = ln.next {
+			addReplyPubsubMessage((*ln.value).(*redisClient), channel, message, t.messageBulk)
+			receivers++
+		}
+	}
+	if t.shard {
+		//shard pubsub ignores patterns.
+		return receivers
+	}
+	//send to clients listening to matching channels.
+	for pattern, clients := range server.pubsubPatterns {
+		if !stringmatchlen(pattern, k, false) {
+			continue
+		}
+		pat := createStringObject(&pattern, len(pattern))
+		for ln := listFirst(clients); ln != nil; ln = ln.next {
+			addReplyPubsubPatMessage((*ln.value).(*redisClient), pat, channel, message)
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// publish a message to all the subscribers.
+func pubsubPublishMessage(channel *robj, message *robj) int64 {
+	return pubsubPublishMessageInternal(channel, message, pubSubType)
+}
+
+/*
+*
+the shard channels of a command are bound to the same hash slot, as a cluster
+would redirect the command otherwise. false is returned after replying with an
+error if they don't.
+*/
+func pubsubCheckShardChannelsSlot(c *redisClient, first uint64) bool {
+	var j uint64
+	for j = first + 1; j < c.argc; j++ {
+		if keyHashSlot(c.argv[j].String()) != keyHashSlot(c.argv[first].String()) {
+			addReplyErrorWithCode(c, "CROSSSLOT Keys in request don't hash to the same slot")
+			return false
+		}
+	}
+	return true
+}
+
+/*
+*
+SUBSCRIBE channel [channel ...]
+*/
+func subscribeCommand(c *redisClient) {
+	var j uint64
+	for j = 1; j < c.argc; j++ {
+		pubsubSubscribeChannel(c, c.argv[j], pubSubType)
+	}
+	c.flags |= REDIS_PUBSUB
+}
+
+/*
+*
+UNSUBSCRIBE [channel ...]
+*/
+func unsubscribeCommand(c *redisClient) {
+	if c.argc == 1 {
+		pubsubUnsubscribeAllChannels(c, true)
+	} else {
+		var j uint64
+		for j = 1; j < c.argc; j++ {
+			pubsubUnsubscribeChannel(c, c.argv[j], true, pubSubType)
+		}
+	}
+	if clientTotalPubSubSubscriptionCount(c) == 0 {
+		c.flags &^= REDIS_PUBSUB
+	}
+}
+
+/*
+*
+PSUBSCRIBE pattern [pattern ...]
+*/
+func psubscribeCommand(c *redisClient) {
+	var j uint64
+	for j = 1; j < c.argc; j++ {
+		pubsubSubscribePattern(c, c.argv[j])
+	}
+	c.flags |= REDIS_PUBSUB
+}
+
+/*
+*
+PUNSUBSCRIBE [pattern [pattern ...]]
+*/
+func punsubscribeCommand(c *redisClient) {
+	if c.argc == 1 {
+		pubsubUnsubscribeAllPatterns(c, true)
+	} else {
+		var j uint64
+		for j = 1; j < c.argc; j++ {
+			pubsubUnsubscribePattern(c, c.argv[j], true)
+		}
+	}
+	if clientTotalPubSubSubscriptionCount(c) == 0 {
+		c.flags &^= REDIS_PUBSUB
+	}
+}
+
+/*
+*
+PUBLISH channel message
+the message is propagated to the replicas, so that their subscribers receive it too.
+*/
+func publishCommand(c *redisClient) {
+	receivers := pubsubPublishMessage(c.argv[1], c.argv[2])
+	forceCommandPropagation(c, REDIS_PROPAGATE_REPL)
+	addReplyLongLong(c, receivers)
+}
+
+/*
+*
+SSUBSCRIBE shardchannel [shardchannel ...]
+*/
+func ssubscribeCommand(c *redisClient) {
+	if !pubsubCheckShardChannelsSlot(c, 1) {
+		return
+	}
+	var j uint64
+	for j = 1; j < c.argc; j++ {
+		pubsubSubscribeChannel(c, c.argv[j], pubSubShardType)
+	}
+	c.flags |= REDIS_PUBSUB
+}
+
+/*
+*
+SUNSUBSCRIBE [shardchannel [shardchannel ...]]
+*/
+func sunsubscribeCommand(c *redisClient) {
+	if c.argc == 1 {
+		pubsubUnsubscribeShardAllChannels(c, true)
+	} else {
+		if !pubsubCheckShardChannelsSlot(c, 1) {
+			return
+		}
+		var j uint64
+		for j = 1; j < c.argc; j++ {
+			pubsubUnsubscribeChannel(c, c.argv[j], true, pubSubShardType)
+		}
+	}
+	if clientTotalPubSubSubscriptionCount(c) == 0 {
+		c.flags &^= REDIS_PUBSUB
+	}
+}
+
+/*
+*
+SPUBLISH shardchannel message
+*/
+func spublishCommand(c *redisClient) {
+	receivers := pubsubPublishMessageInternal(c.argv[1], c.argv[2], pubSubShardType)
+	forceCommandPropagation(c, REDIS_PROPAGATE_REPL)
+	addReplyLongLong(c, receivers)
+}
+
+// reply with the channels of the map matching the pattern, every channel if the pattern is nil.
+func channelList(c *redisClient, pattern *robj, channels map[string]*list) {
+	matches := make([]string, 0)
+	for channel := range channels {
+		if pattern == nil || stringmatchlen(pattern.String(), channel, false) {
+			matches = append(matches, channel)
+		}
+	}
+	addReplyMultiBulkLen(c, int64(len(matches)))
+	for _, channel := range matches {
+		addReplyBulkCString(c, channel)
+	}
+}
+
+// reply with the number of subscribers of each channel given as argument.
+func channelNumsub(c *redisClient, channels map[string]*list) {
+	addReplyMultiBulkLen(c, int64(c.argc-2)*2)
+	var j uint64
+	for j = 2; j < c.argc; j++ {
+		addReplyBulk(c, c.argv[j])
+		var subscribers int64
+		if clients := channels[c.argv[j].String()]; clients != nil {
+			subscribers = listLength(clients)
+		}
+		addReplyLongLong(c, subscribers)
+	}
+}
+
+/*
+*
+PUBSUB CHANNELS [pattern]
+PUBSUB NUMSUB [channel [channel ...]]
+PUBSUB NUMPAT
+PUBSUB SHARDCHANNELS [pattern]
+PUBSUB SHARDNUMSUB [shardchannel [shardchannel ...]]
+*/
+func pubsubCommand(c *redisClient) {
+	subcommand := strings.ToUpper((*c.argv[1].ptr).(string))
+	var pattern *robj
+	if c.argc == 3 {
+		pattern = c.argv[2]
+	}
+	if subcommand == "CHANNELS" && (c.argc == 2 || c.argc == 3) {
+		//PUBSUB CHANNELS [<pattern>]
+		channelList(c, pattern, server.pubsubChannels)
+	} else if subcommand == "NUMSUB" && c.argc >= 2 {
+		//PUBSUB NUMSUB [Channel_1 ... Channel_N]
+		channelNumsub(c, server.pubsubChannels)
+	} else if subcommand == "NUMPAT" && c.argc == 2 {
+		//PUBSUB NUMPAT
+		addReplyLongLong(c, int64(len(server.pubsubPatterns)))
+	} else if subcommand == "SHARDCHANNELS" && (c.argc == 2 || c.argc == 3) {
+		//PUBSUB SHARDCHANNELS [<pattern>]
+		channelList(c, pattern, server.pubsubshardChannels)
+	} else if subcommand == "SHARDNUMSUB" && c.argc >= 2 {
+		//PUBSUB SHARDNUMSUB [ShardChannel_1 ... ShardChannel_N]
+		channelNumsub(c, server.pubsubshardChannels)
+	} else {
+		reply := "unknown subcommand or wrong number of arguments for '" + (*c.argv[1].ptr).(string) + "'"
+		addReplyError(c, &reply)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPubsub(t *testing.T) {
+	setupTestServer()
+	server.pubsubChannels = make(map[string]*list)
+	server.pubsubPatterns = make(map[string]*list)
+	server.pubsubshardChannels = make(map[string]*list)
+	c, sub := newTestClient(t)
+	_, pub := newTestClient(t)
+
+	if reply := sub("SUBSCRIBE news sport"); reply != "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$5\r\nsport\r\n:2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := sub("PSUBSCRIBE n*"); reply != "*3\r\n$10\r\npsubscribe\r\n$2\r\nn*\r\n:3\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	//only the subscription commands are allowed in the context of Pub/Sub.
+	if reply := sub("GET a"); reply != "-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING are allowed in this context\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := sub("PING"); reply != "*2\r\n$4\r\npong\r\n$0\r\n\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	//the message is received once for the channel and once for the pattern.
+	if reply := pub("PUBLISH news hello"); reply != ":2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := string(c.buf); reply != "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n"+
+		"*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$5\r\nhello\r\n" {
+		t.Errorf("unexpected messages %q", reply)
+	}
+	c.buf = c.buf[:0]
+	if reply := pub("PUBLISH other hello"); reply != ":0\r\n" || len(c.buf) != 0 {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	if reply := pub("PUBSUB CHANNELS s*"); reply != "*1\r\n$5\r\nsport\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := pub("PUBSUB NUMSUB news other"); reply != "*4\r\n$4\r\nnews\r\n:1\r\n$5\r\nother\r\n:0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := pub("PUBSUB NUMPAT"); reply != ":1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	//the client leaves the Pub/Sub context once it has no subscriptions left.
+	sub("UNSUBSCRIBE")
+	if reply := sub("PUNSUBSCRIBE n*"); reply != "*3\r\n$12\r\npunsubscribe\r\n$2\r\nn*\r\n:0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if c.flags&REDIS_PUBSUB > 0 || len(server.pubsubChannels) != 0 || len(server.pubsubPatterns) != 0 {
+		t.Error("the client is still subscribed")
+	}
+	if reply := sub("UNSUBSCRIBE"); reply != "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestShardPubsub(t *testing.T) {
+	setupTestServer()
+	server.pubsubChannels = make(map[string]*list)
+	server.pubsubPatterns = make(map[string]*list)
+	server.pubsubshardChannels = make(map[string]*list)
+	c, sub := newTestClient(t)
+	_, pub := newTestClient(t)
+
+	//the channels of a command must be in the same slot.
+	if reply := sub("SSUBSCRIBE {user1}.a {user2}.b"); reply != "-CROSSSLOT Keys in request don't hash to the same slot\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := sub("SSUBSCRIBE {user1}.a {user1}.b"); reply != "*3\r\n$10\r\nssubscribe\r\n$9\r\n{user1}.a\r\n:1\r\n*3\r\n$10\r\nssubscribe\r\n$9\r\n{user1}.b\r\n:2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	//the shard channels are not counted by the global subscriptions and ignore the patterns.
+	if reply := sub("PSUBSCRIBE *"); reply != "*3\r\n$10\r\npsubscribe\r\n$1\r\n*\r\n:1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := pub("SPUBLISH {user1}.a hi"); reply != ":1\r\n" || string(c.buf) != "*3\r\n$8\r\nsmessage\r\n$9\r\n{user1}.a\r\n$2\r\nhi\r\n" {
+		t.Errorf("unexpected reply %q, message %q", reply, c.buf)
+	}
+	c.buf = c.buf[:0]
+	//a global channel with the same name is a different channel.
+	if reply := pub("PUBLISH {user1}.a hi"); reply != ":1\r\n" || string(c.buf) != "*4\r\n$8\r\npmessage\r\n$1\r\n*\r\n$9\r\n{user1}.a\r\n$2\r\nhi\r\n" {
+		t.Errorf("unexpected reply %q, message %q", reply, c.buf)
+	}
+	c.buf = c.buf[:0]
+
+	if reply := pub("PUBSUB SHARDCHANNELS *.a"); reply != "*1\r\n$9\r\n{user1}.a\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := pub("PUBSUB SHARDNUMSUB {user1}.b x"); reply != "*4\r\n$9\r\n{user1}.b\r\n:1\r\n$1\r\nx\r\n:0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := pub("PUBSUB CHANNELS"); reply != "*0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	sub("SUNSUBSCRIBE")
+	if len(server.pubsubshardChannels) != 0 || c.flags&REDIS_PUBSUB == 0 {
+		t.Error("unexpected subscriptions state")
+	}
+	sub("PUNSUBSCRIBE")
+	if c.flags&REDIS_PUBSUB > 0 {
+		t.Error("the client is still in the Pub/Sub context")
+	}
+}
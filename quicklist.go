@@ -0,0 +1,786 @@
+package main
+
+import (
+	"math"
+)
+
+/*
+*
+quicklist, a doubly linked list of listpacks: every node holds a listpack of a
+limited size, so that the list has the memory efficiency of the listpack and
+the O(1) push and pop of the linked list even for millions of elements.
+
+the nodes in the middle of the list can be compressed with LZF, the depth is the
+number of nodes at both ends of the list that are never compressed, as they are
+the ones accessed by the push and pop operations.
+*/
+const (
+	QUICKLIST_NODE_ENCODING_RAW = 1
+	QUICKLIST_NODE_ENCODING_LZF = 2
+
+	QUICKLIST_HEAD = 0
+	QUICKLIST_TAIL = -1
+
+	/* Iterator directions */
+	AL_START_HEAD = 0
+	AL_START_TAIL = 1
+
+	//maximum size in bytes of any multi-element listpack, used when the fill factor is a count of elements.
+	SIZE_SAFETY_LIMIT = 8192
+	//minimum listpack size in bytes for attempting compression.
+	MIN_COMPRESS_BYTES = 48
+	//minimum size reduction in bytes to store the compressed listpack.
+	MIN_COMPRESS_IMPROVE = 8
+)
+
+// the max size of the listpack of a node for the negative fill factors -1 to -5.
+var optimizationLevel = []int{4096, 8192, 16384, 32768, 65536}
+
+type quicklistNode struct {
+	prev *quicklistNode
+	next *quicklistNode
+	//the listpack of the node, LZF compressed if encoding is QUICKLIST_NODE_ENCODING_LZF.
+	entry []byte
+	//listpack size in bytes, even when the node is compressed.
+	sz int
+	//count of elements in the listpack.
+	count    int
+	encoding int
+	//the node was compressed, and was temporarily decompressed for usage.
+	recompress bool
+}
+
+type quicklist struct {
+	head *quicklistNode
+	tail *quicklistNode
+	//total count of all the elements in all the listpacks.
+	count int64
+	//number of quicklistNodes.
+	len int64
+	//fill factor for individual nodes, positive is a count of elements, negative a size class.
+	fill int
+	//depth of end nodes not to compress, 0 means compression is disabled.
+	compress int
+}
+
+type quicklistIter struct {
+	ql      *quicklist
+	current *quicklistNode
+	//the offset of the current element in the listpack of the current node, -1 if it must be seeked.
+	zi int
+	//index of the current element in the listpack, negative when iterating from the tail.
+	offset    int
+	direction int
+}
+
+// an element returned by quicklistNext.
+type quicklistEntry struct {
+	ql   *quicklist
+	node *quicklistNode
+	zi   int
+	//the string value, or the integer value if isInt is true.
+	value   []byte
+	longval int64
+	isInt   bool
+	offset  int
+}
+
+// create a new quicklist with the specified fill factor and compression depth.
+func quicklistNew(fill int, compress int) *quicklist {
+	return &quicklist{fill: fill, compress: compress}
+}
+
+// create a new quicklist with the default fill factor and no compression.
+func quicklistCreate() *quicklist {
+	return quicklistNew(-2, 0)
+}
+
+func quicklistCreateNode() *quicklistNode {
+	return &quicklistNode{encoding: QUICKLIST_NODE_ENCODING_RAW}
+}
+
+// return the total count of the elements in the quicklist.
+func quicklistCount(ql *quicklist) int64 {
+	return ql.count
+}
+
+func quicklistNodeUpdateSz(node *quicklistNode) {
+	node.sz = lpBytes(node.entry)
+}
+
+/*
+*
+compress the listpack of the node, true is returned if it was compressed: the
+listpacks too small or that don't compress well are left raw.
+*/
+func quicklistCompressNode(node *quicklistNode) bool {
+	if node == nil || node.encoding != QUICKLIST_NODE_ENCODING_RAW {
+		return false
+	}
+	node.recompress = false
+	//don't bother compressing small values.
+	if node.sz < MIN_COMPRESS_BYTES {
+		return false
+	}
+	//the compressed data must be smaller than the original by at least MIN_COMPRESS_IMPROVE bytes.
+	compressed := lzfCompress(node.entry[:node.sz], node.sz-MIN_COMPRESS_IMPROVE)
+	if compressed == nil {
+		return false
+	}
+	node.entry = compressed
+	node.encoding = QUICKLIST_NODE_ENCODING_LZF
+	return true
+}
+
+// uncompress the listpack of the node.
+func quicklistDecompressNode(node *quicklistNode) {
+	if node == nil || node.encoding != QUICKLIST_NODE_ENCODING_LZF {
+		return
+	}
+	decompressed, err := lzfDecompress(node.entry, node.sz)
+	if err != nil {
+		panic("Corrupted quicklist node")
+	}
+	node.entry = decompressed
+	node.encoding = QUICKLIST_NODE_ENCODING_RAW
+}
+
+// uncompress the node and mark it for recompression once it was used.
+func quicklistDecompressNodeForUse(node *quicklistNode) {
+	if node != nil && node.encoding == QUICKLIST_NODE_ENCODING_LZF {
+		quicklistDecompressNode(node)
+		node.recompress = true
+	}
+}
+
+// compress the node again only if it was compressed before being used.
+func quicklistRecompressOnly(node *quicklistNode) {
+	if node != nil && node.recompress {
+		quicklistCompressNode(node)
+	}
+}
+
+/*
+*
+force the nodes within the compression depth at both ends of the list to be raw,
+and compress the node if it is outside that depth. the nodes just beyond the
+depth are compressed as well, since they may have just left the depth after an
+insertion or a deletion.
+*/
+func __quicklistCompress(ql *quicklist, node *quicklistNode) {
+	//if length is less than our compress depth (from both sides), we can't compress anything.
+	if ql.compress == 0 || ql.len < int64(ql.compress*2) {
+		return
+	}
+
+	//iterate until we reach compress depth for both sides of the list.
+	forward := ql.head
+	reverse := ql.tail
+	inDepth := false
+	for depth := 0; depth < ql.compress; depth++ {
+		quicklistDecompressNode(forward)
+		quicklistDecompressNode(reverse)
+		if forward == node || reverse == node {
+			inDepth = true
+		}
+		//we passed into compress depth of opposite side of the quicklist so there's no need to compress anything and we can exit.
+		if forward == reverse || forward.next == reverse {
+			return
+		}
+		forward = forward.next
+		reverse = reverse.prev
+	}
+	if !inDepth && node != nil {
+		quicklistCompressNode(node)
+	}
+	//at this point, forward and reverse are one node beyond depth.
+	quicklistCompressNode(forward)
+	quicklistCompressNode(reverse)
+}
+
+func quicklistCompress(ql *quicklist, node *quicklistNode) {
+	if node != nil && node.recompress {
+		quicklistCompressNode(node)
+	} else {
+		__quicklistCompress(ql, node)
+	}
+}
+
+// insert the new node before or after the old node, or as the only node if the quicklist is empty.
+func __quicklistInsertNode(ql *quicklist, oldNode *quicklistNode, newNode *quicklistNode, after bool) {
+	if after {
+		newNode.prev = oldNode
+		if oldNode != nil {
+			newNode.next = oldNode.next
+			if oldNode.next != nil {
+				oldNode.next.prev = newNode
+			}
+			oldNode.next = newNode
+		}
+		if ql.tail == oldNode {
+			ql.tail = newNode
+		}
+	} else {
+		newNode.next = oldNode
+		if oldNode != nil {
+			newNode.prev = oldNode.prev
+			if oldNode.prev != nil {
+				oldNode.prev.next = newNode
+			}
+			oldNode.prev = newNode
+		}
+		if ql.head == oldNode {
+			ql.head = newNode
+		}
+	}
+	//if this insert creates the only element so far, initialize head/tail.
+	if ql.len == 0 {
+		ql.head = newNode
+		ql.tail = newNode
+	}
+	//update len first, so in __quicklistCompress we know exactly len.
+	ql.len++
+	if oldNode != nil {
+		quicklistCompress(ql, oldNode)
+	}
+	quicklistCompress(ql, newNode)
+}
+
+// remove the node from the quicklist, its elements are subtracted from the count.
+func __quicklistDelNode(ql *quicklist, node *quicklistNode) {
+	if node.next != nil {
+		node.next.prev = node.prev
+	}
+	if node.prev != nil {
+		node.prev.next = node.next
+	}
+	if node == ql.tail {
+		ql.tail = node.prev
+	}
+	if node == ql.head {
+		ql.head = node.next
+	}
+	ql.len--
+	ql.count -= int64(node.count)
+	//if we deleted a node within our compress depth, we now have compressed nodes needing to be decompressed.
+	__quicklistCompress(ql, nil)
+	node.prev = nil
+	node.next = nil
+}
+
+// the max size in bytes and the max count of elements of a node for the fill factor.
+func quicklistNodeLimit(fill int) (szLimit int, countLimit int) {
+	if fill >= 0 {
+		//ensure that one node have at least one entry.
+		if fill == 0 {
+			fill = 1
+		}
+		return SIZE_SAFETY_LIMIT, fill
+	}
+	offset := -fill - 1
+	if offset >= len(optimizationLevel) {
+		offset = len(optimizationLevel) - 1
+	}
+	return optimizationLevel[offset], math.MaxInt
+}
+
+// check if a listpack of the specified size and count of elements exceeds the limits of the fill factor.
+func quicklistNodeExceedsLimit(fill int, newSz int, newCount int) bool {
+	szLimit, countLimit := quicklistNodeLimit(fill)
+	return newSz > szLimit || newCount > countLimit
+}
+
+// check if an element of the specified size can be added to the node without exceeding the limits.
+func _quicklistNodeAllowInsert(node *quicklistNode, fill int, sz int) bool {
+	if node == nil {
+		return false
+	}
+	//the estimated size of the new entry: the data plus the largest encoding and backlen.
+	newSz := node.sz + sz + 5 + lpEncodeBacklenSize(sz+5)
+	return !quicklistNodeExceedsLimit(fill, newSz, node.count+1)
+}
+
+/*
+*
+add a new element to the head of the quicklist, true is returned if a new head
+node was created.
+*/
+func quicklistPushHead(ql *quicklist, value []byte) bool {
+	origHead := ql.head
+	if _quicklistNodeAllowInsert(ql.head, ql.fill, len(value)) {
+		ql.head.entry = lpPrepend(ql.head.entry, value)
+		quicklistNodeUpdateSz(ql.head)
+	} else {
+		node := quicklistCreateNode()
+		node.entry = lpPrepend(lpNew(0), value)
+		quicklistNodeUpdateSz(node)
+		__quicklistInsertNode(ql, ql.head, node, false)
+	}
+	ql.count++
+	ql.head.count++
+	return origHead != ql.head
+}
+
+// add a new element to the tail of the quicklist, true is returned if a new tail node was created.
+func quicklistPushTail(ql *quicklist, value []byte) bool {
+	origTail := ql.tail
+	if _quicklistNodeAllowInsert(ql.tail, ql.fill, len(value)) {
+		ql.tail.entry = lpAppend(ql.tail.entry, value)
+		quicklistNodeUpdateSz(ql.tail)
+	} else {
+		node := quicklistCreateNode()
+		node.entry = lpAppend(lpNew(0), value)
+		quicklistNodeUpdateSz(node)
+		__quicklistInsertNode(ql, ql.tail, node, true)
+	}
+	ql.count++
+	ql.tail.count++
+	return origTail != ql.tail
+}
+
+// push the value at the head (QUICKLIST_HEAD) or at the tail (QUICKLIST_TAIL) of the quicklist.
+func quicklistPush(ql *quicklist, value []byte, where int) {
+	if where == QUICKLIST_HEAD {
+		quicklistPushHead(ql, value)
+	} else if where == QUICKLIST_TAIL {
+		quicklistPushTail(ql, value)
+	}
+}
+
+// append the listpack as a new tail node, used to convert a listpack into a quicklist.
+func quicklistAppendListpack(ql *quicklist, lp []byte) {
+	node := quicklistCreateNode()
+	node.entry = lp
+	node.count = lpLength(lp)
+	quicklistNodeUpdateSz(node)
+	__quicklistInsertNode(ql, ql.tail, node, true)
+	ql.count += int64(node.count)
+}
+
+/*
+*
+delete the element at the offset p of the listpack of the node, p is updated to
+the offset of the next element. true is returned if the node was deleted as it
+became empty.
+*/
+func quicklistDelIndex(ql *quicklist, node *quicklistNode, p *int) bool {
+	gone := false
+	node.entry, *p = lpDelete(node.entry, *p)
+	node.count--
+	if node.count == 0 {
+		gone = true
+		__quicklistDelNode(ql, node)
+	} else {
+		quicklistNodeUpdateSz(node)
+	}
+	ql.count--
+	//if we deleted the node, the original node is no longer valid.
+	return gone
+}
+
+// delete the node if it has no elements left, node is set to nil in this case.
+func quicklistDelNodeIfEmpty(ql *quicklist, node **quicklistNode) {
+	if (*node).count == 0 {
+		__quicklistDelNode(ql, *node)
+		*node = nil
+	}
+}
+
+/*
+*
+split the node in two halves when it exceeds the limits of the fill factor, the
+second half is moved to a new node inserted after it.
+*/
+func _quicklistSplitNodeIfNeeded(ql *quicklist, node *quicklistNode) {
+	if node.count < 2 || !quicklistNodeExceedsLimit(ql.fill, node.sz, node.count) {
+		return
+	}
+	half := node.count / 2
+	newNode := quicklistCreateNode()
+	newNode.entry = lpDeleteRange(lpDup(node.entry), 0, half)
+	newNode.count = node.count - half
+	quicklistNodeUpdateSz(newNode)
+
+	node.entry = lpDeleteRange(node.entry, half, node.count-half)
+	node.count = half
+	quicklistNodeUpdateSz(node)
+	__quicklistInsertNode(ql, node, newNode, true)
+}
+
+// check if the two nodes can be merged without exceeding the limits of the fill factor.
+func _quicklistNodeAllowMerge(a *quicklistNode, b *quicklistNode, fill int) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	//approximate merged listpack size, the header and the end of one of the listpacks are dropped.
+	mergeSz := a.sz + b.sz - LP_HDR_SIZE - 1
+	return !quicklistNodeExceedsLimit(fill, mergeSz, a.count+b.count)
+}
+
+// move the elements of the node b at the end of the node a, the node b is deleted.
+func _quicklistListpackMerge(ql *quicklist, a *quicklistNode, b *quicklistNode) {
+	quicklistDecompressNode(a)
+	quicklistDecompressNode(b)
+	a.entry = lpMerge(a.entry, b.entry)
+	a.count += b.count
+	quicklistNodeUpdateSz(a)
+	//the elements of b are now counted in a, __quicklistDelNode subtracts them from the count.
+	b.count = 0
+	__quicklistDelNode(ql, b)
+	quicklistCompress(ql, a)
+}
+
+/*
+*
+merge the node with its previous and next nodes when they fit together within
+the limits, so that a node left small by an update doesn't waste memory.
+*/
+func _quicklistMergeNodes(ql *quicklist, center *quicklistNode) {
+	if _quicklistNodeAllowMerge(center.prev, center, ql.fill) {
+		prev := center.prev
+		_quicklistListpackMerge(ql, prev, center)
+		center = prev
+	}
+	if _quicklistNodeAllowMerge(center, center.next, ql.fill) {
+		_quicklistListpackMerge(ql, center, center.next)
+	}
+}
+
+// return an iterator starting at the head (AL_START_HEAD) or at the tail (AL_START_TAIL) of the quicklist.
+func quicklistGetIterator(ql *quicklist, direction int) *quicklistIter {
+	iter := &quicklistIter{ql: ql, zi: -1, direction: direction}
+	if direction == AL_START_HEAD {
+		iter.current = ql.head
+		iter.offset = 0
+	} else {
+		iter.current = ql.tail
+		iter.offset = -1
+	}
+	return iter
+}
+
+/*
+*
+return an iterator starting at the element at the specified index, a negative
+index counts from the tail. nil is returned if the index is out of range.
+*/
+func quicklistGetIteratorAtIdx(ql *quicklist, direction int, idx int64) *quicklistIter {
+	forward := idx >= 0
+	var index int64
+	if forward {
+		index = idx
+	} else {
+		index = -idx - 1
+	}
+	if index >= ql.count {
+		return nil
+	}
+
+	//seek in the other direction if that way is shorter.
+	seekForward := forward
+	seekIndex := index
+	if index > (ql.count-1)/2 {
+		seekForward = !forward
+		seekIndex = ql.count - 1 - index
+	}
+	var accum int64
+	n := ql.head
+	if !seekForward {
+		n = ql.tail
+	}
+	for n != nil {
+		if accum+int64(n.count) > seekIndex {
+			break
+		}
+		accum += int64(n.count)
+		if seekForward {
+			n = n.next
+		} else {
+			n = n.prev
+		}
+	}
+	if n == nil {
+		return nil
+	}
+	//fix accum so it looks like we seeked in the other direction.
+	if seekForward != forward {
+		accum = ql.count - int64(n.count) - accum
+	}
+
+	iter := quicklistGetIterator(ql, direction)
+	iter.current = n
+	if forward {
+		//forward = normal head-to-tail offset.
+		iter.offset = int(index - accum)
+	} else {
+		//reverse = need negative offset for tail-to-head, so undo the result of the original index = (-idx) - 1 above.
+		iter.offset = int(-index - 1 + accum)
+	}
+	return iter
+}
+
+// release the iterator, the node it was pointing to is compressed again if needed.
+func quicklistReleaseIterator(iter *quicklistIter) {
+	if iter != nil && iter.current != nil {
+		quicklistCompress(iter.ql, iter.current)
+	}
+}
+
+/*
+*
+get the next element of the iterator, false is returned when there are no
+elements left. the quicklist must not be modified while iterating, except for
+the deletion of the current element with quicklistDelEntry.
+*/
+func quicklistNext(iter *quicklistIter, entry *quicklistEntry) bool {
+	*entry = quicklistEntry{zi: -1}
+	if iter == nil {
+		return false
+	}
+	entry.ql = iter.ql
+	entry.node = iter.current
+	for iter.current != nil {
+		entry.node = iter.current
+		if iter.zi == -1 {
+			//if there is no current offset, seek the current index.
+			quicklistDecompressNodeForUse(iter.current)
+			iter.zi = lpSeek(iter.current.entry, iter.offset)
+		} else if iter.direction == AL_START_HEAD {
+			//else, use existing iterator offset and get prev/next as necessary.
+			iter.zi = lpNext(iter.current.entry, iter.zi)
+			iter.offset++
+		} else {
+			iter.zi = lpPrev(iter.current.entry, iter.zi)
+			iter.offset--
+		}
+
+		entry.zi = iter.zi
+		entry.offset = iter.offset
+		if iter.zi != -1 {
+			//populate value from existing listpack position.
+			entry.value, entry.longval, entry.isInt = lpGet(iter.current.entry, iter.zi)
+			return true
+		}
+		//we ran out of listpack entries, pick next node, update offset, then re-run retrieval.
+		quicklistCompress(iter.ql, iter.current)
+		if iter.direction == AL_START_HEAD {
+			iter.current = iter.current.next
+			iter.offset = 0
+		} else {
+			iter.current = iter.current.prev
+			iter.offset = -1
+		}
+		iter.zi = -1
+	}
+	return false
+}
+
+/*
+*
+delete the element returned by quicklistNext, the iterator moves to the next
+element so that the iteration can continue.
+*/
+func quicklistDelEntry(iter *quicklistIter, entry *quicklistEntry) {
+	prev := entry.node.prev
+	next := entry.node.next
+	deletedNode := quicklistDelIndex(entry.ql, entry.node, &entry.zi)
+	//after delete, the zi is now invalid for any future usage.
+	iter.zi = -1
+	/**
+	if current node is deleted, we must update iterator node and offset, otherwise the offset
+	already points to the next element: the elements after the deleted one were shifted.
+	*/
+	if deletedNode {
+		if iter.direction == AL_START_HEAD {
+			iter.current = next
+			iter.offset = 0
+		} else {
+			iter.current = prev
+			iter.offset = -1
+		}
+	}
+}
+
+/*
+*
+insert a new element before or after the element returned by quicklistNext, the
+iterator can't be used anymore after the insertion.
+*/
+func _quicklistInsert(iter *quicklistIter, entry *quicklistEntry, value []byte, after bool) {
+	ql := entry.ql
+	node := entry.node
+	if node == nil {
+		//no node to insert around, the quicklist is empty.
+		quicklistPushHead(ql, value)
+		iter.current = nil
+		return
+	}
+	quicklistDecompressNodeForUse(node)
+	where := LP_BEFORE
+	if after {
+		where = LP_AFTER
+	}
+	node.entry, _ = lpInsert(node.entry, value, entry.zi, where)
+	node.count++
+	quicklistNodeUpdateSz(node)
+	ql.count++
+	_quicklistSplitNodeIfNeeded(ql, node)
+	quicklistCompress(ql, node)
+	_quicklistMergeNodes(ql, node)
+	//in any case, we reset iterator to forbid use of iterator after insert.
+	iter.current = nil
+	iter.zi = -1
+}
+
+func quicklistInsertBefore(iter *quicklistIter, entry *quicklistEntry, value []byte) {
+	_quicklistInsert(iter, entry, value, false)
+}
+
+func quicklistInsertAfter(iter *quicklistIter, entry *quicklistEntry, value []byte) {
+	_quicklistInsert(iter, entry, value, true)
+}
+
+// replace the element returned by quicklistNext, the iterator can't be used anymore.
+func quicklistReplaceEntry(iter *quicklistIter, entry *quicklistEntry, value []byte) {
+	ql := entry.ql
+	node := entry.node
+	quicklistDecompressNodeForUse(node)
+	node.entry, _ = lpReplace(node.entry, entry.zi, value)
+	quicklistNodeUpdateSz(node)
+	_quicklistSplitNodeIfNeeded(ql, node)
+	quicklistCompress(ql, node)
+	_quicklistMergeNodes(ql, node)
+	iter.current = nil
+	iter.zi = -1
+}
+
+// replace the element at the index, false is returned if the index is out of range.
+func quicklistReplaceAtIndex(ql *quicklist, index int64, value []byte) bool {
+	var entry quicklistEntry
+	iter := quicklistGetIteratorAtIdx(ql, AL_START_TAIL, index)
+	if !quicklistNext(iter, &entry) {
+		quicklistReleaseIterator(iter)
+		return false
+	}
+	quicklistReplaceEntry(iter, &entry, value)
+	quicklistReleaseIterator(iter)
+	return true
+}
+
+/*
+*
+delete a range of count elements starting at the index start, a negative start
+counts from the tail. whole nodes are unlinked when all their elements are in
+the range, the others are trimmed.
+*/
+func quicklistDelRange(ql *quicklist, start int64, count int64) bool {
+	if count <= 0 {
+		return false
+	}
+	extent := count //range is inclusive of start position.
+	if start >= 0 && extent > ql.count-start {
+		//if requesting delete more elements than exist, limit to list size.
+		extent = ql.count - start
+	} else if start < 0 && extent > -start {
+		//else, if at negative offset, limit max size to rest of list.
+		extent = -start
+	}
+
+	iter := quicklistGetIteratorAtIdx(ql, AL_START_TAIL, start)
+	if iter == nil {
+		return false
+	}
+	node := iter.current
+	offset := iter.offset
+
+	//iterate over next nodes until everything is deleted.
+	for extent > 0 {
+		next := node.next
+		var del int
+		deleteEntireNode := false
+		if offset == 0 && extent >= int64(node.count) {
+			//if we are deleting more than the count of this node, we can just delete the entire node without listpack math.
+			deleteEntireNode = true
+			del = node.count
+		} else if offset >= 0 && extent+int64(offset) >= int64(node.count) {
+			//if deleting more nodes after this one, calculate delete based on size of current node.
+			del = node.count - offset
+		} else if offset < 0 {
+			//if offset is negative, we are in the first run of this loop and we are deleting the entire range from this start offset to end of list.
+			del = -offset
+			//if the positive offset is greater than the remaining extent, we only delete the remaining extent, not the entire offset.
+			if int64(del) > extent {
+				del = int(extent)
+			}
+		} else {
+			//we are deleting less than extent elements, so only delete the remaining extent.
+			del = int(extent)
+		}
+
+		if deleteEntireNode {
+			__quicklistDelNode(ql, node)
+		} else {
+			quicklistDecompressNodeForUse(node)
+			node.entry = lpDeleteRange(node.entry, offset, del)
+			quicklistNodeUpdateSz(node)
+			node.count -= del
+			ql.count -= int64(del)
+			quicklistDelNodeIfEmpty(ql, &node)
+			if node != nil {
+				quicklistRecompressOnly(node)
+			}
+		}
+		extent -= int64(del)
+		node = next
+		offset = 0
+	}
+	return true
+}
+
+/*
+*
+pop an element from the head (QUICKLIST_HEAD) or the tail (QUICKLIST_TAIL) of the
+quicklist, false is returned if the quicklist is empty.
+*/
+func quicklistPop(ql *quicklist, where int) (value []byte, longval int64, isInt bool, ok bool) {
+	if ql.count == 0 {
+		return nil, 0, false, false
+	}
+	node := ql.head
+	pos := 0
+	if where == QUICKLIST_TAIL {
+		node = ql.tail
+		pos = -1
+	}
+	p := lpSeek(node.entry, pos)
+	sval, longval, isInt := lpGet(node.entry, p)
+	if !isInt {
+		//the listpack is modified in place by the deletion, copy the string.
+		value = append([]byte{}, sval...)
+	}
+	quicklistDelIndex(ql, node, &p)
+	return value, longval, isInt, true
+}
+
+// duplicate the quicklist, the listpacks of the nodes are copied.
+func quicklistDup(orig *quicklist) *quicklist {
+	copied := quicklistNew(orig.fill, orig.compress)
+	for current := orig.head; current != nil; current = current.next {
+		node := quicklistCreateNode()
+		node.entry = lpDup(current.entry)
+		node.sz = current.sz
+		node.count = current.count
+		node.encoding = current.encoding
+		//the duplicated nodes are linked as they are, the compression state is the same.
+		node.prev = copied.tail
+		if copied.tail != nil {
+			copied.tail.next = node
+		} else {
+			copied.head = node
+		}
+		copied.tail = node
+		copied.len++
+	}
+	copied.count = orig.count
+	return copied
+}
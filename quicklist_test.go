@@ -0,0 +1,176 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// the elements of the quicklist iterated from the head, checked against the count and the node counts.
+func testQuicklistElements(t *testing.T, ql *quicklist) []string {
+	var elements []string
+	var entry quicklistEntry
+	iter := quicklistGetIterator(ql, AL_START_HEAD)
+	for quicklistNext(iter, &entry) {
+		if entry.isInt {
+			elements = append(elements, strconv.FormatInt(entry.longval, 10))
+		} else {
+			elements = append(elements, string(entry.value))
+		}
+	}
+	quicklistReleaseIterator(iter)
+
+	var count, nodes int64
+	for node := ql.head; node != nil; node = node.next {
+		if node.count == 0 || (node.next != nil && node.next.prev != node) {
+			t.Fatal("the quicklist nodes are not linked properly")
+		}
+		count += int64(node.count)
+		nodes++
+	}
+	if count != ql.count || nodes != ql.len || int64(len(elements)) != ql.count {
+		t.Fatalf("bad counts: count %d, len %d, iterated %d", ql.count, ql.len, len(elements))
+	}
+	return elements
+}
+
+func TestQuicklistPushPop(t *testing.T) {
+	ql := quicklistNew(4, 0)
+	for i := 0; i < 10; i++ {
+		quicklistPushTail(ql, []byte(strconv.Itoa(i)))
+	}
+	quicklistPushHead(ql, []byte("head"))
+	if ql.len != 4 {
+		t.Errorf("unexpected number of nodes %d", ql.len)
+	}
+	if elements := testQuicklistElements(t, ql); strings.Join(elements, ",") != "head,0,1,2,3,4,5,6,7,8,9" {
+		t.Fatalf("unexpected elements %v", elements)
+	}
+
+	if value, _, _, ok := quicklistPop(ql, QUICKLIST_HEAD); !ok || string(value) != "head" {
+		t.Errorf("unexpected pop %q", value)
+	}
+	if _, longval, isInt, ok := quicklistPop(ql, QUICKLIST_TAIL); !ok || !isInt || longval != 9 {
+		t.Errorf("unexpected pop %d", longval)
+	}
+	for i := 0; i < 9; i++ {
+		quicklistPop(ql, QUICKLIST_TAIL)
+	}
+	if _, _, _, ok := quicklistPop(ql, QUICKLIST_TAIL); ok || ql.len != 0 || ql.head != nil || ql.tail != nil {
+		t.Error("the quicklist is not empty")
+	}
+}
+
+func TestQuicklistIndexAndRange(t *testing.T) {
+	ql := quicklistNew(3, 0)
+	for i := 0; i < 20; i++ {
+		quicklistPushTail(ql, []byte(strconv.Itoa(i)))
+	}
+	var entry quicklistEntry
+	for _, idx := range []int64{0, 5, 19, -1, -7, -20} {
+		want := idx
+		if want < 0 {
+			want += 20
+		}
+		iter := quicklistGetIteratorAtIdx(ql, AL_START_HEAD, idx)
+		if !quicklistNext(iter, &entry) || entry.longval != want {
+			t.Errorf("index %d returned %d", idx, entry.longval)
+		}
+		quicklistReleaseIterator(iter)
+	}
+	if quicklistGetIteratorAtIdx(ql, AL_START_HEAD, 20) != nil || quicklistGetIteratorAtIdx(ql, AL_START_HEAD, -21) != nil {
+		t.Error("out of range index returned an iterator")
+	}
+
+	//a range spanning whole nodes and partial nodes at both ends.
+	quicklistDelRange(ql, 2, 10)
+	quicklistDelRange(ql, -3, 100)
+	if elements := testQuicklistElements(t, ql); strings.Join(elements, ",") != "0,1,12,13,14,15,16" {
+		t.Fatalf("unexpected elements %v", elements)
+	}
+	if !quicklistReplaceAtIndex(ql, -1, []byte("last")) || quicklistReplaceAtIndex(ql, 7, []byte("x")) {
+		t.Error("unexpected replace result")
+	}
+
+	//delete the even elements while iterating backward.
+	iter := quicklistGetIterator(ql, AL_START_TAIL)
+	for quicklistNext(iter, &entry) {
+		if entry.isInt && entry.longval%2 == 0 {
+			quicklistDelEntry(iter, &entry)
+		}
+	}
+	quicklistReleaseIterator(iter)
+	if elements := testQuicklistElements(t, ql); strings.Join(elements, ",") != "1,13,15,last" {
+		t.Fatalf("unexpected elements %v", elements)
+	}
+}
+
+func TestQuicklistInsertSplit(t *testing.T) {
+	ql := quicklistNew(4, 0)
+	for i := 0; i < 4; i++ {
+		quicklistPushTail(ql, []byte(strconv.Itoa(i)))
+	}
+	//the insertion in a full node splits it in half.
+	var entry quicklistEntry
+	iter := quicklistGetIteratorAtIdx(ql, AL_START_HEAD, 1)
+	quicklistNext(iter, &entry)
+	quicklistInsertAfter(iter, &entry, []byte("new"))
+	quicklistReleaseIterator(iter)
+	if ql.len != 2 {
+		t.Errorf("unexpected number of nodes %d", ql.len)
+	}
+	iter = quicklistGetIteratorAtIdx(ql, AL_START_HEAD, 0)
+	quicklistNext(iter, &entry)
+	quicklistInsertBefore(iter, &entry, []byte("first"))
+	quicklistReleaseIterator(iter)
+	if elements := testQuicklistElements(t, ql); strings.Join(elements, ",") != "first,0,1,new,2,3" {
+		t.Fatalf("unexpected elements %v", elements)
+	}
+
+	//a big element is split in its own node, the node is merged back once it's small again.
+	ql = quicklistNew(-1, 0)
+	quicklistPushTail(ql, []byte("a"))
+	quicklistPushTail(ql, []byte("b"))
+	quicklistReplaceAtIndex(ql, 0, []byte(strings.Repeat("a", 5000)))
+	if ql.len != 2 {
+		t.Errorf("unexpected number of nodes %d", ql.len)
+	}
+	quicklistReplaceAtIndex(ql, 0, []byte("a"))
+	if elements := testQuicklistElements(t, ql); ql.len != 1 || strings.Join(elements, ",") != "a,b" {
+		t.Fatalf("unexpected elements %v in %d nodes", elements, ql.len)
+	}
+}
+
+func TestQuicklistCompress(t *testing.T) {
+	ql := quicklistNew(-1, 1)
+	value := strings.Repeat("compressible value ", 10)
+	for i := 0; i < 500; i++ {
+		quicklistPushTail(ql, []byte(value+strconv.Itoa(i)))
+	}
+	//only the nodes at both ends are kept raw.
+	for node := ql.head; node != nil; node = node.next {
+		raw := node.encoding == QUICKLIST_NODE_ENCODING_RAW
+		if raw != (node == ql.head || node == ql.tail) {
+			t.Fatalf("unexpected node encoding %d", node.encoding)
+		}
+		if !raw && len(node.entry) >= node.sz {
+			t.Fatal("the compressed node is not smaller")
+		}
+	}
+
+	dup := quicklistDup(ql)
+	quicklistDelRange(ql, 100, 300)
+	elements := testQuicklistElements(t, ql)
+	if len(elements) != 200 || elements[99] != value+"99" || elements[100] != value+"400" {
+		t.Fatal("unexpected elements after the range deletion")
+	}
+	if elements := testQuicklistElements(t, dup); len(elements) != 500 || elements[250] != value+"250" {
+		t.Fatal("the duplicated quicklist was modified")
+	}
+	//the iteration compresses again the nodes it decompressed.
+	for node := dup.head.next; node != dup.tail; node = node.next {
+		if node.encoding != QUICKLIST_NODE_ENCODING_LZF {
+			t.Fatal("the node was not compressed again after the iteration")
+		}
+	}
+}
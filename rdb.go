@@ -0,0 +1,1317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	/* The current RDB version. When the format changes in a way that is no longer
+	 * backward compatible this number gets incremented. */
+	REDIS_RDB_VERSION = 9
+	/* The version of the files with hashes whose fields have an expire, that
+	 * are saved with the REDIS_RDB_TYPE_HASH_METADATA type. */
+	REDIS_RDB_VERSION_HASH_METADATA = 12
+	/* The most recent RDB version we are able to load: every encoding of the
+	 * supported data types saved up to this version is understood. */
+	REDIS_RDB_MAX_LOAD_VERSION = 12
+
+	/* Defines related to the dump file format. To store 32 bits lengths for short
+	 * keys requires a lot of space, so we check the most significant 2 bits of
+	 * the first byte to interpreter the length:
+	 *
+	 * 00|000000 => if the two MSB are 00 the len is the 6 bits of this byte
+	 * 01|000000 00000000 =>  01, the len is 14 byes, 6 bits + 8 bits of next byte
+	 * 10|000000 [32 bit integer] => 0x80, a full 32 bit len will follow
+	 * 10|000001 [64 bit integer] => 0x81, a full 64 bit len will follow
+	 * 11|OBKIND this means: specially encoded object will follow. The six bits
+	 *           number specify the kind of object that follows.
+	 *           See the REDIS_RDB_ENC_* defines.
+	 */
+	REDIS_RDB_6BITLEN  = 0
+	REDIS_RDB_14BITLEN = 1
+	REDIS_RDB_32BITLEN = 0x80
+	REDIS_RDB_64BITLEN = 0x81
+	REDIS_RDB_ENCVAL   = 3
+
+	/* When a length of a string object stored on disk has the first two bits
+	 * set, the remaining two bits specify a special encoding for the object
+	 * accordingly to the following defines: */
+	REDIS_RDB_ENC_INT8  = 0 /* 8 bit signed integer */
+	REDIS_RDB_ENC_INT16 = 1 /* 16 bit signed integer */
+	REDIS_RDB_ENC_INT32 = 2 /* 32 bit signed integer */
+	REDIS_RDB_ENC_LZF   = 3 /* string compressed with FASTLZ */
+
+	/* Dup object types to RDB object types. Only reason is readability (are we
+	 * dealing with RDB types or with in-memory object types?). */
+	REDIS_RDB_TYPE_STRING = 0
+	REDIS_RDB_TYPE_LIST   = 1
+	REDIS_RDB_TYPE_SET    = 2
+	REDIS_RDB_TYPE_ZSET   = 3
+	REDIS_RDB_TYPE_HASH   = 4
+	REDIS_RDB_TYPE_ZSET_2 = 5 /* ZSET version 2 with doubles stored in binary. */
+	/* Object types for encoded objects, only loaded. */
+	REDIS_RDB_TYPE_LIST_ZIPLIST     = 10
+	REDIS_RDB_TYPE_SET_INTSET       = 11
+	REDIS_RDB_TYPE_ZSET_ZIPLIST     = 12
+	REDIS_RDB_TYPE_HASH_ZIPLIST     = 13
+	REDIS_RDB_TYPE_LIST_QUICKLIST   = 14 /* Quicklist of ziplists, up to version 9. */
+	REDIS_RDB_TYPE_HASH_LISTPACK    = 16
+	REDIS_RDB_TYPE_ZSET_LISTPACK    = 17
+	REDIS_RDB_TYPE_LIST_QUICKLIST_2 = 18 /* Quicklist of listpacks, from version 10. */
+	REDIS_RDB_TYPE_SET_LISTPACK     = 20
+	/* Hash with the expires of its fields, preceded by the earliest of them. */
+	REDIS_RDB_TYPE_HASH_METADATA = 24
+	/* Listpack of field, value and expire triplets, preceded by the earliest expire. */
+	REDIS_RDB_TYPE_HASH_LISTPACK_EX = 25
+
+	/* The containers of the nodes of a REDIS_RDB_TYPE_LIST_QUICKLIST_2. */
+	QUICKLIST_NODE_CONTAINER_PLAIN  = 1 /* A single element saved as a string. */
+	QUICKLIST_NODE_CONTAINER_PACKED = 2 /* A listpack. */
+
+	/* Special RDB opcodes (saved/loaded with rdbSaveType/rdbLoadType). */
+	REDIS_RDB_OPCODE_IDLE          = 248 /* LRU idle time. */
+	REDIS_RDB_OPCODE_FREQ          = 249 /* LFU frequency. */
+	REDIS_RDB_OPCODE_AUX           = 250 /* RDB aux field. */
+	REDIS_RDB_OPCODE_RESIZEDB      = 251 /* Hash table resize hint. */
+	REDIS_RDB_OPCODE_EXPIRETIME_MS = 252 /* Expire time in milliseconds. */
+	REDIS_RDB_OPCODE_EXPIRETIME    = 253 /* Old expire time in seconds. */
+	REDIS_RDB_OPCODE_SELECTDB      = 254 /* DB number of the following keys. */
+	REDIS_RDB_OPCODE_EOF           = 255 /* End of the RDB file. */
+
+	REDIS_BGSAVE_RETRY_DELAY = 5 /* Wait a few secs before trying again. */
+)
+
+/*
+*
+the keys of a database as collected by the event loop when a snapshot is taken,
+the values are shared with the keyspace until the event loop looks them up again,
+see rdbSnapshotShared.
+*/
+type rdbSnapshotDb struct {
+	id      int
+	keys    []*robj
+	vals    []*robj
+	expires []int64
+	//some hash has fields with an expire, the file needs REDIS_RDB_VERSION_HASH_METADATA.
+	fieldExpires bool
+}
+
+/*
+*
+the RDB file is read and written through a rio, that keeps the checksum
+of the processed bytes up to date.
+*/
+type rio struct {
+	w     *bufio.Writer
+	r     *bufio.Reader
+	cksum uint64
+}
+
+func (r *rio) write(p []byte) error {
+	r.cksum = crc64Update(r.cksum, p)
+	_, err := r.w.Write(p)
+	return err
+}
+
+func (r *rio) read(p []byte) error {
+	if _, err := io.ReadFull(r.r, p); err != nil {
+		return err
+	}
+	r.cksum = crc64Update(r.cksum, p)
+	return nil
+}
+
+/*
+*
+take a snapshot of the whole keyspace: only the pointers to the keys and the
+values are collected, the event loop must not modify the keyspace until the
+snapshot is encoded, unless the snapshot is shared with rdbSnapshotShared.
+*/
+func rdbSnapshot() []rdbSnapshotDb {
+	snapshot := make([]rdbSnapshotDb, 0)
+	for j := 0; j < server.dbnum; j++ {
+		db := &server.db[j]
+		size := dictSize(&db.dict)
+		if size == 0 {
+			continue
+		}
+		sdb := rdbSnapshotDb{id: j, keys: make([]*robj, 0, size), vals: make([]*robj, 0, size), expires: make([]int64, 0, size)}
+		iter := dictGetSafeIterator(&db.dict)
+		for de := dictNext(iter); de != nil; de = dictNext(iter) {
+			expire := int64(-1)
+			if ee := dictFind(&db.expires, (*de.key.ptr).(string)); ee != nil {
+				expire = (*ee.val.ptr).(int64)
+			}
+			if de.val.robjType == REDIS_HASH && hashTypeFieldExpires(de.val) != nil {
+				sdb.fieldExpires = true
+			}
+			sdb.keys = append(sdb.keys, de.key)
+			sdb.vals = append(sdb.vals, de.val)
+			sdb.expires = append(sdb.expires, expire)
+		}
+		dictReleaseIterator(iter)
+		snapshot = append(snapshot, sdb)
+	}
+	return snapshot
+}
+
+/*
+*
+take a snapshot encoded by a goroutine while the event loop keeps serving the commands.
+the values are not copied, they are stamped with the id of the snapshot instead: the
+event loop copies a stamped value the first time it looks it up, and keeps the copy in
+the keyspace, so that the snapshot is the only one left accessing the original value.
+the goroutine encodes every value holding snapshotLock, the copy is taken holding it as
+well. the snapshot must be released with rdbReleaseSnapshot once it is encoded.
+*/
+func rdbSnapshotShared() (uint64, []rdbSnapshotDb) {
+	snapshot := rdbSnapshot()
+	server.snapshotId++
+	for _, sdb := range snapshot {
+		for _, val := range sdb.vals {
+			val.snapshotId = server.snapshotId
+		}
+	}
+	server.snapshotsInUse = append(server.snapshotsInUse, server.snapshotId)
+	return server.snapshotId, snapshot
+}
+
+// called by the event loop once the goroutine is done with the snapshot.
+func rdbReleaseSnapshot(id uint64) {
+	for i, inUse := range server.snapshotsInUse {
+		if inUse == id {
+			server.snapshotsInUse = append(server.snapshotsInUse[:i], server.snapshotsInUse[i+1:]...)
+			return
+		}
+	}
+}
+
+/*
+*
+check if the value may still be read by the goroutine of a snapshot: the value was
+in the keyspace when all the snapshots up to its id were taken, so it is shared if
+any of them is still in use.
+*/
+func rdbSnapshotInUse(o *robj) bool {
+	for _, id := range server.snapshotsInUse {
+		if o.snapshotId >= id {
+			return true
+		}
+	}
+	return false
+}
+
+// copy a value shared with a snapshot, the copy replaces the value in the keyspace.
+func rdbCopyObject(o *robj) *robj {
+	server.snapshotLock.Lock()
+	defer server.snapshotLock.Unlock()
+	var ptr interface{}
+	switch o.robjType {
+	case REDIS_STRING:
+		//the value of a string object is replaced and never modified, sharing the pointer is enough.
+		return &robj{robjType: o.robjType, encoding: o.encoding, ptr: o.ptr}
+	case REDIS_LIST:
+		//the listpacks are modified in place, so they are copied.
+		if o.encoding == REDIS_ENCODING_QUICKLIST {
+			ptr = quicklistDup((*o.ptr).(*quicklist))
+		} else {
+			ptr = lpDup((*o.ptr).([]byte))
+		}
+	case REDIS_SET:
+		return setTypeDup(o)
+	case REDIS_HASH:
+		if o.encoding == REDIS_ENCODING_LISTPACK {
+			ptr = lpDup((*o.ptr).([]byte))
+		} else {
+			//the fields and the values are replaced and never modified, only the dict is copied.
+			copied := dictCreate(&hashDictType, nil)
+			di := dictGetSafeIterator((*o.ptr).(*dict))
+			for de := dictNext(di); de != nil; de = dictNext(di) {
+				dictAdd(copied, de.key, de.val)
+			}
+			dictReleaseIterator(di)
+			//the expires of the fields are copied as well.
+			if fe := hashTypeFieldExpires(o); fe != nil {
+				expires := dictCreate(&hashDictType, nil)
+				di = dictGetSafeIterator(fe.expires)
+				for de := dictNext(di); de != nil; de = dictNext(di) {
+					dictAdd(expires, de.key, de.val)
+				}
+				dictReleaseIterator(di)
+				copied.metadata = &hashFieldExpires{expires: expires, minExpire: fe.minExpire}
+			}
+			ptr = copied
+		}
+	case REDIS_ZSET:
+		return zsetDup(o)
+	default:
+		panic("Unknown object type")
+	}
+	return &robj{robjType: o.robjType, encoding: o.encoding, ptr: &ptr}
+}
+
+func rdbSaveType(r *rio, t byte) error {
+	return r.write([]byte{t})
+}
+
+func rdbSaveMillisecondTime(r *rio, t int64) error {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(t))
+	return r.write(buf)
+}
+
+// save an encoded length, the first two bits of the first byte select the format.
+func rdbSaveLen(r *rio, l uint64) error {
+	var buf []byte
+	if l < 1<<6 {
+		buf = []byte{byte(l) | REDIS_RDB_6BITLEN<<6}
+	} else if l < 1<<14 {
+		buf = []byte{byte(l>>8) | REDIS_RDB_14BITLEN<<6, byte(l)}
+	} else if l <= math.MaxUint32 {
+		buf = make([]byte, 5)
+		buf[0] = REDIS_RDB_32BITLEN
+		binary.BigEndian.PutUint32(buf[1:], uint32(l))
+	} else {
+		buf = make([]byte, 9)
+		buf[0] = REDIS_RDB_64BITLEN
+		binary.BigEndian.PutUint64(buf[1:], l)
+	}
+	return r.write(buf)
+}
+
+// encode the integer as a special string if it fits 32 bits, nil otherwise.
+func rdbEncodeInteger(value int64) []byte {
+	if value >= math.MinInt8 && value <= math.MaxInt8 {
+		return []byte{REDIS_RDB_ENCVAL<<6 | REDIS_RDB_ENC_INT8, byte(value)}
+	} else if value >= math.MinInt16 && value <= math.MaxInt16 {
+		buf := []byte{REDIS_RDB_ENCVAL<<6 | REDIS_RDB_ENC_INT16, 0, 0}
+		binary.LittleEndian.PutUint16(buf[1:], uint16(value))
+		return buf
+	} else if value >= math.MinInt32 && value <= math.MaxInt32 {
+		buf := []byte{REDIS_RDB_ENCVAL<<6 | REDIS_RDB_ENC_INT32, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(buf[1:], uint32(value))
+		return buf
+	}
+	return nil
+}
+
+/*
+*
+save a string, strings representing integers are saved as integers, and
+strings longer than 20 bytes are compressed with LZF when it saves space.
+*/
+func rdbSaveRawString(r *rio, s string) error {
+	//try integer encoding, only if the string is the canonical representation of the integer.
+	if len(s) > 0 && len(s) <= 11 {
+		if value, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(value, 10) == s {
+			if enc := rdbEncodeInteger(value); enc != nil {
+				return r.write(enc)
+			}
+		}
+	}
+	//try LZF compression, the compressed string must be at least 4 bytes smaller.
+	if len(s) > 20 {
+		if compressed := lzfCompress([]byte(s), len(s)-4); compressed != nil {
+			if err := rdbSaveType(r, REDIS_RDB_ENCVAL<<6|REDIS_RDB_ENC_LZF); err != nil {
+				return err
+			}
+			if err := rdbSaveLen(r, uint64(len(compressed))); err != nil {
+				return err
+			}
+			if err := rdbSaveLen(r, uint64(len(s))); err != nil {
+				return err
+			}
+			return r.write(compressed)
+		}
+	}
+	if err := rdbSaveLen(r, uint64(len(s))); err != nil {
+		return err
+	}
+	return r.write([]byte(s))
+}
+
+// save a string object, integer encoded objects are saved as integers when possible.
+func rdbSaveStringObject(r *rio, o *robj) error {
+	switch v := (*o.ptr).(type) {
+	case int64:
+		if enc := rdbEncodeInteger(v); enc != nil {
+			return r.write(enc)
+		}
+		return rdbSaveRawString(r, strconv.FormatInt(v, 10))
+	case string:
+		return rdbSaveRawString(r, v)
+	default:
+		panic("Unknown string encoding")
+	}
+}
+
+func rdbSaveBinaryDoubleValue(r *rio, d float64) error {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(d))
+	return r.write(buf)
+}
+
+func rdbSaveObjectType(r *rio, o *robj) error {
+	switch o.robjType {
+	case REDIS_STRING:
+		return rdbSaveType(r, REDIS_RDB_TYPE_STRING)
+	case REDIS_LIST:
+		return rdbSaveType(r, REDIS_RDB_TYPE_LIST)
+	case REDIS_SET:
+		return rdbSaveType(r, REDIS_RDB_TYPE_SET)
+	case REDIS_HASH:
+		if hashTypeFieldExpires(o) != nil {
+			return rdbSaveType(r, REDIS_RDB_TYPE_HASH_METADATA)
+		}
+		return rdbSaveType(r, REDIS_RDB_TYPE_HASH)
+	case REDIS_ZSET:
+		return rdbSaveType(r, REDIS_RDB_TYPE_ZSET_2)
+	}
+	panic("Unknown object type")
+}
+
+func rdbSaveObject(r *rio, o *robj) error {
+	switch o.robjType {
+	case REDIS_STRING:
+		return rdbSaveStringObject(r, o)
+	case REDIS_LIST:
+		if err := rdbSaveLen(r, uint64(listTypeLength(o))); err != nil {
+			return err
+		}
+		var entry listTypeEntry
+		li := listTypeInitIterator(o, 0, REDIS_TAIL)
+		defer listTypeReleaseIterator(li)
+		for listTypeNext(li, &entry) {
+			if err := rdbSaveStringObject(r, listTypeGet(&entry)); err != nil {
+				return err
+			}
+		}
+	case REDIS_SET:
+		if err := rdbSaveLen(r, uint64(setTypeSize(o))); err != nil {
+			return err
+		}
+		si := setTypeInitIterator(o)
+		defer setTypeReleaseIterator(si)
+		for element := setTypeNextObject(si); element != nil; element = setTypeNextObject(si) {
+			if err := rdbSaveStringObject(r, element); err != nil {
+				return err
+			}
+		}
+	case REDIS_HASH:
+		/**
+		the expires of the fields are saved relative to the earliest of them,
+		which is saved first: 0 is saved for the fields with no expire, the
+		expire minus the earliest expire plus one otherwise.
+		*/
+		var minExpire int64 = -1
+		if fe := hashTypeFieldExpires(o); fe != nil {
+			di := dictGetSafeIterator(fe.expires)
+			for de := dictNext(di); de != nil; de = dictNext(di) {
+				if when := (*de.val.ptr).(int64); minExpire == -1 || when < minExpire {
+					minExpire = when
+				}
+			}
+			dictReleaseIterator(di)
+			if err := rdbSaveMillisecondTime(r, minExpire); err != nil {
+				return err
+			}
+		}
+		if err := rdbSaveLen(r, uint64(hashTypeLength(o))); err != nil {
+			return err
+		}
+		hi := hashTypeInitIterator(o)
+		defer hashTypeReleaseIterator(hi)
+		for hashTypeNext(hi) {
+			if minExpire != -1 {
+				var ttl uint64
+				if when := hashTypeGetExpire(o, hashTypeCurrentObject(hi, REDIS_HASH_KEY)); when != -1 {
+					ttl = uint64(when-minExpire) + 1
+				}
+				if err := rdbSaveLen(r, ttl); err != nil {
+					return err
+				}
+			}
+			if err := rdbSaveStringObject(r, hashTypeCurrentObject(hi, REDIS_HASH_KEY)); err != nil {
+				return err
+			}
+			if err := rdbSaveStringObject(r, hashTypeCurrentObject(hi, REDIS_HASH_VALUE)); err != nil {
+				return err
+			}
+		}
+	case REDIS_ZSET:
+		zsl := (*o.ptr).(*zset).zsl
+		if err := rdbSaveLen(r, uint64(zsl.length)); err != nil {
+			return err
+		}
+		//save the elements from the tail, so that loading them inserts every element at the head.
+		for x := zsl.tail; x != nil; x = x.backward {
+			if err := rdbSaveStringObject(r, x.obj); err != nil {
+				return err
+			}
+			if err := rdbSaveBinaryDoubleValue(r, x.score); err != nil {
+				return err
+			}
+		}
+	default:
+		panic("Unknown object type")
+	}
+	return nil
+}
+
+func rdbSaveAuxField(r *rio, key string, val string) error {
+	if err := rdbSaveType(r, REDIS_RDB_OPCODE_AUX); err != nil {
+		return err
+	}
+	if err := rdbSaveRawString(r, key); err != nil {
+		return err
+	}
+	return rdbSaveRawString(r, val)
+}
+
+// save a key-value pair, with the expire time if any, holding snapshotLock.
+func rdbSaveKeyValuePair(r *rio, key *robj, val *robj, expire int64) error {
+	server.snapshotLock.Lock()
+	defer server.snapshotLock.Unlock()
+	if expire != -1 {
+		if err := rdbSaveType(r, REDIS_RDB_OPCODE_EXPIRETIME_MS); err != nil {
+			return err
+		}
+		if err := rdbSaveMillisecondTime(r, expire); err != nil {
+			return err
+		}
+	}
+	if err := rdbSaveObjectType(r, val); err != nil {
+		return err
+	}
+	if err := rdbSaveStringObject(r, key); err != nil {
+		return err
+	}
+	return rdbSaveObject(r, val)
+}
+
+// produce a dump of the snapshot in the RDB format.
+func rdbSaveRio(r *rio, snapshot []rdbSnapshotDb) error {
+	//the files are stamped with the oldest version able to hold the types they contain.
+	version := REDIS_RDB_VERSION
+	for _, sdb := range snapshot {
+		if sdb.fieldExpires {
+			version = REDIS_RDB_VERSION_HASH_METADATA
+		}
+	}
+	if err := r.write([]byte(fmt.Sprintf("REDIS%04d", version))); err != nil {
+		return err
+	}
+	aux := [][2]string{
+		{"redis-ver", REDIS_VERSION},
+		{"redis-bits", "64"},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+		{"used-mem", strconv.FormatInt(server.statUsedMemory, 10)},
+		{"aof-base", "0"},
+	}
+	for _, field := range aux {
+		if err := rdbSaveAuxField(r, field[0], field[1]); err != nil {
+			return err
+		}
+	}
+
+	for _, sdb := range snapshot {
+		//write the SELECT DB opcode and the size hints of the hash tables.
+		if err := rdbSaveType(r, REDIS_RDB_OPCODE_SELECTDB); err != nil {
+			return err
+		}
+		if err := rdbSaveLen(r, uint64(sdb.id)); err != nil {
+			return err
+		}
+		expiresSize := 0
+		for _, expire := range sdb.expires {
+			if expire != -1 {
+				expiresSize++
+			}
+		}
+		if err := rdbSaveType(r, REDIS_RDB_OPCODE_RESIZEDB); err != nil {
+			return err
+		}
+		if err := rdbSaveLen(r, uint64(len(sdb.keys))); err != nil {
+			return err
+		}
+		if err := rdbSaveLen(r, uint64(expiresSize)); err != nil {
+			return err
+		}
+
+		for i, key := range sdb.keys {
+			if err := rdbSaveKeyValuePair(r, key, sdb.vals[i], sdb.expires[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	//EOF opcode and the CRC64 checksum of the whole file.
+	if err := rdbSaveType(r, REDIS_RDB_OPCODE_EOF); err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, r.cksum)
+	if err := r.write(buf); err != nil {
+		return err
+	}
+	return nil
+}
+
+// write the snapshot into filename, the file is fsynced before returning.
+func rdbWriteSnapshot(filename string, snapshot []rdbSnapshotDb) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	r := &rio{w: bufio.NewWriter(f)}
+	if err = rdbSaveRio(r, snapshot); err == nil {
+		err = r.w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(filename)
+	}
+	return err
+}
+
+// save the DB on disk, the event loop is blocked until the file is written.
+func rdbSave(filename string) error {
+	tmpfile := fmt.Sprintf("temp-%d.rdb", os.Getpid())
+	if err := rdbWriteSnapshot(tmpfile, rdbSnapshot()); err != nil {
+		redisLog(REDIS_WARNING, "Failed opening or writing the .rdb for saving: %s", err)
+		return err
+	}
+	//use RENAME to make sure the DB file is changed atomically only if the generated DB file is ok.
+	if err := os.Rename(tmpfile, filename); err != nil {
+		redisLog(REDIS_WARNING, "Error moving temp DB file on the final destination: %s", err)
+		_ = os.Remove(tmpfile)
+		return err
+	}
+	redisLog(REDIS_NOTICE, "DB saved on disk")
+	server.dirty = 0
+	server.lastsave = time.Now().Unix()
+	server.lastbgsaveStatus = REDIS_OK
+	return nil
+}
+
+/*
+*
+save the DB in background: the event loop takes a shared snapshot and a goroutine
+encodes it, the result is handed back to the event loop through eventCh.
+*/
+func rdbSaveBackground(filename string) error {
+	if hasActiveChildProcess() {
+		return errors.New("Background save or AOF rewrite already in progress")
+	}
+	server.dirtyBeforeBgsave = server.dirty
+	server.lastbgsaveTry = time.Now().Unix()
+	server.rdbSaveTimeStart = time.Now().Unix()
+	server.rdbChildRunning = true
+	server.rdbBgsaveScheduled = false
+	server.rdbSaveId++
+	server.rdbTmpfile = fmt.Sprintf("temp-bgsave-%d-%d.rdb", os.Getpid(), server.rdbSaveId)
+
+	id, snapshot := rdbSnapshotShared()
+	tmpfile := server.rdbTmpfile
+	redisLog(REDIS_NOTICE, "Background saving started")
+	go func() {
+		err := rdbWriteSnapshot(tmpfile, snapshot)
+		server.eventCh <- func() {
+			rdbReleaseSnapshot(id)
+			backgroundSaveDoneHandler(filename, tmpfile, err)
+		}
+	}()
+	return nil
+}
+
+// abandon the running background save, its temp file is removed and its result is ignored.
+func killRDBChild() {
+	if !server.rdbChildRunning {
+		return
+	}
+	redisLog(REDIS_NOTICE, "Killing running background save child")
+	_ = os.Remove(server.rdbTmpfile)
+	server.rdbChildRunning = false
+	server.rdbTmpfile = ""
+}
+
+// called by the event loop when the background save is terminated.
+func backgroundSaveDoneHandler(filename string, tmpfile string, err error) {
+	if !server.rdbChildRunning || tmpfile != server.rdbTmpfile {
+		//the background save was killed.
+		_ = os.Remove(tmpfile)
+		return
+	}
+	server.rdbChildRunning = false
+	server.rdbTmpfile = ""
+	if err == nil {
+		err = os.Rename(tmpfile, filename)
+	}
+	if err == nil {
+		redisLog(REDIS_NOTICE, "Background saving terminated with success")
+		server.dirty -= server.dirtyBeforeBgsave
+		server.lastsave = time.Now().Unix()
+		server.lastbgsaveStatus = REDIS_OK
+	} else {
+		redisLog(REDIS_WARNING, "Background saving error: %s", err)
+		_ = os.Remove(tmpfile)
+		server.lastbgsaveStatus = REDIS_ERR
+	}
+	server.rdbLastBgsaveTimeSec = time.Now().Unix() - server.rdbSaveTimeStart
+}
+
+// load a length, the second value reports if the length is a special encoding type.
+func rdbLoadLen(r *rio) (uint64, bool, error) {
+	buf := make([]byte, 8)
+	if err := r.read(buf[:1]); err != nil {
+		return 0, false, err
+	}
+	switch buf[0] >> 6 {
+	case REDIS_RDB_ENCVAL:
+		return uint64(buf[0] & 0x3F), true, nil
+	case REDIS_RDB_6BITLEN:
+		return uint64(buf[0] & 0x3F), false, nil
+	case REDIS_RDB_14BITLEN:
+		first := buf[0]
+		if err := r.read(buf[:1]); err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3F)<<8 | uint64(buf[0]), false, nil
+	}
+	if buf[0] == REDIS_RDB_32BITLEN {
+		if err := r.read(buf[:4]); err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf[:4])), false, nil
+	} else if buf[0] == REDIS_RDB_64BITLEN {
+		if err := r.read(buf); err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	}
+	return 0, false, fmt.Errorf("Unknown length encoding %d in rdbLoadLen()", buf[0])
+}
+
+func rdbLoadString(r *rio) (string, error) {
+	l, encoded, err := rdbLoadLen(r)
+	if err != nil {
+		return "", err
+	}
+	if encoded {
+		switch l {
+		case REDIS_RDB_ENC_INT8, REDIS_RDB_ENC_INT16, REDIS_RDB_ENC_INT32:
+			size := 1 << l
+			buf := make([]byte, size)
+			if err := r.read(buf); err != nil {
+				return "", err
+			}
+			var value int64
+			switch l {
+			case REDIS_RDB_ENC_INT8:
+				value = int64(int8(buf[0]))
+			case REDIS_RDB_ENC_INT16:
+				value = int64(int16(binary.LittleEndian.Uint16(buf)))
+			default:
+				value = int64(int32(binary.LittleEndian.Uint32(buf)))
+			}
+			return strconv.FormatInt(value, 10), nil
+		case REDIS_RDB_ENC_LZF:
+			clen, _, err := rdbLoadLen(r)
+			if err != nil {
+				return "", err
+			}
+			length, _, err := rdbLoadLen(r)
+			if err != nil {
+				return "", err
+			}
+			compressed := make([]byte, clen)
+			if err := r.read(compressed); err != nil {
+				return "", err
+			}
+			val, err := lzfDecompress(compressed, int(length))
+			if err != nil {
+				return "", err
+			}
+			return string(val), nil
+		default:
+			return "", fmt.Errorf("Unknown RDB string encoding type %d", l)
+		}
+	}
+	buf := make([]byte, l)
+	if err := r.read(buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func rdbLoadStringObject(r *rio) (*robj, error) {
+	s, err := rdbLoadString(r)
+	if err != nil {
+		return nil, err
+	}
+	return createStringObject(&s, len(s)), nil
+}
+
+// load a double saved as a string, its first byte is the length or a special value.
+func rdbLoadDoubleValue(r *rio) (float64, error) {
+	buf := make([]byte, 255)
+	if err := r.read(buf[:1]); err != nil {
+		return 0, err
+	}
+	switch buf[0] {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	l := int(buf[0])
+	if err := r.read(buf[:l]); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf[:l]), 64)
+}
+
+func rdbLoadMillisecondTime(r *rio) (int64, error) {
+	buf := make([]byte, 8)
+	if err := r.read(buf); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+func rdbLoadBinaryDoubleValue(r *rio) (float64, error) {
+	buf := make([]byte, 8)
+	if err := r.read(buf); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// add a loaded element to the list, the list is converted to a quicklist when it grows too big.
+func rdbListAdd(o *robj, ele *robj) {
+	ele = tryObjectEncoding(ele)
+	listTypeTryConversionAppend(o, []*robj{ele}, 0, 0)
+	listTypePush(o, ele, REDIS_TAIL)
+}
+
+// create the set of a loaded set of size elements, a regular set is used when there are too many of them.
+func rdbSetCreate(size int) *robj {
+	if size > server.setMaxIntsetEntries {
+		return createSetObject()
+	}
+	return createIntsetObject()
+}
+
+func rdbSetAdd(o *robj, ele *robj) error {
+	if !setTypeAdd(o, ele) {
+		return errors.New("Duplicate set members detected")
+	}
+	return nil
+}
+
+/*
+*
+add a loaded field to the hash, when is the expire of the field or -1. the fields
+already expired are not loaded, unless we are a replica: the master will send the HDEL.
+*/
+func rdbHashAdd(o *robj, field *robj, value *robj, when int64, now int64) {
+	if when != -1 && when <= now && server.masterhost == "" {
+		return
+	}
+	args := []*robj{field, value}
+	hashTypeTryConversion(o, args, 0, 1)
+	hashTypeTryObjectEncoding(o, &args[0], &args[1])
+	hashTypeSet(o, field, args[1], 0)
+	if when != -1 {
+		hashTypeSetExpire(o, field, when)
+	}
+}
+
+func rdbZsetAdd(o *robj, ele *robj, score float64) error {
+	zs := (*o.ptr).(*zset)
+	member := (*ele.ptr).(string)
+	if zs.dict[member] != nil {
+		return errors.New("Duplicate zset fields detected")
+	}
+	zslInsert(zs.zsl, score, ele)
+	zs.dict[member] = &score
+	return nil
+}
+
+/*
+*
+load the elements of a container saved as a single string: an intset, a ziplist
+or a listpack. the integers are converted to strings.
+*/
+func rdbLoadEncodedElements(r *rio, rdbtype byte) ([]string, error) {
+	blob, err := rdbLoadString(r)
+	if err != nil {
+		return nil, err
+	}
+	encoded := []byte(blob)
+	switch rdbtype {
+	case REDIS_RDB_TYPE_SET_INTSET:
+		if !intsetValidateIntegrity(encoded) {
+			return nil, errors.New("Intset integrity check failed.")
+		}
+		elements := make([]string, 0, intsetLen(encoded))
+		for pos := 0; pos < intsetLen(encoded); pos++ {
+			value, _ := intsetGet(encoded, pos)
+			elements = append(elements, strconv.FormatInt(value, 10))
+		}
+		return elements, nil
+	case REDIS_RDB_TYPE_LIST_ZIPLIST, REDIS_RDB_TYPE_ZSET_ZIPLIST, REDIS_RDB_TYPE_HASH_ZIPLIST, REDIS_RDB_TYPE_LIST_QUICKLIST:
+		elements, ok := ziplistElements(encoded)
+		if !ok {
+			return nil, errors.New("Ziplist integrity check failed.")
+		}
+		return elements, nil
+	}
+	if !lpValidateIntegrity(encoded) {
+		return nil, errors.New("Listpack integrity check failed.")
+	}
+	elements := make([]string, 0)
+	for p := lpFirst(encoded); p != -1; p = lpNext(encoded, p) {
+		elements = append(elements, lpGetString(encoded, p))
+	}
+	return elements, nil
+}
+
+// load an object of the specified RDB type.
+func rdbLoadObject(r *rio, rdbtype byte) (*robj, error) {
+	switch rdbtype {
+	case REDIS_RDB_TYPE_STRING:
+		return rdbLoadStringObject(r)
+	case REDIS_RDB_TYPE_LIST:
+		l, _, err := rdbLoadLen(r)
+		if err != nil {
+			return nil, err
+		}
+		o := createListListpackObject()
+		for ; l > 0; l-- {
+			ele, err := rdbLoadStringObject(r)
+			if err != nil {
+				return nil, err
+			}
+			rdbListAdd(o, ele)
+		}
+		return o, nil
+	case REDIS_RDB_TYPE_SET:
+		l, _, err := rdbLoadLen(r)
+		if err != nil {
+			return nil, err
+		}
+		o := rdbSetCreate(int(l))
+		//load every single element of the set.
+		for ; l > 0; l-- {
+			ele, err := rdbLoadStringObject(r)
+			if err != nil {
+				return nil, err
+			}
+			if err := rdbSetAdd(o, ele); err != nil {
+				return nil, err
+			}
+		}
+		return o, nil
+	case REDIS_RDB_TYPE_HASH, REDIS_RDB_TYPE_HASH_METADATA:
+		var minExpire int64
+		var err error
+		if rdbtype == REDIS_RDB_TYPE_HASH_METADATA {
+			if minExpire, err = rdbLoadMillisecondTime(r); err != nil {
+				return nil, err
+			}
+		}
+		l, _, err := rdbLoadLen(r)
+		if err != nil {
+			return nil, err
+		}
+		o := createHashObject()
+		now := time.Now().UnixMilli()
+		for ; l > 0; l-- {
+			var ttl uint64
+			if rdbtype == REDIS_RDB_TYPE_HASH_METADATA {
+				if ttl, _, err = rdbLoadLen(r); err != nil {
+					return nil, err
+				}
+			}
+			field, err := rdbLoadStringObject(r)
+			if err != nil {
+				return nil, err
+			}
+			value, err := rdbLoadStringObject(r)
+			if err != nil {
+				return nil, err
+			}
+			when := int64(-1)
+			if ttl != 0 {
+				when = minExpire + int64(ttl) - 1
+			}
+			rdbHashAdd(o, field, value, when, now)
+		}
+		return o, nil
+	case REDIS_RDB_TYPE_ZSET, REDIS_RDB_TYPE_ZSET_2:
+		l, _, err := rdbLoadLen(r)
+		if err != nil {
+			return nil, err
+		}
+		o := createZsetObject()
+		for ; l > 0; l-- {
+			ele, err := rdbLoadStringObject(r)
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if rdbtype == REDIS_RDB_TYPE_ZSET_2 {
+				score, err = rdbLoadBinaryDoubleValue(r)
+			} else {
+				score, err = rdbLoadDoubleValue(r)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := rdbZsetAdd(o, ele, score); err != nil {
+				return nil, err
+			}
+		}
+		return o, nil
+	case REDIS_RDB_TYPE_LIST_QUICKLIST, REDIS_RDB_TYPE_LIST_QUICKLIST_2:
+		l, _, err := rdbLoadLen(r)
+		if err != nil {
+			return nil, err
+		}
+		o := createListListpackObject()
+		for ; l > 0; l-- {
+			container := uint64(QUICKLIST_NODE_CONTAINER_PACKED)
+			if rdbtype == REDIS_RDB_TYPE_LIST_QUICKLIST_2 {
+				if container, _, err = rdbLoadLen(r); err != nil {
+					return nil, err
+				}
+			}
+			var elements []string
+			switch container {
+			case QUICKLIST_NODE_CONTAINER_PLAIN:
+				ele, err := rdbLoadString(r)
+				if err != nil {
+					return nil, err
+				}
+				elements = []string{ele}
+			case QUICKLIST_NODE_CONTAINER_PACKED:
+				if elements, err = rdbLoadEncodedElements(r, rdbtype); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("Quicklist integrity check failed, unknown container %d", container)
+			}
+			for _, ele := range elements {
+				rdbListAdd(o, createStringObject(&ele, len(ele)))
+			}
+		}
+		return o, nil
+	case REDIS_RDB_TYPE_LIST_ZIPLIST:
+		elements, err := rdbLoadEncodedElements(r, rdbtype)
+		if err != nil {
+			return nil, err
+		}
+		o := createListListpackObject()
+		for _, ele := range elements {
+			rdbListAdd(o, createStringObject(&ele, len(ele)))
+		}
+		return o, nil
+	case REDIS_RDB_TYPE_SET_INTSET, REDIS_RDB_TYPE_SET_LISTPACK:
+		elements, err := rdbLoadEncodedElements(r, rdbtype)
+		if err != nil {
+			return nil, err
+		}
+		o := rdbSetCreate(len(elements))
+		for _, ele := range elements {
+			if err := rdbSetAdd(o, createStringObject(&ele, len(ele))); err != nil {
+				return nil, err
+			}
+		}
+		return o, nil
+	case REDIS_RDB_TYPE_HASH_ZIPLIST, REDIS_RDB_TYPE_HASH_LISTPACK, REDIS_RDB_TYPE_HASH_LISTPACK_EX:
+		//the expires are absolute, the earliest of them saved first is not needed.
+		if rdbtype == REDIS_RDB_TYPE_HASH_LISTPACK_EX {
+			if _, err := rdbLoadMillisecondTime(r); err != nil {
+				return nil, err
+			}
+		}
+		elements, err := rdbLoadEncodedElements(r, rdbtype)
+		if err != nil {
+			return nil, err
+		}
+		//the elements are field-value pairs, followed by the expire with REDIS_RDB_TYPE_HASH_LISTPACK_EX.
+		step := 2
+		if rdbtype == REDIS_RDB_TYPE_HASH_LISTPACK_EX {
+			step = 3
+		}
+		if len(elements)%step != 0 {
+			return nil, errors.New("Hash integrity check failed, wrong number of elements")
+		}
+		o := createHashObject()
+		now := time.Now().UnixMilli()
+		for i := 0; i < len(elements); i += step {
+			when := int64(-1)
+			if step == 3 {
+				//0 is saved for the fields with no expire.
+				ttl, err := strconv.ParseInt(elements[i+2], 10, 64)
+				if err != nil {
+					return nil, errors.New("Hash integrity check failed, invalid expire")
+				}
+				if ttl != 0 {
+					when = ttl
+				}
+			}
+			rdbHashAdd(o, createStringObject(&elements[i], len(elements[i])),
+				createStringObject(&elements[i+1], len(elements[i+1])), when, now)
+		}
+		return o, nil
+	case REDIS_RDB_TYPE_ZSET_ZIPLIST, REDIS_RDB_TYPE_ZSET_LISTPACK:
+		elements, err := rdbLoadEncodedElements(r, rdbtype)
+		if err != nil {
+			return nil, err
+		}
+		//the elements are member-score pairs.
+		if len(elements)%2 != 0 {
+			return nil, errors.New("Zset integrity check failed, wrong number of elements")
+		}
+		o := createZsetObject()
+		for i := 0; i < len(elements); i += 2 {
+			score, err := strconv.ParseFloat(elements[i+1], 64)
+			if err != nil || math.IsNaN(score) {
+				return nil, errors.New("Zset integrity check failed, invalid score")
+			}
+			if err := rdbZsetAdd(o, createStringObject(&elements[i], len(elements[i])), score); err != nil {
+				return nil, err
+			}
+		}
+		return o, nil
+	}
+	return nil, fmt.Errorf("Unknown RDB encoding type %d", rdbtype)
+}
+
+// check if the loaded container has no element, such a key is skipped.
+func rdbObjectIsEmpty(o *robj) bool {
+	switch o.robjType {
+	case REDIS_LIST:
+		return listTypeLength(o) == 0
+	case REDIS_SET:
+		return setTypeSize(o) == 0
+	case REDIS_HASH:
+		return hashTypeLength(o) == 0
+	case REDIS_ZSET:
+		return (*o.ptr).(*zset).zsl.length == 0
+	}
+	return false
+}
+
+/*
+*
+load the RDB file into the databases, the expired keys are skipped. A missing
+file is reported with an error satisfying os.IsNotExist.
+*/
+func rdbLoad(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := &rio{r: bufio.NewReader(f)}
+
+	buf := make([]byte, 9)
+	if err := r.read(buf); err != nil {
+		return err
+	}
+	if string(buf[:5]) != "REDIS" {
+		return errors.New("Wrong signature trying to load DB from file")
+	}
+	rdbver, err := strconv.Atoi(string(buf[5:]))
+	if err != nil || rdbver < 1 || rdbver > REDIS_RDB_MAX_LOAD_VERSION {
+		return fmt.Errorf("Can't handle RDB format version %s", buf[5:])
+	}
+
+	db := &server.db[0]
+	now := time.Now().UnixMilli()
+	expire := int64(-1)
+	for {
+		if err := r.read(buf[:1]); err != nil {
+			return err
+		}
+		rdbtype := buf[0]
+		switch rdbtype {
+		case REDIS_RDB_OPCODE_EXPIRETIME:
+			//the old expire time in seconds.
+			if err := r.read(buf[:4]); err != nil {
+				return err
+			}
+			expire = int64(int32(binary.LittleEndian.Uint32(buf[:4]))) * 1000
+			continue
+		case REDIS_RDB_OPCODE_EXPIRETIME_MS:
+			if err := r.read(buf[:8]); err != nil {
+				return err
+			}
+			expire = int64(binary.LittleEndian.Uint64(buf[:8]))
+			continue
+		case REDIS_RDB_OPCODE_FREQ:
+			//the LFU frequency is not used.
+			if err := r.read(buf[:1]); err != nil {
+				return err
+			}
+			continue
+		case REDIS_RDB_OPCODE_IDLE:
+			//the LRU idle time is not used.
+			if _, _, err := rdbLoadLen(r); err != nil {
+				return err
+			}
+			continue
+		case REDIS_RDB_OPCODE_SELECTDB:
+			dbid, _, err := rdbLoadLen(r)
+			if err != nil {
+				return err
+			}
+			if dbid >= uint64(server.dbnum) {
+				return fmt.Errorf("FATAL: Data file was created with a Redis server configured to handle more than %d databases. Exiting", server.dbnum)
+			}
+			db = &server.db[dbid]
+			continue
+		case REDIS_RDB_OPCODE_RESIZEDB:
+			dbSize, _, err := rdbLoadLen(r)
+			if err != nil {
+				return err
+			}
+			if _, _, err := rdbLoadLen(r); err != nil {
+				return err
+			}
+			dictExpand(&db.dict, dbSize)
+			continue
+		case REDIS_RDB_OPCODE_AUX:
+			auxkey, err := rdbLoadString(r)
+			if err != nil {
+				return err
+			}
+			auxval, err := rdbLoadString(r)
+			if err != nil {
+				return err
+			}
+			if auxkey == "redis-ver" {
+				redisLog(REDIS_NOTICE, "Loading RDB produced by version %s", auxval)
+			}
+			continue
+		case REDIS_RDB_OPCODE_EOF:
+		default:
+			key, err := rdbLoadStringObject(r)
+			if err != nil {
+				return err
+			}
+			val, err := rdbLoadObject(r, rdbtype)
+			if err != nil {
+				return err
+			}
+			//the keys already expired are not loaded, unless we are a replica: the master will send the DEL.
+			//the empty containers, such as a hash whose fields all expired, are not loaded either.
+			if (expire == -1 || expire > now || server.masterhost != "") && !rdbObjectIsEmpty(val) {
+				dbAdd(db, key, val)
+				if expire != -1 {
+					dictReplace(&db.expires, key, createStringObjectFromLongLong(expire))
+				}
+				if val.robjType == REDIS_HASH && hashTypeFieldExpires(val) != nil {
+					hashTypeAddToExpires(db, key)
+				}
+			}
+			expire = -1
+			continue
+		}
+		break
+	}
+
+	//verify the checksum if RDB version is >= 5, a zero checksum means the checksum was disabled.
+	if rdbver >= 5 {
+		expected := r.cksum
+		if err := r.read(buf[:8]); err != nil {
+			return err
+		}
+		cksum := binary.LittleEndian.Uint64(buf[:8])
+		if cksum != 0 && cksum != expected {
+			return errors.New("Wrong RDB checksum")
+		}
+	}
+	return nil
+}
+
+/*
+*
+SAVE
+*/
+func saveCommand(c *redisClient) {
+	if server.rdbChildRunning {
+		reply := "Background save already in progress"
+		addReplyError(c, &reply)
+		return
+	}
+	if rdbSave(server.rdbFilename) == nil {
+		addReply(c, shared.ok)
+	} else {
+		addReply(c, shared.err)
+	}
+}
+
+/*
+*
+BGSAVE [SCHEDULE]
+*/
+func bgsaveCommand(c *redisClient) {
+	schedule := false
+	if c.argc > 1 {
+		if c.argc == 2 && strings.EqualFold((*c.argv[1].ptr).(string), "schedule") {
+			schedule = true
+		} else {
+			addReply(c, shared.syntaxerr)
+			return
+		}
+	}
+
+	if server.rdbChildRunning {
+		reply := "Background save already in progress"
+		addReplyError(c, &reply)
+		return
+	} else if hasActiveChildProcess() {
+		if schedule {
+			server.rdbBgsaveScheduled = true
+			addReplyStatus(c, "Background saving scheduled")
+		} else {
+			reply := "Another child process is active (AOF?): can't BGSAVE right now. " +
+				"Use BGSAVE SCHEDULE in order to schedule a BGSAVE whenever possible."
+			addReplyError(c, &reply)
+		}
+		return
+	}
+	if err := rdbSaveBackground(server.rdbFilename); err != nil {
+		addReply(c, shared.err)
+		return
+	}
+	addReplyStatus(c, "Background saving started")
+}
+
+/*
+*
+LASTSAVE
+*/
+func lastsaveCommand(c *redisClient) {
+	addReplyLongLong(c, server.lastsave)
+}
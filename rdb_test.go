@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRdbSaveAndLoad(t *testing.T) {
+	resetTestDbs(2)
+	db := &server.db[0]
+
+	long := strings.Repeat("compressible ", 20)
+	dbAdd(db, testStringObject("str"), testStringObject("hello"))
+	dbAdd(db, testStringObject("long"), testStringObject(long))
+	dbAdd(db, testStringObject("int"), createStringObjectFromLongLong(123456789012))
+	dbAdd(db, testStringObject("negative"), testStringObject("-42"))
+
+	l := createListListpackObject()
+	listTypePush(l, testStringObject("a"), REDIS_TAIL)
+	listTypePush(l, tryObjectEncoding(testStringObject("70000")), REDIS_TAIL)
+	dbAdd(db, testStringObject("list"), l)
+
+	h := createHashObject()
+	hashTypeSet(h, testStringObject("field"), testStringObject("value"), 0)
+	dbAdd(db, testStringObject("hash"), h)
+
+	//a hash with an expiring field, and one with an expired field that is not loaded.
+	h = createHashObject()
+	hashTypeSet(h, testStringObject("persistent"), testStringObject("v"), 0)
+	hashTypeSet(h, testStringObject("volatile"), testStringObject("v"), 0)
+	hashTypeSet(h, testStringObject("expired"), testStringObject("v"), 0)
+	hashTypeSetExpire(h, testStringObject("volatile"), time.Now().UnixMilli()+100000)
+	hashTypeSetExpire(h, testStringObject("expired"), time.Now().UnixMilli()-1000)
+	dbAdd(db, testStringObject("hfe"), h)
+
+	//an intset and a set with a member that is not an integer.
+	server.setMaxIntsetEntries = 512
+	s := setTypeCreate(testStringObject("1"), 1)
+	setTypeAdd(s, testStringObject("1"))
+	setTypeAdd(s, testStringObject("-70000"))
+	dbAdd(db, testStringObject("intset"), s)
+	s = setTypeCreate(testStringObject("member"), 1)
+	setTypeAdd(s, testStringObject("member"))
+	setTypeAdd(s, testStringObject("2"))
+	dbAdd(db, testStringObject("set"), s)
+
+	z := createZsetObject()
+	zs := (*z.ptr).(*zset)
+	for i, member := range []string{"one", "two", "inf"} {
+		score := float64(i + 1)
+		if member == "inf" {
+			score = math.Inf(1)
+		}
+		zslInsert(zs.zsl, score, testStringObject(member))
+		zs.dict[member] = &score
+	}
+	dbAdd(db, testStringObject("zset"), z)
+
+	//a key with a ttl in the future and an expired one.
+	volatile := testStringObject("volatile")
+	dbAdd(db, volatile, testStringObject("v"))
+	dictReplace(&db.expires, volatile, createStringObjectFromLongLong(time.Now().UnixMilli()+100000))
+	expired := testStringObject("expired")
+	dbAdd(db, expired, testStringObject("v"))
+	dictReplace(&db.expires, expired, createStringObjectFromLongLong(time.Now().UnixMilli()-1000))
+
+	dbAdd(&server.db[1], testStringObject("other"), testStringObject("db"))
+
+	filename := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := rdbWriteSnapshot(filename, rdbSnapshot()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	resetTestDbs(2)
+	if err := rdbLoad(filename); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	db = &server.db[0]
+
+	expectString := func(key string, expected string) {
+		o := lookupKey(db, testStringObject(key))
+		if o == nil || o.robjType != REDIS_STRING || o.String() != expected {
+			t.Errorf("unexpected value of %s: %v", key, o)
+		}
+	}
+	expectString("str", "hello")
+	expectString("long", long)
+	expectString("int", "123456789012")
+	expectString("negative", "-42")
+	expectString("volatile", "v")
+
+	if lookupKey(db, testStringObject("expired")) != nil {
+		t.Error("the expired key was loaded")
+	}
+	if dictFind(&db.expires, "volatile") == nil {
+		t.Error("the expire of the volatile key was not loaded")
+	}
+
+	var entry listTypeEntry
+	l = lookupKey(db, testStringObject("list"))
+	if l == nil || listTypeLength(l) != 2 || !listTypeNext(listTypeInitIterator(l, -1, REDIS_TAIL), &entry) ||
+		listTypeGet(&entry).String() != "70000" {
+		t.Error("the list was not loaded")
+	}
+
+	h = lookupKey(db, testStringObject("hash"))
+	if h == nil || hashTypeGetValueObject(h, testStringObject("field")) == nil ||
+		hashTypeGetValueObject(h, testStringObject("field")).String() != "value" {
+		t.Error("the hash was not loaded")
+	}
+	h = lookupKey(db, testStringObject("hfe"))
+	if h == nil || hashTypeLength(h) != 2 || hashTypeExists(h, testStringObject("expired")) ||
+		hashTypeGetExpire(h, testStringObject("persistent")) != -1 ||
+		hashTypeGetExpire(h, testStringObject("volatile")) < time.Now().UnixMilli() ||
+		dictFind(&db.hexpires, "hfe") == nil {
+		t.Error("the hash with expiring fields was not loaded")
+	}
+
+	s = lookupKey(db, testStringObject("intset"))
+	if s == nil || s.encoding != REDIS_ENCODING_INTSET || setTypeSize(s) != 2 || !setTypeIsMember(s, testStringObject("-70000")) {
+		t.Error("the intset was not loaded")
+	}
+	s = lookupKey(db, testStringObject("set"))
+	if s == nil || s.encoding != REDIS_ENCODING_HT || setTypeSize(s) != 2 || !setTypeIsMember(s, testStringObject("2")) {
+		t.Error("the set was not loaded")
+	}
+
+	z = lookupKey(db, testStringObject("zset"))
+	if z == nil || (*z.ptr).(*zset).zsl.length != 3 || !math.IsInf(*(*z.ptr).(*zset).dict["inf"], 1) ||
+		(*z.ptr).(*zset).zsl.header.level[0].forward.obj.String() != "one" {
+		t.Error("the zset was not loaded")
+	}
+
+	if lookupKey(&server.db[1], testStringObject("other")) == nil {
+		t.Error("the key of the second db was not loaded")
+	}
+}
+
+func TestRdbLoadCorrupted(t *testing.T) {
+	resetTestDbs(1)
+	dbAdd(&server.db[0], testStringObject("key"), testStringObject("value"))
+	filename := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := rdbWriteSnapshot(filename, rdbSnapshot()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	//flip a byte of the value, the checksum no longer matches.
+	content, _ := os.ReadFile(filename)
+	i := strings.Index(string(content), "value")
+	content[i] = 'V'
+	_ = os.WriteFile(filename, content, 0644)
+
+	resetTestDbs(1)
+	if err := rdbLoad(filename); err == nil || err.Error() != "Wrong RDB checksum" {
+		t.Fatal("expected a checksum error, got", err)
+	}
+}
+
+func TestRdbSnapshotShared(t *testing.T) {
+	resetTestDbs(1)
+	server.snapshotsInUse = nil
+	db := &server.db[0]
+	dbAdd(db, testStringObject("str"), testStringObject("old"))
+	l := createListListpackObject()
+	listTypePush(l, testStringObject("a"), REDIS_TAIL)
+	dbAdd(db, testStringObject("list"), l)
+	h := createHashObject()
+	hashTypeSet(h, testStringObject("field"), testStringObject("old"), 0)
+	if h.encoding == REDIS_ENCODING_LISTPACK {
+		hashTypeConvert(h, REDIS_ENCODING_HT)
+	}
+	dbAdd(db, testStringObject("hash"), h)
+	z := createZsetObject()
+	var retflags int
+	var newscore float64
+	for i := 0; i < 100; i++ {
+		zsetAdd(z, float64(i), testStringObject("m"+strconv.Itoa(i)), ZADD_IN_NONE, &retflags, &newscore)
+	}
+	dbAdd(db, testStringObject("zset"), z)
+
+	id, snapshot := rdbSnapshotShared()
+
+	//the values are copied when they are looked up, the snapshot keeps the original ones.
+	if lookupKeyRead(db, testStringObject("str")) == snapshot[0].vals[0] {
+		t.Error("the string shared with the snapshot was not copied")
+	}
+	listTypePush(lookupKeyWrite(db, testStringObject("list")), testStringObject("b"), REDIS_TAIL)
+	hashTypeSet(lookupKeyWrite(db, testStringObject("hash")), testStringObject("field"), testStringObject("new"), 0)
+	zsetAdd(lookupKeyWrite(db, testStringObject("zset")), 1000, testStringObject("m0"), ZADD_IN_NONE, &retflags, &newscore)
+	if listTypeLength(l) != 1 || hashTypeGetValueObject(h, testStringObject("field")).String() != "old" ||
+		(*z.ptr).(*zset).zsl.tail.obj.String() != "m99" || *(*z.ptr).(*zset).dict["m0"] != 0 {
+		t.Error("a value shared with the snapshot was modified")
+	}
+	zcopy := lookupKey(db, testStringObject("zset"))
+	if zcopy == z || (*zcopy.ptr).(*zset).zsl.tail.obj.String() != "m0" ||
+		zslGetRank((*zcopy.ptr).(*zset).zsl, 50, testStringObject("m50")) != 50 {
+		t.Error("the copy of the zset was not modified")
+	}
+	//once copied, the value is no longer shared.
+	if lookupKey(db, testStringObject("zset")) != zcopy {
+		t.Error("the value was copied twice")
+	}
+
+	filename := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := rdbWriteSnapshot(filename, snapshot); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	rdbReleaseSnapshot(id)
+	if len(server.snapshotsInUse) != 0 || rdbSnapshotInUse(zcopy) || rdbSnapshotInUse(z) {
+		t.Error("the snapshot was not released")
+	}
+
+	resetTestDbs(1)
+	if err := rdbLoad(filename); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	db = &server.db[0]
+	if o := lookupKey(db, testStringObject("list")); o == nil || listTypeLength(o) != 1 {
+		t.Error("the snapshot does not contain the original list")
+	}
+	if o := lookupKey(db, testStringObject("hash")); o == nil || hashTypeGetValueObject(o, testStringObject("field")).String() != "old" {
+		t.Error("the snapshot does not contain the original hash")
+	}
+	if o := lookupKey(db, testStringObject("zset")); o == nil || *(*o.ptr).(*zset).dict["m0"] != 0 {
+		t.Error("the snapshot does not contain the original zset")
+	}
+}
+
+// write an RDB file with the specified version, the keys of the DB 0 are saved by save.
+func testWriteRdb(t *testing.T, version int, save func(r *rio)) string {
+	filename := filepath.Join(t.TempDir(), "dump.rdb")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer f.Close()
+	r := &rio{w: bufio.NewWriter(f)}
+	_ = r.write([]byte(fmt.Sprintf("REDIS%04d", version)))
+	_ = rdbSaveType(r, REDIS_RDB_OPCODE_SELECTDB)
+	_ = rdbSaveLen(r, 0)
+	save(r)
+	_ = rdbSaveType(r, REDIS_RDB_OPCODE_EOF)
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, r.cksum)
+	_ = r.write(buf)
+	if err := r.w.Flush(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return filename
+}
+
+// save a key whose value is a single string, such as a listpack.
+func testSaveEncoded(r *rio, rdbtype byte, key string, blob []byte) {
+	_ = rdbSaveType(r, rdbtype)
+	_ = rdbSaveRawString(r, key)
+	_ = rdbSaveRawString(r, string(blob))
+}
+
+func testListpack(elements ...string) []byte {
+	lp := lpNew(0)
+	for _, ele := range elements {
+		lp = lpAppend(lp, []byte(ele))
+	}
+	return lp
+}
+
+// encode a ziplist as redis does, the integers use the smallest encoding.
+func testZiplist(elements ...string) []byte {
+	zl := make([]byte, ZIPLIST_HEADER_SIZE)
+	prevlen := 0
+	for _, ele := range elements {
+		var entry []byte
+		if prevlen < ZIP_BIG_PREVLEN {
+			entry = []byte{byte(prevlen)}
+		} else {
+			entry = binary.LittleEndian.AppendUint32([]byte{ZIP_BIG_PREVLEN}, uint32(prevlen))
+		}
+		v, err := strconv.ParseInt(ele, 10, 64)
+		switch {
+		case err != nil && len(ele) < 64:
+			entry = append(entry, byte(len(ele)))
+			entry = append(entry, ele...)
+		case err != nil:
+			entry = append(entry, byte(ZIP_STR_14B|len(ele)>>8), byte(len(ele)))
+			entry = append(entry, ele...)
+		case v >= 0 && v <= 12:
+			entry = append(entry, byte(ZIP_INT_IMM_MIN+v))
+		case v >= math.MinInt8 && v <= math.MaxInt8:
+			entry = append(entry, ZIP_INT_8B, byte(v))
+		case v >= math.MinInt16 && v <= math.MaxInt16:
+			entry = binary.LittleEndian.AppendUint16(append(entry, ZIP_INT_16B), uint16(v))
+		case v >= -1<<23 && v < 1<<23:
+			entry = append(entry, ZIP_INT_24B, byte(v), byte(v>>8), byte(v>>16))
+		case v >= math.MinInt32 && v <= math.MaxInt32:
+			entry = binary.LittleEndian.AppendUint32(append(entry, ZIP_INT_32B), uint32(v))
+		default:
+			entry = binary.LittleEndian.AppendUint64(append(entry, ZIP_INT_64B), uint64(v))
+		}
+		prevlen = len(entry)
+		zl = append(zl, entry...)
+	}
+	zl = append(zl, ZIP_END)
+	binary.LittleEndian.PutUint32(zl[0:4], uint32(len(zl)))
+	binary.LittleEndian.PutUint32(zl[4:8], uint32(len(zl)-1-prevlen))
+	binary.LittleEndian.PutUint16(zl[8:10], uint16(len(elements)))
+	return zl
+}
+
+func TestRdbVersion(t *testing.T) {
+	resetTestDbs(1)
+	db := &server.db[0]
+	dbAdd(db, testStringObject("str"), testStringObject("v"))
+	filename := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := rdbWriteSnapshot(filename, rdbSnapshot()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if content, _ := os.ReadFile(filename); !strings.HasPrefix(string(content), "REDIS0009") {
+		t.Errorf("unexpected header %q", content[:9])
+	}
+
+	//the expires of the hash fields need the version introducing REDIS_RDB_TYPE_HASH_METADATA.
+	h := createHashObject()
+	hashTypeSet(h, testStringObject("f"), testStringObject("v"), 0)
+	hashTypeSetExpire(h, testStringObject("f"), time.Now().UnixMilli()+100000)
+	dbAdd(db, testStringObject("hfe"), h)
+	if err := rdbWriteSnapshot(filename, rdbSnapshot()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	content, _ := os.ReadFile(filename)
+	if !strings.HasPrefix(string(content), "REDIS0012") {
+		t.Errorf("unexpected header %q", content[:9])
+	}
+	resetTestDbs(1)
+	if err := rdbLoad(filename); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if h = lookupKey(&server.db[0], testStringObject("hfe")); h == nil || hashTypeGetExpire(h, testStringObject("f")) == -1 {
+		t.Error("the hash with an expiring field was not loaded")
+	}
+
+	//the versions newer than the loader are refused.
+	copy(content, "REDIS0013")
+	_ = os.WriteFile(filename, content, 0644)
+	if err := rdbLoad(filename); err == nil || !strings.Contains(err.Error(), "Can't handle RDB format version") {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestRdbLoadEncodedTypes(t *testing.T) {
+	server.setMaxIntsetEntries = 512
+	load := func(version int, save func(r *rio)) {
+		resetTestDbs(1)
+		if err := rdbLoad(testWriteRdb(t, version, save)); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	elements := func(key string) []string {
+		o := lookupKey(&server.db[0], testStringObject(key))
+		if o == nil {
+			return nil
+		}
+		var result []string
+		switch o.robjType {
+		case REDIS_LIST:
+			var entry listTypeEntry
+			li := listTypeInitIterator(o, 0, REDIS_TAIL)
+			for listTypeNext(li, &entry) {
+				result = append(result, listTypeGet(&entry).String())
+			}
+		case REDIS_SET:
+			si := setTypeInitIterator(o)
+			for ele := setTypeNextObject(si); ele != nil; ele = setTypeNextObject(si) {
+				result = append(result, ele.String())
+			}
+			sort.Strings(result)
+		case REDIS_HASH:
+			hi := hashTypeInitIterator(o)
+			for hashTypeNext(hi) {
+				result = append(result, hashTypeCurrentObject(hi, REDIS_HASH_KEY).String()+"="+
+					hashTypeCurrentObject(hi, REDIS_HASH_VALUE).String())
+			}
+			sort.Strings(result)
+		case REDIS_ZSET:
+			for x := (*o.ptr).(*zset).zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+				result = append(result, x.obj.String()+"="+strconv.FormatFloat(x.score, 'g', -1, 64))
+			}
+		}
+		return result
+	}
+	expect := func(key string, expected ...string) {
+		if got := elements(key); strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Errorf("unexpected elements of %s: %v", key, got)
+		}
+	}
+
+	//the ziplists and the quicklist of ziplists of the files saved before the version 10.
+	big := strings.Repeat("s", 100)
+	load(9, func(r *rio) {
+		testSaveEncoded(r, REDIS_RDB_TYPE_LIST_ZIPLIST, "list", testZiplist("x", "7", "-100", "-300", "100000", "-2000000000", "5000000000", big))
+		testSaveEncoded(r, REDIS_RDB_TYPE_HASH_ZIPLIST, "hash", testZiplist("f", "v", "n", "12"))
+		testSaveEncoded(r, REDIS_RDB_TYPE_ZSET_ZIPLIST, "zset", testZiplist("a", "1", "b", "2.5"))
+		_ = rdbSaveType(r, REDIS_RDB_TYPE_LIST_QUICKLIST)
+		_ = rdbSaveRawString(r, "quicklist")
+		_ = rdbSaveLen(r, 2)
+		_ = rdbSaveRawString(r, string(testZiplist("a", "b")))
+		_ = rdbSaveRawString(r, string(testZiplist("c")))
+		testSaveEncoded(r, REDIS_RDB_TYPE_SET_INTSET, "intset", []byte{2, 0, 0, 0, 2, 0, 0, 0, 0xFE, 0xFF, 7, 0})
+		testSaveEncoded(r, REDIS_RDB_TYPE_HASH_ZIPLIST, "empty", testZiplist())
+	})
+	expect("list", "x", "7", "-100", "-300", "100000", "-2000000000", "5000000000", big)
+	expect("hash", "f=v", "n=12")
+	expect("zset", "a=1", "b=2.5")
+	expect("quicklist", "a", "b", "c")
+	expect("intset", "-2", "7")
+	if lookupKey(&server.db[0], testStringObject("empty")) != nil {
+		t.Error("an empty hash was loaded")
+	}
+
+	//the listpacks and the quicklist of listpacks of the versions 10 and 11.
+	load(11, func(r *rio) {
+		testSaveEncoded(r, REDIS_RDB_TYPE_SET_LISTPACK, "set", testListpack("b", "a", "1"))
+		testSaveEncoded(r, REDIS_RDB_TYPE_HASH_LISTPACK, "hash", testListpack("f", "v", "n", "1"))
+		testSaveEncoded(r, REDIS_RDB_TYPE_ZSET_LISTPACK, "zset", testListpack("a", "-1", "b", "2.5", "c", "inf"))
+		_ = rdbSaveType(r, REDIS_RDB_TYPE_LIST_QUICKLIST_2)
+		_ = rdbSaveRawString(r, "quicklist")
+		_ = rdbSaveLen(r, 2)
+		_ = rdbSaveLen(r, QUICKLIST_NODE_CONTAINER_PACKED)
+		_ = rdbSaveRawString(r, string(testListpack("a", "2")))
+		_ = rdbSaveLen(r, QUICKLIST_NODE_CONTAINER_PLAIN)
+		_ = rdbSaveRawString(r, big)
+		testSaveEncoded(r, REDIS_RDB_TYPE_SET_LISTPACK, "empty", testListpack())
+	})
+	expect("set", "1", "a", "b")
+	expect("hash", "f=v", "n=1")
+	expect("zset", "a=-1", "b=2.5", "c=+Inf")
+	expect("quicklist", "a", "2", big)
+	if lookupKey(&server.db[0], testStringObject("empty")) != nil {
+		t.Error("an empty set was loaded")
+	}
+
+	//the listpack of a hash with expiring fields of the version 12, 0 means no expire.
+	now := time.Now().UnixMilli()
+	load(12, func(r *rio) {
+		_ = rdbSaveType(r, REDIS_RDB_TYPE_HASH_LISTPACK_EX)
+		_ = rdbSaveRawString(r, "hash")
+		_ = rdbSaveMillisecondTime(r, now-1000)
+		_ = rdbSaveRawString(r, string(testListpack("keep", "v", "0", "volatile", "v", strconv.FormatInt(now+100000, 10),
+			"expired", "v", strconv.FormatInt(now-1000, 10))))
+	})
+	expect("hash", "keep=v", "volatile=v")
+	if h := lookupKey(&server.db[0], testStringObject("hash")); h == nil || hashTypeGetExpire(h, testStringObject("volatile")) != now+100000 ||
+		dictFind(&server.db[0].hexpires, "hash") == nil {
+		t.Error("the expire of the field was not loaded")
+	}
+
+	//the corrupted containers are refused.
+	corruptedListpack := testListpack("a", "b")
+	corruptedListpack[LP_HDR_SIZE] = 0xF5
+	corruptedZiplist := testZiplist("a", "b")
+	corruptedZiplist[len(corruptedZiplist)-3] = ZIP_INT_24B
+	for _, c := range []struct {
+		rdbtype byte
+		blob    []byte
+		err     string
+	}{
+		{REDIS_RDB_TYPE_HASH_LISTPACK, corruptedListpack, "Listpack integrity check failed"},
+		{REDIS_RDB_TYPE_HASH_LISTPACK, testListpack("f"), "wrong number of elements"},
+		{REDIS_RDB_TYPE_SET_LISTPACK, testListpack("a", "a"), "Duplicate set members"},
+		{REDIS_RDB_TYPE_ZSET_LISTPACK, testListpack("a", "nan"), "invalid score"},
+		{REDIS_RDB_TYPE_ZSET_ZIPLIST, testZiplist("a", "1", "a", "2"), "Duplicate zset fields"},
+		{REDIS_RDB_TYPE_ZSET_ZIPLIST, corruptedZiplist, "Ziplist integrity check failed"},
+		{REDIS_RDB_TYPE_SET_INTSET, []byte{2, 0, 0, 0, 2, 0, 0, 0, 7, 0, 7, 0}, "Intset integrity check failed"},
+	} {
+		resetTestDbs(1)
+		err := rdbLoad(testWriteRdb(t, 11, func(r *rio) { testSaveEncoded(r, c.rdbtype, "key", c.blob) }))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("type %d: unexpected error %v", c.rdbtype, err)
+		}
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
+	REDIS_VERSION = "7.2.0"
+
 	REDIS_CMD_WRITE           = 1    /* "w" flag */
 	REDIS_CMD_READONLY        = 2    /* "r" flag */
 	REDIS_CMD_DENYOOM         = 4    /* "m" flag */
@@ -31,6 +35,11 @@ const (
 	REDIS_CALL_PROPAGATE = 4
 	REDIS_CALL_FULL      = (REDIS_CALL_SLOWLOG | REDIS_CALL_STATS | REDIS_CALL_PROPAGATE)
 
+	/* Command propagation flags, see propagate() function */
+	REDIS_PROPAGATE_NONE = 0
+	REDIS_PROPAGATE_AOF  = 1
+	REDIS_PROPAGATE_REPL = 2
+
 	/* Units */
 	UNIT_SECONDS      = 0
 	UNIT_MILLISECONDS = 1
@@ -40,6 +49,7 @@ const (
 	REDIS_SET_XX       = (1 << 1) /* Set if key exists. */
 
 	REDIS_DEFAULT_DBNUM = 16
+	REDIS_DEFAULT_HZ    = 10 /* Time interrupt calls/sec. */
 
 	/* Object types */
 	REDIS_STRING = 0
@@ -51,15 +61,17 @@ const (
 	/* Objects encoding. Some kind of objects like Strings and Hashes can be
 	 * internally represented in multiple ways. The 'encoding' field of the object
 	 * is set to one of this fields for this object. */
-	REDIS_ENCODING_RAW        = 0 /* Raw representation */
-	REDIS_ENCODING_INT        = 1 /* Encoded as integer */
-	REDIS_ENCODING_HT         = 2 /* Encoded as hash table */
-	REDIS_ENCODING_ZIPMAP     = 3 /* Encoded as zipmap */
-	REDIS_ENCODING_LINKEDLIST = 4 /* Encoded as regular linked list */
-	REDIS_ENCODING_ZIPLIST    = 5 /* Encoded as ziplist */
-	REDIS_ENCODING_INTSET     = 6 /* Encoded as intset */
-	REDIS_ENCODING_SKIPLIST   = 7 /* Encoded as skiplist */
-	REDIS_ENCODING_EMBSTR     = 8 /* Embedded sds string encoding */
+	REDIS_ENCODING_RAW        = 0  /* Raw representation */
+	REDIS_ENCODING_INT        = 1  /* Encoded as integer */
+	REDIS_ENCODING_HT         = 2  /* Encoded as hash table */
+	REDIS_ENCODING_ZIPMAP     = 3  /* Encoded as zipmap */
+	REDIS_ENCODING_LINKEDLIST = 4  /* Encoded as regular linked list */
+	REDIS_ENCODING_ZIPLIST    = 5  /* Encoded as ziplist */
+	REDIS_ENCODING_INTSET     = 6  /* Encoded as intset */
+	REDIS_ENCODING_SKIPLIST   = 7  /* Encoded as skiplist */
+	REDIS_ENCODING_EMBSTR     = 8  /* Embedded sds string encoding */
+	REDIS_ENCODING_QUICKLIST  = 9  /* Encoded as linked list of listpacks */
+	REDIS_ENCODING_LISTPACK   = 11 /* Encoded as a listpack */
 
 	/* List related stuff */
 	REDIS_HEAD = 0
@@ -71,26 +83,184 @@ const (
 	REDIS_HASH_KEY   = 1
 	REDIS_HASH_VALUE = 2
 
+	/* hashTypeSet() flags */
+	REDIS_HASH_SET_KEEP_TTL = 1 /* Keep the expire of an updated field */
+
+	/* The latest expire time of a hash field, in milliseconds */
+	HASH_FIELD_EXPIRE_TIME_MAX = (1 << 48) - 1
+
+	/* Active expire of the hash fields */
+	ACTIVE_EXPIRE_CYCLE_LOOKUPS_PER_LOOP = 20 /* Hashes sampled per DB every cycle */
+
 	ZSKIPLIST_MAXLEVEL = 32
 	ZSKIPLIST_P        = 0.25
+
+	/* Input flags of zsetAdd() */
+	ZADD_IN_NONE = 0
+	ZADD_IN_INCR = 1 << 0 /* Increment the score instead of setting it */
+	ZADD_IN_NX   = 1 << 1 /* Don't touch elements not already existing */
+	ZADD_IN_XX   = 1 << 2 /* Only touch elements already existing */
+	ZADD_IN_GT   = 1 << 3 /* Only update existing when new scores are higher */
+	ZADD_IN_LT   = 1 << 4 /* Only update existing when new scores are lower */
+
+	/* Output flags of zsetAdd() */
+	ZADD_OUT_NOP     = 1 << 0 /* Operation not performed because of conditionals */
+	ZADD_OUT_NAN     = 1 << 1 /* The resulting score is not a number */
+	ZADD_OUT_ADDED   = 1 << 2 /* The element was new and was added */
+	ZADD_OUT_UPDATED = 1 << 3 /* The element already existed, score updated */
 )
 
 type redisServer struct {
-	//record the ip and port number of the redis server.
-	ip   string
-	port int
+	//absolute path of the config file, empty if the server runs with the default config.
+	configfile string
+	//record the addresses and port number of the redis server.
+	bindaddr []string
+	port     int
 	//semaphore used to notify shutdown.
 	shutDownCh    chan struct{}
-	commandCh     chan redisClient
-	closeClientCh chan redisClient
+	commandCh     chan *redisClient
+	closeClientCh chan *redisClient
 	done          atomic.Int32
+	//connections accepted by the listeners, handed over to the event loop.
+	acceptCh chan net.Conn
+	//functions run by the event loop on behalf of the background goroutines.
+	eventCh chan func()
 	//record all connected clients.
 	clients sync.Map
+	//the id assigned to the next connected client.
+	nextClientId atomic.Uint64
+	//the number of connected clients, checked against maxclients when accepting.
+	connectedClients atomic.Int64
 	//listen and process new connections.
-	listen   net.Listener
-	commands map[string]redisCommand
-	db       []redisDb
-	dbnum    int
+	listeners []net.Listener
+	commands  map[string]*redisCommand
+	//clients that have replies to flush in beforeSleep and clients to close asynchronously.
+	clientsPendingWrite *list
+	clientsToClose      *list
+	clientObufLimits    [REDIS_CLIENT_TYPE_COUNT]clientBufferLimitsConfig
+	hz                  int
+	cronTicker          *time.Ticker
+	cronloops           int64 /* Number of times the cron function run */
+	db                  []redisDb
+	dbnum               int
+	//close the clients idle for more than maxidletime seconds, 0 means never.
+	maxidletime int
+	maxclients  int
+	//max number of memory bytes to use, and the memory used as sampled by serverCron.
+	maxmemory      int64
+	statUsedMemory int64
+	//changes to DB from the last save
+	dirty             int64
+	dirtyBeforeBgsave int64 /* Used to restore dirty on failed BGSAVE */
+	//save points array for RDB
+	saveparams           []saveparam
+	rdbFilename          string     /* Name of RDB file */
+	rdbChildRunning      bool       /* A background save is in progress */
+	rdbBgsaveScheduled   bool       /* BGSAVE when possible if true. */
+	rdbTmpfile           string     /* The temp file written by the background save */
+	rdbSaveId            int64      /* Makes the temp file of every background save unique */
+	rdbSaveTimeStart     int64      /* Current RDB save start time. */
+	rdbLastBgsaveTimeSec int64      /* Time used by last RDB save run. */
+	snapshotId           uint64     /* Id of the last snapshot of the keyspace shared with a goroutine */
+	snapshotsInUse       []uint64   /* Ids of the shared snapshots not encoded yet */
+	snapshotLock         sync.Mutex /* Held while a shared value is encoded or copied */
+	lastsave             int64      /* Unix time of last successful save */
+	lastbgsaveTry        int64      /* Unix time of last attempted bgsave */
+	lastbgsaveStatus     int        /* REDIS_OK or REDIS_ERR */
+	//AOF persistence
+	aofEnabled             bool         /* AOF configuration */
+	aofState               int          /* REDIS_AOF_(ON|OFF|WAIT_REWRITE) */
+	aofFsync               int          /* Kind of fsync() policy */
+	aofFilename            string       /* Basename of the AOF file and manifest file */
+	aofDirname             string       /* Name of the AOF directory */
+	aofManifest            *aofManifest /* Used to track AOFs. */
+	aofRewritePerc         int          /* Rewrite AOF if % growth is > M and... */
+	aofRewriteMinSize      int64        /* the AOF file is at least N bytes. */
+	aofRewriteBaseSize     int64        /* AOF size on latest startup or rewrite. */
+	aofLastIncrSize        int64        /* The size of the latest incr AOF. */
+	aofChildRunning        bool         /* A background AOF rewrite is in progress */
+	aofRewriteScheduled    bool         /* Rewrite once BGSAVE terminates. */
+	aofRewriteBuf          []byte       /* Hold changes during an AOF rewrite. */
+	aofRewriteTmpfile      string       /* The temp file written by the background rewrite */
+	aofRewriteId           int64        /* Makes the temp file of every rewrite unique */
+	aofRewriteTimeStart    int64        /* Current AOF rewrite start time. */
+	aofRewriteTimeLastSec  int64        /* Time used by last AOF rewrite run. */
+	aofLastbgrewriteStatus int          /* REDIS_OK or REDIS_ERR */
+	aofLoadTruncated       bool         /* Don't stop on unexpected AOF EOF. */
+	aofFd                  *os.File     /* File descriptor of currently selected AOF file */
+	aofSelectedDb          int          /* Currently selected DB in AOF */
+	aofBuf                 []byte       /* AOF buffer, written before entering the event loop */
+	aofCurrentSize         int64        /* AOF current size. */
+	aofFsyncOffset         int64        /* AOF offset which is already synced to disk. */
+	aofLastFsync           int64        /* Unix time of last fsync() */
+	aofFlushPostponedStart int64        /* Unix time of postponed AOF flush */
+	aofFsyncInProgress     atomic.Bool  /* A background fsync is running */
+	aofDelayedFsync        int64        /* delayed AOF fsync() counter */
+	aofLastWriteStatus     int          /* REDIS_OK or REDIS_ERR */
+	aofLastWriteErr        string       /* Valid if aofLastWriteStatus is ERR */
+	//replication (master)
+	replid               string /* My current replication ID. */
+	replid2              string /* replid inherited from master */
+	masterReplOffset     int64  /* My current replication offset */
+	secondReplidOffset   int64  /* Accept offsets up to this for replid2. */
+	slaveseldb           int    /* Last SELECTed DB in replication output */
+	replPingSlavePeriod  int    /* Master pings the slave every N seconds */
+	replBacklog          []byte /* Replication backlog for partial syncs */
+	replBacklogSize      int64  /* Backlog circular buffer size */
+	replBacklogHistlen   int64  /* Backlog actual data length */
+	replBacklogIdx       int64  /* Backlog circular buffer current offset, that is the next byte will be written to. */
+	replBacklogOff       int64  /* Replication "master offset" of first byte in the replication backlog buffer. */
+	slaves               *list  /* List of slaves */
+	clientsWaitingAcks   *list  /* Clients waiting in WAIT command. */
+	readyKeys            *list  /* List of readyList structures for BLPOP & co */
+	getackSlaves         bool   /* If true, send REPLCONF GETACK. */
+	replicationCronLoops int64  /* Number of times replicationCron() ran */
+	//replication (slave)
+	masterauth         string         /* AUTH with this password with master */
+	masterhost         string         /* Hostname of master */
+	masterport         int            /* Port of master */
+	replTimeout        int            /* Timeout after N seconds of master idle */
+	master             *redisClient   /* Client that is master for this slave */
+	replCachedMasterDb int            /* DB selected by the master when the link was lost */
+	replState          int            /* Replication status if the instance is a slave */
+	replHandshake      *replHandshake /* The connection attempt in progress */
+	replDownSince      int64          /* Unix time at which link with master went down */
+	replSlaveRo        bool           /* Slave is read only? */
+	//pubsub
+	pubsubChannels map[string]*list /* Map channels to list of subscribed clients */
+	pubsubPatterns map[string]*list /* Map patterns to list of subscribed clients */
+	//shard level channels bound to a hash slot, map channels to list of subscribed clients.
+	pubsubshardChannels map[string]*list
+	//hash, list and set encoding parameters
+	hashMaxListpackEntries int /* Max fields of a listpack encoded hash */
+	hashMaxListpackValue   int /* Max length of the fields and values of a listpack encoded hash */
+	listMaxListpackSize    int /* Fill factor of the quicklist nodes */
+	listCompressDepth      int /* Number of quicklist nodes never compressed at both ends */
+	setMaxIntsetEntries    int /* Max members of an intset encoded set */
+	//we are loading data from disk if true
+	loading bool
+	//logging
+	verbosity   int
+	logfile     string
+	logfileFd   *os.File
+	requirepass string
+	//fields used only for stats
+	statStartTime      int64 /* Server start time */
+	statNumcommands    int64 /* Number of processed commands */
+	statNumconnections int64 /* Number of connections received */
+	statExpiredkeys    int64 /* Number of expired keys */
+	statExpiredSubkeys int64 /* Number of expired hash fields */
+	statKeyspaceHits   int64 /* Number of successful lookups of keys */
+	statKeyspaceMisses int64 /* Number of failed lookups of keys */
+	statRejectedConn   int64 /* Clients rejected because of maxclients */
+	statSyncFull       int64 /* Number of full resyncs with slaves. */
+	statSyncPartialOk  int64 /* Number of accepted PSYNC requests. */
+	statSyncPartialErr int64 /* Number of unaccepted PSYNC requests. */
+}
+
+type saveparam struct {
+	seconds int64
+	changes int64
 }
 
 type robj = redisObject
@@ -99,6 +269,8 @@ type redisObject struct {
 	robjType int
 	encoding int
 	ptr      *interface{}
+	//id of the last snapshot sharing the object, see rdbSnapshotShared.
+	snapshotId uint64
 }
 
 /*
@@ -142,13 +314,37 @@ type zset struct {
 	zsl  *zskiplist
 }
 
+/*
+score区间的定义，例如ZRANGEBYSCORE key (1 5代表(1,5]
+*/
+type zrangespec struct {
+	min, max float64
+	//标识min和max是否为开区间
+	minex, maxex bool
+}
+
+/*
+字典序区间的定义，例如ZRANGEBYLEX key [a (c代表[a,c)
+"-"和"+"分别代表最小和最大的字符串，此时minInf或maxInf为-1或1
+*/
+type zlexrangespec struct {
+	min, max string
+	//标识min和max是否为开区间
+	minex, maxex bool
+	//-1代表"-"，1代表"+"，0代表普通字符串
+	minInf, maxInf int
+}
+
 func initServer() {
-	log.Println("init redis server")
-	server.ip = "localhost"
-	server.port = 6379
+	redisLog(REDIS_NOTICE, "init redis server")
 	server.shutDownCh = make(chan struct{})
-	server.closeClientCh = make(chan redisClient)
-	server.commandCh = make(chan redisClient)
+	server.closeClientCh = make(chan *redisClient)
+	server.commandCh = make(chan *redisClient)
+	server.acceptCh = make(chan net.Conn)
+	server.eventCh = make(chan func())
+	server.cronTicker = time.NewTicker(time.Second / time.Duration(server.hz))
+	server.clientsPendingWrite = listCreate()
+	server.clientsToClose = listCreate()
 
 	createSharedObjects()
 	server.db = make([]redisDb, server.dbnum)
@@ -159,37 +355,99 @@ func initServer() {
 		//server.db[j].expires = make(map[string]int64)
 		server.db[j].dict = *dictCreate(&dbDictType, nil)
 		server.db[j].expires = *dictCreate(&dbDictType, nil)
+		server.db[j].hexpires = *dictCreate(&dbDictType, nil)
+		server.db[j].watchedKeys = make(map[string]*list)
+		server.db[j].blockingKeys = make(map[string]*list)
+		server.db[j].readyKeys = make(map[string]struct{})
 	}
+	server.statStartTime = time.Now().Unix()
+	resetServerStats()
+	server.lastsave = time.Now().Unix()
+	server.lastbgsaveStatus = REDIS_OK
+	server.rdbLastBgsaveTimeSec = -1
+	server.aofLastWriteStatus = REDIS_OK
+	server.aofLastbgrewriteStatus = REDIS_OK
+	server.aofRewriteTimeLastSec = -1
+	server.slaves = listCreate()
+	server.clientsWaitingAcks = listCreate()
+	server.readyKeys = listCreate()
+	server.pubsubChannels = make(map[string]*list)
+	server.pubsubPatterns = make(map[string]*list)
+	server.pubsubshardChannels = make(map[string]*list)
+	server.slaveseldb = -1
+	changeReplicationId()
+	clearReplicationId2()
+}
+
+// reset the stats reported by INFO, used at startup and by CONFIG RESETSTAT.
+func resetServerStats() {
+	server.statNumcommands = 0
+	server.statNumconnections = 0
+	server.statExpiredkeys = 0
+	server.statExpiredSubkeys = 0
+	server.statKeyspaceHits = 0
+	server.statKeyspaceMisses = 0
+	server.statRejectedConn = 0
+	server.statSyncFull = 0
+	server.statSyncPartialOk = 0
+	server.statSyncPartialErr = 0
 }
 
-func loadServerConfig() {
-	log.Println("load redis server config")
-	server.dbnum = REDIS_DEFAULT_DBNUM
+// reset the calls and microseconds counters of every command.
+func resetCommandTableStats() {
+	for _, cmd := range server.commands {
+		cmd.microseconds = 0
+		cmd.calls = 0
+	}
 }
 
 func acceptTcpHandler(conn net.Conn) {
 	//the current server is being or has been shut down, and no new connections are being processed.
 	if server.done.Load() == 1 {
-		log.Println("the current service is being shut down. The connection is denied.")
+		redisLog(REDIS_VERBOSE, "the current service is being shut down. The connection is denied.")
 		_ = conn.Close()
-
+		return
 	}
+	//refuse the connection if the max number of clients is reached.
+	if server.connectedClients.Load() >= int64(server.maxclients) {
+		_, _ = conn.Write([]byte("-ERR max number of clients reached\r\n"))
+		_ = conn.Close()
+		server.statRejectedConn++
+		return
+	}
+	server.connectedClients.Add(1)
+	server.statNumconnections++
+	redisLog(REDIS_VERBOSE, "Accepted %s", conn.RemoteAddr())
 	//init the redis client and handles network read and write events.
 	c := createClient(conn)
-	server.clients.Store(c.string(), c)
+	server.clients.Store(c.id, c)
 	go readQueryFromClient(c, server.closeClientCh, server.commandCh)
 
 }
 
 func createClient(conn net.Conn) *redisClient {
 	c := redisClient{conn: conn, argc: 0, argv: make([]*robj, 0), multibulklen: -1}
+	c.id = server.nextClientId.Add(1)
+	c.resp = 2
+	c.cmdDone = make(chan struct{}, 1)
+	c.blockedCh = make(chan struct{}, 1)
+	c.buf = make([]byte, 0, REDIS_REPLY_CHUNK_BYTES)
+	c.reply = listCreate()
+	c.lastinteraction = time.Now().Unix()
+	initClientMultiState(&c)
+	c.watchedKeys = listCreate()
+	c.pubsubChannels = make(map[string]*robj)
+	c.pubsubPatterns = make(map[string]*robj)
+	c.pubsubshardChannels = make(map[string]*robj)
 	selectDb(&c, 0)
 	return &c
 }
 
 func closeRedisServer() {
-	log.Println("close listen and all redis client")
-	_ = server.listen.Close()
+	redisLog(REDIS_NOTICE, "close listen and all redis client")
+	for _, listen := range server.listeners {
+		_ = listen.Close()
+	}
 	server.clients.Range(func(key, value any) bool {
 		client := value.(*redisClient)
 		_ = client.conn.Close()
@@ -201,7 +459,8 @@ func closeRedisServer() {
 }
 
 func initServerConfig() {
-	server.commands = make(map[string]redisCommand)
+	initConfigValues()
+	server.commands = make(map[string]*redisCommand)
 
 	populateCommandTable()
 }
@@ -209,7 +468,7 @@ func initServerConfig() {
 func populateCommandTable() {
 
 	for i := 0; i < len(redisCommandTable); i++ {
-		redisCommand := redisCommandTable[i]
+		redisCommand := &redisCommandTable[i]
 		for _, f := range redisCommand.sflag {
 			if f == 'w' {
 				redisCommand.flag |= REDIS_CMD_WRITE
@@ -240,40 +499,392 @@ func populateCommandTable() {
 			} else {
 				log.Panicln("Unsupported command flag")
 			}
-
-			server.commands[redisCommand.name] = redisCommand
 		}
+		server.commands[redisCommand.name] = redisCommand
 
 	}
 }
 
+func lookupCommand(name string) *redisCommand {
+	return server.commands[strings.ToUpper(name)]
+}
+
 func processCommand(c *redisClient) {
 	//check the command table to see if the specified command exists.
 	ptr := c.argv[0].ptr
 	cmd, exists := server.commands[strings.ToUpper((*ptr).(string))]
 
+	if !exists {
+		flagTransaction(c)
+		reply := "unknown command"
+		addReplyError(c, &reply)
+		return
+	}
 	//assign the function of the command to "cmd".
 	c.cmd = cmd
 	c.lastCmd = cmd
-
-	if !exists {
-		c.conn.Write([]byte("-ERR unknown command\r\n"))
-		return
-	} else if (c.cmd.arity > 0 && c.cmd.arity != int64(c.argc)) ||
+	if (c.cmd.arity > 0 && c.cmd.arity != int64(c.argc)) ||
 		int64(c.argc) < -(c.cmd.arity) {
+		flagTransaction(c)
 		reply := "wrong number of arguments for " + (*ptr).(string) + " command"
 		addReplyError(c, &reply)
 		return
 	}
 
+	//check if the user is authenticated
+	if server.requirepass != "" && !c.authenticated && c.cmd.name != "AUTH" && c.cmd.name != "HELLO" {
+		flagTransaction(c)
+		addReplyErrorWithCode(c, "NOAUTH Authentication required.")
+		return
+	}
+
+	//refuse the commands that may grow the memory usage once maxmemory is reached, the master is always obeyed.
+	if server.maxmemory > 0 && c.flags&REDIS_MASTER == 0 && c.cmd.flag&REDIS_CMD_DENYOOM > 0 && server.statUsedMemory > server.maxmemory {
+		flagTransaction(c)
+		addReplyErrorWithCode(c, "OOM command not allowed when used memory > 'maxmemory'.")
+		return
+	}
+
+	//don't accept write commands if there are problems persisting on disk.
+	if server.aofState != REDIS_AOF_OFF && server.aofLastWriteStatus == REDIS_ERR && c.flags&REDIS_MASTER == 0 && c.cmd.flag&REDIS_CMD_WRITE > 0 {
+		flagTransaction(c)
+		addReplyErrorWithCode(c, "MISCONF Errors writing to the AOF file: "+server.aofLastWriteErr)
+		return
+	}
+
+	//don't accept write commands if this is a read only replica, but accept the ones sent by our master.
+	if server.masterhost != "" && server.replSlaveRo && c.flags&REDIS_MASTER == 0 && c.cmd.flag&REDIS_CMD_WRITE > 0 {
+		flagTransaction(c)
+		addReplyErrorWithCode(c, "READONLY You can't write against a read only replica.")
+		return
+	}
+
+	//only allow a subset of commands in the context of Pub/Sub, RESP3 clients can execute any command.
+	if c.flags&REDIS_PUBSUB > 0 && c.resp == 2 && c.cmd.name != "PING" &&
+		c.cmd.name != "SUBSCRIBE" && c.cmd.name != "UNSUBSCRIBE" &&
+		c.cmd.name != "PSUBSCRIBE" && c.cmd.name != "PUNSUBSCRIBE" &&
+		c.cmd.name != "SSUBSCRIBE" && c.cmd.name != "SUNSUBSCRIBE" {
+		flagTransaction(c)
+		reply := "Can't execute '" + strings.ToLower(c.cmd.name) + "': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING are allowed in this context"
+		addReplyError(c, &reply)
+		return
+	}
+
+	//the commands of a transaction are queued, they are executed by EXEC.
+	if c.flags&REDIS_MULTI > 0 && c.cmd.name != "EXEC" && c.cmd.name != "DISCARD" &&
+		c.cmd.name != "MULTI" && c.cmd.name != "WATCH" {
+		queueMultiCommand(c)
+		addReply(c, shared.queued)
+		return
+	}
 	//invoke "call" to pass the parameters to the function pointed to by "cmd" for processing.
 	call(c, REDIS_CALL_FULL)
+	//serve the clients blocked on the keys that received new data.
+	if listLength(server.readyKeys) > 0 {
+		handleClientsBlockedOnKeys()
+	}
+}
+
+/*
+*
+the event loop of the server: every command, client close request and timer
+event is processed by this single goroutine, so the data structures are never
+accessed concurrently.
+*/
+func aeMain(s *redisServer) {
+	defer s.cronTicker.Stop()
+	for {
+		select {
+		case conn := <-s.acceptCh:
+			acceptTcpHandler(conn)
+		case c := <-s.commandCh:
+			c.lastinteraction = time.Now().Unix()
+			/**
+			the stream of our master is added to our backlog and proxied to our replicas before the command is executed,
+			a transaction is held back until it is terminated so that our offset never points inside it.
+			*/
+			if c.flags&REDIS_MASTER > 0 {
+				c.pendingMasterStream = append(c.pendingMasterStream, c.argv[:c.argc])
+				if c.flags&REDIS_MULTI == 0 && !strings.EqualFold(c.argv[0].String(), "MULTI") {
+					replicationFeedPendingMasterStream(c)
+				}
+			}
+			//retrieve the Redis client from "commandCh" and call "processCommand" to handle the instructions parsed from the array.
+			processCommand(c)
+			if c.flags&REDIS_MASTER > 0 && c.flags&REDIS_MULTI == 0 {
+				replicationFeedPendingMasterStream(c)
+			}
+			if c.flags&REDIS_BLOCKED > 0 {
+				c.blockedCh <- struct{}{}
+			} else {
+				c.cmdDone <- struct{}{}
+			}
+		case c := <-s.closeClientCh:
+			//the reader hit EOF or a protocol error, in the latter case reply the error before closing.
+			if c.protocolError != "" {
+				addReplyError(c, &c.protocolError)
+				writeToClient(c)
+			}
+			freeClient(c)
+		case fn := <-s.eventCh:
+			fn()
+		case <-s.cronTicker.C:
+			serverCron()
+		}
+		beforeSleep()
+	}
+}
+
+/*
+*
+this function gets called every time the event loop processed an event,
+flushing the clients output buffers.
+*/
+func beforeSleep() {
+	//try to process the clients blocked in WAIT, the ACKs of the replicas may have been received.
+	if listLength(server.clientsWaitingAcks) > 0 {
+		processClientsWaitingReplicas()
+	}
+	//send all the replicas an ACK request if at least one client blocked in WAIT during this iteration.
+	if server.getackSlaves {
+		replicationFeedSlaves(server.slaveseldb, []*robj{shared.replconf, shared.getack, shared.star})
+		server.getackSlaves = false
+	}
+	//write the AOF buffer on disk before the replies are sent to the clients.
+	if server.aofState == REDIS_AOF_ON {
+		flushAppendOnlyFile(false)
+	}
+	handleClientsWithPendingWrites()
+	freeClientsInAsyncFreeQueue()
+}
+
+// the timer handler, called server.hz times per second.
+func serverCron() {
+	//sample the memory used by the dataset, checked against maxmemory.
+	server.statUsedMemory = usedMemory()
+
+	clientsCron()
+
+	//replication cron function, the connection with the master and the pings to the replicas.
+	if server.cronloops%int64(server.hz) == 0 {
+		replicationCron()
+	}
+	server.cronloops++
+
+	//expire the fields of the hashes, a replica waits for the HDEL of its master instead.
+	if server.masterhost == "" {
+		activeExpireHashFieldsCycle()
+	}
+
+	//retry the postponed AOF writes and the ones failed because of an error, and fsync the AOF every second.
+	if server.aofState == REDIS_AOF_ON {
+		flushAppendOnlyFile(false)
+	}
+
+	now := time.Now().Unix()
+	//start a scheduled AOF rewrite if this was requested by the user, or needed to enable the AOF.
+	if !hasActiveChildProcess() && server.aofRewriteScheduled &&
+		(server.aofLastbgrewriteStatus == REDIS_OK || now-server.aofRewriteTimeStart > REDIS_BGSAVE_RETRY_DELAY) {
+		_ = rewriteAppendOnlyFileBackground()
+	}
+
+	if !hasActiveChildProcess() {
+		if server.rdbBgsaveScheduled {
+			//start a scheduled BGSAVE if the previous one is terminated.
+			_ = rdbSaveBackground(server.rdbFilename)
+		} else {
+			/**
+			if there is not a background saving in progress check if we have to save now:
+			a save point is reached when enough changes happened in enough seconds,
+			after a failed BGSAVE we wait REDIS_BGSAVE_RETRY_DELAY seconds before retrying.
+			*/
+			for _, sp := range server.saveparams {
+				if server.dirty >= sp.changes && now-server.lastsave > sp.seconds &&
+					(now-server.lastbgsaveTry > REDIS_BGSAVE_RETRY_DELAY || server.lastbgsaveStatus == REDIS_OK) {
+					redisLog(REDIS_NOTICE, "%d changes in %d seconds. Saving...", sp.changes, sp.seconds)
+					_ = rdbSaveBackground(server.rdbFilename)
+					break
+				}
+			}
+		}
+	}
+
+	//trigger an AOF rewrite if needed.
+	if server.aofState == REDIS_AOF_ON && !hasActiveChildProcess() &&
+		server.aofRewritePerc > 0 && server.aofCurrentSize > server.aofRewriteMinSize {
+		base := server.aofRewriteBaseSize
+		if base == 0 {
+			base = 1
+		}
+		growth := (server.aofCurrentSize * 100 / base) - 100
+		if growth >= int64(server.aofRewritePerc) {
+			redisLog(REDIS_NOTICE, "Starting automatic rewriting of AOF on %d%% growth", growth)
+			_ = rewriteAppendOnlyFileBackground()
+		}
+	}
+}
+
+// return true if a background save or a background AOF rewrite is in progress.
+func hasActiveChildProcess() bool {
+	return server.rdbChildRunning || server.aofChildRunning
+}
+
+/*
+*
+called before shutting down the server: a final snapshot is saved if save points
+are configured, the shutdown is aborted if it can not be saved.
+*/
+func prepareForShutdown() int {
+	redisLog(REDIS_WARNING, "User requested shutdown...")
+	//the background save is abandoned, its result would be older than the final snapshot.
+	if server.rdbChildRunning {
+		redisLog(REDIS_WARNING, "There is a child saving an .rdb. Killing it!")
+		killRDBChild()
+	}
+	//kill the AOF rewrite, its result would be thrown away by the new process anyway.
+	if server.aofChildRunning {
+		redisLog(REDIS_WARNING, "There is a child rewriting the AOF. Killing it!")
+		killAppendOnlyChild()
+	}
+	//the AOF can't be used until the initial rewrite is done.
+	if server.aofState == REDIS_AOF_WAIT_REWRITE {
+		redisLog(REDIS_WARNING, "Writing initial AOF, can't exit.")
+		return REDIS_ERR
+	}
+	//flush and fsync the AOF, the commands not yet written would be lost otherwise.
+	if server.aofState == REDIS_AOF_ON {
+		redisLog(REDIS_NOTICE, "Calling fsync() on the AOF file.")
+		flushAppendOnlyFile(true)
+		_ = server.aofFd.Sync()
+	}
+	if len(server.saveparams) > 0 {
+		redisLog(REDIS_NOTICE, "Saving the final RDB snapshot before exiting.")
+		if rdbSave(server.rdbFilename) != nil {
+			redisLog(REDIS_WARNING, "Error trying to save the DB, can't exit.")
+			return REDIS_ERR
+		}
+	}
+	redisLog(REDIS_WARNING, "Redis is now ready to exit, bye bye...")
+	return REDIS_OK
+}
+
+// load the dataset at startup, the AOF is used when enabled as it is the most up to date.
+func loadDataFromDisk() {
+	start := time.Now()
+	if server.aofEnabled {
+		if err := loadAppendOnlyFiles(); err != nil {
+			redisLog(REDIS_WARNING, "Fatal error loading the append only file: %s. Exiting.", err)
+			os.Exit(1)
+		}
+		redisLog(REDIS_NOTICE, "DB loaded from append only file: %.3f seconds", time.Since(start).Seconds())
+	} else {
+		err := rdbLoad(server.rdbFilename)
+		if err == nil {
+			redisLog(REDIS_NOTICE, "DB loaded from disk: %.3f seconds", time.Since(start).Seconds())
+		} else if !os.IsNotExist(err) {
+			redisLog(REDIS_WARNING, "Fatal error loading the DB: %s. Exiting.", err)
+			os.Exit(1)
+		}
+	}
+	//the loaded dataset is the one on disk.
+	server.dirty = 0
+}
+
+/*
+*
+close the clients idle for more than maxidletime seconds, and re-check the output buffer
+limits of the clients that can not keep up with their replies, so that a soft limit
+reached for long enough is enforced even if no new reply is added.
+*/
+func clientsCron() {
+	now := time.Now().Unix()
+	nowMs := time.Now().UnixMilli()
+	server.clients.Range(func(key, value any) bool {
+		c := value.(*redisClient)
+		clientsCronHandleTimeout(c, nowMs)
+		if server.maxidletime > 0 && c.flags&(REDIS_SLAVE|REDIS_MASTER|REDIS_BLOCKED|REDIS_PUBSUB) == 0 &&
+			now-c.lastinteraction > int64(server.maxidletime) {
+			redisLog(REDIS_VERBOSE, "Closing idle client id=%d", c.id)
+			freeClient(c)
+			return true
+		}
+		if clientHasPendingReplies(c) {
+			checkClientOutputBufferLimits(c)
+		}
+		return true
+	})
 }
 
 func call(c *redisClient, flags int) {
+	//the command may rewrite c.cmd and c.argv to propagate a different command, the stats go to the executed one.
+	realCmd := c.cmd
+	//the force propagation flags are per command, EXEC restores the ones of its own call.
+	clientOldFlags := c.flags
+	c.flags &^= REDIS_FORCE_AOF | REDIS_FORCE_REPL
+	dirty := server.dirty
+	start := time.Now()
 	c.cmd.proc(c)
+	duration := time.Since(start).Microseconds()
+	dirty = server.dirty - dirty
+
+	if flags&REDIS_CALL_STATS > 0 {
+		realCmd.microseconds += duration
+		realCmd.calls++
+	}
+	server.statNumcommands++
+
+	//propagate the command into the AOF and to the replicas if it modified the dataset, or if propagation was forced.
+	if flags&REDIS_CALL_PROPAGATE > 0 {
+		propagateFlags := REDIS_PROPAGATE_NONE
+		if dirty > 0 {
+			propagateFlags |= REDIS_PROPAGATE_AOF | REDIS_PROPAGATE_REPL
+		}
+		if c.flags&REDIS_FORCE_REPL > 0 {
+			propagateFlags |= REDIS_PROPAGATE_REPL
+		}
+		if c.flags&REDIS_FORCE_AOF > 0 {
+			propagateFlags |= REDIS_PROPAGATE_AOF
+		}
+		if propagateFlags != REDIS_PROPAGATE_NONE {
+			propagate(c.cmd, c.db.id, c.argv[:c.argc], propagateFlags)
+		}
+	}
+	c.flags &^= REDIS_FORCE_AOF | REDIS_FORCE_REPL
+	c.flags |= clientOldFlags & (REDIS_FORCE_AOF | REDIS_FORCE_REPL)
+	//remember the replication offset of the last write of the client, WAIT waits for it.
+	c.woff = server.masterReplOffset
+}
+
+/*
+*
+propagate the specified command (in the context of the specified database id)
+to the AOF and to the replicas, according to the flags.
+*/
+func propagate(cmd *redisCommand, dbid int, argv []*robj, flags int) {
+	if flags == REDIS_PROPAGATE_NONE {
+		return
+	}
+	if server.aofState != REDIS_AOF_OFF && flags&REDIS_PROPAGATE_AOF > 0 {
+		feedAppendOnlyFile(cmd, dbid, argv)
+	}
+	if flags&REDIS_PROPAGATE_REPL > 0 {
+		replicationFeedSlaves(dbid, argv)
+	}
+}
 
-	//todo aof use flags
+/*
+*
+used inside commands implementations in order to force the propagation of
+the specified command execution into the AOF and/or to the replicas, even
+if the dataset was not modified.
+*/
+func forceCommandPropagation(c *redisClient, flags int) {
+	if flags&REDIS_PROPAGATE_REPL > 0 {
+		c.flags |= REDIS_FORCE_REPL
+	}
+	if flags&REDIS_PROPAGATE_AOF > 0 {
+		c.flags |= REDIS_FORCE_AOF
+	}
 }
 
 func (o *robj) String() string {
@@ -0,0 +1,1063 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	/* Slave replication state, slave side */
+	REDIS_REPL_NONE       = 0 /* No active replication */
+	REDIS_REPL_CONNECT    = 1 /* Must connect to master */
+	REDIS_REPL_CONNECTING = 2 /* Handshake with the master in progress */
+	REDIS_REPL_TRANSFER   = 3 /* Receiving .rdb from master */
+	REDIS_REPL_CONNECTED  = 4 /* Connected to master */
+
+	/* Slave replication state, master side */
+	REDIS_REPL_WAIT_BGSAVE_END = 6 /* Waiting RDB file creation and transfer. */
+	REDIS_REPL_ONLINE          = 7 /* RDB file transmitted, sending just updates. */
+
+	/* Slave capabilities. */
+	SLAVE_CAPA_NONE   = 0
+	SLAVE_CAPA_EOF    = 1 << 0 /* Can parse the RDB EOF streaming format. */
+	SLAVE_CAPA_PSYNC2 = 1 << 1 /* Supports PSYNC2 protocol. */
+
+	REDIS_RUN_ID_SIZE            = 40
+	REDIS_REPL_BACKLOG_MIN_SIZE  = 1024 * 16 /* 16k */
+	REDIS_REPL_TRANSFER_BUF_SIZE = 1024 * 16
+)
+
+/*
+*
+the state of a connection attempt to the master, the handshake and the transfer of the
+RDB are performed by a goroutine, the event loop only receives the established link.
+the handshake is cancelled closing its connection, e.g. when REPLICAOF changes master.
+*/
+type replHandshake struct {
+	addr          string
+	auth          string
+	listeningPort int
+	replid        string
+	offset        int64
+	timeout       time.Duration
+
+	mu        sync.Mutex
+	conn      net.Conn
+	cancelled bool
+}
+
+// --------------------------- MASTER -> SLAVES ------------------------------
+
+// generate a new random replication ID, used when our history diverges from the one of our master.
+func changeReplicationId() {
+	server.replid = getRandomHexChars(REDIS_RUN_ID_SIZE)
+}
+
+// clear the secondary replication ID, no partial resynchronization is possible with the previous history.
+func clearReplicationId2() {
+	server.replid2 = strings.Repeat("0", REDIS_RUN_ID_SIZE)
+	server.secondReplidOffset = -1
+}
+
+/*
+*
+use the current replication ID as secondary ID and create a new one: the replicas that
+were following our master can still partially resynchronize with us up to the current
+offset, after that our history diverges from the one of the old master.
+*/
+func shiftReplicationId() {
+	server.replid2 = server.replid
+	//the replica will ask for the first byte it has not yet received, so the offset is incremented by one.
+	server.secondReplidOffset = server.masterReplOffset + 1
+	changeReplicationId()
+	redisLog(REDIS_NOTICE, "Setting secondary replication ID to %s, valid up to offset: %d. New replication ID is %s",
+		server.replid2, server.secondReplidOffset, server.replid)
+}
+
+func createReplicationBacklog() {
+	server.replBacklog = make([]byte, server.replBacklogSize)
+	server.replBacklogHistlen = 0
+	server.replBacklogIdx = 0
+	//we don't have any data inside our buffer, but the next byte will be the byte at masterReplOffset + 1.
+	server.replBacklogOff = server.masterReplOffset + 1
+}
+
+/*
+*
+the repl-backlog-size config takes effect immediately when changed with CONFIG SET,
+the data of the old backlog is discarded.
+*/
+func resizeReplicationBacklog() error {
+	if server.replBacklog != nil && int64(len(server.replBacklog)) != server.replBacklogSize {
+		createReplicationBacklog()
+	}
+	return nil
+}
+
+// add data to the replication backlog, the replication offset is incremented accordingly.
+func feedReplicationBacklog(p []byte) {
+	server.masterReplOffset += int64(len(p))
+	size := int64(len(server.replBacklog))
+	for len(p) > 0 {
+		thislen := size - server.replBacklogIdx
+		if thislen > int64(len(p)) {
+			thislen = int64(len(p))
+		}
+		copy(server.replBacklog[server.replBacklogIdx:], p[:thislen])
+		server.replBacklogIdx += thislen
+		if server.replBacklogIdx == size {
+			server.replBacklogIdx = 0
+		}
+		server.replBacklogHistlen += thislen
+		p = p[thislen:]
+	}
+	if server.replBacklogHistlen > size {
+		server.replBacklogHistlen = size
+	}
+	//set the offset of the first byte we have in the backlog.
+	server.replBacklogOff = server.masterReplOffset - server.replBacklogHistlen + 1
+}
+
+/*
+*
+append the replication stream to the backlog and to the output buffer of the replicas.
+the replicas still waiting for the RDB accumulate it, it is sent once they are online.
+*/
+func feedReplicationBuffer(p []byte) {
+	if server.replBacklog == nil {
+		return
+	}
+	feedReplicationBacklog(p)
+	s := string(p)
+	for node := server.slaves.head; node != nil; node = node.next {
+		addReply((*node.value).(*redisClient), &s)
+	}
+}
+
+/*
+*
+propagate a write command executed against the DB dictid to the replicas. a replica
+never calls it: it proxies the stream of its master as it is to its own replicas.
+*/
+func replicationFeedSlaves(dictid int, argv []*robj) {
+	if server.masterhost != "" {
+		return
+	}
+	//there is nothing to feed if there are no replicas and no backlog.
+	if server.replBacklog == nil && listLength(server.slaves) == 0 {
+		return
+	}
+
+	buf := make([]byte, 0)
+	//send a SELECT command to the replicas if the DB is not the same of the last command.
+	if server.slaveseldb != dictid {
+		buf = catAppendOnlyGenericCommand(buf, []string{"SELECT", strconv.Itoa(dictid)})
+		server.slaveseldb = dictid
+	}
+	args := make([]string, len(argv))
+	for j, o := range argv {
+		args[j] = o.String()
+	}
+	buf = catAppendOnlyGenericCommand(buf, args)
+	feedReplicationBuffer(buf)
+}
+
+// the commands received from our master are added to our backlog and sent to our replicas exactly as received.
+func replicationFeedStreamFromMasterStream(argv []*robj) {
+	args := make([]string, len(argv))
+	for j, o := range argv {
+		args[j] = o.String()
+	}
+	buf := catAppendOnlyGenericCommand(nil, args)
+	if server.replBacklog == nil {
+		server.masterReplOffset += int64(len(buf))
+		return
+	}
+	feedReplicationBuffer(buf)
+}
+
+/*
+*
+feed the commands received from our master and held back by the master client, a
+transaction is only fed once it is terminated: if the link is lost in the middle of
+it the partial resynchronization restarts from its MULTI.
+*/
+func replicationFeedPendingMasterStream(c *redisClient) {
+	for _, argv := range c.pendingMasterStream {
+		replicationFeedStreamFromMasterStream(argv)
+	}
+	c.pendingMasterStream = nil
+}
+
+/*
+*
+feed the replica with the backlog starting at the specified offset,
+the number of bytes added to the output buffer is returned.
+*/
+func addReplyReplicationBacklog(c *redisClient, offset int64) int64 {
+	if server.replBacklogHistlen == 0 {
+		return 0
+	}
+	size := int64(len(server.replBacklog))
+	//compute the amount of bytes we need to discard.
+	skip := offset - server.replBacklogOff
+	//point j to the oldest byte, then to the first byte to send.
+	j := (server.replBacklogIdx + (size - server.replBacklogHistlen)) % size
+	j = (j + skip) % size
+	//feed the replica with all the data we have in the backlog from offset.
+	l := server.replBacklogHistlen - skip
+	for l > 0 {
+		thislen := size - j
+		if thislen > l {
+			thislen = l
+		}
+		s := string(server.replBacklog[j : j+thislen])
+		addReply(c, &s)
+		l -= thislen
+		j = 0
+	}
+	return server.replBacklogHistlen - skip
+}
+
+// return the name of the replica used in the logs: its ip and listening port.
+func replicationGetSlaveName(c *redisClient) string {
+	host, port, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return c.conn.RemoteAddr().String()
+	}
+	if c.slaveListeningPort != 0 {
+		port = strconv.Itoa(c.slaveListeningPort)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+/*
+*
+try a partial resynchronization with the replica: if the replication ID matches our
+history and the requested offset is still in the backlog, "+CONTINUE" is replied and
+the missing part of the stream is sent. REDIS_ERR is returned when a full
+resynchronization is needed.
+*/
+func masterTryPartialResynchronization(c *redisClient) int {
+	masterReplid := c.argv[1].String()
+	psyncOffset, err := strconv.ParseInt(c.argv[2].String(), 10, 64)
+	if err != nil {
+		return REDIS_ERR
+	}
+
+	/**
+	is the replication ID of this master the same advertised by the wannabe replica via PSYNC?
+	if the replication ID changed this master has a different replication history, and there
+	is no way to continue, unless the replica is following our previous history up to
+	secondReplidOffset.
+	*/
+	if !strings.EqualFold(masterReplid, server.replid) &&
+		(!strings.EqualFold(masterReplid, server.replid2) || psyncOffset > server.secondReplidOffset) {
+		if masterReplid == "?" {
+			redisLog(REDIS_NOTICE, "Full resync requested by replica %s", replicationGetSlaveName(c))
+		} else if !strings.EqualFold(masterReplid, server.replid2) {
+			redisLog(REDIS_NOTICE, "Partial resynchronization not accepted: Replication ID mismatch (Replica asked for '%s', my replication IDs are '%s' and '%s')",
+				masterReplid, server.replid, server.replid2)
+		} else {
+			redisLog(REDIS_NOTICE, "Partial resynchronization not accepted: Requested offset for second ID was %d, but I can reply up to %d",
+				psyncOffset, server.secondReplidOffset)
+		}
+		return REDIS_ERR
+	}
+
+	//we still have the data our replica is asking for?
+	if server.replBacklog == nil || psyncOffset < server.replBacklogOff ||
+		psyncOffset > server.replBacklogOff+server.replBacklogHistlen {
+		redisLog(REDIS_NOTICE, "Unable to partial resync with replica %s for lack of backlog (Replica request was: %d).",
+			replicationGetSlaveName(c), psyncOffset)
+		if psyncOffset > server.masterReplOffset {
+			redisLog(REDIS_WARNING, "Warning: replica %s tried to PSYNC with an offset that is greater than the master replication offset.",
+				replicationGetSlaveName(c))
+		}
+		return REDIS_ERR
+	}
+
+	/**
+	if we reached this point, we are able to perform a partial resync: the replica is
+	online right away, and we send it the backlog data from the requested offset.
+	the reply is written to the socket directly, before the backlog is queued.
+	*/
+	c.flags |= REDIS_SLAVE
+	c.replstate = REDIS_REPL_ONLINE
+	c.replAckTime = time.Now().Unix()
+	i := interface{}(c)
+	listAddNodeTail(server.slaves, &i)
+	reply := "+CONTINUE\r\n"
+	if c.slaveCapa&SLAVE_CAPA_PSYNC2 > 0 {
+		reply = "+CONTINUE " + server.replid + "\r\n"
+	}
+	if _, err := c.conn.Write([]byte(reply)); err != nil {
+		freeClientAsync(c)
+		return REDIS_OK
+	}
+	psynclen := addReplyReplicationBacklog(c, psyncOffset)
+	redisLog(REDIS_NOTICE, "Partial resynchronization request from %s accepted. Sending %d bytes of backlog starting from offset %d.",
+		replicationGetSlaveName(c), psynclen, psyncOffset)
+	return REDIS_OK
+}
+
+/*
+*
+start the full resynchronization of the replica: the event loop takes the snapshot of the
+dataset at the current replication offset, a goroutine encodes it and sends it to the
+replica. the stream generated meanwhile is accumulated in the output buffer of the
+replica, and sent once the RDB is transferred.
+*/
+func startBgsaveForReplication(c *redisClient) {
+	id, snapshot := rdbSnapshotShared()
+	c.psyncInitialOffset = server.masterReplOffset
+	c.replstate = REDIS_REPL_WAIT_BGSAVE_END
+	//force a SELECT to be emitted, the replica loads the RDB with the DB 0 selected.
+	server.slaveseldb = -1
+
+	//old replicas sending SYNC don't expect the "+FULLRESYNC" reply.
+	if c.flags&REDIS_PRE_PSYNC == 0 {
+		reply := fmt.Sprintf("+FULLRESYNC %s %d\r\n", server.replid, c.psyncInitialOffset)
+		if _, err := c.conn.Write([]byte(reply)); err != nil {
+			freeClientAsync(c)
+			return
+		}
+	}
+
+	redisLog(REDIS_NOTICE, "Starting BGSAVE for SYNC with target: replica %s", replicationGetSlaveName(c))
+	conn := c.conn
+	timeout := time.Duration(server.replTimeout) * time.Second
+	go func() {
+		var payload bytes.Buffer
+		r := &rio{w: bufio.NewWriter(&payload)}
+		err := rdbSaveRio(r, snapshot)
+		if err == nil {
+			err = r.w.Flush()
+		}
+		if err == nil {
+			_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+			if _, err = fmt.Fprintf(conn, "$%d\r\n", payload.Len()); err == nil {
+				_, err = conn.Write(payload.Bytes())
+			}
+			_ = conn.SetWriteDeadline(time.Time{})
+		}
+		server.eventCh <- func() {
+			rdbReleaseSnapshot(id)
+			sendBulkToSlaveDone(c, err)
+		}
+	}()
+}
+
+// called by the event loop once the RDB is sent to the replica.
+func sendBulkToSlaveDone(c *redisClient, err error) {
+	if c.flags&REDIS_CLOSE_ASAP > 0 {
+		return
+	}
+	if err != nil {
+		redisLog(REDIS_WARNING, "SYNC failed. Error sending the RDB to the replica %s: %s", replicationGetSlaveName(c), err)
+		freeClient(c)
+		return
+	}
+	redisLog(REDIS_NOTICE, "Synchronization with replica %s succeeded", replicationGetSlaveName(c))
+	putSlaveOnline(c)
+}
+
+// the replica receives the stream accumulated while the RDB was transferred.
+func putSlaveOnline(c *redisClient) {
+	c.replstate = REDIS_REPL_ONLINE
+	//the replica starts sending ACKs once online, don't disconnect it for a timeout right away.
+	c.replAckTime = time.Now().Unix()
+	if clientHasPendingReplies(c) {
+		putClientInPendingWriteQueue(c)
+	}
+}
+
+// SYNC and PSYNC <replid> <offset>
+func syncCommand(c *redisClient) {
+	//ignore SYNC if already replica.
+	if c.flags&REDIS_SLAVE > 0 {
+		return
+	}
+	//refuse SYNC requests if we are a replica but the link with our master is not ok.
+	if server.masterhost != "" && server.replState != REDIS_REPL_CONNECTED {
+		addReplyErrorWithCode(c, "NOMASTERLINK Can't SYNC while not connected with my master")
+		return
+	}
+	//the replica expects the RDB right after the reply, there must be nothing else in the output buffer.
+	if clientHasPendingReplies(c) {
+		errMsg := "SYNC and PSYNC are invalid with pending output"
+		addReplyError(c, &errMsg)
+		return
+	}
+
+	redisLog(REDIS_NOTICE, "Replica %s asks for synchronization", replicationGetSlaveName(c))
+	if c.cmd.name == "PSYNC" {
+		if masterTryPartialResynchronization(c) == REDIS_OK {
+			server.statSyncPartialOk++
+			return
+		}
+		//a "?" replication ID means the replica explicitly asked for a full resync.
+		if c.argv[1].String() != "?" {
+			server.statSyncPartialErr++
+		}
+	} else {
+		c.flags |= REDIS_PRE_PSYNC
+	}
+
+	//full resynchronization.
+	server.statSyncFull++
+	c.flags |= REDIS_SLAVE
+	i := interface{}(c)
+	listAddNodeTail(server.slaves, &i)
+	//create the backlog if needed, starting a new history.
+	if listLength(server.slaves) == 1 && server.replBacklog == nil {
+		changeReplicationId()
+		clearReplicationId2()
+		createReplicationBacklog()
+		redisLog(REDIS_NOTICE, "Replication backlog created, my new replication IDs are '%s' and '%s'", server.replid, server.replid2)
+	}
+	startBgsaveForReplication(c)
+}
+
+// REPLCONF <option> <value> <option> <value> ...
+func replconfCommand(c *redisClient) {
+	if c.argc%2 == 0 {
+		addReply(c, shared.syntaxerr)
+		return
+	}
+	for j := 1; j < int(c.argc); j += 2 {
+		option := strings.ToLower(c.argv[j].String())
+		switch option {
+		case "listening-port":
+			port, err := strconv.Atoi(c.argv[j+1].String())
+			if err != nil || port < 0 || port > 65535 {
+				errMsg := "value is not an integer or out of range"
+				addReplyError(c, &errMsg)
+				return
+			}
+			c.slaveListeningPort = port
+		case "capa":
+			//ignore capabilities not understood by this master.
+			capa := strings.ToLower(c.argv[j+1].String())
+			if capa == "eof" {
+				c.slaveCapa |= SLAVE_CAPA_EOF
+			} else if capa == "psync2" {
+				c.slaveCapa |= SLAVE_CAPA_PSYNC2
+			}
+		case "ack":
+			/**
+			REPLCONF ACK is used by the replica to inform the master the amount of
+			replication stream that it processed so far. it is an internal command
+			that no reply is expected for.
+			*/
+			if c.flags&REDIS_SLAVE == 0 {
+				return
+			}
+			offset, err := strconv.ParseInt(c.argv[j+1].String(), 10, 64)
+			if err != nil {
+				return
+			}
+			if offset > c.replAckOff {
+				c.replAckOff = offset
+			}
+			c.replAckTime = time.Now().Unix()
+			return
+		case "getack":
+			//REPLCONF GETACK is used in order to request an ACK ASAP to the replica.
+			if server.masterhost != "" && server.master == c {
+				replicationSendAck()
+			}
+			return
+		default:
+			errMsg := "Unrecognized REPLCONF option: " + c.argv[j].String()
+			addReplyError(c, &errMsg)
+			return
+		}
+	}
+	addReply(c, shared.ok)
+}
+
+/*
+*
+send a REPLCONF ACK command to the master to inform it about the current processed offset.
+the reply is forced, as the replies to the master are otherwise discarded.
+*/
+func replicationSendAck() {
+	c := server.master
+	if c == nil {
+		return
+	}
+	c.flags |= REDIS_MASTER_FORCE_REPLY
+	addReplyMultiBulkLen(c, 3)
+	addReplyBulkCString(c, "REPLCONF")
+	addReplyBulkCString(c, "ACK")
+	addReplyBulkCString(c, strconv.FormatInt(server.masterReplOffset, 10))
+	c.flags &^= REDIS_MASTER_FORCE_REPLY
+}
+
+// return the number of replicas that already acknowledged the specified replication offset.
+func replicationCountAcksByOffset(offset int64) int64 {
+	var count int64
+	for node := server.slaves.head; node != nil; node = node.next {
+		slave := (*node.value).(*redisClient)
+		if slave.replstate == REDIS_REPL_ONLINE && slave.replAckOff >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+/*
+*
+WAIT numreplicas timeout
+block the client until the specified number of replicas acknowledged the last
+write of the client, or the timeout in milliseconds is reached.
+*/
+func waitCommand(c *redisClient) {
+	if server.masterhost != "" {
+		errMsg := "WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated."
+		addReplyError(c, &errMsg)
+		return
+	}
+	numreplicas, err := strconv.ParseInt(c.argv[1].String(), 10, 64)
+	if err != nil {
+		errMsg := "value is not an integer or out of range"
+		addReplyError(c, &errMsg)
+		return
+	}
+	var timeout int64
+	if getTimeoutFromObjectOrReply(c, c.argv[2], &timeout, UNIT_MILLISECONDS) != REDIS_OK {
+		return
+	}
+
+	//first try without blocking at all, a client executing a transaction can't block.
+	ackreplicas := replicationCountAcksByOffset(c.woff)
+	if ackreplicas >= numreplicas || c.flags&REDIS_MULTI > 0 {
+		addReplyLongLong(c, ackreplicas)
+		return
+	}
+
+	//otherwise block the client and put it into our list of clients waiting for ACK from replicas.
+	c.bpop.timeout = timeout
+	c.bpop.reploffset = c.woff
+	c.bpop.numreplicas = int(numreplicas)
+	i := interface{}(c)
+	listAddNodeTail(server.clientsWaitingAcks, &i)
+	blockClient(c, REDIS_BLOCKED_WAIT)
+
+	//make sure that the replicas will send an ACK as soon as possible.
+	server.getackSlaves = true
+}
+
+// remove the client from the list of clients waiting for replicas ACKs, called by unblockClient.
+func unblockClientWaitingReplicas(c *redisClient) {
+	if ln := listSearchKey(server.clientsWaitingAcks, c); ln != nil {
+		listDelNode(server.clientsWaitingAcks, ln)
+	}
+}
+
+/*
+*
+check if there are clients blocked in WAIT that can be unblocked since
+we received enough ACKs from replicas, called by beforeSleep.
+*/
+func processClientsWaitingReplicas() {
+	node := server.clientsWaitingAcks.head
+	for node != nil {
+		next := node.next
+		c := (*node.value).(*redisClient)
+		numreplicas := replicationCountAcksByOffset(c.bpop.reploffset)
+		if numreplicas >= int64(c.bpop.numreplicas) {
+			addReplyLongLong(c, numreplicas)
+			unblockClient(c)
+		}
+		node = next
+	}
+}
+
+// close the connection with all our replicas, they will reconnect and resynchronize.
+func disconnectSlaves() {
+	slaves := make([]*redisClient, 0, listLength(server.slaves))
+	for node := server.slaves.head; node != nil; node = node.next {
+		slaves = append(slaves, (*node.value).(*redisClient))
+	}
+	for _, c := range slaves {
+		freeClient(c)
+	}
+}
+
+// remove the replica from the list of replicas, called when the client is freed.
+func replicationFreeSlave(c *redisClient) {
+	if ln := listSearchKey(server.slaves, c); ln != nil {
+		listDelNode(server.slaves, ln)
+	}
+	redisLog(REDIS_NOTICE, "Connection with replica %s lost.", replicationGetSlaveName(c))
+}
+
+// ----------------------------- SLAVE --------------------------------------
+
+/*
+*
+connect to the master in background: the handshake and the transfer of the RDB
+happen in a goroutine, the result is handed over to the event loop.
+*/
+func connectWithMaster() {
+	h := &replHandshake{
+		addr:          net.JoinHostPort(server.masterhost, strconv.Itoa(server.masterport)),
+		auth:          server.masterauth,
+		listeningPort: server.port,
+		//our history can be continued by the master if it still has it in its backlog.
+		replid:  server.replid,
+		offset:  server.masterReplOffset + 1,
+		timeout: time.Duration(server.replTimeout) * time.Second,
+	}
+	server.replHandshake = h
+	server.replState = REDIS_REPL_CONNECTING
+	go syncWithMaster(h)
+}
+
+// abort the handshake in progress, its result is discarded by the event loop.
+func cancelReplicationHandshake() {
+	h := server.replHandshake
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.cancelled = true
+	if h.conn != nil {
+		_ = h.conn.Close()
+	}
+	h.mu.Unlock()
+	server.replHandshake = nil
+	if server.replState == REDIS_REPL_CONNECTING || server.replState == REDIS_REPL_TRANSFER {
+		server.replState = REDIS_REPL_CONNECT
+	}
+}
+
+// send a command to the master during the handshake and read the reply line.
+func sendSynchronousCommand(conn net.Conn, reader *bufio.Reader, timeout time.Duration, args ...string) (string, error) {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(catAppendOnlyGenericCommand(nil, args)); err != nil {
+		return "", fmt.Errorf("error writing to master: %s", err)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("error reading from master: %s", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+/*
+*
+the handshake with the master, run by a goroutine: PING, AUTH, REPLCONF and PSYNC are
+sent in order, then the RDB of a full resynchronization is received in a temp file.
+*/
+func syncWithMaster(h *replHandshake) {
+	conn, err := net.DialTimeout("tcp", h.addr, h.timeout)
+	if err != nil {
+		replicationHandshakeFailed(h, nil, fmt.Errorf("Error condition on socket for SYNC: %s", err))
+		return
+	}
+	h.mu.Lock()
+	if h.cancelled {
+		h.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	h.conn = conn
+	h.mu.Unlock()
+	redisLog(REDIS_NOTICE, "MASTER <-> REPLICA sync started")
+	reader := bufio.NewReader(conn)
+
+	//check that the master is able to process commands, a master requiring a password is fine.
+	reply, err := sendSynchronousCommand(conn, reader, h.timeout, "PING")
+	if err != nil {
+		replicationHandshakeFailed(h, conn, err)
+		return
+	}
+	if strings.HasPrefix(reply, "-") && !strings.HasPrefix(reply, "-NOAUTH") &&
+		!strings.HasPrefix(reply, "-NOPERM") && !strings.HasPrefix(reply, "-ERR operation not permitted") {
+		replicationHandshakeFailed(h, conn, fmt.Errorf("Error reply to PING from master: '%s'", reply))
+		return
+	}
+	redisLog(REDIS_NOTICE, "Master replied to PING, replication can continue...")
+
+	if h.auth != "" {
+		if reply, err = sendSynchronousCommand(conn, reader, h.timeout, "AUTH", h.auth); err != nil {
+			replicationHandshakeFailed(h, conn, err)
+			return
+		}
+		if strings.HasPrefix(reply, "-") {
+			replicationHandshakeFailed(h, conn, fmt.Errorf("Unable to AUTH to MASTER: %s", reply))
+			return
+		}
+	}
+
+	//set the replica port, so that the master's INFO command can list the replica listening port correctly.
+	if reply, err = sendSynchronousCommand(conn, reader, h.timeout, "REPLCONF", "listening-port", strconv.Itoa(h.listeningPort)); err != nil {
+		replicationHandshakeFailed(h, conn, err)
+		return
+	}
+	if strings.HasPrefix(reply, "-") {
+		redisLog(REDIS_NOTICE, "(Non critical) Master does not understand REPLCONF listening-port: %s", reply)
+	}
+	if reply, err = sendSynchronousCommand(conn, reader, h.timeout, "REPLCONF", "capa", "psync2"); err != nil {
+		replicationHandshakeFailed(h, conn, err)
+		return
+	}
+	if strings.HasPrefix(reply, "-") {
+		redisLog(REDIS_NOTICE, "(Non critical) Master does not understand REPLCONF capa: %s", reply)
+	}
+
+	redisLog(REDIS_NOTICE, "Trying a partial resynchronization (request %s:%d).", h.replid, h.offset)
+	if reply, err = sendSynchronousCommand(conn, reader, h.timeout, "PSYNC", h.replid, strconv.FormatInt(h.offset, 10)); err != nil {
+		replicationHandshakeFailed(h, conn, err)
+		return
+	}
+
+	if strings.HasPrefix(reply, "+FULLRESYNC") {
+		fields := strings.Fields(reply)
+		var offset int64
+		if len(fields) == 3 && len(fields[1]) == REDIS_RUN_ID_SIZE {
+			offset, err = strconv.ParseInt(fields[2], 10, 64)
+		}
+		if len(fields) != 3 || len(fields[1]) != REDIS_RUN_ID_SIZE || err != nil {
+			replicationHandshakeFailed(h, conn, errors.New("Master replied with wrong +FULLRESYNC syntax."))
+			return
+		}
+		redisLog(REDIS_NOTICE, "Full resync from master: %s:%d", fields[1], offset)
+		server.eventCh <- func() {
+			if server.replHandshake == h {
+				server.replState = REDIS_REPL_TRANSFER
+			}
+		}
+		tmpfile, err := readSyncBulkPayload(conn, reader, h.timeout)
+		if err != nil {
+			replicationHandshakeFailed(h, conn, err)
+			return
+		}
+		_ = conn.SetDeadline(time.Time{})
+		server.eventCh <- func() {
+			replicationAttachToNewMaster(h, conn, reader, fields[1], offset, tmpfile)
+		}
+	} else if strings.HasPrefix(reply, "+CONTINUE") {
+		newReplid := strings.TrimSpace(reply[len("+CONTINUE"):])
+		_ = conn.SetDeadline(time.Time{})
+		server.eventCh <- func() {
+			replicationResurrectMaster(h, conn, reader, newReplid)
+		}
+	} else if strings.HasPrefix(reply, "-NOMASTERLINK") || strings.HasPrefix(reply, "-LOADING") {
+		replicationHandshakeFailed(h, conn, fmt.Errorf("Master is currently unable to PSYNC but should be in the future: %s", reply))
+	} else {
+		replicationHandshakeFailed(h, conn, fmt.Errorf("Unexpected reply to PSYNC from master: %s", reply))
+	}
+}
+
+/*
+*
+receive the RDB sent by the master in a temp file, the read deadline is refreshed
+every time some data is received, so only a stalled transfer times out.
+*/
+func readSyncBulkPayload(conn net.Conn, reader *bufio.Reader, timeout time.Duration) (string, error) {
+	var line string
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		var err error
+		if line, err = reader.ReadString('\n'); err != nil {
+			return "", fmt.Errorf("I/O error reading bulk count from MASTER: %s", err)
+		}
+		//the master may send newlines to keep the connection alive while the RDB is produced.
+		if line != "\n" {
+			break
+		}
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "-") {
+		return "", fmt.Errorf("MASTER aborted replication with an error: %s", line[1:])
+	} else if !strings.HasPrefix(line, "$") {
+		return "", fmt.Errorf("Bad protocol from MASTER, the first byte is not '$' (we received '%s'), are you sure the host and port are right?", line)
+	}
+	size, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil || size < 0 {
+		return "", fmt.Errorf("Bad protocol from MASTER, invalid bulk length '%s'", line)
+	}
+	redisLog(REDIS_NOTICE, "MASTER <-> REPLICA sync: receiving %d bytes from master to disk", size)
+
+	tmpfile := fmt.Sprintf("temp-%d.%d.rdb", time.Now().Unix(), os.Getpid())
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		return "", fmt.Errorf("Opening the temp file needed for MASTER <-> REPLICA synchronization: %s", err)
+	}
+	buf := make([]byte, REDIS_REPL_TRANSFER_BUF_SIZE)
+	for left := size; left > 0 && err == nil; {
+		chunk := buf
+		if left < int64(len(chunk)) {
+			chunk = chunk[:left]
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		if _, err = io.ReadFull(reader, chunk); err == nil {
+			_, err = f.Write(chunk)
+			left -= int64(len(chunk))
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpfile)
+		return "", fmt.Errorf("I/O error trying to sync with MASTER: %s", err)
+	}
+	return tmpfile, nil
+}
+
+// the handshake failed, it is retried by replicationCron.
+func replicationHandshakeFailed(h *replHandshake, conn net.Conn, err error) {
+	if conn != nil {
+		_ = conn.Close()
+	}
+	server.eventCh <- func() {
+		if server.replHandshake != h {
+			return
+		}
+		redisLog(REDIS_WARNING, "%s", err)
+		server.replHandshake = nil
+		server.replState = REDIS_REPL_CONNECT
+	}
+}
+
+/*
+*
+called by the event loop once the RDB of a full resynchronization is received: the
+dataset is replaced by the one of the master, and our history becomes its history.
+*/
+func replicationAttachToNewMaster(h *replHandshake, conn net.Conn, reader *bufio.Reader, replid string, offset int64, tmpfile string) {
+	if server.replHandshake != h {
+		_ = conn.Close()
+		_ = os.Remove(tmpfile)
+		return
+	}
+	server.replHandshake = nil
+
+	//the AOF is stopped while loading, then rewritten from the new dataset.
+	aofWasOn := server.aofState != REDIS_AOF_OFF
+	if aofWasOn {
+		stopAppendOnly()
+	}
+	redisLog(REDIS_NOTICE, "MASTER <-> REPLICA sync: Flushing old data")
+	emptyDb(-1)
+
+	//rename the received RDB, so that it is the one loaded at the next restart.
+	err := os.Rename(tmpfile, server.rdbFilename)
+	if err != nil {
+		err = fmt.Errorf("Failed trying to rename the temp DB into %s in MASTER <-> REPLICA synchronization: %s", server.rdbFilename, err)
+		_ = os.Remove(tmpfile)
+	} else {
+		redisLog(REDIS_NOTICE, "MASTER <-> REPLICA sync: Loading DB in memory")
+		server.loading = true
+		if err = rdbLoad(server.rdbFilename); err != nil {
+			err = fmt.Errorf("Failed trying to load the MASTER synchronization DB from disk: %s", err)
+			emptyDb(-1)
+		}
+		server.loading = false
+	}
+	if err != nil {
+		redisLog(REDIS_WARNING, "%s", err)
+		_ = conn.Close()
+		server.replState = REDIS_REPL_CONNECT
+	} else {
+		//our history is now the one of the master, the old replicas can't continue with it.
+		server.replid = replid
+		server.masterReplOffset = offset
+		clearReplicationId2()
+		disconnectSlaves()
+		createReplicationBacklog()
+		replicationCreateMasterClient(conn, reader, 0)
+		redisLog(REDIS_NOTICE, "MASTER <-> REPLICA sync: Finished with success")
+	}
+
+	if aofWasOn {
+		redisLog(REDIS_NOTICE, "Restarting the AOF after the synchronization with the master")
+		if startAppendOnly() != nil {
+			redisLog(REDIS_WARNING, "Failed enabling the AOF after successful master synchronization! Trying it again in one second.")
+			server.aofRewriteScheduled = true
+		}
+	}
+}
+
+/*
+*
+called by the event loop when the master accepted a partial resynchronization:
+the stream continues from our offset, in the DB selected before the link was lost.
+*/
+func replicationResurrectMaster(h *replHandshake, conn net.Conn, reader *bufio.Reader, newReplid string) {
+	if server.replHandshake != h {
+		_ = conn.Close()
+		return
+	}
+	server.replHandshake = nil
+
+	//the master changed its replication ID, e.g. it was promoted: our previous history is kept as secondary ID.
+	if newReplid != "" && newReplid != server.replid {
+		server.replid2 = server.replid
+		server.secondReplidOffset = server.masterReplOffset + 1
+		server.replid = newReplid
+		redisLog(REDIS_NOTICE, "Master replication ID changed to %s", newReplid)
+		//our replicas need to know the new replication ID.
+		disconnectSlaves()
+	}
+	if server.replBacklog == nil {
+		createReplicationBacklog()
+	}
+	replicationCreateMasterClient(conn, reader, server.replCachedMasterDb)
+	redisLog(REDIS_NOTICE, "MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization.")
+}
+
+// create the client used to execute the commands sent by the master.
+func replicationCreateMasterClient(conn net.Conn, reader *bufio.Reader, dbid int) {
+	c := createClient(conn)
+	c.flags |= REDIS_MASTER
+	c.authenticated = true
+	selectDb(c, dbid)
+	server.master = c
+	server.replState = REDIS_REPL_CONNECTED
+	server.replDownSince = 0
+	server.clients.Store(c.id, c)
+	server.connectedClients.Add(1)
+	go processInputBuffer(c, reader, server.closeClientCh, server.commandCh)
+}
+
+// called when the master client is freed, we will reconnect and try a partial resynchronization.
+func replicationHandleMasterDisconnection() {
+	server.replCachedMasterDb = server.master.db.id
+	server.master = nil
+	server.replState = REDIS_REPL_CONNECT
+	server.replDownSince = time.Now().Unix()
+	redisLog(REDIS_NOTICE, "Connection with master lost.")
+}
+
+// set the master to replicate, the connection is established in background.
+func replicationSetMaster(host string, port int) {
+	wasMaster := server.masterhost == ""
+	server.masterhost = host
+	server.masterport = port
+	if server.master != nil {
+		freeClient(server.master)
+	}
+	cancelReplicationHandshake()
+	//our own history can be continued by the new master if it was one of our replicas.
+	if wasMaster {
+		server.replCachedMasterDb = 0
+		if server.slaveseldb != -1 {
+			server.replCachedMasterDb = server.slaveseldb
+		}
+	}
+	server.replState = REDIS_REPL_CONNECT
+	redisLog(REDIS_NOTICE, "Connecting to MASTER %s:%d", server.masterhost, server.masterport)
+	connectWithMaster()
+}
+
+// stop replicating, this server becomes a master with a new history.
+func replicationUnsetMaster() {
+	if server.masterhost == "" {
+		return
+	}
+	server.masterhost = ""
+	if server.master != nil {
+		freeClient(server.master)
+	}
+	cancelReplicationHandshake()
+	//our replicas can partially resynchronize with the new replication ID, they need to reconnect to know it.
+	shiftReplicationId()
+	disconnectSlaves()
+	server.replState = REDIS_REPL_NONE
+	//the next command propagated to our replicas must be preceded by a SELECT.
+	server.slaveseldb = -1
+}
+
+// REPLICAOF <host> <port> | NO ONE, SLAVEOF is an alias.
+func replicaofCommand(c *redisClient) {
+	if strings.EqualFold(c.argv[1].String(), "no") && strings.EqualFold(c.argv[2].String(), "one") {
+		if server.masterhost != "" {
+			replicationUnsetMaster()
+			redisLog(REDIS_NOTICE, "MASTER MODE enabled (user request from 'id=%d addr=%s')", c.id, c.conn.RemoteAddr())
+		}
+	} else {
+		if c.flags&REDIS_SLAVE > 0 {
+			errMsg := "Command is not valid when client is a replica."
+			addReplyError(c, &errMsg)
+			return
+		}
+		host := c.argv[1].String()
+		port, err := strconv.Atoi(c.argv[2].String())
+		if err != nil || port < 0 || port > 65535 {
+			errMsg := "Invalid master port"
+			addReplyError(c, &errMsg)
+			return
+		}
+		//check if we are already attached to the specified master.
+		if server.masterhost != "" && strings.EqualFold(server.masterhost, host) && server.masterport == port {
+			redisLog(REDIS_NOTICE, "REPLICAOF would result into synchronization with the master we are already connected with. No operation performed.")
+			addReplyStatus(c, "OK Already connected to specified master")
+			return
+		}
+		replicationSetMaster(host, port)
+		redisLog(REDIS_NOTICE, "REPLICAOF %s:%d enabled (user request from 'id=%d addr=%s')", host, port, c.id, c.conn.RemoteAddr())
+	}
+	addReply(c, shared.ok)
+}
+
+// --------------------------- REPLICATION CRON  ----------------------------
+
+// replication cron function, called 1 time per second.
+func replicationCron() {
+	//check if we should connect to a master.
+	if server.masterhost != "" && server.replState == REDIS_REPL_CONNECT {
+		redisLog(REDIS_NOTICE, "Connecting to MASTER %s:%d", server.masterhost, server.masterport)
+		connectWithMaster()
+	}
+
+	//timed out master when we are an already connected replica.
+	if server.master != nil && time.Now().Unix()-server.master.lastinteraction > int64(server.replTimeout) {
+		redisLog(REDIS_WARNING, "MASTER timeout: no data nor PING received...")
+		freeClient(server.master)
+	}
+
+	//send an ACK to our master every second, it is used by WAIT and to detect timeouts.
+	if server.master != nil {
+		replicationSendAck()
+	}
+
+	//disconnect the replicas that did not send an ACK for more than repl-timeout seconds.
+	now := time.Now().Unix()
+	slaves := make([]*redisClient, 0)
+	for node := server.slaves.head; node != nil; node = node.next {
+		slave := (*node.value).(*redisClient)
+		//the replicas using SYNC never send ACKs.
+		if slave.replstate == REDIS_REPL_ONLINE && slave.flags&REDIS_PRE_PSYNC == 0 &&
+			now-slave.replAckTime > int64(server.replTimeout) {
+			slaves = append(slaves, slave)
+		}
+	}
+	for _, slave := range slaves {
+		redisLog(REDIS_WARNING, "Disconnecting timedout replica: %s", replicationGetSlaveName(slave))
+		freeClient(slave)
+	}
+
+	//ping our replicas, so that they are able to detect a timeout of the link with us.
+	if server.replicationCronLoops%int64(server.replPingSlavePeriod) == 0 && listLength(server.slaves) > 0 {
+		replicationFeedSlaves(server.slaveseldb, []*robj{shared.ping})
+	}
+	server.replicationCronLoops++
+}
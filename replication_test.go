@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReplicationBacklog(t *testing.T) {
+	server.clientsPendingWrite = listCreate()
+	server.slaves = listCreate()
+	server.replBacklogSize = 16
+	server.masterReplOffset = 100
+	createReplicationBacklog()
+	if server.replBacklogOff != 101 {
+		t.Fatal("unexpected offset of the empty backlog:", server.replBacklogOff)
+	}
+
+	//write more than the backlog size, so that the oldest data is overwritten.
+	stream := "0123456789abcdefghijklmnopqrstuvwxyz"
+	feedReplicationBacklog([]byte(stream[:10]))
+	feedReplicationBacklog([]byte(stream[10:]))
+	if server.masterReplOffset != 136 || server.replBacklogHistlen != 16 || server.replBacklogOff != 121 {
+		t.Fatal("unexpected backlog state", server.masterReplOffset, server.replBacklogHistlen, server.replBacklogOff)
+	}
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	c := createClient(conn)
+	c.flags |= REDIS_SLAVE
+	c.replstate = REDIS_REPL_ONLINE
+	//the replica asks for the first byte it has not received yet.
+	if n := addReplyReplicationBacklog(c, 131); n != 6 || string(c.buf) != "uvwxyz" {
+		t.Errorf("unexpected backlog data %q (%d bytes)", c.buf, n)
+	}
+	c.buf = c.buf[:0]
+	if n := addReplyReplicationBacklog(c, 121); n != 16 || string(c.buf) != stream[20:] {
+		t.Errorf("unexpected backlog data %q (%d bytes)", c.buf, n)
+	}
+}
+
+func TestMasterTryPartialResynchronization(t *testing.T) {
+	server.clientsPendingWrite = listCreate()
+	server.slaves = listCreate()
+	server.replBacklogSize = 1024
+	server.masterReplOffset = 0
+	changeReplicationId()
+	clearReplicationId2()
+	createReplicationBacklog()
+	feedReplicationBacklog([]byte("*1\r\n$4\r\nPING\r\n"))
+	shiftReplicationId()
+	feedReplicationBacklog([]byte("*1\r\n$4\r\nPING\r\n"))
+
+	psync := func(replid string, offset string) (int, string) {
+		conn, peer := net.Pipe()
+		defer conn.Close()
+		defer peer.Close()
+		reply := make(chan string)
+		go func() {
+			buf := make([]byte, 128)
+			n, _ := peer.Read(buf)
+			reply <- string(buf[:n])
+		}()
+		c := createClient(conn)
+		c.slaveCapa = SLAVE_CAPA_PSYNC2
+		c.argv = []*robj{testStringObject("PSYNC"), testStringObject(replid), testStringObject(offset)}
+		c.argc = 3
+		res := masterTryPartialResynchronization(c)
+		if res != REDIS_OK {
+			return res, ""
+		}
+		return res, <-reply + string(c.buf)
+	}
+
+	if res, reply := psync(server.replid, "15"); res != REDIS_OK || reply != "+CONTINUE "+server.replid+"\r\n*1\r\n$4\r\nPING\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	//the previous history can be continued up to the offset where it diverged.
+	if res, _ := psync(server.replid2, "15"); res != REDIS_OK {
+		t.Error("partial resync refused for the secondary replication ID")
+	}
+	if res, _ := psync(server.replid2, "16"); res != REDIS_ERR {
+		t.Error("partial resync accepted after the end of the secondary replication ID")
+	}
+	if res, _ := psync(strings.Repeat("a", REDIS_RUN_ID_SIZE), "1"); res != REDIS_ERR {
+		t.Error("partial resync accepted for an unknown replication ID")
+	}
+	if res, _ := psync(server.replid, "40"); res != REDIS_ERR {
+		t.Error("partial resync accepted for an offset not in the backlog")
+	}
+}
+
+func TestWaitCommand(t *testing.T) {
+	if server.commands == nil {
+		server.commands = make(map[string]*redisCommand)
+		populateCommandTable()
+	}
+	server.clientsPendingWrite = listCreate()
+	server.clientsWaitingAcks = listCreate()
+	server.slaves = listCreate()
+	server.masterhost = ""
+	for _, ack := range []int64{100, 200} {
+		slave := createClient(nil)
+		slave.flags |= REDIS_SLAVE
+		slave.replstate = REDIS_REPL_ONLINE
+		slave.replAckOff = ack
+		i := interface{}(slave)
+		listAddNodeTail(server.slaves, &i)
+	}
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	c := createClient(conn)
+	c.argv = []*robj{testStringObject("WAIT"), testStringObject("2"), testStringObject("0")}
+	c.argc = 3
+	c.woff = 150
+	waitCommand(c)
+	if c.flags&REDIS_BLOCKED == 0 || listLength(server.clientsWaitingAcks) != 1 || !server.getackSlaves {
+		t.Fatal("the client was not blocked")
+	}
+
+	//the second replica acknowledges the offset.
+	(*server.slaves.head.value).(*redisClient).replAckOff = 150
+	processClientsWaitingReplicas()
+	if c.flags&REDIS_BLOCKED > 0 || listLength(server.clientsWaitingAcks) != 0 || string(c.buf) != ":2\r\n" {
+		t.Fatalf("the client was not unblocked, reply %q", c.buf)
+	}
+	<-c.cmdDone
+
+	//the number of replicas acknowledging the offset is replied right away if enough.
+	c.buf = c.buf[:0]
+	c.argv[1] = testStringObject("1")
+	waitCommand(c)
+	if c.flags&REDIS_BLOCKED > 0 || string(c.buf) != ":2\r\n" {
+		t.Errorf("unexpected reply %q", c.buf)
+	}
+
+	c.buf = c.buf[:0]
+	c.argv[2] = testStringObject("-1")
+	waitCommand(c)
+	if string(c.buf) != "-ERR timeout is negative\r\n" {
+		t.Errorf("unexpected reply %q", c.buf)
+	}
+}
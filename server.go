@@ -1,7 +1,16 @@
 package main
 
 import (
-	"unsafe"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var dbDictType = dictType{
@@ -13,50 +22,326 @@ var dbDictType = dictType{
 	valDestructor: nil,
 }
 
+// the type of the dicts of the hash table encoded hashes, the fields are the keys.
+var hashDictType = dictType{
+	hashFunction:  dictSdsHash,
+	keyDup:        nil,
+	valDup:        nil,
+	keyCompare:    dictCompare,
+	keyDestructor: nil,
+	valDestructor: nil,
+}
+
+// the type of the dicts of the hash table encoded sets, the members are the keys and the values are nil.
+var setDictType = dictType{
+	hashFunction:  dictSdsHash,
+	keyDup:        nil,
+	valDup:        nil,
+	keyCompare:    dictCompare,
+	keyDestructor: nil,
+	valDestructor: nil,
+}
+
 func dictSdsHash(key string) int {
 	return dictGenHashFunction(key, len(key))
 }
 
+/*
+*
+MurmurHash2 by Austin Appleby, as used by redis. the key is read 4 bytes at a time
+as a little endian 32 bit word, the arithmetic is done on 32 bits like in the C version.
+*/
 func dictGenHashFunction(key string, kLen int) int {
-	var seed int = dict_hash_function_seed
-	var m int = 0x5bd1e995
-	var r int = 24
+	seed := uint32(dict_hash_function_seed)
+	const m uint32 = 0x5bd1e995
+	const r = 24
 
-	var h int = seed ^ kLen
+	//initialize the hash to a 'random' value.
+	h := seed ^ uint32(kLen)
 
-	runes := []rune(key)
+	//mix 4 bytes at a time into the hash, the key is read byte by byte as kLen is the length in bytes and not in runes.
 	pos := 0
-
 	for kLen >= 4 {
-		k := *(*int)(unsafe.Pointer(&runes[pos]))
+		k := uint32(key[pos]) | uint32(key[pos+1])<<8 | uint32(key[pos+2])<<16 | uint32(key[pos+3])<<24
 		k *= m
 		k ^= k >> r
 		k *= m
+
+		h *= m
 		h ^= k
 
 		pos += 4
 		kLen -= 4
 	}
 
+	//handle the last few bytes of the input array.
 	switch kLen {
 	case 3:
-		h ^= int(runes[2]) << 16
-
+		h ^= uint32(key[pos+2]) << 16
+		fallthrough
 	case 2:
-		h ^= int(runes[1]) << 8
-
+		h ^= uint32(key[pos+1]) << 8
+		fallthrough
 	case 1:
-		h ^= int(runes[0])
+		h ^= uint32(key[pos])
 		h *= m
 	}
 
+	//do a few final mixes of the hash to ensure the last few bytes are well-incorporated.
 	h ^= h >> 13
 	h *= m
 	h ^= h >> 15
-	return h
-
+	return int(h)
 }
 
 func dictCompare(privdata *interface{}, key1 string, key2 string) bool {
 	return key1 == key2
 }
+
+// log the message if the level is not below the configured verbosity.
+func redisLog(level int, format string, v ...interface{}) {
+	if level < server.verbosity {
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// return the number of bytes currently allocated by the live objects of the heap.
+func usedMemory() int64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return int64(sample[0].Value.Uint64())
+}
+
+// format a number of bytes in a human readable form, as reported by INFO.
+func bytesToHuman(n int64) string {
+	d := float64(n)
+	switch {
+	case n < 1024:
+		return strconv.FormatInt(n, 10) + "B"
+	case n < 1024*1024:
+		return fmt.Sprintf("%.2fK", d/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.2fM", d/(1024*1024))
+	case n < 1024*1024*1024*1024:
+		return fmt.Sprintf("%.2fG", d/(1024*1024*1024))
+	default:
+		return fmt.Sprintf("%.2fT", d/(1024*1024*1024*1024))
+	}
+}
+
+/*
+*
+create the string returned by the INFO command, the sections are the ones
+requested, "default" and "all" select the default sections or every section.
+*/
+func genRedisInfoString(sections map[string]bool) string {
+	all := sections["all"] || sections["everything"]
+	defaults := len(sections) == 0 || sections["default"] || all
+	selected := func(name string) bool {
+		return sections[name] || (defaults && name != "commandstats") || all
+	}
+	var b strings.Builder
+	now := time.Now().Unix()
+
+	if selected("server") {
+		uptime := now - server.statStartTime
+		b.WriteString("# Server\r\n")
+		fmt.Fprintf(&b, "redis_version:%s\r\n", REDIS_VERSION)
+		b.WriteString("redis_mode:standalone\r\n")
+		fmt.Fprintf(&b, "os:%s %s\r\n", runtime.GOOS, runtime.GOARCH)
+		fmt.Fprintf(&b, "go_version:%s\r\n", runtime.Version())
+		fmt.Fprintf(&b, "process_id:%d\r\n", os.Getpid())
+		fmt.Fprintf(&b, "tcp_port:%d\r\n", server.port)
+		fmt.Fprintf(&b, "uptime_in_seconds:%d\r\n", uptime)
+		fmt.Fprintf(&b, "uptime_in_days:%d\r\n", uptime/(3600*24))
+		fmt.Fprintf(&b, "hz:%d\r\n", server.hz)
+		fmt.Fprintf(&b, "config_file:%s\r\n", server.configfile)
+	}
+
+	if selected("clients") {
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# Clients\r\n")
+		fmt.Fprintf(&b, "connected_clients:%d\r\n", server.connectedClients.Load())
+		fmt.Fprintf(&b, "maxclients:%d\r\n", server.maxclients)
+	}
+
+	if selected("memory") {
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# Memory\r\n")
+		fmt.Fprintf(&b, "used_memory:%d\r\n", server.statUsedMemory)
+		fmt.Fprintf(&b, "used_memory_human:%s\r\n", bytesToHuman(server.statUsedMemory))
+		fmt.Fprintf(&b, "maxmemory:%d\r\n", server.maxmemory)
+		fmt.Fprintf(&b, "maxmemory_human:%s\r\n", bytesToHuman(server.maxmemory))
+	}
+
+	if selected("persistence") {
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		lastbgsaveStatus := "ok"
+		if server.lastbgsaveStatus != REDIS_OK {
+			lastbgsaveStatus = "err"
+		}
+		rdbBgsaveInProgress := 0
+		rdbCurrentBgsaveTimeSec := int64(-1)
+		if server.rdbChildRunning {
+			rdbBgsaveInProgress = 1
+			rdbCurrentBgsaveTimeSec = now - server.rdbSaveTimeStart
+		}
+		b.WriteString("# Persistence\r\n")
+		fmt.Fprintf(&b, "loading:%d\r\n", btoi(server.loading))
+		fmt.Fprintf(&b, "rdb_changes_since_last_save:%d\r\n", server.dirty)
+		fmt.Fprintf(&b, "rdb_bgsave_in_progress:%d\r\n", rdbBgsaveInProgress)
+		fmt.Fprintf(&b, "rdb_last_save_time:%d\r\n", server.lastsave)
+		fmt.Fprintf(&b, "rdb_last_bgsave_status:%s\r\n", lastbgsaveStatus)
+		fmt.Fprintf(&b, "rdb_last_bgsave_time_sec:%d\r\n", server.rdbLastBgsaveTimeSec)
+		fmt.Fprintf(&b, "rdb_current_bgsave_time_sec:%d\r\n", rdbCurrentBgsaveTimeSec)
+		aofLastWriteStatus := "ok"
+		if server.aofLastWriteStatus != REDIS_OK {
+			aofLastWriteStatus = "err"
+		}
+		aofLastBgrewriteStatus := "ok"
+		if server.aofLastbgrewriteStatus != REDIS_OK {
+			aofLastBgrewriteStatus = "err"
+		}
+		aofCurrentRewriteTimeSec := int64(-1)
+		if server.aofChildRunning {
+			aofCurrentRewriteTimeSec = now - server.aofRewriteTimeStart
+		}
+		fmt.Fprintf(&b, "aof_enabled:%d\r\n", btoi(server.aofState != REDIS_AOF_OFF))
+		fmt.Fprintf(&b, "aof_rewrite_in_progress:%d\r\n", btoi(server.aofChildRunning))
+		fmt.Fprintf(&b, "aof_rewrite_scheduled:%d\r\n", btoi(server.aofRewriteScheduled))
+		fmt.Fprintf(&b, "aof_last_rewrite_time_sec:%d\r\n", server.aofRewriteTimeLastSec)
+		fmt.Fprintf(&b, "aof_current_rewrite_time_sec:%d\r\n", aofCurrentRewriteTimeSec)
+		fmt.Fprintf(&b, "aof_last_bgrewrite_status:%s\r\n", aofLastBgrewriteStatus)
+		fmt.Fprintf(&b, "aof_last_write_status:%s\r\n", aofLastWriteStatus)
+		if server.aofState != REDIS_AOF_OFF {
+			fmt.Fprintf(&b, "aof_current_size:%d\r\n", server.aofCurrentSize)
+			fmt.Fprintf(&b, "aof_base_size:%d\r\n", server.aofRewriteBaseSize)
+			fmt.Fprintf(&b, "aof_rewrite_buffer_length:%d\r\n", len(server.aofRewriteBuf))
+			fmt.Fprintf(&b, "aof_buffer_length:%d\r\n", len(server.aofBuf))
+			fmt.Fprintf(&b, "aof_pending_bio_fsync:%d\r\n", btoi(server.aofFsyncInProgress.Load()))
+			fmt.Fprintf(&b, "aof_delayed_fsync:%d\r\n", server.aofDelayedFsync)
+		}
+	}
+
+	if selected("stats") {
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# Stats\r\n")
+		fmt.Fprintf(&b, "total_connections_received:%d\r\n", server.statNumconnections)
+		fmt.Fprintf(&b, "total_commands_processed:%d\r\n", server.statNumcommands)
+		fmt.Fprintf(&b, "rejected_connections:%d\r\n", server.statRejectedConn)
+		fmt.Fprintf(&b, "expired_keys:%d\r\n", server.statExpiredkeys)
+		fmt.Fprintf(&b, "expired_subkeys:%d\r\n", server.statExpiredSubkeys)
+		fmt.Fprintf(&b, "keyspace_hits:%d\r\n", server.statKeyspaceHits)
+		fmt.Fprintf(&b, "keyspace_misses:%d\r\n", server.statKeyspaceMisses)
+		fmt.Fprintf(&b, "pubsub_channels:%d\r\n", len(server.pubsubChannels))
+		fmt.Fprintf(&b, "pubsub_patterns:%d\r\n", len(server.pubsubPatterns))
+		fmt.Fprintf(&b, "pubsubshard_channels:%d\r\n", len(server.pubsubshardChannels))
+		fmt.Fprintf(&b, "sync_full:%d\r\n", server.statSyncFull)
+		fmt.Fprintf(&b, "sync_partial_ok:%d\r\n", server.statSyncPartialOk)
+		fmt.Fprintf(&b, "sync_partial_err:%d\r\n", server.statSyncPartialErr)
+	}
+
+	if selected("replication") {
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# Replication\r\n")
+		if server.masterhost == "" {
+			b.WriteString("role:master\r\n")
+		} else {
+			b.WriteString("role:slave\r\n")
+			linkStatus := "down"
+			lastIo := int64(-1)
+			if server.replState == REDIS_REPL_CONNECTED {
+				linkStatus = "up"
+				lastIo = now - server.master.lastinteraction
+			}
+			fmt.Fprintf(&b, "master_host:%s\r\n", server.masterhost)
+			fmt.Fprintf(&b, "master_port:%d\r\n", server.masterport)
+			fmt.Fprintf(&b, "master_link_status:%s\r\n", linkStatus)
+			fmt.Fprintf(&b, "master_last_io_seconds_ago:%d\r\n", lastIo)
+			fmt.Fprintf(&b, "master_sync_in_progress:%d\r\n", btoi(server.replState == REDIS_REPL_TRANSFER))
+			fmt.Fprintf(&b, "slave_repl_offset:%d\r\n", server.masterReplOffset)
+			if server.replState != REDIS_REPL_CONNECTED && server.replDownSince != 0 {
+				fmt.Fprintf(&b, "master_link_down_since_seconds:%d\r\n", now-server.replDownSince)
+			}
+			fmt.Fprintf(&b, "slave_read_only:%d\r\n", btoi(server.replSlaveRo))
+		}
+		fmt.Fprintf(&b, "connected_slaves:%d\r\n", listLength(server.slaves))
+		slaveid := 0
+		for node := server.slaves.head; node != nil; node = node.next {
+			slave := (*node.value).(*redisClient)
+			host, _, err := net.SplitHostPort(slave.conn.RemoteAddr().String())
+			if err != nil {
+				host = slave.conn.RemoteAddr().String()
+			}
+			state := "online"
+			if slave.replstate == REDIS_REPL_WAIT_BGSAVE_END {
+				state = "wait_bgsave"
+			}
+			fmt.Fprintf(&b, "slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n", slaveid, host,
+				slave.slaveListeningPort, state, slave.replAckOff, now-slave.replAckTime)
+			slaveid++
+		}
+		fmt.Fprintf(&b, "master_replid:%s\r\n", server.replid)
+		fmt.Fprintf(&b, "master_replid2:%s\r\n", server.replid2)
+		fmt.Fprintf(&b, "master_repl_offset:%d\r\n", server.masterReplOffset)
+		fmt.Fprintf(&b, "second_repl_offset:%d\r\n", server.secondReplidOffset)
+		fmt.Fprintf(&b, "repl_backlog_active:%d\r\n", btoi(server.replBacklog != nil))
+		fmt.Fprintf(&b, "repl_backlog_size:%d\r\n", server.replBacklogSize)
+		fmt.Fprintf(&b, "repl_backlog_first_byte_offset:%d\r\n", server.replBacklogOff)
+		fmt.Fprintf(&b, "repl_backlog_histlen:%d\r\n", server.replBacklogHistlen)
+	}
+
+	if selected("commandstats") {
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# Commandstats\r\n")
+		names := make([]string, 0, len(server.commands))
+		for name, cmd := range server.commands {
+			if cmd.calls > 0 {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cmd := server.commands[name]
+			fmt.Fprintf(&b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f\r\n", strings.ToLower(name),
+				cmd.calls, cmd.microseconds, float64(cmd.microseconds)/float64(cmd.calls))
+		}
+	}
+
+	if selected("keyspace") {
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# Keyspace\r\n")
+		for j := 0; j < server.dbnum; j++ {
+			keys := dictSize(&server.db[j].dict)
+			vkeys := dictSize(&server.db[j].expires)
+			if keys > 0 {
+				fmt.Fprintf(&b, "db%d:keys=%d,expires=%d\r\n", j, keys, vkeys)
+			}
+		}
+	}
+	return b.String()
+}
+
+// INFO [section [section ...]]
+func infoCommand(c *redisClient) {
+	sections := make(map[string]bool)
+	for j := 1; j < int(c.argc); j++ {
+		sections[strings.ToLower((*c.argv[j].ptr).(string))] = true
+	}
+	addReplyVerbatim(c, genRedisInfoString(sections), "txt")
+}
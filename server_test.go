@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// replace the databases of the server with dbnum empty databases.
+func resetTestDbs(dbnum int) {
+	createSharedObjects()
+	server.dbnum = dbnum
+	server.db = make([]redisDb, dbnum)
+	for j := 0; j < dbnum; j++ {
+		server.db[j].id = j
+		server.db[j].dict = *dictCreate(&dbDictType, nil)
+		server.db[j].expires = *dictCreate(&dbDictType, nil)
+		server.db[j].hexpires = *dictCreate(&dbDictType, nil)
+		server.db[j].watchedKeys = make(map[string]*list)
+		server.db[j].blockingKeys = make(map[string]*list)
+		server.db[j].readyKeys = make(map[string]struct{})
+	}
+}
+
+// create a string object holding s.
+func testStringObject(s string) *robj {
+	return createStringObject(&s, len(s))
+}
+
+// set up the server state the commands rely on, as initServer does.
+func setupTestServer() {
+	if server.commands == nil {
+		server.commands = make(map[string]*redisCommand)
+		populateCommandTable()
+	}
+	resetTestDbs(2)
+	server.clientsPendingWrite = listCreate()
+	server.slaves = listCreate()
+	server.readyKeys = listCreate()
+	server.masterhost = ""
+	server.hashMaxListpackEntries = 128
+	server.hashMaxListpackValue = 64
+	server.listMaxListpackSize = -2
+	server.listCompressDepth = 0
+	server.setMaxIntsetEntries = 512
+}
+
+// create a client connected through a pipe, and a function executing a command and returning its reply.
+func newTestClient(t *testing.T) (*redisClient, func(string) string) {
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		_ = conn.Close()
+		_ = peer.Close()
+	})
+	c := createClient(conn)
+	return c, func(command string) string {
+		args := strings.Split(command, " ")
+		c.argv = make([]*robj, len(args))
+		for j := range args {
+			c.argv[j] = testStringObject(args[j])
+		}
+		c.argc = uint64(len(args))
+		processCommand(c)
+		reply := string(c.buf)
+		c.buf = c.buf[:0]
+		return reply
+	}
+}
@@ -1,6 +1,39 @@
 package main
 
-import "log"
+import (
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+*
+check the length of a number of objects to see if we need to convert a listpack
+to a real hash: the hash is converted if a field or a value is too long, or if
+there are too many new fields. only strings are checked, the integers are small.
+*/
+func hashTypeTryConversion(o *robj, argv []*robj, start int, end int) {
+	if o.encoding != REDIS_ENCODING_LISTPACK {
+		return
+	}
+	//we guess that most of the values in the input are unique, so if there are enough arguments the hash is converted right away.
+	if (end-start+1)/2 > server.hashMaxListpackEntries {
+		hashTypeConvert(o, REDIS_ENCODING_HT)
+		return
+	}
+	for i := start; i <= end; i++ {
+		if argv[i].encoding == REDIS_ENCODING_INT {
+			continue
+		}
+		if len(argv[i].String()) > server.hashMaxListpackValue {
+			hashTypeConvert(o, REDIS_ENCODING_HT)
+			return
+		}
+	}
+}
 
 func hashTypeLookupWriteOrCreate(c *redisClient, key *robj) *robj {
 	//check if the dictionary exists.
@@ -22,14 +55,15 @@ func hashTypeLookupWriteOrCreate(c *redisClient, key *robj) *robj {
 	return o
 }
 
+// create an empty hash encoded as a listpack, it is converted to a real hash once it grows.
 func createHashObject() *robj {
 	o := new(robj)
 
 	o.robjType = REDIS_HASH
-	o.encoding = REDIS_ENCODING_HT
+	o.encoding = REDIS_ENCODING_LISTPACK
 
-	dict := make(map[string]*robj)
-	i := interface{}(dict)
+	lp := lpNew(0)
+	i := interface{}(lp)
 	o.ptr = &i
 
 	return o
@@ -41,71 +75,912 @@ func hashTypeTryObjectEncoding(subject *robj, o1 **robj, o2 **robj) {
 	if it is, proceed with the logic processing
 	*/
 	if subject.encoding == REDIS_ENCODING_HT {
-		//perform type conversion on the field.
-		if o1 != nil {
-			*o1 = tryObjectEncoding(*o1)
-		}
-		//perform type conversion on the field.
+		//the fields are the keys of the dict, so they are kept as strings.
+		//perform type conversion on the value.
 		if o2 != nil {
 			*o2 = tryObjectEncoding(*o2)
 		}
 	}
 }
 
-func hashTypeSet(o *robj, field *robj, value *robj) int {
+/*
+*
+get the value of the field from a listpack encoded hash, found is false if the
+field doesn't exist.
+*/
+func hashTypeGetFromListpack(o *robj, field *robj) (sval []byte, ival int64, isInt bool, found bool) {
+	lp := (*o.ptr).([]byte)
+	fptr := lpFirst(lp)
+	if fptr != -1 {
+		fptr = lpFind(lp, fptr, []byte(field.String()), 1)
+		if fptr != -1 {
+			//grab pointer to the value (fptr points to the field).
+			sval, ival, isInt = lpGet(lp, lpNext(lp, fptr))
+			return sval, ival, isInt, true
+		}
+	}
+	return nil, 0, false, false
+}
+
+func hashTypeGetFromHashTable(o *robj, field *robj, value **robj) bool {
+	de := dictFind((*o.ptr).(*dict), field.String())
+	if de == nil {
+		return false
+	}
+	*value = de.val
+	return true
+}
 
-	if o.encoding == REDIS_ENCODING_ZIPLIST {
-		//todo
-		return 0
+// return the value of the field as an object, or nil if the field doesn't exist.
+func hashTypeGetValueObject(o *robj, field *robj) *robj {
+	if o.encoding == REDIS_ENCODING_LISTPACK {
+		if sval, ival, isInt, found := hashTypeGetFromListpack(o, field); found {
+			return createStringObjectFromListpack(sval, ival, isInt)
+		}
 	} else if o.encoding == REDIS_ENCODING_HT {
-		m := (*o.ptr).(map[string]*robj)
-		/**
-		if it is an add operation, return true,
-		and then the function returns 1 .
-		conversely,return 0 to inform the external system
-		that the current operation is an update
-
-		*/
-		if dictReplace_new(m, field, value) {
-			return 0
+		var value *robj
+		if hashTypeGetFromHashTable(o, field, &value) {
+			return value
 		}
-		return 1
 	} else {
 		log.Panic("Unknown hash encoding")
-		return -1
 	}
+	return nil
+}
+
+// return the length of the value of the field, or 0 if the field doesn't exist.
+func hashTypeGetValueLength(o *robj, field *robj) int64 {
+	if o.encoding == REDIS_ENCODING_LISTPACK {
+		sval, ival, isInt, found := hashTypeGetFromListpack(o, field)
+		if !found {
+			return 0
+		}
+		if isInt {
+			return int64(len(strconv.FormatInt(ival, 10)))
+		}
+		return int64(len(sval))
+	}
+	if value := hashTypeGetValueObject(o, field); value != nil {
+		return int64(len(value.String()))
+	}
+	return 0
 }
 
 func hashTypeExists(o *robj, field *robj) bool {
-	/**
-	because the robj pointer records the interface type,
-	when storing, the field is forcefully cast to the interface type,
-	and the same applies to the key
-	*/
-	dict := (*o.ptr).(map[string]*robj)
-	key := (*field.ptr).(string)
-	//if it exists, return true.
-	if _, e := dict[key]; e {
-		return true
+	if o.encoding == REDIS_ENCODING_LISTPACK {
+		_, _, _, found := hashTypeGetFromListpack(o, field)
+		return found
+	} else if o.encoding == REDIS_ENCODING_HT {
+		//if it exists, return true.
+		return dictFind((*o.ptr).(*dict), field.String()) != nil
 	}
+	log.Panic("Unknown hash encoding")
 	return false
 }
 
+/*
+*
+add a new field, or overwrite the value of an existing field: 1 is returned if
+the field was updated, 0 if it was added. the hash is converted to a real hash
+if it has too many fields after the insertion. the expire of an updated field
+is removed, unless REDIS_HASH_SET_KEEP_TTL is set in flags.
+*/
+func hashTypeSet(o *robj, field *robj, value *robj, flags int) int {
+	update := 0
+	if o.encoding == REDIS_ENCODING_LISTPACK {
+		lp := (*o.ptr).([]byte)
+		f := []byte(field.String())
+		v := []byte(value.String())
+		fptr := lpFirst(lp)
+		if fptr != -1 {
+			fptr = lpFind(lp, fptr, f, 1)
+			if fptr != -1 {
+				//grab pointer to the value (fptr points to the field), and replace it.
+				lp, _ = lpReplace(lp, lpNext(lp, fptr), v)
+				update = 1
+			}
+		}
+		if update == 0 {
+			//push new field/value pair onto the tail of the listpack.
+			lp = lpAppend(lp, f)
+			lp = lpAppend(lp, v)
+		}
+		*o.ptr = lp
+		//check if the listpack needs to be converted to a hash table.
+		if hashTypeLength(o) > int64(server.hashMaxListpackEntries) {
+			hashTypeConvert(o, REDIS_ENCODING_HT)
+		}
+	} else if o.encoding == REDIS_ENCODING_HT {
+		d := (*o.ptr).(*dict)
+		//overwrite the value of an existing field, otherwise add the field with a key of its own.
+		if de := dictFind(d, field.String()); de != nil {
+			de.val = value
+			update = 1
+			if flags&REDIS_HASH_SET_KEEP_TTL == 0 {
+				hashTypeRemoveExpire(o, field)
+			}
+		} else {
+			key := field.String()
+			dictAdd(d, createStringObject(&key, len(key)), value)
+		}
+	} else {
+		log.Panic("Unknown hash encoding")
+		return -1
+	}
+	return update
+}
+
+// delete the field, false is returned if the field doesn't exist.
 func hashTypeDelete(o *robj, field *robj) bool {
 	var deleted bool
-	if o.encoding == REDIS_ENCODING_ZIPLIST {
-		//todo
-		return false
+	if o.encoding == REDIS_ENCODING_LISTPACK {
+		lp := (*o.ptr).([]byte)
+		fptr := lpFirst(lp)
+		if fptr != -1 {
+			fptr = lpFind(lp, fptr, []byte(field.String()), 1)
+			if fptr != -1 {
+				//delete both of the field and the value.
+				lp, fptr = lpDelete(lp, fptr)
+				lp, _ = lpDelete(lp, fptr)
+				*o.ptr = lp
+				deleted = true
+			}
+		}
 	} else if o.encoding == REDIS_ENCODING_HT {
-		dict := (*o.ptr).(map[string]*robj)
-		key := (*field.ptr).(string)
-		_, ok := dict[key]
-		if ok {
-			delete(dict, key)
-			deleted = true
+		deleted = dictDelete((*o.ptr).(*dict), field.String()) == DICT_OK
+		if deleted {
+			hashTypeRemoveExpire(o, field)
 		}
 	} else {
 		log.Panic("Unknown hash encoding")
 	}
 	return deleted
 }
+
+// return a random field of a non empty hash and its value.
+func hashTypeRandomElement(o *robj) (field *robj, value *robj) {
+	if o.encoding == REDIS_ENCODING_LISTPACK {
+		lp := (*o.ptr).([]byte)
+		fptr := lpSeek(lp, rand.Intn(lpLength(lp)/2)*2)
+		field = createStringObjectFromListpack(lpGet(lp, fptr))
+		value = createStringObjectFromListpack(lpGet(lp, lpNext(lp, fptr)))
+		return field, value
+	} else if o.encoding == REDIS_ENCODING_HT {
+		de := dictGetRandomKey((*o.ptr).(*dict))
+		return de.key, de.val
+	}
+	log.Panic("Unknown hash encoding")
+	return nil, nil
+}
+
+// return the number of fields in the hash.
+func hashTypeLength(o *robj) int64 {
+	if o.encoding == REDIS_ENCODING_LISTPACK {
+		return int64(lpLength((*o.ptr).([]byte)) / 2)
+	} else if o.encoding == REDIS_ENCODING_HT {
+		return int64(dictSize((*o.ptr).(*dict)))
+	}
+	log.Panic("Unknown hash encoding")
+	return -1
+}
+
+/*
+*
+an iterator over the fields of a hash. a hash table is walked with a safe dict
+iterator, so the current field can be deleted while iterating; the iterator
+must be released with hashTypeReleaseIterator.
+*/
+type hashTypeIterator struct {
+	subject  *robj
+	encoding int
+	//the offsets of the current field and value of the listpack.
+	fptr int
+	vptr int
+	//the dict iterator and the current entry of the hash table.
+	di *dictIterator
+	de *dictEntry
+}
+
+func hashTypeInitIterator(subject *robj) *hashTypeIterator {
+	hi := &hashTypeIterator{subject: subject, encoding: subject.encoding, fptr: -1, vptr: -1}
+	if hi.encoding == REDIS_ENCODING_HT {
+		hi.di = dictGetSafeIterator((*subject.ptr).(*dict))
+	} else if hi.encoding != REDIS_ENCODING_LISTPACK {
+		log.Panic("Unknown hash encoding")
+	}
+	return hi
+}
+
+func hashTypeReleaseIterator(hi *hashTypeIterator) {
+	if hi.encoding == REDIS_ENCODING_HT {
+		dictReleaseIterator(hi.di)
+	}
+}
+
+// move to the next field, false is returned when there are no fields left.
+func hashTypeNext(hi *hashTypeIterator) bool {
+	if hi.encoding == REDIS_ENCODING_LISTPACK {
+		lp := (*hi.subject.ptr).([]byte)
+		if hi.fptr == -1 {
+			//initialize cursor.
+			hi.fptr = lpFirst(lp)
+		} else {
+			//advance cursor.
+			hi.fptr = lpNext(lp, hi.vptr)
+		}
+		if hi.fptr == -1 {
+			return false
+		}
+		//grab pointer to the value (fptr points to the field).
+		hi.vptr = lpNext(lp, hi.fptr)
+		return true
+	} else if hi.encoding == REDIS_ENCODING_HT {
+		hi.de = dictNext(hi.di)
+		return hi.de != nil
+	}
+	log.Panic("Unknown hash encoding")
+	return false
+}
+
+// return the field (REDIS_HASH_KEY) or the value (REDIS_HASH_VALUE) at the current position of the iterator.
+func hashTypeCurrentObject(hi *hashTypeIterator, what int) *robj {
+	if hi.encoding == REDIS_ENCODING_LISTPACK {
+		lp := (*hi.subject.ptr).([]byte)
+		if what&REDIS_HASH_KEY > 0 {
+			return createStringObjectFromListpack(lpGet(lp, hi.fptr))
+		}
+		return createStringObjectFromListpack(lpGet(lp, hi.vptr))
+	} else if hi.encoding == REDIS_ENCODING_HT {
+		if what&REDIS_HASH_KEY > 0 {
+			return hi.de.key
+		}
+		return hi.de.val
+	}
+	log.Panic("Unknown hash encoding")
+	return nil
+}
+
+// convert a listpack encoded hash to a hash table, the fields keep their values.
+func hashTypeConvert(o *robj, enc int) {
+	if o.encoding == REDIS_ENCODING_LISTPACK {
+		if enc != REDIS_ENCODING_HT {
+			log.Panic("Unknown hash encoding")
+		}
+		d := dictCreate(&hashDictType, nil)
+		hi := hashTypeInitIterator(o)
+		for hashTypeNext(hi) {
+			//the keys of the dict must be strings, even if the field was stored as an integer.
+			field := hashTypeCurrentObject(hi, REDIS_HASH_KEY).String()
+			value := hashTypeCurrentObject(hi, REDIS_HASH_VALUE)
+			if dictAdd(d, createStringObject(&field, len(field)), value) != DICT_OK {
+				log.Panic("Listpack corruption detected")
+			}
+		}
+		hashTypeReleaseIterator(hi)
+		*o.ptr = d
+		o.encoding = REDIS_ENCODING_HT
+	} else if o.encoding == REDIS_ENCODING_HT {
+		log.Panic("Not implemented")
+	} else {
+		log.Panic("Unknown hash encoding")
+	}
+}
+
+/*
+*
+the expires of the fields of a hash, kept in the metadata of the dict of a hash
+table: a listpack is converted once one of its fields gets an expire. the
+expires dict maps the fields to the unix time in milliseconds at which they
+expire, minExpire is never later than the earliest of them, so the hashes with
+no expired field are skipped without walking their fields.
+*/
+type hashFieldExpires struct {
+	expires   *dict
+	minExpire int64
+}
+
+// return the expires of the fields of the hash, nil if none of its fields has an expire.
+func hashTypeFieldExpires(o *robj) *hashFieldExpires {
+	if o.encoding != REDIS_ENCODING_HT {
+		return nil
+	}
+	fe, _ := (*o.ptr).(*dict).metadata.(*hashFieldExpires)
+	return fe
+}
+
+// return the expire of the field in milliseconds, or -1 if the field has no expire.
+func hashTypeGetExpire(o *robj, field *robj) int64 {
+	fe := hashTypeFieldExpires(o)
+	if fe == nil {
+		return -1
+	}
+	de := dictFind(fe.expires, field.String())
+	if de == nil {
+		return -1
+	}
+	return (*de.val.ptr).(int64)
+}
+
+/*
+*
+set the expire of an existing field of the hash, the unix time in milliseconds.
+the hash must be added to the expires of its DB with hashTypeAddToExpires, so
+that the field is expired by the active expire cycle.
+*/
+func hashTypeSetExpire(o *robj, field *robj, when int64) {
+	if o.encoding == REDIS_ENCODING_LISTPACK {
+		hashTypeConvert(o, REDIS_ENCODING_HT)
+	}
+	d := (*o.ptr).(*dict)
+	fe := hashTypeFieldExpires(o)
+	if fe == nil {
+		fe = &hashFieldExpires{expires: dictCreate(&hashDictType, nil), minExpire: when}
+		d.metadata = fe
+	}
+	f := field.String()
+	dictReplace(fe.expires, createStringObject(&f, len(f)), createStringObjectFromLongLong(when))
+	if when < fe.minExpire {
+		fe.minExpire = when
+	}
+}
+
+// remove the expire of the field, false is returned if the field has no expire.
+func hashTypeRemoveExpire(o *robj, field *robj) bool {
+	fe := hashTypeFieldExpires(o)
+	if fe == nil || dictDelete(fe.expires, field.String()) != DICT_OK {
+		return false
+	}
+	//the hash has no expiring field left, it is removed from the expires of its DB by the active expire cycle.
+	if dictSize(fe.expires) == 0 {
+		(*o.ptr).(*dict).metadata = nil
+	}
+	return true
+}
+
+// track the hash in the expires of the DB, once one of its fields got an expire.
+func hashTypeAddToExpires(db *redisDb, key *robj) {
+	if dictFind(&db.hexpires, key.String()) == nil {
+		k := key.String()
+		dictAdd(&db.hexpires, createStringObject(&k, len(k)), nil)
+	}
+}
+
+/*
+*
+delete the expired fields of the hash, the deletions are propagated as an HDEL
+to the AOF and to the replicas. true is returned if the hash was deleted because
+all of its fields expired. like the keys, nothing is expired while loading or
+by a replica, which waits for the HDEL of its master.
+*/
+func hashTypeExpireIfNeeded(db *redisDb, key *robj, o *robj) bool {
+	if o.robjType != REDIS_HASH || server.loading || server.masterhost != "" {
+		return false
+	}
+	fe := hashTypeFieldExpires(o)
+	now := time.Now().UnixMilli()
+	if fe == nil || fe.minExpire > now {
+		return false
+	}
+
+	//collect the expired fields, and compute the earliest expire of the fields left.
+	var expired []*robj
+	minExpire := int64(math.MaxInt64)
+	di := dictGetSafeIterator(fe.expires)
+	for de := dictNext(di); de != nil; de = dictNext(di) {
+		if when := (*de.val.ptr).(int64); when <= now {
+			expired = append(expired, de.key)
+		} else if when < minExpire {
+			minExpire = when
+		}
+	}
+	dictReleaseIterator(di)
+	fe.minExpire = minExpire
+	if len(expired) == 0 {
+		return false
+	}
+
+	for _, field := range expired {
+		hashTypeDelete(o, field)
+	}
+	server.statExpiredSubkeys += int64(len(expired))
+	argv := append([]*robj{shared.hdel, key}, expired...)
+	propagate(lookupCommand("HDEL"), db.id, argv, REDIS_PROPAGATE_AOF|REDIS_PROPAGATE_REPL)
+	signalModifiedKey(db, key)
+
+	if hashTypeLength(o) == 0 {
+		dbDelete(db, key)
+		return true
+	}
+	if hashTypeFieldExpires(o) == nil {
+		dictDelete(&db.hexpires, key.String())
+	}
+	return false
+}
+
+/*
+*
+called by serverCron: a few hashes with expiring fields are sampled in every
+DB, continuing the scan of the expires of the DB where the last cycle stopped,
+and their expired fields are deleted. the hashes that no longer have expiring
+fields are removed from the expires of the DB.
+*/
+func activeExpireHashFieldsCycle() {
+	if server.loading {
+		return
+	}
+	for j := 0; j < server.dbnum; j++ {
+		db := &server.db[j]
+		if dictSize(&db.hexpires) == 0 {
+			continue
+		}
+		//the keys are collected first, the expire of the fields modifies the expires of the DB.
+		var keys []*robj
+		for i := 0; i < ACTIVE_EXPIRE_CYCLE_LOOKUPS_PER_LOOP; i++ {
+			db.hexpiresCursor = dictScan(&db.hexpires, db.hexpiresCursor, func(de *dictEntry) {
+				keys = append(keys, de.key)
+			})
+			if db.hexpiresCursor == 0 || len(keys) >= ACTIVE_EXPIRE_CYCLE_LOOKUPS_PER_LOOP {
+				break
+			}
+		}
+		for _, key := range keys {
+			o := lookupKey(db, key)
+			if o == nil || o.robjType != REDIS_HASH || hashTypeFieldExpires(o) == nil {
+				dictDelete(&db.hexpires, key.String())
+				continue
+			}
+			hashTypeExpireIfNeeded(db, key, o)
+		}
+	}
+}
+
+/*
+*
+parse the FIELDS numfields field [field ...] arguments starting at argv[start],
+each field is followed by its value when withValues is set. the fields are
+returned, or nil if an error was replied.
+*/
+func hashTypeParseFieldsOrReply(c *redisClient, start uint64, withValues bool) []*robj {
+	if start >= c.argc || strings.ToLower(c.argv[start].String()) != "fields" {
+		errMsg := "Mandatory argument FIELDS is missing or not at the right position"
+		addReplyError(c, &errMsg)
+		return nil
+	}
+	if start+1 >= c.argc {
+		addReply(c, shared.syntaxerr)
+		return nil
+	}
+	errMsg := "Parameter `numFields` should be greater than 0"
+	var numFields int64
+	if !getRangeLongFromObjectOrReply(c, c.argv[start+1], 1, math.MaxInt32, &numFields, &errMsg) {
+		return nil
+	}
+	args := numFields
+	if withValues {
+		args *= 2
+	}
+	if int64(c.argc-start-2) != args {
+		errMsg := "The `numfields` parameter must match the number of arguments"
+		addReplyError(c, &errMsg)
+		return nil
+	}
+	return c.argv[start+2:]
+}
+
+/*
+*
+parse the expire time of argv[i] in the given unit, relative to basetime, to
+an absolute unix time in milliseconds. false is returned if an error was
+replied: the time must not be negative, nor too far in the future.
+*/
+func hashTypeParseExpireOrReply(c *redisClient, i uint64, basetime int64, unit int, when *int64) bool {
+	var t int64
+	if !getLongFromObjectOrReply(c, c.argv[i], &t, nil) {
+		return false
+	}
+	if t < 0 {
+		errMsg := "invalid expire time, must be >= 0"
+		addReplyError(c, &errMsg)
+		return false
+	}
+	if unit == UNIT_SECONDS {
+		if t > HASH_FIELD_EXPIRE_TIME_MAX/1000 {
+			t = HASH_FIELD_EXPIRE_TIME_MAX + 1
+		} else {
+			t *= 1000
+		}
+	}
+	if t > HASH_FIELD_EXPIRE_TIME_MAX-basetime {
+		errMsg := "invalid expire time in '" + strings.ToLower(c.cmd.name) + "' command"
+		addReplyError(c, &errMsg)
+		return false
+	}
+	*when = t + basetime
+	return true
+}
+
+/*
+*
+rewrite the command to propagate to the AOF and to the replicas: the fields
+whose expire was set are propagated as an HPEXPIREAT with the absolute time,
+the deleted ones as an HDEL, and an HSET or HDEL of the fields is propagated
+before the expire if given.
+*/
+func hashTypePropagateExpire(c *redisClient, key *robj, when int64, updated []*robj, deleted []*robj) {
+	var argv []*robj
+	if len(updated) > 0 {
+		argv = []*robj{shared.hpexpireat, key, createStringObjectFromLongLong(when), shared.fields,
+			createStringObjectFromLongLong(int64(len(updated)))}
+		argv = append(argv, updated...)
+	}
+	if len(deleted) > 0 {
+		hdel := append([]*robj{shared.hdel, key}, deleted...)
+		if argv == nil {
+			argv = hdel
+		} else {
+			//both the commands are needed, the HDEL is propagated right away.
+			propagate(lookupCommand("HDEL"), c.db.id, hdel, REDIS_PROPAGATE_AOF|REDIS_PROPAGATE_REPL)
+		}
+	}
+	if argv != nil {
+		rewriteClientCommandVector(c, argv...)
+	}
+}
+
+/*
+*
+set the expire of the fields to when, the new expire is checked against the
+current one according to the NX, XX, GT and LT flags. the reply code of every
+field is returned: -2 if the field doesn't exist, 0 if the condition is not met,
+1 if the expire was set, 2 if the field was deleted because the time is in the
+past. the fields with their expire set and the deleted ones are returned too.
+*/
+func hashTypeSetExpireOfFields(c *redisClient, key *robj, o *robj, when int64, flag string, fields []*robj) (codes []int64, updated []*robj, deleted []*robj) {
+	//like for the keys, a time in the past deletes the fields, but not while loading or on a replica.
+	past := when <= time.Now().UnixMilli() && !server.loading && server.masterhost == ""
+	codes = make([]int64, len(fields))
+	for i, field := range fields {
+		if !hashTypeExists(o, field) {
+			codes[i] = -2
+			continue
+		}
+		current := hashTypeGetExpire(o, field)
+		if (flag == "nx" && current != -1) || (flag == "xx" && current == -1) ||
+			(flag == "gt" && (current == -1 || when <= current)) || (flag == "lt" && current != -1 && when >= current) {
+			codes[i] = 0
+			continue
+		}
+		if past {
+			hashTypeDelete(o, field)
+			deleted = append(deleted, field)
+			codes[i] = 2
+		} else {
+			hashTypeSetExpire(o, field, when)
+			updated = append(updated, field)
+			codes[i] = 1
+		}
+	}
+	if len(updated) > 0 {
+		hashTypeAddToExpires(c.db, key)
+	}
+	if len(updated) > 0 || len(deleted) > 0 {
+		if hashTypeLength(o) == 0 {
+			dbDelete(c.db, key)
+		}
+		signalModifiedKey(c.db, key)
+		server.dirty += int64(len(updated) + len(deleted))
+	}
+	return codes, updated, deleted
+}
+
+/*
+*
+this is the generic command implementation for HEXPIRE, HPEXPIRE, HEXPIREAT
+and HPEXPIREAT, like expireGenericCommand for the keys:
+HEXPIRE key seconds [NX | XX | GT | LT] FIELDS numfields field [field ...]
+*/
+func hexpireGenericCommand(c *redisClient, basetime int64, unit int) {
+	key := c.argv[1]
+	var when int64
+	if !hashTypeParseExpireOrReply(c, 2, basetime, unit, &when) {
+		return
+	}
+	//the optional condition comes before the fields.
+	flag := ""
+	fieldsAt := uint64(3)
+	if opt := strings.ToLower(c.argv[3].String()); opt == "nx" || opt == "xx" || opt == "gt" || opt == "lt" {
+		flag = opt
+		fieldsAt++
+	}
+	fields := hashTypeParseFieldsOrReply(c, fieldsAt, false)
+	if fields == nil {
+		return
+	}
+
+	o := lookupKeyWrite(c.db, key)
+	if o != nil && checkType(c, o, REDIS_HASH) {
+		return
+	}
+	codes := make([]int64, len(fields))
+	var updated, deleted []*robj
+	if o == nil {
+		//no key, every field is missing.
+		for i := range codes {
+			codes[i] = -2
+		}
+	} else {
+		codes, updated, deleted = hashTypeSetExpireOfFields(c, key, o, when, flag, fields)
+	}
+	addReplyMultiBulkLen(c, int64(len(codes)))
+	for _, code := range codes {
+		addReplyLongLong(c, code)
+	}
+	hashTypePropagateExpire(c, key, when, updated, deleted)
+}
+
+func hexpireCommand(c *redisClient) {
+	hexpireGenericCommand(c, time.Now().UnixMilli(), UNIT_SECONDS)
+}
+
+func hpexpireCommand(c *redisClient) {
+	hexpireGenericCommand(c, time.Now().UnixMilli(), UNIT_MILLISECONDS)
+}
+
+func hexpireatCommand(c *redisClient) {
+	hexpireGenericCommand(c, 0, UNIT_SECONDS)
+}
+
+func hpexpireatCommand(c *redisClient) {
+	hexpireGenericCommand(c, 0, UNIT_MILLISECONDS)
+}
+
+/*
+*
+HTTL and HPTTL key FIELDS numfields field [field ...]
+reply -2 for a field that doesn't exist, -1 for a field with no expire, the
+remaining time to live otherwise.
+*/
+func httlGenericCommand(c *redisClient, outputMs bool) {
+	fields := hashTypeParseFieldsOrReply(c, 2, false)
+	if fields == nil {
+		return
+	}
+	o := lookupKeyRead(c.db, c.argv[1])
+	if o != nil && checkType(c, o, REDIS_HASH) {
+		return
+	}
+	addReplyMultiBulkLen(c, int64(len(fields)))
+	for _, field := range fields {
+		if o == nil || !hashTypeExists(o, field) {
+			addReplyLongLong(c, -2)
+			continue
+		}
+		expire := hashTypeGetExpire(o, field)
+		if expire == -1 {
+			addReplyLongLong(c, -1)
+			continue
+		}
+		ttl := expire - time.Now().UnixMilli()
+		if ttl < 0 {
+			ttl = 0
+		}
+		if outputMs {
+			addReplyLongLong(c, ttl)
+		} else {
+			addReplyLongLong(c, (ttl+500)/1000)
+		}
+	}
+}
+
+func httlCommand(c *redisClient) {
+	httlGenericCommand(c, false)
+}
+
+func hpttlCommand(c *redisClient) {
+	httlGenericCommand(c, true)
+}
+
+/*
+*
+HPERSIST key FIELDS numfields field [field ...]
+reply -2 for a field that doesn't exist, -1 for a field with no expire, and 1
+when the expire of the field is removed.
+*/
+func hpersistCommand(c *redisClient) {
+	fields := hashTypeParseFieldsOrReply(c, 2, false)
+	if fields == nil {
+		return
+	}
+	o := lookupKeyWrite(c.db, c.argv[1])
+	if o != nil && checkType(c, o, REDIS_HASH) {
+		return
+	}
+	changed := false
+	addReplyMultiBulkLen(c, int64(len(fields)))
+	for _, field := range fields {
+		if o == nil || !hashTypeExists(o, field) {
+			addReplyLongLong(c, -2)
+		} else if hashTypeRemoveExpire(o, field) {
+			changed = true
+			server.dirty++
+			addReplyLongLong(c, 1)
+		} else {
+			addReplyLongLong(c, -1)
+		}
+	}
+	if changed {
+		signalModifiedKey(c.db, c.argv[1])
+	}
+}
+
+/*
+*
+parse the expire option of HGETEX and HSETEX starting at argv[i]: EX, PX,
+EXAT and PXAT set when to an absolute unix time in milliseconds, PERSIST and
+KEEPTTL are accepted if allowed. the option is returned lowercased, and the
+index of the next argument; the option is empty if an error was replied.
+*/
+func hashTypeParseExpireOptionOrReply(c *redisClient, i uint64, allowed string, when *int64) (string, uint64) {
+	opt := strings.ToLower(c.argv[i].String())
+	switch opt {
+	case "ex", "px", "exat", "pxat":
+		if i+1 >= c.argc {
+			addReply(c, shared.syntaxerr)
+			return "", i
+		}
+		basetime, unit := int64(0), UNIT_MILLISECONDS
+		if opt == "ex" || opt == "px" {
+			basetime = time.Now().UnixMilli()
+		}
+		if opt == "ex" || opt == "exat" {
+			unit = UNIT_SECONDS
+		}
+		if !hashTypeParseExpireOrReply(c, i+1, basetime, unit, when) {
+			return "", i
+		}
+		//a relative time must be positive.
+		if (opt == "ex" || opt == "px") && *when == basetime {
+			errMsg := "invalid expire time in '" + strings.ToLower(c.cmd.name) + "' command"
+			addReplyError(c, &errMsg)
+			return "", i
+		}
+		return opt, i + 2
+	case allowed:
+		return opt, i + 1
+	}
+	addReply(c, shared.syntaxerr)
+	return "", i
+}
+
+/*
+*
+HGETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds |
+PXAT unix-time-milliseconds | PERSIST] FIELDS numfields field [field ...]
+reply the values of the fields like HMGET, and set or remove their expire.
+*/
+func hgetexCommand(c *redisClient) {
+	var when int64
+	opt := ""
+	i := uint64(2)
+	if strings.ToLower(c.argv[i].String()) != "fields" {
+		if opt, i = hashTypeParseExpireOptionOrReply(c, i, "persist", &when); opt == "" {
+			return
+		}
+	}
+	fields := hashTypeParseFieldsOrReply(c, i, false)
+	if fields == nil {
+		return
+	}
+
+	key := c.argv[1]
+	o := lookupKeyWrite(c.db, key)
+	if o != nil && checkType(c, o, REDIS_HASH) {
+		return
+	}
+	addReplyMultiBulkLen(c, int64(len(fields)))
+	for _, field := range fields {
+		addHashFieldToReply(c, o, field)
+	}
+	if o == nil || opt == "" {
+		return
+	}
+
+	if opt == "persist" {
+		var persisted []*robj
+		for _, field := range fields {
+			if hashTypeRemoveExpire(o, field) {
+				persisted = append(persisted, field)
+			}
+		}
+		if len(persisted) > 0 {
+			signalModifiedKey(c.db, key)
+			server.dirty += int64(len(persisted))
+			argv := []*robj{shared.hpersist, key, shared.fields, createStringObjectFromLongLong(int64(len(persisted)))}
+			rewriteClientCommandVector(c, append(argv, persisted...)...)
+		}
+		return
+	}
+	_, updated, deleted := hashTypeSetExpireOfFields(c, key, o, when, "", fields)
+	hashTypePropagateExpire(c, key, when, updated, deleted)
+}
+
+/*
+*
+HSETEX key [FNX | FXX] [EX seconds | PX milliseconds | EXAT unix-time-seconds |
+PXAT unix-time-milliseconds | KEEPTTL] FIELDS numfields field value [field value ...]
+set the fields and their expire, with FNX only if none of the fields exist, with
+FXX only if all of them exist. 1 is replied if the fields were set, 0 otherwise.
+*/
+func hsetexCommand(c *redisClient) {
+	var when int64
+	cond, opt := "", ""
+	i := uint64(2)
+	for i < c.argc && strings.ToLower(c.argv[i].String()) != "fields" {
+		arg := strings.ToLower(c.argv[i].String())
+		if (arg == "fnx" || arg == "fxx") && cond == "" {
+			cond = arg
+			i++
+			continue
+		}
+		if opt != "" {
+			addReply(c, shared.syntaxerr)
+			return
+		}
+		if opt, i = hashTypeParseExpireOptionOrReply(c, i, "keepttl", &when); opt == "" {
+			return
+		}
+	}
+	fields := hashTypeParseFieldsOrReply(c, i, true)
+	if fields == nil {
+		return
+	}
+
+	key := c.argv[1]
+	o := lookupKeyWrite(c.db, key)
+	if o != nil && checkType(c, o, REDIS_HASH) {
+		return
+	}
+	//check the condition on the existence of the fields.
+	if cond != "" {
+		for j := 0; j < len(fields); j += 2 {
+			exists := o != nil && hashTypeExists(o, fields[j])
+			if (cond == "fnx" && exists) || (cond == "fxx" && !exists) {
+				addReply(c, shared.czero)
+				return
+			}
+		}
+	}
+	if o == nil {
+		o = createHashObject()
+		dbAdd(c.db, key, o)
+	}
+
+	fieldsAt := int(i + 2)
+	hashTypeTryConversion(o, c.argv, fieldsAt, int(c.argc-1))
+	flags := 0
+	if opt == "keepttl" {
+		flags = REDIS_HASH_SET_KEEP_TTL
+	}
+	names := make([]*robj, 0, len(fields)/2)
+	for j := fieldsAt; j < int(c.argc); j += 2 {
+		hashTypeTryObjectEncoding(o, &c.argv[j], &c.argv[j+1])
+		hashTypeSet(o, c.argv[j], c.argv[j+1], flags)
+		names = append(names, c.argv[j])
+	}
+	signalModifiedKey(c.db, key)
+	server.dirty += int64(len(names))
+	addReply(c, shared.cone)
+
+	if opt == "" || opt == "keepttl" {
+		return
+	}
+	_, updated, deleted := hashTypeSetExpireOfFields(c, key, o, when, "", names)
+	if len(deleted) > 0 {
+		//the fields expired right away, the fields are propagated as deleted.
+		rewriteClientCommandVector(c, append([]*robj{shared.hdel, key}, deleted...)...)
+	} else if len(updated) > 0 {
+		//propagate the absolute expire time, so that the replicas and the AOF don't depend on the clock.
+		argv := []*robj{c.argv[0], key, shared.pxat, createStringObjectFromLongLong(when)}
+		rewriteClientCommandVector(c, append(argv, c.argv[fieldsAt-2:]...)...)
+	}
+}
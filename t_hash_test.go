@@ -0,0 +1,414 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashCommands(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+	encoding := func() int {
+		return lookupKey(c.db, testStringObject("h")).encoding
+	}
+
+	//the same commands are checked on a listpack and on a hash table.
+	for _, enc := range []int{REDIS_ENCODING_LISTPACK, REDIS_ENCODING_HT} {
+		run("DEL h")
+		if reply := run("HSET h a 1"); reply != ":1\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if enc == REDIS_ENCODING_HT {
+			run("HSET h big " + strings.Repeat("x", 65))
+			run("HDEL h big")
+		}
+		if encoding() != enc {
+			t.Fatalf("unexpected encoding %d", encoding())
+		}
+		if reply := run("HSET h a 2"); reply != ":0\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		run("HMSET h b bval 100 -5")
+		if reply := run("HSETNX h b x"); reply != ":0\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HSETNX h c cval"); reply != ":1\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HMGET h a 100 c missing"); reply != "*4\r\n$1\r\n2\r\n$2\r\n-5\r\n$4\r\ncval\r\n$-1\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HDEL h a missing"); reply != ":1\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HGET h a"); reply != "$-1\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		//the fields of a listpack are replied in insertion order.
+		reply := run("HGETALL h")
+		if enc == REDIS_ENCODING_LISTPACK && reply != "*6\r\n$1\r\nb\r\n$4\r\nbval\r\n$3\r\n100\r\n$2\r\n-5\r\n$1\r\nc\r\n$4\r\ncval\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		} else if len(reply) != len("*6\r\n$1\r\nb\r\n$4\r\nbval\r\n$3\r\n100\r\n$2\r\n-5\r\n$1\r\nc\r\n$4\r\ncval\r\n") {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		run("HDEL h b 100 c")
+		if lookupKey(c.db, testStringObject("h")) != nil {
+			t.Error("the empty hash was not deleted")
+		}
+	}
+}
+
+func TestHashEncodingConversion(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+	encoding := func(key string) int {
+		return lookupKey(c.db, testStringObject(key)).encoding
+	}
+
+	//the hash is converted once it has more than hash-max-listpack-entries fields.
+	server.hashMaxListpackEntries = 4
+	run("HMSET h 1 a 2 b 3 c 4 d")
+	if encoding("h") != REDIS_ENCODING_LISTPACK {
+		t.Fatal("a small hash is not encoded as a listpack")
+	}
+	run("HSET h 5 e")
+	if encoding("h") != REDIS_ENCODING_HT {
+		t.Fatal("the hash was not converted to a hash table")
+	}
+	if reply := run("HGET h 3"); reply != "$1\r\nc\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	//too many fields in a single command convert the hash right away.
+	run("HMSET many 1 a 2 b 3 c 4 d 5 e")
+	if encoding("many") != REDIS_ENCODING_HT {
+		t.Fatal("the hash was not converted to a hash table")
+	}
+
+	//a long field or value converts the hash.
+	run("HSET v f " + strings.Repeat("x", 64))
+	if encoding("v") != REDIS_ENCODING_LISTPACK {
+		t.Fatal("a value within the limit converted the hash")
+	}
+	run("HSETNX v " + strings.Repeat("y", 65) + " z")
+	if encoding("v") != REDIS_ENCODING_HT {
+		t.Fatal("a long field did not convert the hash")
+	}
+	if reply := run("HGET v f"); reply != "$64\r\n"+strings.Repeat("x", 64)+"\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestHashFieldCommands(t *testing.T) {
+	setupTestServer()
+	_, run := newTestClient(t)
+
+	for _, big := range []bool{false, true} {
+		run("DEL h")
+		if reply := run("HSET h a 1 b hello c 1.5"); reply != ":3\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if big {
+			run("HSET h big " + strings.Repeat("x", 65))
+		}
+		if reply := run("HSET h a 2 d x"); reply != ":1\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HSET h a"); reply != "-ERR wrong number of arguments for HSET command\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HLEN h"); big && reply != ":5\r\n" || !big && reply != ":4\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HEXISTS h b"); reply != ":1\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HEXISTS h missing"); reply != ":0\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HSTRLEN h b") + run("HSTRLEN h a") + run("HSTRLEN h missing"); reply != ":5\r\n:1\r\n:0\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+
+		if reply := run("HINCRBY h a 10"); reply != ":12\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HINCRBY h new -3"); reply != ":-3\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HINCRBY h b 1"); reply != "-ERR hash value is not an integer\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		run("HSET h max 9223372036854775807")
+		if reply := run("HINCRBY h max 1"); reply != "-ERR increment or decrement would overflow\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HINCRBYFLOAT h c 2.25"); reply != "$4\r\n3.75\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HINCRBYFLOAT h b 1"); reply != "-ERR hash value is not a float\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HGET h c"); reply != "$4\r\n3.75\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+
+		run("DEL k")
+		run("HSET k f1 v1 f2 v2")
+		if reply := run("HKEYS k"); reply != "*2\r\n$2\r\nf1\r\n$2\r\nf2\r\n" && reply != "*2\r\n$2\r\nf2\r\n$2\r\nf1\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("HVALS k"); reply != "*2\r\n$2\r\nv1\r\n$2\r\nv2\r\n" && reply != "*2\r\n$2\r\nv2\r\n$2\r\nv1\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+	}
+	if reply := run("HMGET missing a b"); reply != "*2\r\n$-1\r\n$-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HKEYS missing") + run("HLEN missing"); reply != "*0\r\n:0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestHashRandomFieldAndScan(t *testing.T) {
+	setupTestServer()
+	_, run := newTestClient(t)
+
+	for _, n := range []int{10, 300} {
+		run("DEL h")
+		fields := make(map[string]bool)
+		for i := 0; i < n; i++ {
+			run("HSET h f" + strconv.Itoa(i) + " v" + strconv.Itoa(i))
+			fields["f"+strconv.Itoa(i)] = true
+		}
+		//the bulk strings of a flat array reply.
+		elements := func(reply string) []string {
+			var elements []string
+			lines := strings.Split(reply, "\r\n")
+			for j := 1; j < len(lines); j++ {
+				if strings.HasPrefix(lines[j], "$") {
+					elements = append(elements, lines[j+1])
+					j++
+				}
+			}
+			return elements
+		}
+
+		//distinct fields are replied with a positive count, whatever the count compared to the size.
+		for _, count := range []int{1, 5, n / 2, n - 1, n, n + 10} {
+			reply := run("HRANDFIELD h " + strconv.Itoa(count) + " WITHVALUES")
+			pairs := elements(reply)
+			want := count
+			if want > n {
+				want = n
+			}
+			seen := make(map[string]bool)
+			for j := 0; j < len(pairs); j += 2 {
+				if !fields[pairs[j]] || seen[pairs[j]] || pairs[j+1] != "v"+pairs[j][1:] {
+					t.Fatalf("unexpected reply %q", reply)
+				}
+				seen[pairs[j]] = true
+			}
+			if len(seen) != want {
+				t.Fatalf("count %d replied %d fields", count, len(seen))
+			}
+		}
+		if fieldsReply := elements(run("HRANDFIELD h -" + strconv.Itoa(n*2))); len(fieldsReply) != n*2 {
+			t.Fatalf("a negative count replied %d fields", len(fieldsReply))
+		}
+		if reply := strings.Split(run("HRANDFIELD h"), "\r\n"); len(reply) != 3 || !fields[reply[1]] {
+			t.Errorf("unexpected reply %v", reply)
+		}
+
+		//a full iteration returns every field with its value.
+		scanned := make(map[string]bool)
+		cursor := "0"
+		for {
+			reply := run("HSCAN h " + cursor + " COUNT 20")
+			lines := strings.Split(reply, "\r\n")
+			cursor = lines[2]
+			pairs := elements(strings.Join(lines[3:], "\r\n"))
+			for j := 0; j < len(pairs); j += 2 {
+				if pairs[j+1] != "v"+pairs[j][1:] {
+					t.Fatalf("unexpected reply %q", reply)
+				}
+				scanned[pairs[j]] = true
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+		if len(scanned) != n {
+			t.Fatalf("HSCAN returned %d fields", len(scanned))
+		}
+	}
+
+	if reply := run("HSCAN h 0 MATCH f1? NOVALUES COUNT 1000"); !strings.HasPrefix(reply, "*2\r\n$1\r\n0\r\n*10\r\n") {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HSCAN missing 0"); reply != "*2\r\n$1\r\n0\r\n*0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HSCAN h 0 COUNT 0"); reply != "-ERR syntax error\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HRANDFIELD missing 3"); reply != "*0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestHashFieldExpire(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+
+	run("HSET h a 1 b 2 c 3")
+	if reply := run("HEXPIRE h 100 FIELDS 3 a b missing"); reply != "*3\r\n:1\r\n:1\r\n:-2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if encoding := lookupKey(c.db, testStringObject("h")).encoding; encoding != REDIS_ENCODING_HT {
+		t.Errorf("unexpected encoding %d", encoding)
+	}
+	if reply := run("HTTL h FIELDS 3 a c missing"); reply != "*3\r\n:100\r\n:-1\r\n:-2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HTTL missing FIELDS 1 a"); reply != "*1\r\n:-2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	//the conditions are checked against the current expire, a field with no expire never expires.
+	if reply := run("HPEXPIRE h 50000 NX FIELDS 2 a c"); reply != "*2\r\n:0\r\n:1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HPEXPIRE h 200000 GT FIELDS 2 a c"); reply != "*2\r\n:1\r\n:1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HPEXPIRE h 300000 LT FIELDS 1 a"); reply != "*1\r\n:0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HPERSIST h FIELDS 2 c c"); reply != "*2\r\n:1\r\n:-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HPEXPIRE h 300000 XX FIELDS 1 c"); reply != "*1\r\n:0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	//HSET removes the expire of the field, HINCRBY keeps it.
+	run("HSET h a 10")
+	run("HINCRBY h b 1")
+	if reply := run("HTTL h FIELDS 2 a b"); reply != "*2\r\n:-1\r\n:100\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	if reply := run("HEXPIRE h 10 FIELDS 2 a"); reply != "-ERR The `numfields` parameter must match the number of arguments\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HEXPIRE h 10 FIELDS 0 a"); reply != "-ERR Parameter `numFields` should be greater than 0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HEXPIRE h 10 NX a b"); reply != "-ERR Mandatory argument FIELDS is missing or not at the right position\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HEXPIRE h -1 FIELDS 1 a"); reply != "-ERR invalid expire time, must be >= 0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HPEXPIREAT h 281474976710656 FIELDS 1 a"); reply != "-ERR invalid expire time in 'hpexpireat' command\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	//a time in the past deletes the fields, and the hash once it's empty.
+	if reply := run("HPEXPIREAT h 1 FIELDS 2 a b"); reply != "*2\r\n:2\r\n:2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HEXPIRE h 0 FIELDS 1 c"); reply != "*1\r\n:2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if lookupKey(c.db, testStringObject("h")) != nil || dictFind(&c.db.hexpires, "h") != nil {
+		t.Error("the empty hash was not deleted")
+	}
+
+	//the expired fields are deleted when the hash is accessed.
+	run("HSET h a 1 b 2 c 3")
+	o := lookupKey(c.db, testStringObject("h"))
+	hashTypeSetExpire(o, testStringObject("a"), time.Now().UnixMilli()-1)
+	hashTypeAddToExpires(c.db, testStringObject("h"))
+	if reply := run("HGETALL h"); strings.Contains(reply, "$1\r\na\r\n") || !strings.HasPrefix(reply, "*4\r\n") {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HLEN h"); reply != ":2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	//and in the background by the active expire cycle.
+	hashTypeSetExpire(o, testStringObject("b"), time.Now().UnixMilli()-1)
+	hashTypeSetExpire(o, testStringObject("c"), time.Now().UnixMilli()-1)
+	hashTypeAddToExpires(c.db, testStringObject("h"))
+	expired := server.statExpiredSubkeys
+	activeExpireHashFieldsCycle()
+	if lookupKey(c.db, testStringObject("h")) != nil || server.statExpiredSubkeys != expired+2 {
+		t.Error("the expired fields were not deleted by the active expire cycle")
+	}
+	if dictSize(&c.db.hexpires) != 0 {
+		t.Error("the deleted hash is still in the expires of the DB")
+	}
+}
+
+func TestHashGetexSetex(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+
+	if reply := run("HSETEX h EX 100 FIELDS 2 a 1 b 2"); reply != ":1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	//the relative time is propagated as an absolute one.
+	if c.cmd.name != "HSETEX" || strings.ToLower(c.argv[2].String()) != "pxat" {
+		t.Errorf("unexpected propagated command %s %s", c.cmd.name, c.argv[2].String())
+	}
+	if reply := run("HTTL h FIELDS 2 a b"); reply != "*2\r\n:100\r\n:100\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HSETEX h FNX FIELDS 2 a 3 c 3"); reply != ":0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HSETEX h FXX KEEPTTL FIELDS 1 a 3"); reply != ":1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HSETEX h FXX FIELDS 1 b 4"); reply != ":1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HTTL h FIELDS 2 a b"); reply != "*2\r\n:100\r\n:-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HSETEX h EX 10 PX 10 FIELDS 1 a 1"); reply != "-ERR syntax error\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HSETEX h FIELDS 2 a 1"); reply != "-ERR The `numfields` parameter must match the number of arguments\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	if reply := run("HGETEX h PERSIST FIELDS 3 a b missing"); reply != "*3\r\n$1\r\n3\r\n$1\r\n4\r\n$-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HTTL h FIELDS 1 a"); reply != "*1\r\n:-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HGETEX h PX 5000 FIELDS 1 b"); reply != "*1\r\n$1\r\n4\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if c.cmd.name != "HPEXPIREAT" {
+		t.Errorf("unexpected propagated command %s", c.cmd.name)
+	}
+	if reply := run("HPTTL h FIELDS 1 b"); reply != "*1\r\n:5000\r\n" && reply != "*1\r\n:4999\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("HGETEX h EX 0 FIELDS 1 b"); reply != "-ERR invalid expire time in 'hgetex' command\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	//the fields are replied before they are deleted by a time in the past.
+	if reply := run("HGETEX h PXAT 1 FIELDS 2 a b"); reply != "*2\r\n$1\r\n3\r\n$1\r\n4\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if c.cmd.name != "HDEL" || lookupKey(c.db, testStringObject("h")) != nil {
+		t.Error("the fields were not deleted")
+	}
+	if reply := run("HGETEX missing FIELDS 1 a"); reply != "*1\r\n$-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
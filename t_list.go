@@ -2,57 +2,954 @@ package main
 
 import (
 	"log"
+	"math"
+	"strconv"
+	"strings"
 )
 
-func listTypePush(subject *robj, value *robj, where int) {
+const (
+	/* the kind of conversion attempted by listTypeTryConversion */
+	LIST_CONV_AUTO      = 0 /* The list may grow or shrink */
+	LIST_CONV_GROWING   = 1 /* The list is growing, only listpack to quicklist */
+	LIST_CONV_SHRINKING = 2 /* The list is shrinking, only quicklist to listpack */
+)
 
-	if subject.encoding == REDIS_ENCODING_ZIPLIST {
-		//todo
-	} else if subject.encoding == REDIS_ENCODING_LINKEDLIST {
-		lobj := (*subject.ptr).(*list)
-		node := interface{}(value)
-		if where == REDIS_HEAD {
-			listAddNodeHead(lobj, &node)
-		} else {
-			listAddNodeTail(lobj, &node)
+/*
+*
+convert the listpack to a quicklist if the elements from argv[start] to
+argv[end] would make it exceed the list-max-listpack-size limits.
+*/
+func listTypeTryConvertListpack(o *robj, argv []*robj, start int, end int) {
+	lp := (*o.ptr).([]byte)
+	addBytes, addLength := 0, 0
+	if argv != nil {
+		for i := start; i <= end; i++ {
+			if argv[i].encoding == REDIS_ENCODING_INT {
+				continue
+			}
+			addBytes += len(argv[i].String())
+		}
+		addLength = end - start + 1
+	}
+	if quicklistNodeExceedsLimit(server.listMaxListpackSize, lpBytes(lp)+addBytes, lpLength(lp)+addLength) {
+		ql := quicklistNew(server.listMaxListpackSize, server.listCompressDepth)
+		//append the listpack to the quicklist if it's not empty, otherwise it is dropped.
+		if lpLength(lp) > 0 {
+			quicklistAppendListpack(ql, lp)
+		}
+		*o.ptr = ql
+		o.encoding = REDIS_ENCODING_QUICKLIST
+	}
+}
+
+/*
+*
+convert the quicklist to a listpack if it has a single node small enough: when
+shrinking, the node must be under half of the limits, so that a list near the
+limits doesn't keep converting back and forth.
+*/
+func listTypeTryConvertQuicklist(o *robj, shrinking bool) {
+	ql := (*o.ptr).(*quicklist)
+	//a quicklist can be converted to listpack only if it has only one node.
+	if ql.len != 1 {
+		return
+	}
+	szLimit, countLimit := quicklistNodeLimit(server.listMaxListpackSize)
+	if shrinking {
+		szLimit /= 2
+		countLimit /= 2
+	}
+	if ql.head.sz > szLimit || ql.count > int64(countLimit) {
+		return
+	}
+	quicklistDecompressNode(ql.head)
+	*o.ptr = ql.head.entry
+	o.encoding = REDIS_ENCODING_LISTPACK
+}
+
+func listTypeTryConversionRaw(o *robj, lct int, argv []*robj, start int, end int) {
+	if o.encoding == REDIS_ENCODING_QUICKLIST {
+		//growing has nothing to do with quicklist.
+		if lct == LIST_CONV_GROWING {
+			return
+		}
+		listTypeTryConvertQuicklist(o, lct == LIST_CONV_SHRINKING)
+	} else if o.encoding == REDIS_ENCODING_LISTPACK {
+		//shrinking has nothing to do with listpack.
+		if lct == LIST_CONV_SHRINKING {
+			return
 		}
+		listTypeTryConvertListpack(o, argv, start, end)
 	} else {
 		log.Panic("Unknown list encoding")
 	}
 }
 
-func listTypeLength(subject *robj) int64 {
+// check if the list needs to be converted to the appropriate encoding after its size changed.
+func listTypeTryConversion(o *robj, lct int) {
+	listTypeTryConversionRaw(o, lct, nil, 0, 0)
+}
+
+// check if the list needs to be converted before the elements from argv[start] to argv[end] are added.
+func listTypeTryConversionAppend(o *robj, argv []*robj, start int, end int) {
+	listTypeTryConversionRaw(o, LIST_CONV_GROWING, argv, start, end)
+}
 
-	if subject.encoding == REDIS_ENCODING_ZIPLIST {
-		//todo
-		return 0
-	} else if subject.encoding == REDIS_ENCODING_LINKEDLIST {
-		lobj := (*subject.ptr).(*list)
-		return lobj.len
+/*
+*
+push the value at the head (REDIS_HEAD) or at the tail (REDIS_TAIL) of the list,
+the caller must use listTypeTryConversionAppend before pushing.
+*/
+func listTypePush(subject *robj, value *robj, where int) {
+	ele := []byte(value.String())
+	if subject.encoding == REDIS_ENCODING_QUICKLIST {
+		pos := QUICKLIST_TAIL
+		if where == REDIS_HEAD {
+			pos = QUICKLIST_HEAD
+		}
+		quicklistPush((*subject.ptr).(*quicklist), ele, pos)
+	} else if subject.encoding == REDIS_ENCODING_LISTPACK {
+		lp := (*subject.ptr).([]byte)
+		if where == REDIS_HEAD {
+			lp = lpPrepend(lp, ele)
+		} else {
+			lp = lpAppend(lp, ele)
+		}
+		*subject.ptr = lp
 	} else {
 		log.Panic("Unknown list encoding")
 	}
+}
+
+func listTypeLength(subject *robj) int64 {
+	if subject.encoding == REDIS_ENCODING_QUICKLIST {
+		return quicklistCount((*subject.ptr).(*quicklist))
+	} else if subject.encoding == REDIS_ENCODING_LISTPACK {
+		return int64(lpLength((*subject.ptr).([]byte)))
+	}
+	log.Panic("Unknown list encoding")
 	return -1
 }
 
+// pop an element from the head (REDIS_HEAD) or the tail (REDIS_TAIL), nil is returned if the list is empty.
 func listTypePop(subject *robj, where int) *robj {
 	var value *robj
-	if subject.encoding == REDIS_ENCODING_ZIPLIST {
-		//todo
-	} else if subject.encoding == REDIS_ENCODING_LINKEDLIST {
-		lobj := (*subject.ptr).(*list)
-		var ln *listNode
-		//get the head or tail element based on the linked list identifier.
+	if subject.encoding == REDIS_ENCODING_QUICKLIST {
+		pos := QUICKLIST_TAIL
+		if where == REDIS_HEAD {
+			pos = QUICKLIST_HEAD
+		}
+		if sval, ival, isInt, ok := quicklistPop((*subject.ptr).(*quicklist), pos); ok {
+			value = createStringObjectFromListpack(sval, ival, isInt)
+		}
+	} else if subject.encoding == REDIS_ENCODING_LISTPACK {
+		lp := (*subject.ptr).([]byte)
+		var p int
+		//get the head or tail element based on the identifier.
 		if where == REDIS_HEAD {
-			ln = lobj.head
+			p = lpFirst(lp)
 		} else {
-			ln = lobj.tail
+			p = lpLast(lp)
+		}
+		if p != -1 {
+			//read the value of the element before it is removed from the listpack.
+			value = createStringObjectFromListpack(lpGet(lp, p))
+			lp, _ = lpDelete(lp, p)
+			*subject.ptr = lp
 		}
-		//read the value of the element and remove it from the linked list.
-		value = (*ln.value).(*robj)
-		listDelNode(lobj, ln)
 	} else {
 		log.Panic("Unknown list encoding")
 	}
 	return value
 }
+
+/*
+*
+an iterator over the elements of a list, starting at an index and moving towards
+the tail (REDIS_TAIL) or towards the head (REDIS_HEAD) of the list.
+*/
+type listTypeIterator struct {
+	subject   *robj
+	encoding  int
+	direction int
+	//the quicklist iterator, or the offset of the next element of the listpack.
+	iter *quicklistIter
+	lpi  int
+}
+
+// the element the iterator points to, returned by listTypeNext.
+type listTypeEntry struct {
+	li    *listTypeIterator
+	entry quicklistEntry
+	lpe   int
+}
+
+// initialize an iterator at the specified index.
+func listTypeInitIterator(subject *robj, index int64, direction int) *listTypeIterator {
+	li := &listTypeIterator{subject: subject, encoding: subject.encoding, direction: direction, lpi: -1}
+	if li.encoding == REDIS_ENCODING_QUICKLIST {
+		//REDIS_HEAD means start at TAIL and move *towards* head, REDIS_TAIL means start at HEAD and move *towards* tail.
+		iterDirection := AL_START_HEAD
+		if direction == REDIS_HEAD {
+			iterDirection = AL_START_TAIL
+		}
+		li.iter = quicklistGetIteratorAtIdx((*subject.ptr).(*quicklist), iterDirection, index)
+	} else if li.encoding == REDIS_ENCODING_LISTPACK {
+		li.lpi = lpSeek((*subject.ptr).([]byte), int(index))
+	} else {
+		log.Panic("Unknown list encoding")
+	}
+	return li
+}
+
+// clean up the iterator, compressing again the quicklist node it was using.
+func listTypeReleaseIterator(li *listTypeIterator) {
+	if li.encoding == REDIS_ENCODING_QUICKLIST {
+		quicklistReleaseIterator(li.iter)
+	}
+}
+
+/*
+*
+stores a pointer to the current element in entry and advances the iterator,
+false is returned when there are no elements left.
+*/
+func listTypeNext(li *listTypeIterator, entry *listTypeEntry) bool {
+	//protect from converting when iterating.
+	if li.subject.encoding != li.encoding {
+		log.Panic("The list encoding changed while iterating")
+	}
+	entry.li = li
+	if li.encoding == REDIS_ENCODING_QUICKLIST {
+		return quicklistNext(li.iter, &entry.entry)
+	} else if li.encoding == REDIS_ENCODING_LISTPACK {
+		entry.lpe = li.lpi
+		if entry.lpe != -1 {
+			lp := (*li.subject.ptr).([]byte)
+			if li.direction == REDIS_TAIL {
+				li.lpi = lpNext(lp, li.lpi)
+			} else {
+				li.lpi = lpPrev(lp, li.lpi)
+			}
+			return true
+		}
+	} else {
+		log.Panic("Unknown list encoding")
+	}
+	return false
+}
+
+// return the raw value of the entry: the string, or the integer if isInt is true.
+func listTypeGetValue(entry *listTypeEntry) (sval []byte, ival int64, isInt bool) {
+	if entry.li.encoding == REDIS_ENCODING_QUICKLIST {
+		return entry.entry.value, entry.entry.longval, entry.entry.isInt
+	} else if entry.li.encoding == REDIS_ENCODING_LISTPACK {
+		return lpGet((*entry.li.subject.ptr).([]byte), entry.lpe)
+	}
+	log.Panic("Unknown list encoding")
+	return nil, 0, false
+}
+
+// return the value of the entry.
+func listTypeGet(entry *listTypeEntry) *robj {
+	return createStringObjectFromListpack(listTypeGetValue(entry))
+}
+
+// insert the value before (REDIS_HEAD) or after (REDIS_TAIL) the entry.
+func listTypeInsert(entry *listTypeEntry, value *robj, where int) {
+	ele := []byte(value.String())
+	if entry.li.encoding == REDIS_ENCODING_QUICKLIST {
+		if where == REDIS_TAIL {
+			quicklistInsertAfter(entry.li.iter, &entry.entry, ele)
+		} else {
+			quicklistInsertBefore(entry.li.iter, &entry.entry, ele)
+		}
+	} else if entry.li.encoding == REDIS_ENCODING_LISTPACK {
+		lpw := LP_BEFORE
+		if where == REDIS_TAIL {
+			lpw = LP_AFTER
+		}
+		lp, _ := lpInsert((*entry.li.subject.ptr).([]byte), ele, entry.lpe, lpw)
+		*entry.li.subject.ptr = lp
+	} else {
+		log.Panic("Unknown list encoding")
+	}
+}
+
+// replace the value of the entry.
+func listTypeReplace(entry *listTypeEntry, value *robj) {
+	ele := []byte(value.String())
+	if entry.li.encoding == REDIS_ENCODING_QUICKLIST {
+		quicklistReplaceEntry(entry.li.iter, &entry.entry, ele)
+	} else if entry.li.encoding == REDIS_ENCODING_LISTPACK {
+		lp, _ := lpReplace((*entry.li.subject.ptr).([]byte), entry.lpe, ele)
+		*entry.li.subject.ptr = lp
+	} else {
+		log.Panic("Unknown list encoding")
+	}
+}
+
+// compare the value of the entry with the object, the elements are compared as strings.
+func listTypeEqual(entry *listTypeEntry, o *robj) bool {
+	sval, ival, isInt := listTypeGetValue(entry)
+	if isInt {
+		return strconv.FormatInt(ival, 10) == o.String()
+	}
+	return string(sval) == o.String()
+}
+
+// delete the element pointed to by the entry, the iterator moves to the next element.
+func listTypeDelete(li *listTypeIterator, entry *listTypeEntry) {
+	if entry.li.encoding == REDIS_ENCODING_QUICKLIST {
+		quicklistDelEntry(li.iter, &entry.entry)
+	} else if entry.li.encoding == REDIS_ENCODING_LISTPACK {
+		lp, p := lpDelete((*li.subject.ptr).([]byte), entry.lpe)
+		*li.subject.ptr = lp
+		//update position of the iterator depending on the direction.
+		if li.direction == REDIS_TAIL {
+			li.lpi = p
+		} else if p != -1 {
+			li.lpi = lpPrev(lp, p)
+		} else {
+			li.lpi = lpLast(lp)
+		}
+	} else {
+		log.Panic("Unknown list encoding")
+	}
+}
+
+// replace the element at the index, false is returned if the index is out of range.
+func listTypeReplaceAtIndex(subject *robj, index int64, value *robj) bool {
+	ele := []byte(value.String())
+	if subject.encoding == REDIS_ENCODING_QUICKLIST {
+		return quicklistReplaceAtIndex((*subject.ptr).(*quicklist), index, ele)
+	} else if subject.encoding == REDIS_ENCODING_LISTPACK {
+		lp := (*subject.ptr).([]byte)
+		p := lpSeek(lp, int(index))
+		if p == -1 {
+			return false
+		}
+		lp, _ = lpReplace(lp, p, ele)
+		*subject.ptr = lp
+		return true
+	}
+	log.Panic("Unknown list encoding")
+	return false
+}
+
+// delete count elements starting at the index, a negative index counts from the tail.
+func listTypeDelRange(subject *robj, start int64, count int64) {
+	if subject.encoding == REDIS_ENCODING_QUICKLIST {
+		quicklistDelRange((*subject.ptr).(*quicklist), start, count)
+	} else if subject.encoding == REDIS_ENCODING_LISTPACK {
+		*subject.ptr = lpDeleteRange((*subject.ptr).([]byte), int(start), int(count))
+	} else {
+		log.Panic("Unknown list encoding")
+	}
+}
+
+/*
+*
+called after elements are removed from a list: the key is deleted if the list is
+now empty, otherwise it may be converted back to a listpack. the modification is
+signaled.
+*/
+func listElementsRemoved(c *redisClient, key *robj, o *robj) {
+	if listTypeLength(o) == 0 {
+		dbDelete(c.db, key)
+	} else {
+		listTypeTryConversion(o, LIST_CONV_SHRINKING)
+	}
+	signalModifiedKey(c.db, key)
+	server.dirty++
+}
+
+// parse a LEFT or RIGHT argument into REDIS_HEAD or REDIS_TAIL.
+func getListPositionFromObjectOrReply(c *redisClient, arg *robj, position *int) bool {
+	s := arg.String()
+	if strings.EqualFold(s, "left") {
+		*position = REDIS_HEAD
+	} else if strings.EqualFold(s, "right") {
+		*position = REDIS_TAIL
+	} else {
+		addReply(c, shared.syntaxerr)
+		return false
+	}
+	return true
+}
+
+/*
+*
+pop up to count elements from the list at the key, replying the key name and an
+array of the popped elements. the command is replicated as [LR]POP key count.
+*/
+func listPopRangeAndReplyWithKey(c *redisClient, o *robj, key *robj, where int, count int64) {
+	llen := listTypeLength(o)
+	rangelen := count
+	if rangelen > llen {
+		rangelen = llen
+	}
+	//we return key-name just once, and an array of elements.
+	addReplyMultiBulkLen(c, 2)
+	addReplyBulk(c, key)
+	addReplyMultiBulkLen(c, rangelen)
+	for j := int64(0); j < rangelen; j++ {
+		addReplyBulk(c, listTypePop(o, where))
+	}
+	listElementsRemoved(c, key, o)
+
+	countObj := createStringObjectFromLongLong(rangelen)
+	if where == REDIS_HEAD {
+		rewriteClientCommandVector(c, shared.lpop, key, countObj)
+	} else {
+		rewriteClientCommandVector(c, shared.rpop, key, countObj)
+	}
+}
+
+/*
+*
+push the value moved by LMOVE into the destination list, creating it if needed,
+the pushed value is replied to the client.
+*/
+func lmoveHandlePush(c *redisClient, dstkey *robj, dstobj *robj, value *robj, where int) {
+	//create the list if the key does not exist.
+	if dstobj == nil {
+		dstobj = createListListpackObject()
+		dbAdd(c.db, dstkey, dstobj)
+	}
+	signalModifiedKey(c.db, dstkey)
+	listTypeTryConversionAppend(dstobj, []*robj{value}, 0, 0)
+	listTypePush(dstobj, value, where)
+	//always send the pushed value to the client.
+	addReplyBulk(c, value)
+}
+
+// RPOPLPUSH source destination
+func rpoplpushCommand(c *redisClient) {
+	lmoveGenericCommand(c, REDIS_TAIL, REDIS_HEAD)
+}
+
+// LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func lmoveCommand(c *redisClient) {
+	var wherefrom, whereto int
+	if !getListPositionFromObjectOrReply(c, c.argv[3], &wherefrom) ||
+		!getListPositionFromObjectOrReply(c, c.argv[4], &whereto) {
+		return
+	}
+	lmoveGenericCommand(c, wherefrom, whereto)
+}
+
+func lmoveGenericCommand(c *redisClient, wherefrom int, whereto int) {
+	sobj := lookupKeyWriteOrReply(c, c.argv[1], shared.null[c.resp])
+	if sobj == nil || checkType(c, sobj, REDIS_LIST) {
+		return
+	}
+	//the destination is checked before the source is modified.
+	dobj := lookupKeyWrite(c.db, c.argv[2])
+	if dobj != nil && checkType(c, dobj, REDIS_LIST) {
+		return
+	}
+	touchedkey := c.argv[1]
+	value := listTypePop(sobj, wherefrom)
+	lmoveHandlePush(c, c.argv[2], dobj, value, whereto)
+	listElementsRemoved(c, touchedkey, sobj)
+	//replicate BLMOVE as LMOVE.
+	if c.cmd.name == "BLMOVE" {
+		rewriteClientCommandVector(c, shared.lmove, c.argv[1], c.argv[2], c.argv[3], c.argv[4])
+	}
+}
+
+/*
+*
+blocking pop of the first non empty list among the keys: BLPOP, BRPOP and BLMPOP.
+if all the lists are empty, the client blocks until one of them receives data or
+the timeout is reached. count is -1 for BLPOP/BRPOP, which reply a single element.
+*/
+func blockingPopGenericCommand(c *redisClient, keys []*robj, where int, timeoutIdx int, count int64) {
+	var timeout int64
+	if getTimeoutFromObjectOrReply(c, c.argv[timeoutIdx], &timeout, UNIT_SECONDS) != REDIS_OK {
+		return
+	}
+	//traverse all input keys, we take action only based on one key.
+	for _, key := range keys {
+		o := lookupKeyWrite(c.db, key)
+		//non-existing key, move to next key.
+		if o == nil {
+			continue
+		}
+		if checkType(c, o, REDIS_LIST) {
+			return
+		}
+		llen := listTypeLength(o)
+		//empty list, move to next key.
+		if llen == 0 {
+			continue
+		}
+
+		if count != -1 {
+			//BLMPOP, non empty list, like a normal [LR]POP with count option.
+			listPopRangeAndReplyWithKey(c, o, key, where, count)
+			return
+		}
+
+		//non empty list, this is like a normal [LR]POP.
+		value := listTypePop(o, where)
+		addReplyMultiBulkLen(c, 2)
+		addReplyBulk(c, key)
+		addReplyBulk(c, value)
+		listElementsRemoved(c, key, o)
+		//replicate it as an [LR]POP instead of B[LR]POP.
+		if where == REDIS_HEAD {
+			rewriteClientCommandVector(c, shared.lpop, key)
+		} else {
+			rewriteClientCommandVector(c, shared.rpop, key)
+		}
+		return
+	}
+
+	//if we are inside a MULTI/EXEC the client can't block, the only thing we can do is treating it as a timeout (even with timeout 0).
+	if c.flags&REDIS_MULTI > 0 {
+		addReplyNullArray(c)
+		return
+	}
+	//if the keys do not exist we must block.
+	blockForKeys(c, REDIS_BLOCKED_LIST, keys, timeout)
+}
+
+// BLPOP key [key ...] timeout
+func blpopCommand(c *redisClient) {
+	blockingPopGenericCommand(c, c.argv[1:c.argc-1], REDIS_HEAD, int(c.argc-1), -1)
+}
+
+// BRPOP key [key ...] timeout
+func brpopCommand(c *redisClient) {
+	blockingPopGenericCommand(c, c.argv[1:c.argc-1], REDIS_TAIL, int(c.argc-1), -1)
+}
+
+func blmoveGenericCommand(c *redisClient, wherefrom int, whereto int, timeout int64) {
+	key := lookupKeyWrite(c.db, c.argv[1])
+	if key != nil && checkType(c, key, REDIS_LIST) {
+		return
+	}
+	if key == nil {
+		if c.flags&REDIS_MULTI > 0 {
+			//blocking against an empty list in a MULTI state returns immediately.
+			addReplyNull(c)
+		} else {
+			//the list is empty and the client blocks.
+			blockForKeys(c, REDIS_BLOCKED_LIST, c.argv[1:2], timeout)
+		}
+		return
+	}
+	//the list exists and has elements, so the regular LMOVE is executed.
+	lmoveGenericCommand(c, wherefrom, whereto)
+}
+
+// BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func blmoveCommand(c *redisClient) {
+	var wherefrom, whereto int
+	var timeout int64
+	if !getListPositionFromObjectOrReply(c, c.argv[3], &wherefrom) ||
+		!getListPositionFromObjectOrReply(c, c.argv[4], &whereto) {
+		return
+	}
+	if getTimeoutFromObjectOrReply(c, c.argv[5], &timeout, UNIT_SECONDS) != REDIS_OK {
+		return
+	}
+	blmoveGenericCommand(c, wherefrom, whereto, timeout)
+}
+
+/*
+*
+pop up to count elements from the first non empty list among the keys, a null
+reply is sent if all the lists are empty.
+*/
+func mpopGenericCommand(c *redisClient, keys []*robj, where int, count int64) {
+	for _, key := range keys {
+		o := lookupKeyWrite(c.db, key)
+		//non-existing key, move to next key.
+		if o == nil {
+			continue
+		}
+		if checkType(c, o, REDIS_LIST) {
+			return
+		}
+		//empty list, move to next key.
+		if listTypeLength(o) == 0 {
+			continue
+		}
+		listPopRangeAndReplyWithKey(c, o, key, where, count)
+		return
+	}
+	//look like we are not able to pop up any elements.
+	addReplyNullArray(c)
+}
+
+/*
+*
+parse the arguments of LMPOP and BLMPOP: numkeys key [key ...] LEFT|RIGHT [COUNT count]
+starting at numkeysIdx, then pop from the first non empty list.
+*/
+func lmpopGenericCommand(c *redisClient, numkeysIdx int, isBlock bool) {
+	var numkeys, count int64
+	var where int
+	count = -1
+	//parse the numkeys.
+	errMsg := "numkeys should be greater than 0"
+	if !getRangeLongFromObjectOrReply(c, c.argv[numkeysIdx], 1, math.MaxInt64, &numkeys, &errMsg) {
+		return
+	}
+	//parse the where, whereIdx is the index of where in the argv.
+	if numkeys >= int64(c.argc) {
+		addReply(c, shared.syntaxerr)
+		return
+	}
+	whereIdx := numkeysIdx + int(numkeys) + 1
+	if whereIdx >= int(c.argc) {
+		addReply(c, shared.syntaxerr)
+		return
+	}
+	if !getListPositionFromObjectOrReply(c, c.argv[whereIdx], &where) {
+		return
+	}
+	//parse the optional arguments.
+	for j := whereIdx + 1; j < int(c.argc); j++ {
+		opt := c.argv[j].String()
+		moreargs := int(c.argc) - 1 - j
+		if count == -1 && strings.EqualFold(opt, "count") && moreargs > 0 {
+			j++
+			errMsg := "count should be greater than 0"
+			if !getRangeLongFromObjectOrReply(c, c.argv[j], 1, math.MaxInt64, &count, &errMsg) {
+				return
+			}
+		} else {
+			addReply(c, shared.syntaxerr)
+			return
+		}
+	}
+	if count == -1 {
+		count = 1
+	}
+
+	if isBlock {
+		blockingPopGenericCommand(c, c.argv[numkeysIdx+1:whereIdx], where, 1, count)
+	} else {
+		mpopGenericCommand(c, c.argv[numkeysIdx+1:whereIdx], where, count)
+	}
+}
+
+// LMPOP numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func lmpopCommand(c *redisClient) {
+	lmpopGenericCommand(c, 1, false)
+}
+
+// BLMPOP timeout numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func blmpopCommand(c *redisClient) {
+	lmpopGenericCommand(c, 2, true)
+}
+
+func llenCommand(c *redisClient) {
+	o := lookupKeyReadOrReply(c, c.argv[1], shared.czero)
+	if o == nil || checkType(c, o, REDIS_LIST) {
+		return
+	}
+	addReplyLongLong(c, listTypeLength(o))
+}
+
+// LSET key index element
+func lsetCommand(c *redisClient) {
+	o := lookupKeyWriteOrReply(c, c.argv[1], shared.nokeyerr)
+	if o == nil || checkType(c, o, REDIS_LIST) {
+		return
+	}
+	var index int64
+	if !getLongFromObjectOrReply(c, c.argv[2], &index, nil) {
+		return
+	}
+	value := tryObjectEncoding(c.argv[3])
+	listTypeTryConversionAppend(o, c.argv, 3, 3)
+	if !listTypeReplaceAtIndex(o, index, value) {
+		addReply(c, shared.outofrangeerr)
+		return
+	}
+	addReply(c, shared.ok)
+	//we might replace a big item with a small one or vice versa, but we've already handled the growing case.
+	listTypeTryConversion(o, LIST_CONV_SHRINKING)
+	signalModifiedKey(c.db, c.argv[1])
+	server.dirty++
+}
+
+/*
+*
+LINSERT key BEFORE|AFTER pivot element
+the length of the list is replied, or -1 if the pivot was not found.
+*/
+func linsertCommand(c *redisClient) {
+	var where int
+	if strings.EqualFold(c.argv[2].String(), "after") {
+		where = REDIS_TAIL
+	} else if strings.EqualFold(c.argv[2].String(), "before") {
+		where = REDIS_HEAD
+	} else {
+		addReply(c, shared.syntaxerr)
+		return
+	}
+
+	subject := lookupKeyWriteOrReply(c, c.argv[1], shared.czero)
+	if subject == nil || checkType(c, subject, REDIS_LIST) {
+		return
+	}
+
+	//we're not sure if this value will be inserted yet, but we need to convert the list preemptively.
+	listTypeTryConversionAppend(subject, c.argv, 4, 4)
+
+	//seek pivot from head to tail.
+	inserted := false
+	var entry listTypeEntry
+	iter := listTypeInitIterator(subject, 0, REDIS_TAIL)
+	for listTypeNext(iter, &entry) {
+		if listTypeEqual(&entry, c.argv[3]) {
+			listTypeInsert(&entry, tryObjectEncoding(c.argv[4]), where)
+			inserted = true
+			break
+		}
+	}
+	listTypeReleaseIterator(iter)
+
+	if !inserted {
+		//notify client of a failed insert.
+		addReplyLongLong(c, -1)
+		return
+	}
+	signalModifiedKey(c.db, c.argv[1])
+	server.dirty++
+	addReplyLongLong(c, listTypeLength(subject))
+}
+
+/*
+*
+LREM key count element
+remove the first count occurrences of the element, from the tail if count is
+negative, all of them if count is zero.
+*/
+func lremCommand(c *redisClient) {
+	var toremove, removed int64
+	if !getLongFromObjectOrReply(c, c.argv[2], &toremove, nil) {
+		return
+	}
+	subject := lookupKeyWriteOrReply(c, c.argv[1], shared.czero)
+	if subject == nil || checkType(c, subject, REDIS_LIST) {
+		return
+	}
+
+	var li *listTypeIterator
+	if toremove < 0 {
+		toremove = -toremove
+		li = listTypeInitIterator(subject, -1, REDIS_HEAD)
+	} else {
+		li = listTypeInitIterator(subject, 0, REDIS_TAIL)
+	}
+
+	var entry listTypeEntry
+	for listTypeNext(li, &entry) {
+		if listTypeEqual(&entry, c.argv[3]) {
+			listTypeDelete(li, &entry)
+			server.dirty++
+			removed++
+			if toremove != 0 && removed == toremove {
+				break
+			}
+		}
+	}
+	listTypeReleaseIterator(li)
+
+	if removed > 0 {
+		signalModifiedKey(c.db, c.argv[1])
+	}
+	if listTypeLength(subject) == 0 {
+		dbDelete(c.db, c.argv[1])
+	} else if removed > 0 {
+		listTypeTryConversion(subject, LIST_CONV_SHRINKING)
+	}
+	addReplyLongLong(c, removed)
+}
+
+/*
+*
+LTRIM key start stop
+trim the list so that it only contains the specified range of elements, the key
+is deleted if the range is empty.
+*/
+func ltrimCommand(c *redisClient) {
+	var start, end, ltrim, rtrim int64
+	if !getLongFromObjectOrReply(c, c.argv[2], &start, nil) ||
+		!getLongFromObjectOrReply(c, c.argv[3], &end, nil) {
+		return
+	}
+	o := lookupKeyWriteOrReply(c, c.argv[1], shared.ok)
+	if o == nil || checkType(c, o, REDIS_LIST) {
+		return
+	}
+	llen := listTypeLength(o)
+
+	//convert negative indexes.
+	if start < 0 {
+		start = llen + start
+	}
+	if end < 0 {
+		end = llen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	//invariant: start >= 0, so this test will be true when end < 0. the range is empty when start > end || start >= llen.
+	if start > end || start >= llen {
+		//out of range start or start > end result in empty list.
+		ltrim = llen
+		rtrim = 0
+	} else {
+		if end >= llen {
+			end = llen - 1
+		}
+		ltrim = start
+		rtrim = llen - end - 1
+	}
+
+	//remove list elements to perform the trim.
+	listTypeDelRange(o, 0, ltrim)
+	listTypeDelRange(o, -rtrim, rtrim)
+
+	signalModifiedKey(c.db, c.argv[1])
+	server.dirty += ltrim + rtrim
+	if listTypeLength(o) == 0 {
+		dbDelete(c.db, c.argv[1])
+	} else {
+		listTypeTryConversion(o, LIST_CONV_SHRINKING)
+	}
+	addReply(c, shared.ok)
+}
+
+/*
+*
+LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+
+the "rank" is the position of the match, so if it is 1, the first match
+is returned, if it is 2 the second match is returned and so forth.
+it is 1 by default. if negative has the same meaning but the search is
+performed starting from the end of the list.
+
+if COUNT is given, instead of returning the single element, a list of
+all the matching elements up to "num-matches" are returned. COUNT can
+be combined with RANK in order to returning only the element starting
+from the Nth. if COUNT is zero, all the matching elements are returned.
+
+MAXLEN tells the command to scan a max of len elements. if zero (the
+default), all the elements in the list are scanned if needed.
+
+the returned elements indexes are always referring to what LINDEX
+would return. so first element from head is 0, and so forth.
+*/
+func lposCommand(c *redisClient) {
+	ele := c.argv[2]
+	direction := REDIS_TAIL
+	var rank, count, maxlen int64 = 1, -1, 0 //count -1: option not given.
+
+	//parse the optional arguments.
+	for j := 3; j < int(c.argc); j++ {
+		opt := c.argv[j].String()
+		moreargs := int(c.argc) - 1 - j
+		if strings.EqualFold(opt, "rank") && moreargs > 0 {
+			j++
+			if !getRangeLongFromObjectOrReply(c, c.argv[j], -math.MaxInt64, math.MaxInt64, &rank, nil) {
+				return
+			}
+			if rank == 0 {
+				errMsg := "RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list"
+				addReplyError(c, &errMsg)
+				return
+			}
+		} else if strings.EqualFold(opt, "count") && moreargs > 0 {
+			j++
+			errMsg := "COUNT can't be negative"
+			if !getPositiveLongFromObjectOrReply(c, c.argv[j], &count, &errMsg) {
+				return
+			}
+		} else if strings.EqualFold(opt, "maxlen") && moreargs > 0 {
+			j++
+			errMsg := "MAXLEN can't be negative"
+			if !getPositiveLongFromObjectOrReply(c, c.argv[j], &maxlen, &errMsg) {
+				return
+			}
+		} else {
+			addReply(c, shared.syntaxerr)
+			return
+		}
+	}
+
+	//a negative rank means start from the tail.
+	if rank < 0 {
+		rank = -rank
+		direction = REDIS_HEAD
+	}
+
+	//we return NULL or an empty array if there is no such key (or if we find no matches, depending on the presence of the COUNT option.
+	o := lookupKeyRead(c.db, c.argv[1])
+	if o == nil {
+		if count != -1 {
+			addReply(c, shared.emptymultibulk)
+		} else {
+			addReply(c, shared.null[c.resp])
+		}
+		return
+	}
+	if checkType(c, o, REDIS_LIST) {
+		return
+	}
+
+	//seek the element.
+	var li *listTypeIterator
+	if direction == REDIS_HEAD {
+		li = listTypeInitIterator(o, -1, direction)
+	} else {
+		li = listTypeInitIterator(o, 0, direction)
+	}
+	var entry listTypeEntry
+	llen := listTypeLength(o)
+	var index, matches, matchindex int64 = 0, 0, -1
+	var found []int64
+	for listTypeNext(li, &entry) && (maxlen == 0 || index < maxlen) {
+		if listTypeEqual(&entry, ele) {
+			matches++
+			if direction == REDIS_TAIL {
+				matchindex = index
+			} else {
+				matchindex = llen - index - 1
+			}
+			if matches >= rank {
+				if count == -1 {
+					break
+				}
+				found = append(found, matchindex)
+				if count != 0 && matches-rank+1 >= count {
+					break
+				}
+			}
+		}
+		index++
+		matchindex = -1 //remember if we exit the loop without a match.
+	}
+	listTypeReleaseIterator(li)
+
+	//reply to the client, an array if the COUNT option was selected.
+	if count != -1 {
+		addReplyMultiBulkLen(c, int64(len(found)))
+		for _, idx := range found {
+			addReplyLongLong(c, idx)
+		}
+	} else if matchindex != -1 {
+		addReplyLongLong(c, matchindex)
+	} else {
+		addReply(c, shared.null[c.resp])
+	}
+}
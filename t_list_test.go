@@ -0,0 +1,328 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the reply of a client served or timed out while blocked, the reader of the client is released.
+func testBlockedReply(t *testing.T, c *redisClient) string {
+	if c.flags&REDIS_BLOCKED > 0 {
+		t.Fatal("the client is still blocked")
+	}
+	select {
+	case <-c.cmdDone:
+	default:
+		t.Fatal("the reader of the client was not released")
+	}
+	reply := string(c.buf)
+	c.buf = c.buf[:0]
+	return reply
+}
+
+func TestListPop(t *testing.T) {
+	setupTestServer()
+	_, run := newTestClient(t)
+
+	run("RPUSH l a b c d e")
+	if reply := run("RPOP l"); reply != "$1\r\ne\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LPOP l 0"); reply != "*0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("RPOP l 2"); reply != "*2\r\n$1\r\nd\r\n$1\r\nc\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LPOP l -1"); reply != "-ERR value is out of range, must be positive\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	//the key is deleted once the list is empty.
+	if reply := run("LPOP l 10"); reply != "*2\r\n$1\r\na\r\n$1\r\nb\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LPOP l 10"); reply != "*-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LPOP l"); reply != "$-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	run("RPUSH src a b")
+	if reply := run("LMOVE src dst RIGHT LEFT"); reply != "$1\r\nb\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LMOVE src dst UP LEFT"); reply != "-ERR syntax error\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	run("LMOVE src dst LEFT RIGHT")
+	if reply := run("LRANGE dst 0 -1"); reply != "*2\r\n$1\r\nb\r\n$1\r\na\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestListCommands(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+
+	if reply := run("LPUSHX l a"); reply != ":0\r\n" || lookupKey(c.db, testStringObject("l")) != nil {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	run("LPUSH l c b a")
+	run("RPUSHX l d")
+	if reply := run("LRANGE l 0 10"); reply != "*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LRANGE l 5 10"); reply != "*0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LLEN l"); reply != ":4\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	if reply := run("LSET l -1 e"); reply != "+OK\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LSET l 4 e"); reply != "-ERR index out of range\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LSET x 0 e"); reply != "-ERR no such key\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	if reply := run("LINSERT l BEFORE a z"); reply != ":5\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LINSERT l AFTER e z"); reply != ":6\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LINSERT l AFTER y z"); reply != ":-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LRANGE l 0 -1"); reply != "*6\r\n$1\r\nz\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\ne\r\n$1\r\nz\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	if reply := run("LPOS l z"); reply != ":0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LPOS l z RANK -1"); reply != ":5\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LPOS l z COUNT 0"); reply != "*2\r\n:0\r\n:5\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LPOS l z RANK 2 MAXLEN 3"); reply != "$-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LPOS l z RANK 0"); !strings.HasPrefix(reply, "-ERR RANK can't be zero") {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	//a negative count removes the occurrences starting from the tail.
+	run("RPUSH l a")
+	if reply := run("LREM l -1 a"); reply != ":1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LREM l 0 z"); reply != ":2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LRANGE l 0 -1"); reply != "*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\ne\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	if reply := run("LTRIM l 1 -2"); reply != "+OK\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LRANGE l 0 -1"); reply != "*2\r\n$1\r\nb\r\n$1\r\nc\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	if reply := run("RPOPLPUSH l l"); reply != "$1\r\nc\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LMPOP 2 x l RIGHT COUNT 1"); reply != "*2\r\n$1\r\nl\r\n*1\r\n$1\r\nb\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LMPOP 1 x LEFT"); reply != "*-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	//the key is deleted once the list is trimmed or emptied.
+	if reply := run("LTRIM l 5 10"); reply != "+OK\r\n" || lookupKey(c.db, testStringObject("l")) != nil {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	run("RPUSH l a a")
+	if reply := run("LREM l 0 a"); reply != ":2\r\n" || lookupKey(c.db, testStringObject("l")) != nil {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestBlockingPop(t *testing.T) {
+	setupTestServer()
+	c1, run1 := newTestClient(t)
+	c2, run2 := newTestClient(t)
+	_, push := newTestClient(t)
+
+	//the data is served right away if a list is not empty.
+	push("RPUSH b x")
+	if reply := run1("BLPOP a b 0"); reply != "*2\r\n$1\r\nb\r\n$1\r\nx\r\n" || c1.flags&REDIS_BLOCKED > 0 {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run1("BLPOP a b"); reply != "-ERR timeout is not a float or out of range\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	//the clients blocked on a key are served in FIFO order.
+	if reply := run1("BLPOP a b 0"); reply != "" || c1.flags&REDIS_BLOCKED == 0 {
+		t.Fatalf("the client did not block, reply %q", reply)
+	}
+	if reply := run2("BRPOP b 0"); reply != "" || c2.flags&REDIS_BLOCKED == 0 {
+		t.Fatalf("the client did not block, reply %q", reply)
+	}
+	if reply := push("RPUSH b y z"); reply != ":2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := testBlockedReply(t, c1); reply != "*2\r\n$1\r\nb\r\n$1\r\ny\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := testBlockedReply(t, c2); reply != "*2\r\n$1\r\nb\r\n$1\r\nz\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if lookupKey(c1.db, testStringObject("b")) != nil || len(c1.db.blockingKeys) != 0 {
+		t.Error("the served keys were not cleaned up")
+	}
+
+	//a client that doesn't find data stays blocked.
+	run1("BLPOP a 0")
+	run2("BLPOP a 0")
+	push("RPUSH a x")
+	if reply := testBlockedReply(t, c1); reply != "*2\r\n$1\r\na\r\n$1\r\nx\r\n" || c2.flags&REDIS_BLOCKED == 0 {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	//a disconnected client is removed from the blocking keys.
+	server.clients.Store(c2.id, c2)
+	freeClient(c2)
+	<-c2.cmdDone
+	if len(c2.db.blockingKeys) != 0 {
+		t.Error("the freed client is still blocked on the key")
+	}
+
+	//the client is unblocked with a null reply once the timeout is reached.
+	run1("BLPOP a 0.01")
+	clientsCronHandleTimeout(c1, time.Now().UnixMilli())
+	if c1.flags&REDIS_BLOCKED == 0 {
+		t.Fatal("the client was unblocked before its timeout")
+	}
+	time.Sleep(20 * time.Millisecond)
+	clientsCronHandleTimeout(c1, time.Now().UnixMilli())
+	if reply := testBlockedReply(t, c1); reply != "*-1\r\n" || len(c1.db.blockingKeys) != 0 {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	//the client can't block inside a transaction.
+	run1("MULTI")
+	run1("BLPOP a 0")
+	if reply := run1("EXEC"); reply != "*1\r\n*-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestBlockingMove(t *testing.T) {
+	setupTestServer()
+	c1, run1 := newTestClient(t)
+	c2, run2 := newTestClient(t)
+	_, push := newTestClient(t)
+
+	//the element moved by the first client serves the second one.
+	if reply := run1("BLMOVE a b LEFT RIGHT 0"); reply != "" || c1.flags&REDIS_BLOCKED == 0 {
+		t.Fatalf("the client did not block, reply %q", reply)
+	}
+	run2("BLMPOP 0 2 c b RIGHT COUNT 5")
+	push("RPUSH a x y")
+	if reply := testBlockedReply(t, c1); reply != "$1\r\nx\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := testBlockedReply(t, c2); reply != "*2\r\n$1\r\nb\r\n*1\r\n$1\r\nx\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := push("LRANGE a 0 -1"); reply != "*1\r\n$1\r\ny\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	if reply := run1("BLMPOP 0 2 a LEFT"); reply != "-ERR syntax error\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run1("BLMPOP 0 0 a LEFT"); reply != "-ERR numkeys should be greater than 0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run1("BLMPOP 0 1 a LEFT COUNT 2"); reply != "*2\r\n$1\r\na\r\n*1\r\n$1\r\ny\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestListEncodingConversion(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+	encoding := func() int {
+		return lookupKey(c.db, testStringObject("l")).encoding
+	}
+
+	//a list is converted to a quicklist once it exceeds list-max-listpack-size.
+	server.listMaxListpackSize = 4
+	run("RPUSH l 1 2 3 4")
+	if encoding() != REDIS_ENCODING_LISTPACK {
+		t.Fatal("a small list is not encoded as a listpack")
+	}
+	run("RPUSH l 5")
+	if encoding() != REDIS_ENCODING_QUICKLIST {
+		t.Fatal("the list was not converted to a quicklist")
+	}
+	//it is converted back once it has a single node under half of the limit.
+	run("RPOP l 2")
+	if encoding() != REDIS_ENCODING_QUICKLIST {
+		t.Fatal("the list was converted back before shrinking enough")
+	}
+	run("RPOP l")
+	if encoding() != REDIS_ENCODING_LISTPACK {
+		t.Fatal("the list was not converted back to a listpack")
+	}
+
+	//a big element converts the list with a size limit.
+	server.listMaxListpackSize = -1
+	run("LSET l 0 " + strings.Repeat("x", 5000))
+	if encoding() != REDIS_ENCODING_QUICKLIST {
+		t.Fatal("the list was not converted to a quicklist")
+	}
+	run("LSET l 0 1")
+	if encoding() != REDIS_ENCODING_LISTPACK {
+		t.Fatal("the list was not converted back to a listpack")
+	}
+
+	//the commands have the same semantics on a compressed quicklist.
+	server.listMaxListpackSize = 2
+	server.listCompressDepth = 1
+	run("DEL l")
+	for i := 0; i < 10; i++ {
+		run("RPUSH l abcdefghijklmnopqrstuvwxyz-abcdefghijklmnopqrstuvwxyz-" + strconv.Itoa(i) + " " + strconv.Itoa(i))
+	}
+	if reply := run("LINDEX l -3"); reply != "$1\r\n8\r\n" || encoding() != REDIS_ENCODING_QUICKLIST {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LREM l 0 5"); reply != ":1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LINSERT l AFTER 6 x"); reply != ":20\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("LPOS l x"); reply != ":13\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	run("LTRIM l 11 14")
+	if reply := run("LRANGE l 1 2"); reply != "*2\r\n$1\r\n6\r\n$1\r\nx\r\n" || listTypeLength(lookupKey(c.db, testStringObject("l"))) != 4 {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
@@ -0,0 +1,1030 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+*
+factory method to return a set that can hold the value. when the value is an
+integer and the size hint is small enough, the set is encoded as an intset,
+otherwise as a hash table.
+*/
+func setTypeCreate(value *robj, sizeHint int) *robj {
+	var llval int64
+	if isObjectRepresentableAsLongLong(value, &llval) && sizeHint <= server.setMaxIntsetEntries {
+		return createIntsetObject()
+	}
+	return createSetObject()
+}
+
+// return the member as a string object, the keys of the dicts of the sets must be strings.
+func setTypeStringObject(o *robj) *robj {
+	if o.encoding != REDIS_ENCODING_INT {
+		return o
+	}
+	s := o.String()
+	return createStringObject(&s, len(s))
+}
+
+// add the member to the set, return true if it was added and false if it was already a member.
+func setTypeAdd(subject *robj, value *robj) bool {
+	var llval int64
+	if subject.encoding == REDIS_ENCODING_INTSET {
+		if isObjectRepresentableAsLongLong(value, &llval) {
+			is, added := intsetAdd((*subject.ptr).([]byte), llval)
+			*subject.ptr = is
+			if added {
+				//convert to regular set when the intset contains too many entries.
+				if intsetLen(is) > server.setMaxIntsetEntries {
+					setTypeConvert(subject, REDIS_ENCODING_HT)
+				}
+				return true
+			}
+			return false
+		}
+		//failed to get integer from object, convert to regular set.
+		setTypeConvert(subject, REDIS_ENCODING_HT)
+	}
+	if subject.encoding == REDIS_ENCODING_HT {
+		return dictAdd((*subject.ptr).(*dict), setTypeStringObject(value), nil) == DICT_OK
+	}
+	log.Panic("Unknown set encoding")
+	return false
+}
+
+// remove the member from the set, return true if it was a member.
+func setTypeRemove(setobj *robj, value *robj) bool {
+	var llval int64
+	if setobj.encoding == REDIS_ENCODING_HT {
+		return dictDelete((*setobj.ptr).(*dict), value.String()) == DICT_OK
+	} else if setobj.encoding == REDIS_ENCODING_INTSET {
+		if isObjectRepresentableAsLongLong(value, &llval) {
+			is, removed := intsetRemove((*setobj.ptr).([]byte), llval)
+			*setobj.ptr = is
+			return removed
+		}
+		return false
+	}
+	log.Panic("Unknown set encoding")
+	return false
+}
+
+func setTypeIsMember(subject *robj, value *robj) bool {
+	var llval int64
+	if subject.encoding == REDIS_ENCODING_HT {
+		return dictFind((*subject.ptr).(*dict), value.String()) != nil
+	} else if subject.encoding == REDIS_ENCODING_INTSET {
+		if isObjectRepresentableAsLongLong(value, &llval) {
+			return intsetFind((*subject.ptr).([]byte), llval)
+		}
+		return false
+	}
+	log.Panic("Unknown set encoding")
+	return false
+}
+
+/*
+*
+like setTypeIsMember, for a member returned by setTypeNext: the member is the
+integer llele when ele is nil, so that the members of an intset are looked up
+in another intset without being converted to an object and back.
+*/
+func setTypeIsMemberAux(subject *robj, ele *robj, llele int64) bool {
+	if ele != nil {
+		return setTypeIsMember(subject, ele)
+	}
+	if subject.encoding == REDIS_ENCODING_INTSET {
+		return intsetFind((*subject.ptr).([]byte), llele)
+	} else if subject.encoding == REDIS_ENCODING_HT {
+		return dictFind((*subject.ptr).(*dict), strconv.FormatInt(llele, 10)) != nil
+	}
+	log.Panic("Unknown set encoding")
+	return false
+}
+
+// return a random member of a non empty set, the members of an intset are integer objects.
+func setTypeRandomElement(setobj *robj) *robj {
+	if setobj.encoding == REDIS_ENCODING_HT {
+		return dictGetRandomKey((*setobj.ptr).(*dict)).key
+	} else if setobj.encoding == REDIS_ENCODING_INTSET {
+		return createStringObjectFromLongLong(intsetRandom((*setobj.ptr).([]byte)))
+	}
+	log.Panic("Unknown set encoding")
+	return nil
+}
+
+// return the number of members of the set.
+func setTypeSize(subject *robj) int64 {
+	if subject.encoding == REDIS_ENCODING_HT {
+		return int64(dictSize((*subject.ptr).(*dict)))
+	} else if subject.encoding == REDIS_ENCODING_INTSET {
+		return int64(intsetLen((*subject.ptr).([]byte)))
+	}
+	log.Panic("Unknown set encoding")
+	return -1
+}
+
+/*
+*
+an iterator over the members of a set. a hash table is walked with a safe dict
+iterator, so the current member can be deleted while iterating; the iterator
+must be released with setTypeReleaseIterator.
+*/
+type setTypeIterator struct {
+	subject  *robj
+	encoding int
+	//the position of the next member of the intset.
+	ii int
+	di *dictIterator
+}
+
+func setTypeInitIterator(subject *robj) *setTypeIterator {
+	si := &setTypeIterator{subject: subject, encoding: subject.encoding}
+	if si.encoding == REDIS_ENCODING_HT {
+		si.di = dictGetSafeIterator((*subject.ptr).(*dict))
+	} else if si.encoding != REDIS_ENCODING_INTSET {
+		log.Panic("Unknown set encoding")
+	}
+	return si
+}
+
+func setTypeReleaseIterator(si *setTypeIterator) {
+	if si.encoding == REDIS_ENCODING_HT {
+		dictReleaseIterator(si.di)
+	}
+}
+
+/*
+*
+move to the next member of the set and return the encoding of the set, or -1
+when there are no members left. the member of a hash table is returned as ele,
+the member of an intset as llele, without creating an object.
+*/
+func setTypeNext(si *setTypeIterator) (ele *robj, llele int64, encoding int) {
+	if si.encoding == REDIS_ENCODING_HT {
+		de := dictNext(si.di)
+		if de == nil {
+			return nil, 0, -1
+		}
+		return de.key, 0, si.encoding
+	} else if si.encoding == REDIS_ENCODING_INTSET {
+		llval, ok := intsetGet((*si.subject.ptr).([]byte), si.ii)
+		if !ok {
+			return nil, 0, -1
+		}
+		si.ii++
+		return nil, llval, si.encoding
+	}
+	log.Panic("Unknown set encoding")
+	return nil, 0, -1
+}
+
+// return the next member of the set as an object, nil is returned when there are no members left.
+func setTypeNextObject(si *setTypeIterator) *robj {
+	ele, llele, encoding := setTypeNext(si)
+	if encoding == REDIS_ENCODING_INTSET {
+		return createStringObjectFromLongLong(llele)
+	}
+	return ele
+}
+
+// convert an intset encoded set to a hash table, the members become string keys of the dict.
+func setTypeConvert(setobj *robj, enc int) {
+	if setobj.encoding != REDIS_ENCODING_INTSET || enc != REDIS_ENCODING_HT {
+		log.Panic("Unsupported set conversion")
+	}
+	d := dictCreate(&setDictType, nil)
+	si := setTypeInitIterator(setobj)
+	for element := setTypeNextObject(si); element != nil; element = setTypeNextObject(si) {
+		if dictAdd(d, setTypeStringObject(element), nil) != DICT_OK {
+			log.Panic("Intset corruption detected")
+		}
+	}
+	setTypeReleaseIterator(si)
+	*setobj.ptr = d
+	setobj.encoding = REDIS_ENCODING_HT
+}
+
+// return a copy of the set with the same encoding.
+func setTypeDup(o *robj) *robj {
+	if o.encoding == REDIS_ENCODING_INTSET {
+		is := intsetDup((*o.ptr).([]byte))
+		i := interface{}(is)
+		set := createObject(REDIS_SET, &i)
+		set.encoding = REDIS_ENCODING_INTSET
+		return set
+	}
+	set := createSetObject()
+	si := setTypeInitIterator(o)
+	for element := setTypeNextObject(si); element != nil; element = setTypeNextObject(si) {
+		setTypeAdd(set, element)
+	}
+	setTypeReleaseIterator(si)
+	return set
+}
+
+/*
+*
+SADD key member [member ...]
+reply the number of members added to the set, the set is created if the key
+doesn't exist.
+*/
+func saddCommand(c *redisClient) {
+	set := lookupKeyWrite(c.db, c.argv[1])
+	if set == nil {
+		set = setTypeCreate(c.argv[2], int(c.argc-2))
+		dbAdd(c.db, c.argv[1], set)
+	} else if checkType(c, set, REDIS_SET) {
+		return
+	}
+
+	var added int64
+	for j := uint64(2); j < c.argc; j++ {
+		if setTypeAdd(set, c.argv[j]) {
+			added++
+		}
+	}
+	if added > 0 {
+		signalModifiedKey(c.db, c.argv[1])
+	}
+	server.dirty += added
+	addReplyLongLong(c, added)
+}
+
+// SREM key member [member ...]
+func sremCommand(c *redisClient) {
+	set := lookupKeyWriteOrReply(c, c.argv[1], shared.czero)
+	if set == nil || checkType(c, set, REDIS_SET) {
+		return
+	}
+
+	var deleted int64
+	for j := uint64(2); j < c.argc; j++ {
+		if setTypeRemove(set, c.argv[j]) {
+			deleted++
+			//the set is deleted once empty, the remaining members can't be members anymore.
+			if setTypeSize(set) == 0 {
+				dbDelete(c.db, c.argv[1])
+				break
+			}
+		}
+	}
+	if deleted > 0 {
+		signalModifiedKey(c.db, c.argv[1])
+		server.dirty += deleted
+	}
+	addReplyLongLong(c, deleted)
+}
+
+/*
+*
+SMOVE source destination member
+move the member from the source set to the destination set, the destination
+set is created if needed and the source set is deleted once empty.
+*/
+func smoveCommand(c *redisClient) {
+	srcset := lookupKeyWrite(c.db, c.argv[1])
+	dstset := lookupKeyWrite(c.db, c.argv[2])
+	ele := c.argv[3]
+
+	//if the source key does not exist return 0.
+	if srcset == nil {
+		addReply(c, shared.czero)
+		return
+	}
+	//if the source key has the wrong type, or the destination key is set and has the wrong type, return with an error.
+	if checkType(c, srcset, REDIS_SET) || (dstset != nil && checkType(c, dstset, REDIS_SET)) {
+		return
+	}
+	//if srcset and dstset are equal, SMOVE is a no-op.
+	if srcset == dstset {
+		if setTypeIsMember(srcset, ele) {
+			addReply(c, shared.cone)
+		} else {
+			addReply(c, shared.czero)
+		}
+		return
+	}
+
+	//if the element cannot be removed from the src set, return 0.
+	if !setTypeRemove(srcset, ele) {
+		addReply(c, shared.czero)
+		return
+	}
+
+	//remove the src set from the database when empty.
+	if setTypeSize(srcset) == 0 {
+		dbDelete(c.db, c.argv[1])
+	}
+	//create the destination set when it doesn't exist.
+	if dstset == nil {
+		dstset = setTypeCreate(ele, 1)
+		dbAdd(c.db, c.argv[2], dstset)
+	}
+	signalModifiedKey(c.db, c.argv[1])
+	signalModifiedKey(c.db, c.argv[2])
+	server.dirty++
+
+	//an extra key has changed when ele was successfully added to dstset.
+	if setTypeAdd(dstset, ele) {
+		server.dirty++
+	}
+	addReply(c, shared.cone)
+}
+
+func sismemberCommand(c *redisClient) {
+	set := lookupKeyReadOrReply(c, c.argv[1], shared.czero)
+	if set == nil || checkType(c, set, REDIS_SET) {
+		return
+	}
+	if setTypeIsMember(set, c.argv[2]) {
+		addReply(c, shared.cone)
+	} else {
+		addReply(c, shared.czero)
+	}
+}
+
+// SMISMEMBER key member [member ...], a missing key is an empty set so every member is replied as 0.
+func smismemberCommand(c *redisClient) {
+	set := lookupKeyRead(c.db, c.argv[1])
+	if set != nil && checkType(c, set, REDIS_SET) {
+		return
+	}
+
+	addReplyMultiBulkLen(c, int64(c.argc-2))
+	for j := uint64(2); j < c.argc; j++ {
+		if set != nil && setTypeIsMember(set, c.argv[j]) {
+			addReply(c, shared.cone)
+		} else {
+			addReply(c, shared.czero)
+		}
+	}
+}
+
+func scardCommand(c *redisClient) {
+	set := lookupKeyReadOrReply(c, c.argv[1], shared.czero)
+	if set == nil || checkType(c, set, REDIS_SET) {
+		return
+	}
+	addReplyLongLong(c, setTypeSize(set))
+}
+
+func smembersCommand(c *redisClient) {
+	set := lookupKeyRead(c.db, c.argv[1])
+	if set == nil {
+		addReplySetLen(c, 0)
+		return
+	}
+	if checkType(c, set, REDIS_SET) {
+		return
+	}
+
+	addReplySetLen(c, setTypeSize(set))
+	si := setTypeInitIterator(set)
+	for element := setTypeNextObject(si); element != nil; element = setTypeNextObject(si) {
+		addReplyBulk(c, element)
+	}
+	setTypeReleaseIterator(si)
+}
+
+/*
+*
+how many times bigger should be the set compared to the remaining size
+for us to use the "create new set" strategy. read later in the
+implementation for more info.
+*/
+const SPOP_MOVE_STRATEGY_MUL = 5
+
+/*
+*
+SPOP key [count]
+without count a single random member is removed and replied, it's propagated
+as SREM so that the replicas and the AOF remove the same member.
+*/
+func spopCommand(c *redisClient) {
+	if c.argc == 3 {
+		spopWithCountCommand(c)
+		return
+	} else if c.argc > 3 {
+		addReply(c, shared.syntaxerr)
+		return
+	}
+
+	//make sure a key with the name inputted exists, and that it's type is indeed a set.
+	set := lookupKeyWriteOrReply(c, c.argv[1], shared.null[c.resp])
+	if set == nil || checkType(c, set, REDIS_SET) {
+		return
+	}
+
+	//pop a random element from the set.
+	ele := setTypeRandomElement(set)
+	setTypeRemove(set, ele)
+
+	//replicate/AOF this command as an SREM operation.
+	key := c.argv[1]
+	rewriteClientCommandVector(c, shared.srem, key, ele)
+
+	addReplyBulk(c, ele)
+
+	//delete the set if it's empty.
+	if setTypeSize(set) == 0 {
+		dbDelete(c.db, key)
+	}
+	signalModifiedKey(c.db, key)
+	server.dirty++
+}
+
+func spopWithCountCommand(c *redisClient) {
+	var count int64
+	//get the count argument.
+	if !getPositiveLongFromObjectOrReply(c, c.argv[2], &count, nil) {
+		return
+	}
+
+	//make sure a key with the name inputted exists, and that it's type is indeed a set. otherwise, return nil.
+	set := lookupKeyWrite(c.db, c.argv[1])
+	if set == nil {
+		addReplySetLen(c, 0)
+		return
+	}
+	if checkType(c, set, REDIS_SET) {
+		return
+	}
+
+	//if count is zero, serve an empty set ASAP to avoid special cases later.
+	if count == 0 {
+		addReplySetLen(c, 0)
+		return
+	}
+
+	size := setTypeSize(set)
+	key := c.argv[1]
+	signalModifiedKey(c.db, key)
+	server.dirty += count
+
+	/**
+	CASE 1: the number of requested elements is greater than or equal to
+	the number of elements inside the set: simply return the whole set,
+	the set is deleted and the command is propagated as DEL.
+	*/
+	if count >= size {
+		addReplySetLen(c, size)
+		si := setTypeInitIterator(set)
+		for element := setTypeNextObject(si); element != nil; element = setTypeNextObject(si) {
+			addReplyBulk(c, element)
+		}
+		setTypeReleaseIterator(si)
+		dbDelete(c.db, key)
+		rewriteClientCommandVector(c, shared.del, key)
+		return
+	}
+
+	//the popped elements are propagated with a single SREM.
+	argv := make([]*robj, 0, count+2)
+	argv = append(argv, shared.srem, key)
+	addReplySetLen(c, count)
+
+	remaining := size - count
+	if remaining*SPOP_MOVE_STRATEGY_MUL > count {
+		/**
+		CASE 2: the number of elements to return is small compared to the
+		set size. we can just extract random elements and return them to
+		the set.
+		*/
+		for ; count > 0; count-- {
+			ele := setTypeRandomElement(set)
+			setTypeRemove(set, ele)
+			argv = append(argv, ele)
+			addReplyBulk(c, ele)
+		}
+	} else {
+		/**
+		CASE 3: the number of elements to return is very big, approaching
+		the size of the set itself. after some time extracting random elements
+		from such a set becomes computationally expensive, so we use
+		a different strategy, we extract random elements that we don't
+		want to return (the elements that will remain part of the set),
+		creating a new set as we do this (that will be stored as the original
+		set). then we return the elements left in the original set and
+		release it.
+		*/
+		newset := createIntsetObject()
+		for ; remaining > 0; remaining-- {
+			ele := setTypeRandomElement(set)
+			setTypeAdd(newset, ele)
+			setTypeRemove(set, ele)
+		}
+
+		//transfer the old set to the client.
+		si := setTypeInitIterator(set)
+		for element := setTypeNextObject(si); element != nil; element = setTypeNextObject(si) {
+			argv = append(argv, element)
+			addReplyBulk(c, element)
+		}
+		setTypeReleaseIterator(si)
+
+		//assign the new set as the key value.
+		dbOverwrite(c.db, key, newset)
+	}
+	rewriteClientCommandVector(c, argv...)
+}
+
+/*
+*
+SRANDMEMBER key [count]
+without count a single random member is replied. a positive count replies
+distinct members, a negative count may reply the same member multiple times.
+*/
+func srandmemberCommand(c *redisClient) {
+	if c.argc == 3 {
+		var l int64
+		if !getRangeLongFromObjectOrReply(c, c.argv[2], -math.MaxInt64, math.MaxInt64, &l, nil) {
+			return
+		}
+		srandmemberWithCountCommand(c, l)
+		return
+	} else if c.argc > 3 {
+		addReply(c, shared.syntaxerr)
+		return
+	}
+
+	//handle variant without <count> argument. reply with simple bulk string.
+	set := lookupKeyReadOrReply(c, c.argv[1], shared.null[c.resp])
+	if set == nil || checkType(c, set, REDIS_SET) {
+		return
+	}
+	addReplyBulk(c, setTypeRandomElement(set))
+}
+
+func srandmemberWithCountCommand(c *redisClient, l int64) {
+	var count int64
+	uniq := true
+	if l >= 0 {
+		count = l
+	} else {
+		count = -l
+		uniq = false
+	}
+
+	set := lookupKeyReadOrReply(c, c.argv[1], shared.emptymultibulk)
+	if set == nil || checkType(c, set, REDIS_SET) {
+		return
+	}
+	size := setTypeSize(set)
+
+	//if count is zero, serve it ASAP to avoid special cases later.
+	if count == 0 {
+		addReply(c, shared.emptymultibulk)
+		return
+	}
+
+	/**
+	CASE 1: the count was negative, so the extraction method is just:
+	"return N random elements" sampling the whole set every time.
+	this case is trivial and can be served without auxiliary data structures.
+	*/
+	if !uniq || count == 1 {
+		addReplyMultiBulkLen(c, count)
+		for ; count > 0; count-- {
+			addReplyBulk(c, setTypeRandomElement(set))
+		}
+		return
+	}
+
+	//CASE 2: the number of requested elements is greater than the number of elements inside the set: simply return the whole set.
+	if count >= size {
+		addReplyMultiBulkLen(c, size)
+		si := setTypeInitIterator(set)
+		for element := setTypeNextObject(si); element != nil; element = setTypeNextObject(si) {
+			addReplyBulk(c, element)
+		}
+		setTypeReleaseIterator(si)
+		return
+	}
+
+	d := dictCreate(&setDictType, nil)
+	if count*3 > size {
+		/**
+		CASE 3: the number of elements inside the set is not greater than
+		3 times the number of requested elements. in this case we create a
+		set from scratch with all the elements, and subtract random elements
+		to reach the requested number of elements.
+		*/
+		si := setTypeInitIterator(set)
+		for element := setTypeNextObject(si); element != nil; element = setTypeNextObject(si) {
+			dictAdd(d, setTypeStringObject(element), nil)
+		}
+		setTypeReleaseIterator(si)
+		for int64(dictSize(d)) > count {
+			de := dictGetRandomKey(d)
+			dictDelete(d, de.key.String())
+		}
+	} else {
+		/**
+		CASE 4: we have a big set compared to the requested number of elements.
+		in this case we can simply get random elements from the set and add
+		to the temporary set, trying to eventually get enough unique elements
+		to reach the specified count.
+		*/
+		for int64(dictSize(d)) < count {
+			dictAdd(d, setTypeStringObject(setTypeRandomElement(set)), nil)
+		}
+	}
+
+	addReplyMultiBulkLen(c, count)
+	di := dictGetIterator(d)
+	for de := dictNext(di); de != nil; de = dictNext(di) {
+		addReplyBulk(c, de.key)
+	}
+	dictReleaseIterator(di)
+}
+
+func sscanCommand(c *redisClient) {
+	var cursor uint64
+	if !parseScanCursorOrReply(c, c.argv[2], &cursor) {
+		return
+	}
+	set := lookupKeyReadOrReply(c, c.argv[1], shared.emptyscan)
+	if set == nil || checkType(c, set, REDIS_SET) {
+		return
+	}
+	scanGenericCommand(c, set, &cursor)
+}
+
+/*
+*
+the generic implementation of SINTER, SINTERSTORE and SINTERCARD. the members
+of the smallest set are looked up in the other sets, the result is stored in
+dstkey if not nil, or only counted up to limit (0 means no limit) when
+cardinalityOnly is set, otherwise it's replied.
+*/
+func sinterGenericCommand(c *redisClient, setkeys []*robj, dstkey *robj, cardinalityOnly bool, limit int64) {
+	sets := make([]*robj, len(setkeys))
+	empty := false
+	for j, key := range setkeys {
+		var setobj *robj
+		if dstkey != nil {
+			setobj = lookupKeyWrite(c.db, key)
+		} else {
+			setobj = lookupKeyRead(c.db, key)
+		}
+		//a missing key is an empty set, the type of the other keys is still checked.
+		if setobj == nil {
+			empty = true
+			continue
+		}
+		if checkType(c, setobj, REDIS_SET) {
+			return
+		}
+		sets[j] = setobj
+	}
+
+	//the intersection with an empty set is empty, so we can return ASAP.
+	if empty {
+		if dstkey != nil {
+			if lookupKeyWrite(c.db, dstkey) != nil {
+				dbDelete(c.db, dstkey)
+				signalModifiedKey(c.db, dstkey)
+				server.dirty++
+			}
+			addReply(c, shared.czero)
+		} else if cardinalityOnly {
+			addReply(c, shared.czero)
+		} else {
+			addReplySetLen(c, 0)
+		}
+		return
+	}
+
+	/**
+	sort sets from the smallest to largest, this will improve our
+	algorithm's performance: only the members of the smallest set are
+	looked up, and a member is discarded as soon as possible.
+	*/
+	sort.SliceStable(sets, func(i, j int) bool {
+		return setTypeSize(sets[i]) < setTypeSize(sets[j])
+	})
+
+	var dstset *robj
+	var members []*robj
+	var cardinality int64
+	if dstkey != nil {
+		dstset = createIntsetObject()
+	}
+
+	/**
+	iterate all the elements of the first (smallest) set, and test
+	the element against all the other sets, if at least one set does
+	not include the element it is discarded. the members of an intset
+	are looked up as integers.
+	*/
+	si := setTypeInitIterator(sets[0])
+	for ele, llele, encoding := setTypeNext(si); encoding != -1; ele, llele, encoding = setTypeNext(si) {
+		j := 1
+		for ; j < len(sets); j++ {
+			if sets[j] == sets[0] {
+				continue
+			}
+			if !setTypeIsMemberAux(sets[j], ele, llele) {
+				break
+			}
+		}
+		//only take action when all sets contain the member.
+		if j != len(sets) {
+			continue
+		}
+		if cardinalityOnly {
+			cardinality++
+			//we stop the searching after reaching the limit.
+			if limit != 0 && cardinality >= limit {
+				break
+			}
+			continue
+		}
+		if ele == nil {
+			ele = createStringObjectFromLongLong(llele)
+		}
+		if dstkey != nil {
+			setTypeAdd(dstset, ele)
+		} else {
+			members = append(members, ele)
+		}
+	}
+	setTypeReleaseIterator(si)
+
+	if cardinalityOnly {
+		addReplyLongLong(c, cardinality)
+	} else if dstkey != nil {
+		setTypeStoreResult(c, dstkey, dstset)
+	} else {
+		addReplySetLen(c, int64(len(members)))
+		for _, member := range members {
+			addReplyBulk(c, member)
+		}
+	}
+}
+
+/*
+*
+store the result of a set operation in dstkey and reply its size, the key is
+deleted when the result is empty.
+*/
+func setTypeStoreResult(c *redisClient, dstkey *robj, dstset *robj) {
+	if size := setTypeSize(dstset); size > 0 {
+		setKey(c.db, dstkey, dstset)
+		addReplyLongLong(c, size)
+		server.dirty++
+		return
+	}
+	addReply(c, shared.czero)
+	if lookupKeyWrite(c.db, dstkey) != nil {
+		dbDelete(c.db, dstkey)
+		signalModifiedKey(c.db, dstkey)
+		server.dirty++
+	}
+}
+
+// SINTER key [key ...]
+func sinterCommand(c *redisClient) {
+	sinterGenericCommand(c, c.argv[1:c.argc], nil, false, 0)
+}
+
+// SINTERSTORE destination key [key ...]
+func sinterstoreCommand(c *redisClient) {
+	sinterGenericCommand(c, c.argv[2:c.argc], c.argv[1], false, 0)
+}
+
+// SINTERCARD numkeys key [key ...] [LIMIT limit]
+func sintercardCommand(c *redisClient) {
+	var numkeys, limit int64
+
+	errMsg := "numkeys should be greater than 0"
+	if !getRangeLongFromObjectOrReply(c, c.argv[1], 1, math.MaxInt64, &numkeys, &errMsg) {
+		return
+	}
+	if numkeys > int64(c.argc-2) {
+		errMsg := "Number of keys can't be greater than number of args"
+		addReplyError(c, &errMsg)
+		return
+	}
+
+	for j := 2 + int(numkeys); j < int(c.argc); j++ {
+		opt := c.argv[j].String()
+		moreargs := int(c.argc) - 1 - j
+		if strings.EqualFold(opt, "limit") && moreargs > 0 {
+			j++
+			errMsg := "LIMIT can't be negative"
+			if !getPositiveLongFromObjectOrReply(c, c.argv[j], &limit, &errMsg) {
+				return
+			}
+		} else {
+			addReply(c, shared.syntaxerr)
+			return
+		}
+	}
+
+	sinterGenericCommand(c, c.argv[2:2+numkeys], nil, true, limit)
+}
+
+const (
+	SET_OP_UNION = 0
+	SET_OP_DIFF  = 1
+	SET_OP_INTER = 2
+)
+
+/*
+*
+the generic implementation of SUNION, SDIFF and their STORE forms, the result
+is stored in dstkey if not nil, otherwise it's replied.
+*/
+func sunionDiffGenericCommand(c *redisClient, setkeys []*robj, dstkey *robj, op int) {
+	sets := make([]*robj, len(setkeys))
+	sameset := false
+	for j, key := range setkeys {
+		var setobj *robj
+		if dstkey != nil {
+			setobj = lookupKeyWrite(c.db, key)
+		} else {
+			setobj = lookupKeyRead(c.db, key)
+		}
+		if setobj == nil {
+			continue
+		}
+		if checkType(c, setobj, REDIS_SET) {
+			return
+		}
+		sets[j] = setobj
+		if j > 0 && sets[0] == sets[j] {
+			sameset = true
+		}
+	}
+
+	/**
+	select what DIFF algorithm to use.
+
+	algorithm 1 is O(N*M) where N is the size of the element first set
+	and M the total number of sets.
+
+	algorithm 2 is O(N) where N is the total number of elements in all
+	the sets.
+
+	we compute what is the best bet with the current input here.
+	*/
+	diffAlgo := 1
+	if op == SET_OP_DIFF && sets[0] != nil && !sameset {
+		var algoOneWork, algoTwoWork int64
+		for _, set := range sets {
+			if set == nil {
+				continue
+			}
+			algoOneWork += setTypeSize(sets[0])
+			algoTwoWork += setTypeSize(set)
+		}
+		//algorithm 1 has better constant times and performs less operations if there are elements in common. give it some advantage.
+		algoOneWork /= 2
+		if algoOneWork > algoTwoWork {
+			diffAlgo = 2
+		}
+
+		//with algorithm 1 it is better to order the sets to subtract by decreasing size, so that we are more likely to find duplicated elements ASAP.
+		if diffAlgo == 1 && len(sets) > 1 {
+			others := sets[1:]
+			sort.SliceStable(others, func(i, j int) bool {
+				var si, sj int64
+				if others[i] != nil {
+					si = setTypeSize(others[i])
+				}
+				if others[j] != nil {
+					sj = setTypeSize(others[j])
+				}
+				return si > sj
+			})
+		}
+	}
+
+	/**
+	we need a temp set object to store our union/diff. if the dstkey
+	is not nil (that is, we are inside an SUNIONSTORE/SDIFFSTORE operation) then
+	this set object will be the resulting object to set into the target key.
+	*/
+	dstset := createIntsetObject()
+	var cardinality int64
+
+	if op == SET_OP_UNION {
+		//union is trivial, just add every element of every set to the temporary set.
+		for _, set := range sets {
+			if set == nil {
+				continue
+			}
+			si := setTypeInitIterator(set)
+			for ele := setTypeNextObject(si); ele != nil; ele = setTypeNextObject(si) {
+				if setTypeAdd(dstset, ele) {
+					cardinality++
+				}
+			}
+			setTypeReleaseIterator(si)
+		}
+	} else if op == SET_OP_DIFF && sameset {
+		//at least one of the sets is the same one (same key) as the first one, result must be empty.
+	} else if op == SET_OP_DIFF && sets[0] != nil && diffAlgo == 1 {
+		/**
+		DIFF Algorithm 1:
+
+		we perform the diff by iterating all the elements of the first set,
+		and only adding it to the target set if the element does not exist
+		into all the other sets.
+
+		this way we perform at max N*M operations, where N is the size of
+		the first set, and M the number of sets.
+		*/
+		si := setTypeInitIterator(sets[0])
+		for ele, llele, encoding := setTypeNext(si); encoding != -1; ele, llele, encoding = setTypeNext(si) {
+			j := 1
+			for ; j < len(sets); j++ {
+				//no key is the same as a nil set.
+				if sets[j] == nil {
+					continue
+				}
+				if setTypeIsMemberAux(sets[j], ele, llele) {
+					break
+				}
+			}
+			if j == len(sets) {
+				//there is no other set with this element. add it.
+				if ele == nil {
+					ele = createStringObjectFromLongLong(llele)
+				}
+				setTypeAdd(dstset, ele)
+				cardinality++
+			}
+		}
+		setTypeReleaseIterator(si)
+	} else if op == SET_OP_DIFF && sets[0] != nil && diffAlgo == 2 {
+		/**
+		DIFF Algorithm 2:
+
+		add all the elements of the first set to the auxiliary set.
+		then remove all the elements of all the next sets from it.
+
+		this is O(N) where N is the sum of all the elements in every set.
+		*/
+		for j, set := range sets {
+			if set == nil {
+				continue
+			}
+			si := setTypeInitIterator(set)
+			for ele := setTypeNextObject(si); ele != nil; ele = setTypeNextObject(si) {
+				if j == 0 {
+					if setTypeAdd(dstset, ele) {
+						cardinality++
+					}
+				} else if setTypeRemove(dstset, ele) {
+					cardinality--
+				}
+			}
+			setTypeReleaseIterator(si)
+
+			//exit if result set is empty as any additional removal of elements will have no effect.
+			if cardinality == 0 {
+				break
+			}
+		}
+	}
+
+	//output the content of the resulting set, if not in STORE mode.
+	if dstkey == nil {
+		addReplySetLen(c, cardinality)
+		si := setTypeInitIterator(dstset)
+		for ele := setTypeNextObject(si); ele != nil; ele = setTypeNextObject(si) {
+			addReplyBulk(c, ele)
+		}
+		setTypeReleaseIterator(si)
+	} else {
+		setTypeStoreResult(c, dstkey, dstset)
+	}
+}
+
+// SUNION key [key ...]
+func sunionCommand(c *redisClient) {
+	sunionDiffGenericCommand(c, c.argv[1:c.argc], nil, SET_OP_UNION)
+}
+
+// SUNIONSTORE destination key [key ...]
+func sunionstoreCommand(c *redisClient) {
+	sunionDiffGenericCommand(c, c.argv[2:c.argc], c.argv[1], SET_OP_UNION)
+}
+
+// SDIFF key [key ...]
+func sdiffCommand(c *redisClient) {
+	sunionDiffGenericCommand(c, c.argv[1:c.argc], nil, SET_OP_DIFF)
+}
+
+// SDIFFSTORE destination key [key ...]
+func sdiffstoreCommand(c *redisClient) {
+	sunionDiffGenericCommand(c, c.argv[2:c.argc], c.argv[1], SET_OP_DIFF)
+}
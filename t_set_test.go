@@ -0,0 +1,363 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// the bulk strings of a flat array reply, sorted as the members of a set have no order.
+func testSetReplyMembers(reply string) []string {
+	var members []string
+	lines := strings.Split(reply, "\r\n")
+	for j := 1; j < len(lines); j++ {
+		if strings.HasPrefix(lines[j], "$") {
+			members = append(members, lines[j+1])
+			j++
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+func TestSetCommands(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+	encoding := func(key string) int {
+		return lookupKey(c.db, testStringObject(key)).encoding
+	}
+
+	//the same commands are checked on an intset and on a hash table.
+	for _, enc := range []int{REDIS_ENCODING_INTSET, REDIS_ENCODING_HT} {
+		run("DEL s")
+		first := "1"
+		if enc == REDIS_ENCODING_HT {
+			first = "a"
+		}
+		if reply := run("SADD s " + first + " 2 3 2"); reply != ":3\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if encoding("s") != enc {
+			t.Fatalf("unexpected encoding %d", encoding("s"))
+		}
+		if reply := run("SADD s 3 4"); reply != ":1\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("SCARD s"); reply != ":4\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("SISMEMBER s 2"); reply != ":1\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("SISMEMBER s 02"); reply != ":0\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if reply := run("SMISMEMBER s 2 x " + first); reply != "*3\r\n:1\r\n:0\r\n:1\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		if members := testSetReplyMembers(run("SMEMBERS s")); strings.Join(members, ",") != first+",2,3,4" &&
+			strings.Join(members, ",") != "2,3,4,"+first {
+			t.Errorf("unexpected members %v", members)
+		}
+		if reply := run("SREM s 2 x 3"); reply != ":2\r\n" {
+			t.Errorf("unexpected reply %q", reply)
+		}
+		run("SREM s " + first + " 4")
+		if lookupKey(c.db, testStringObject("s")) != nil {
+			t.Error("the empty set was not deleted")
+		}
+	}
+
+	if reply := run("SMISMEMBER missing a b"); reply != "*2\r\n:0\r\n:0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("SMEMBERS missing"); reply != "*0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	run("SET str v")
+	if reply := run("SADD str a"); reply != *shared.wrongtypeerr {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestSetEncodingConversion(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+	encoding := func(key string) int {
+		return lookupKey(c.db, testStringObject(key)).encoding
+	}
+
+	//the intset is upgraded to larger integers, and converted by a member that is not an integer.
+	run("SADD s 1 -70000 9223372036854775807")
+	if encoding("s") != REDIS_ENCODING_INTSET {
+		t.Fatal("an integer set is not encoded as an intset")
+	}
+	run("SADD s 007")
+	if encoding("s") != REDIS_ENCODING_HT {
+		t.Fatal("the set was not converted to a hash table")
+	}
+	if members := testSetReplyMembers(run("SMEMBERS s")); strings.Join(members, ",") != "-70000,007,1,9223372036854775807" {
+		t.Errorf("unexpected members %v", members)
+	}
+
+	//the set is converted once it has more than set-max-intset-entries members.
+	server.setMaxIntsetEntries = 4
+	run("SADD small 1 2 3 4")
+	if encoding("small") != REDIS_ENCODING_INTSET {
+		t.Fatal("a small set is not encoded as an intset")
+	}
+	run("SADD small 5")
+	if encoding("small") != REDIS_ENCODING_HT {
+		t.Fatal("the set was not converted to a hash table")
+	}
+	if reply := run("SISMEMBER small 5"); reply != ":1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	//a set created with too many members is a hash table right away.
+	run("SADD big 1 2 3 4 5 6")
+	if encoding("big") != REDIS_ENCODING_HT {
+		t.Fatal("the set was not created as a hash table")
+	}
+}
+
+func TestSetMove(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+
+	run("SADD src 1 a")
+	if reply := run("SMOVE src dst 1"); reply != ":1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("SMOVE src dst 1"); reply != ":0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if o := lookupKey(c.db, testStringObject("dst")); o == nil || o.encoding != REDIS_ENCODING_INTSET || setTypeSize(o) != 1 {
+		t.Fatal("the destination set was not created")
+	}
+	//the source set is deleted once empty.
+	run("SMOVE src dst a")
+	if lookupKey(c.db, testStringObject("src")) != nil {
+		t.Error("the empty source set was not deleted")
+	}
+	if reply := run("SMOVE dst dst a"); reply != ":1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("SMOVE missing dst a"); reply != ":0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	run("SET str v")
+	if reply := run("SMOVE dst str a"); reply != *shared.wrongtypeerr {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if members := testSetReplyMembers(run("SMEMBERS dst")); strings.Join(members, ",") != "1,a" {
+		t.Errorf("unexpected members %v", members)
+	}
+}
+
+func TestSetPopAndRandomMember(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+
+	for _, prefix := range []string{"", "m"} {
+		for _, n := range []int{10, 300} {
+			run("DEL s")
+			members := make(map[string]bool)
+			for i := 0; i < n; i++ {
+				run("SADD s " + prefix + strconv.Itoa(i))
+				members[prefix+strconv.Itoa(i)] = true
+			}
+
+			//distinct members are replied with a positive count, whatever the count compared to the size.
+			for _, count := range []int{1, 5, n / 2, n - 1, n, n + 10} {
+				reply := testSetReplyMembers(run("SRANDMEMBER s " + strconv.Itoa(count)))
+				want := count
+				if want > n {
+					want = n
+				}
+				for j, member := range reply {
+					if !members[member] || (j > 0 && reply[j-1] == member) {
+						t.Fatalf("unexpected member %q", member)
+					}
+				}
+				if len(reply) != want {
+					t.Fatalf("count %d replied %d members", count, len(reply))
+				}
+			}
+			if reply := testSetReplyMembers(run("SRANDMEMBER s -" + strconv.Itoa(n*2))); len(reply) != n*2 {
+				t.Fatalf("a negative count replied %d members", len(reply))
+			}
+
+			//the popped members are removed and propagated with a single SREM, with both strategies.
+			remaining := n
+			for _, count := range []int{1, n / 2, n - 1 - n/2 - 3} {
+				popped := testSetReplyMembers(run("SPOP s " + strconv.Itoa(count)))
+				if len(popped) != count || c.cmd.name != "SREM" || int(c.argc) != count+2 {
+					t.Fatalf("SPOP %d popped %d members", count, len(popped))
+				}
+				for _, member := range popped {
+					if !members[member] {
+						t.Fatalf("unexpected member %q", member)
+					}
+					delete(members, member)
+				}
+				remaining -= count
+				if o := lookupKey(c.db, testStringObject("s")); setTypeSize(o) != int64(remaining) {
+					t.Fatalf("the set has %d members instead of %d", setTypeSize(o), remaining)
+				}
+			}
+			reply := strings.Split(run("SPOP s"), "\r\n")
+			if len(reply) != 3 || !members[reply[1]] || c.cmd.name != "SREM" {
+				t.Fatalf("unexpected reply %v", reply)
+			}
+			//the whole set is popped and the command propagated as DEL.
+			if popped := testSetReplyMembers(run("SPOP s 1000")); len(popped) != remaining-1 || c.cmd.name != "DEL" {
+				t.Fatalf("unexpected popped members %v", popped)
+			}
+			if lookupKey(c.db, testStringObject("s")) != nil {
+				t.Fatal("the empty set was not deleted")
+			}
+		}
+	}
+
+	if reply := run("SPOP missing"); reply != "$-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("SPOP missing 3"); reply != "*0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("SPOP missing -1"); reply != "-ERR value is out of range, must be positive\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("SRANDMEMBER missing"); reply != "$-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("SRANDMEMBER missing 3"); reply != "*0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestSetScan(t *testing.T) {
+	setupTestServer()
+	_, run := newTestClient(t)
+
+	for _, n := range []int{10, 300} {
+		run("DEL s")
+		for i := 0; i < n; i++ {
+			run("SADD s m" + strconv.Itoa(i))
+		}
+		//a full iteration returns every member.
+		scanned := make(map[string]bool)
+		cursor := "0"
+		for {
+			lines := strings.Split(run("SSCAN s "+cursor+" COUNT 20"), "\r\n")
+			cursor = lines[2]
+			for _, member := range testSetReplyMembers(strings.Join(lines[3:], "\r\n")) {
+				scanned[member] = true
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+		if len(scanned) != n {
+			t.Fatalf("SSCAN returned %d members", len(scanned))
+		}
+	}
+
+	//an intset is replied at once.
+	run("SADD ints 1 2 3 10 11")
+	if reply := run("SSCAN ints 0 MATCH 1*"); reply != "*2\r\n$1\r\n0\r\n*3\r\n$1\r\n1\r\n$2\r\n10\r\n$2\r\n11\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("SSCAN ints 0 NOVALUES"); reply != "-ERR syntax error\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("SSCAN missing 0"); reply != "*2\r\n$1\r\n0\r\n*0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+	members := func(command string) string {
+		return strings.Join(testSetReplyMembers(run(command)), ",")
+	}
+
+	run("SADD a 1 2 3 4")
+	run("SADD b 2 3 5")
+	run("SADD c x 3 2")
+	if m := members("SINTER a b c"); m != "2,3" {
+		t.Errorf("unexpected intersection %s", m)
+	}
+	if m := members("SINTER a b"); m != "2,3" {
+		t.Errorf("unexpected intersection %s", m)
+	}
+	if reply := run("SINTER a missing"); reply != "*0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	run("SET str v")
+	if reply := run("SINTER missing str"); reply != *shared.wrongtypeerr {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if m := members("SUNION a b c missing"); m != "1,2,3,4,5,x" {
+		t.Errorf("unexpected union %s", m)
+	}
+	if m := members("SDIFF a b c"); m != "1,4" {
+		t.Errorf("unexpected difference %s", m)
+	}
+	if reply := run("SDIFF a missing b a"); reply != "*0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("SDIFF missing a"); reply != "*0\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	//the difference of a big set with small ones iterates all the sets instead of looking up the members.
+	for i := 0; i < 100; i++ {
+		run("SADD big " + strconv.Itoa(i))
+	}
+	if reply := testSetReplyMembers(run("SDIFF big a b c")); len(reply) != 95 {
+		t.Errorf("unexpected difference of %d members", len(reply))
+	}
+
+	//the STORE forms replace the destination, an empty result deletes it.
+	if reply := run("SINTERSTORE dst a b"); reply != ":2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if o := lookupKey(c.db, testStringObject("dst")); o == nil || o.encoding != REDIS_ENCODING_INTSET {
+		t.Fatal("the intersection was not stored as an intset")
+	}
+	if reply := run("SUNIONSTORE dst a c"); reply != ":5\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if o := lookupKey(c.db, testStringObject("dst")); o == nil || o.encoding != REDIS_ENCODING_HT {
+		t.Fatal("the union was not stored as a hash table")
+	}
+	if reply := run("SDIFFSTORE str a b"); reply != ":2\r\n" || members("SMEMBERS str") != "1,4" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("SINTERSTORE dst a missing"); reply != ":0\r\n" || lookupKey(c.db, testStringObject("dst")) != nil {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("SDIFFSTORE str a a"); reply != ":0\r\n" || lookupKey(c.db, testStringObject("str")) != nil {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	for command, expected := range map[string]string{
+		"SINTERCARD 3 a b c":        ":2\r\n",
+		"SINTERCARD 2 a b LIMIT 1":  ":1\r\n",
+		"SINTERCARD 2 a b LIMIT 0":  ":2\r\n",
+		"SINTERCARD 2 a missing":    ":0\r\n",
+		"SINTERCARD 1 big limit 10": ":10\r\n",
+		"SINTERCARD 0 a":            "-ERR numkeys should be greater than 0\r\n",
+		"SINTERCARD 3 a b":          "-ERR Number of keys can't be greater than number of args\r\n",
+		"SINTERCARD 2 a b LIMIT -1": "-ERR LIMIT can't be negative\r\n",
+		"SINTERCARD 2 a b LIMIT":    "-ERR syntax error\r\n",
+		"SINTERCARD 1 a b":          "-ERR syntax error\r\n",
+	} {
+		if reply := run(command); reply != expected {
+			t.Errorf("%s: unexpected reply %q", command, reply)
+		}
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"math"
 	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 func zslCreate() *zskiplist {
@@ -129,6 +133,44 @@ func zslRandomLevel() int {
 	return level
 }
 
+// 按原跳表的结构逐个复制节点，节点的层高和跨度保持不变，无需重新查找插入位置
+func zslDup(zsl *zskiplist) *zskiplist {
+	copied := zslCreate()
+	copied.level = zsl.level
+	copied.length = zsl.length
+	//update[i]记录新跳表第i层索引当前的最后一个节点，新节点直接链接在它之后
+	update := make([]*zskiplistNode, ZSKIPLIST_MAXLEVEL)
+	for i := 0; i < ZSKIPLIST_MAXLEVEL; i++ {
+		update[i] = copied.header
+		copied.header.level[i].span = zsl.header.level[i].span
+	}
+	var prev *zskiplistNode
+	for x := zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		node := zslCreateNode(len(x.level), x.score, x.obj)
+		for i := range x.level {
+			node.level[i].span = x.level[i].span
+			update[i].level[i].forward = node
+			update[i] = node
+		}
+		node.backward = prev
+		prev = node
+	}
+	copied.tail = prev
+	return copied
+}
+
+// 复制有序集合，元素对象不会被原地修改所以直接共享，字典中的分值指向新的副本
+func zsetDup(o *robj) *robj {
+	zobj := createZsetObject()
+	zs := (*zobj.ptr).(*zset)
+	zs.zsl = zslDup((*o.ptr).(*zset).zsl)
+	for x := zs.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		score := x.score
+		zs.dict[x.obj.String()] = &score
+	}
+	return zobj
+}
+
 func zslGetRank(zsl *zskiplist, score float64, obj *robj) int64 {
 	var rank int64
 	//从索引最高节点开始进行查找
@@ -200,84 +242,213 @@ func zslDeleteNode(zsl *zskiplist, x *zskiplistNode, update []*zskiplistNode) {
 }
 
 func zaddCommand(c *redisClient) {
-	//传入0，即本次传入的score在元素存在情况下执行覆盖score而非累加score
-	zaddGenericCommand(c, 0)
+	zaddGenericCommand(c, ZADD_IN_NONE)
+}
+
+func zincrbyCommand(c *redisClient) {
+	//ZINCRBY等价于带INCR选项的ZADD
+	zaddGenericCommand(c, ZADD_IN_INCR)
+}
+
+/*
+*
+将元素添加到有序集合中或者更新其score，flags为ZADD_IN_*选项，
+retflags返回ZADD_OUT_*标识本次操作的结果，newscore返回元素最新的score。
+score为nan或者INCR累加后得到nan时返回false，其余情况均返回true:
+  - NX: 元素已存在则不做任何操作
+  - XX: 元素不存在则不做任何操作
+  - GT/LT: 新的score大于/小于当前score才更新，不影响新元素的添加
+  - INCR: 将score累加到当前score上
+*/
+func zsetAdd(zobj *robj, score float64, ele *robj, flags int, retflags *int, newscore *float64) bool {
+	incr := flags&ZADD_IN_INCR != 0
+	nx := flags&ZADD_IN_NX != 0
+	xx := flags&ZADD_IN_XX != 0
+	gt := flags&ZADD_IN_GT != 0
+	lt := flags&ZADD_IN_LT != 0
+	*retflags = 0
+
+	//score为nan时无论其他参数如何都返回错误
+	if math.IsNaN(score) {
+		*retflags = ZADD_OUT_NAN
+		return false
+	}
+
+	zs := (*zobj.ptr).(*zset)
+	k := ele.String()
+	curscore, exists := zs.dict[k]
+	if exists {
+		//NX选项下元素已存在直接返回
+		if nx {
+			*retflags |= ZADD_OUT_NOP
+			return true
+		}
+		//INCR选项则将score累加到当前score上，例如inf加上-inf会得到nan
+		if incr {
+			score += *curscore
+			if math.IsNaN(score) {
+				*retflags |= ZADD_OUT_NAN
+				return false
+			}
+		}
+		//GT/LT选项下只有新的score大于/小于当前score才更新
+		if (lt && score >= *curscore) || (gt && score <= *curscore) {
+			*retflags |= ZADD_OUT_NOP
+			return true
+		}
+		*newscore = score
+		//score发生变化则将元素从跳表中删除再插入，并更新字典中对应元素的score
+		if score != *curscore {
+			zslDelete(zs.zsl, *curscore, ele)
+			zslInsert(zs.zsl, score, ele)
+			zs.dict[k] = &score
+			*retflags |= ZADD_OUT_UPDATED
+		}
+		return true
+	} else if !xx {
+		//若是新增则插入到有序集合对应的跳表和字典中
+		zslInsert(zs.zsl, score, ele)
+		zs.dict[k] = &score
+		*retflags |= ZADD_OUT_ADDED
+		*newscore = score
+		return true
+	}
+	//XX选项下元素不存在则不做任何操作
+	*retflags |= ZADD_OUT_NOP
+	return true
 }
 
-func zaddGenericCommand(c *redisClient, incr int) {
+/*
+*
+ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+ZINCRBY key increment member
+*/
+func zaddGenericCommand(c *redisClient, flags int) {
 	//拿到有序集合的key
 	key := c.argv[1]
+	var score float64
+	ch := false
 
-	var ele *robj
-	var zobj *robj
-	var j uint64
-	//var score float64
-	//初始化变量记录本次操作添加和更新的元素数
-	var added int64
-	var updated int64
+	/**
+	解析选项，遍历结束时scoreidx指向第一个score-member对中score的位置
+	*/
+	scoreidx := uint64(2)
+	for ; scoreidx < c.argc; scoreidx++ {
+		opt := c.argv[scoreidx].String()
+		if strings.EqualFold(opt, "nx") {
+			flags |= ZADD_IN_NX
+		} else if strings.EqualFold(opt, "xx") {
+			flags |= ZADD_IN_XX
+		} else if strings.EqualFold(opt, "ch") {
+			ch = true
+		} else if strings.EqualFold(opt, "incr") {
+			flags |= ZADD_IN_INCR
+		} else if strings.EqualFold(opt, "gt") {
+			flags |= ZADD_IN_GT
+		} else if strings.EqualFold(opt, "lt") {
+			flags |= ZADD_IN_LT
+		} else {
+			break
+		}
+	}
+	incr := flags&ZADD_IN_INCR != 0
+	nx := flags&ZADD_IN_NX != 0
+	xx := flags&ZADD_IN_XX != 0
+	gt := flags&ZADD_IN_GT != 0
+	lt := flags&ZADD_IN_LT != 0
+
+	//选项之后的参数必须是成对的score和member
+	elements := c.argc - scoreidx
+	if elements%2 != 0 || elements == 0 {
+		addReply(c, shared.syntaxerr)
+		return
+	}
+	elements /= 2
 
-	//参数非偶数，入参异常直接输出错误后返回
-	if c.argc%2 != 0 {
-		addReplyError(c, shared.syntaxerr)
+	//检查互相冲突的选项，XX可以和GT或LT一起使用
+	if nx && xx {
+		errMsg := "XX and NX options at the same time are not compatible"
+		addReplyError(c, &errMsg)
+		return
+	}
+	if (gt && nx) || (lt && nx) || (gt && lt) {
+		errMsg := "GT, LT, and/or NX options at the same time are not compatible"
+		addReplyError(c, &errMsg)
+		return
+	}
+	if incr && elements > 1 {
+		errMsg := "INCR option supports a single increment-element pair"
+		addReplyError(c, &errMsg)
 		return
 	}
-	//减去zadd和key 再除去2 得到本次插入的元素数
-	elements := (c.argc - 2) / 2
 
-	//创建scores记录每个元素对应的score值
+	//先解析所有的score，保证指令要么全部执行要么不执行
 	scores := make([]float64, elements)
-	for j = 0; j < elements; j++ {
-		//对score进行转换，若报错直接返回
-		if !getDoubleFromObjectOrReply(c, c.argv[2+j*2], &scores[j], nil) {
+	for j := uint64(0); j < elements; j++ {
+		if !getDoubleFromObjectOrReply(c, c.argv[scoreidx+j*2], &scores[j], nil) {
 			return
 		}
 	}
 
-	//若为空则创建一个有序集合,并添加到数据库中
-	zobj = lookupKeyWrite(c.db, c.argv[1])
-	if zobj == nil {
+	//初始化变量记录本次操作添加、更新和处理的元素数
+	var added, updated, processed int64
+	nanerr := false
+	zobj := lookupKeyWrite(c.db, key)
+	if zobj != nil && checkType(c, zobj, REDIS_ZSET) {
+		return
+	}
+	//key不存在且指定了XX则不做任何操作，否则创建一个有序集合并添加到数据库中
+	if zobj == nil && !xx {
 		zobj = createZsetObject()
 		dbAdd(c.db, key, zobj)
-	} else if zobj.robjType != REDIS_ZSET { //若类型不对则返回异常
-		addReply(c, shared.wrongtypeerr)
-		return
 	}
 
-	zs := (*zobj.ptr).(*zset)
-
-	//基于元素数遍历集合
-	for j = 0; j < elements; j++ {
-		//拿到本次元素对应的score
-		//score = scores[j]
-		//拿到对应的元素
-		ele = c.argv[3+j*2]
-		k := (*ele.ptr).(string)
-
-		//如果该元素存在于字典中
-		if zs.dict[k] != nil {
-			//拿到当前元素对应的score
-			curScore := zs.dict[k]
-			//若不一样则更新字典中对应元素的score，并将该元素从跳表中删除再插入
-			if *curScore != scores[j] {
-				zslDelete(zs.zsl, *curScore, c.argv[3+j*2])
-				zslInsert(zs.zsl, scores[j], c.argv[3+j*2])
-				zs.dict[k] = &scores[j]
-				//维护更新数
-				updated++
-			}
-
-		} else { //若是新增则插入到有序集合对应的跳表和字典中
-			zslInsert(zs.zsl, scores[j], c.argv[3+j*2])
-			zs.dict[k] = &scores[j]
-			//维护添加数
+	for j := uint64(0); zobj != nil && j < elements; j++ {
+		var retflags int
+		var newscore float64
+		ele := c.argv[scoreidx+1+j*2]
+		if !zsetAdd(zobj, scores[j], ele, flags, &retflags, &newscore) {
+			//例如INCR时inf加上-inf得到nan，已处理的元素依旧生效
+			errMsg := "resulting score is not a number (NaN)"
+			addReplyError(c, &errMsg)
+			nanerr = true
+			break
+		}
+		if retflags&ZADD_OUT_ADDED != 0 {
 			added++
 		}
-
+		if retflags&ZADD_OUT_UPDATED != 0 {
+			updated++
+		}
+		if retflags&ZADD_OUT_NOP == 0 {
+			processed++
+		}
+		score = newscore
 	}
 
-	//返回本次插入数
-	addReplyLongLong(c, added)
+	//通知监视该key的客户端其事务已失效
+	if added+updated > 0 {
+		signalModifiedKey(c.db, key)
+	}
+	//累加修改数,用于判断是否达到RDB的保存条件
+	server.dirty += added + updated
+	if nanerr {
+		return
+	}
 
+	if incr {
+		//INCR选项返回元素最新的score，因为条件选项没有执行时返回空
+		if processed > 0 {
+			addReplyDouble(c, score)
+		} else {
+			addReplyNull(c)
+		}
+	} else if ch {
+		//CH选项返回添加和更新的元素总数
+		addReplyLongLong(c, added+updated)
+	} else {
+		addReplyLongLong(c, added)
+	}
 }
 
 func zcardCommand(c *redisClient) {
@@ -301,7 +472,7 @@ func zrankGenericCommand(c *redisClient, reverse int) {
 	ele := c.argv[2]
 
 	//查看有序集合是否存在
-	o := lookupKeyReadOrReply(c, key, nil)
+	o := lookupKeyReadOrReply(c, key, shared.null[c.resp])
 	if o == nil || checkType(c, o, REDIS_ZSET) {
 		return
 	}
@@ -323,7 +494,7 @@ func zrankGenericCommand(c *redisClient, reverse int) {
 			addReplyLongLong(c, rank-1)
 		}
 	} else { //不存在返回空
-		addReply(c, shared.nullbulk)
+		addReplyNull(c)
 	}
 
 }
@@ -346,6 +517,7 @@ func zremCommand(c *redisClient) {
 		if zs.dict[ele] != nil {
 			//更新删除结果
 			deleted++
+			server.dirty++
 			zslDelete(zs.zsl, *zs.dict[ele], c.argv[j])
 			delete(zs.dict, ele)
 
@@ -355,7 +527,1436 @@ func zremCommand(c *redisClient) {
 			}
 		}
 	}
+	//通知监视该key的客户端其事务已失效
+	if deleted > 0 {
+		signalModifiedKey(c.db, c.argv[1])
+	}
 	//返回删除数
 	addReplyLongLong(c, deleted)
 
 }
+
+func zscoreCommand(c *redisClient) {
+	//查看有序集合是否存在且类型是否正确
+	o := lookupKeyReadOrReply(c, c.argv[1], shared.null[c.resp])
+	if o == nil || checkType(c, o, REDIS_ZSET) {
+		return
+	}
+	//从字典中定位元素的score，RESP3客户端会收到double类型的响应
+	zs := (*o.ptr).(*zset)
+	score, exists := zs.dict[(*c.argv[2].ptr).(string)]
+	if !exists {
+		addReplyNull(c)
+		return
+	}
+	addReplyDouble(c, *score)
+}
+
+/*
+*
+基于排名定位节点，rank从1开始，即header走到该节点经过的跨度，
+借助各层索引的跨度信息，复杂度为O(log N)
+*/
+func zslGetElementByRank(zsl *zskiplist, rank int64) *zskiplistNode {
+	var traversed int64
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		//只要跨度累加后不超过rank就前移
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		//跨度正好等于rank说明找到了该节点
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+/*
+*
+返回节点x之后第n个节点，n为负数则为x之前的第-n个节点，超出跳表范围返回nil
+先计算x的排名，再基于排名定位目标节点，复杂度为O(log N)
+*/
+func zslGetElementByOffset(zsl *zskiplist, x *zskiplistNode, n int64) *zskiplistNode {
+	if x == nil || n == 0 {
+		return x
+	}
+	rank := zslGetRank(zsl, x.score, x.obj) + n
+	if rank < 1 || rank > zsl.length {
+		return nil
+	}
+	return zslGetElementByRank(zsl, rank)
+}
+
+// 解析score区间的一端，以"("开头代表开区间，score不能为nan
+func zslParseRangeItem(s string, value *float64, ex *bool) bool {
+	if strings.HasPrefix(s, "(") {
+		*ex = true
+		s = s[1:]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) {
+		return false
+	}
+	*value = v
+	return true
+}
+
+// 解析ZRANGEBYSCORE、ZCOUNT等指令的min和max参数
+func zslParseRange(min *robj, max *robj, spec *zrangespec) bool {
+	return zslParseRangeItem(min.String(), &spec.min, &spec.minex) &&
+		zslParseRangeItem(max.String(), &spec.max, &spec.maxex)
+}
+
+func zslValueGteMin(value float64, spec *zrangespec) bool {
+	if spec.minex {
+		return value > spec.min
+	}
+	return value >= spec.min
+}
+
+func zslValueLteMax(value float64, spec *zrangespec) bool {
+	if spec.maxex {
+		return value < spec.max
+	}
+	return value <= spec.max
+}
+
+// 判断跳表中是否有元素落在区间内
+func zslIsInRange(zsl *zskiplist, spec *zrangespec) bool {
+	//区间为空直接返回false
+	if spec.min > spec.max || (spec.min == spec.max && (spec.minex || spec.maxex)) {
+		return false
+	}
+	//尾节点小于min或者第一个节点大于max，说明没有元素在区间内
+	x := zsl.tail
+	if x == nil || !zslValueGteMin(x.score, spec) {
+		return false
+	}
+	x = zsl.header.level[0].forward
+	if x == nil || !zslValueLteMax(x.score, spec) {
+		return false
+	}
+	return true
+}
+
+// 返回区间内的第一个节点，没有则返回nil
+func zslFirstInRange(zsl *zskiplist, spec *zrangespec) *zskiplistNode {
+	if !zslIsInRange(zsl, spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		//前移直到前向节点大于等于min
+		for x.level[i].forward != nil && !zslValueGteMin(x.level[i].forward.score, spec) {
+			x = x.level[i].forward
+		}
+	}
+	//区间内有元素，所以前向节点一定不为空
+	x = x.level[0].forward
+	//检查节点是否小于等于max
+	if !zslValueLteMax(x.score, spec) {
+		return nil
+	}
+	return x
+}
+
+// 返回区间内的最后一个节点，没有则返回nil
+func zslLastInRange(zsl *zskiplist, spec *zrangespec) *zskiplistNode {
+	if !zslIsInRange(zsl, spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		//只要前向节点还在max范围内就前移
+		for x.level[i].forward != nil && zslValueLteMax(x.level[i].forward.score, spec) {
+			x = x.level[i].forward
+		}
+	}
+	//区间内有元素，所以x一定不是头节点，检查节点是否大于等于min
+	if !zslValueGteMin(x.score, spec) {
+		return nil
+	}
+	return x
+}
+
+/*
+*
+返回区间内第n个节点(从0开始)，n为负数则从区间末尾开始计算，-1即区间内最后一个节点。
+LIMIT的offset基于跨度直接跳转而不是逐个遍历，复杂度为O(log N)
+*/
+func zslNthInRange(zsl *zskiplist, spec *zrangespec, n int64) *zskiplistNode {
+	var x *zskiplistNode
+	if n >= 0 {
+		x = zslGetElementByOffset(zsl, zslFirstInRange(zsl, spec), n)
+	} else {
+		x = zslGetElementByOffset(zsl, zslLastInRange(zsl, spec), n+1)
+	}
+	if x == nil || !zslValueGteMin(x.score, spec) || !zslValueLteMax(x.score, spec) {
+		return nil
+	}
+	return x
+}
+
+/*
+*
+解析字典序区间的一端:"+"和"-"代表最大和最小的字符串，
+"("开头代表开区间，"["开头代表闭区间，其余情况均不合法
+*/
+func zslParseLexRangeItem(s string, dest *string, inf *int, ex *bool) bool {
+	switch {
+	case s == "+":
+		*inf = 1
+		*ex = true
+	case s == "-":
+		*inf = -1
+		*ex = true
+	case strings.HasPrefix(s, "("):
+		*dest = s[1:]
+		*ex = true
+	case strings.HasPrefix(s, "["):
+		*dest = s[1:]
+		*ex = false
+	default:
+		return false
+	}
+	return true
+}
+
+// 解析ZRANGEBYLEX、ZLEXCOUNT等指令的min和max参数
+func zslParseLexRange(min *robj, max *robj, spec *zlexrangespec) bool {
+	return zslParseLexRangeItem(min.String(), &spec.min, &spec.minInf, &spec.minex) &&
+		zslParseLexRangeItem(max.String(), &spec.max, &spec.maxInf, &spec.maxex)
+}
+
+// 比较两个字符串，inf为-1或1的字符串分别小于或大于其他所有字符串
+func zslLexCmp(a string, aInf int, b string, bInf int) int {
+	if aInf != 0 || bInf != 0 {
+		return aInf - bInf
+	}
+	return strings.Compare(a, b)
+}
+
+func zslLexValueGteMin(value string, spec *zlexrangespec) bool {
+	cmp := zslLexCmp(value, 0, spec.min, spec.minInf)
+	if spec.minex {
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+func zslLexValueLteMax(value string, spec *zlexrangespec) bool {
+	cmp := zslLexCmp(value, 0, spec.max, spec.maxInf)
+	if spec.maxex {
+		return cmp < 0
+	}
+	return cmp <= 0
+}
+
+// 判断跳表中是否有元素落在字典序区间内
+func zslIsInLexRange(zsl *zskiplist, spec *zlexrangespec) bool {
+	//区间为空直接返回false
+	cmp := zslLexCmp(spec.min, spec.minInf, spec.max, spec.maxInf)
+	if cmp > 0 || (cmp == 0 && (spec.minex || spec.maxex)) {
+		return false
+	}
+	x := zsl.tail
+	if x == nil || !zslLexValueGteMin(x.obj.String(), spec) {
+		return false
+	}
+	x = zsl.header.level[0].forward
+	if x == nil || !zslLexValueLteMax(x.obj.String(), spec) {
+		return false
+	}
+	return true
+}
+
+// 返回字典序区间内的第一个节点，没有则返回nil
+func zslFirstInLexRange(zsl *zskiplist, spec *zlexrangespec) *zskiplistNode {
+	if !zslIsInLexRange(zsl, spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !zslLexValueGteMin(x.level[i].forward.obj.String(), spec) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if !zslLexValueLteMax(x.obj.String(), spec) {
+		return nil
+	}
+	return x
+}
+
+// 返回字典序区间内的最后一个节点，没有则返回nil
+func zslLastInLexRange(zsl *zskiplist, spec *zlexrangespec) *zskiplistNode {
+	if !zslIsInLexRange(zsl, spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslLexValueLteMax(x.level[i].forward.obj.String(), spec) {
+			x = x.level[i].forward
+		}
+	}
+	if !zslLexValueGteMin(x.obj.String(), spec) {
+		return nil
+	}
+	return x
+}
+
+// 返回字典序区间内第n个节点，规则与zslNthInRange一致
+func zslNthInLexRange(zsl *zskiplist, spec *zlexrangespec, n int64) *zskiplistNode {
+	var x *zskiplistNode
+	if n >= 0 {
+		x = zslGetElementByOffset(zsl, zslFirstInLexRange(zsl, spec), n)
+	} else {
+		x = zslGetElementByOffset(zsl, zslLastInLexRange(zsl, spec), n+1)
+	}
+	if x == nil || !zslLexValueGteMin(x.obj.String(), spec) || !zslLexValueLteMax(x.obj.String(), spec) {
+		return nil
+	}
+	return x
+}
+
+const (
+	//ZRANGE的区间类型，AUTO代表由BYSCORE、BYLEX参数决定，默认按排名
+	ZRANGE_AUTO  = 0
+	ZRANGE_RANK  = 1
+	ZRANGE_SCORE = 2
+	ZRANGE_LEX   = 3
+
+	//ZRANGE的遍历方向，AUTO代表由REV参数决定，默认正序
+	ZRANGE_DIRECTION_AUTO    = 0
+	ZRANGE_DIRECTION_FORWARD = 1
+	ZRANGE_DIRECTION_REVERSE = 2
+)
+
+/*
+*
+ZRANGE系列指令的结果处理器，先收集区间内的元素和score，
+最后根据dstkey是否为空返回给客户端或者存储到ZRANGESTORE的目标key中
+*/
+type zrangeResultHandler struct {
+	c          *redisClient
+	dstkey     *robj
+	withscores bool
+	members    []*robj
+	scores     []float64
+}
+
+func zrangeResultEmit(handler *zrangeResultHandler, obj *robj, score float64) {
+	handler.members = append(handler.members, obj)
+	handler.scores = append(handler.scores, score)
+}
+
+func zrangeResultFinalize(handler *zrangeResultHandler) {
+	c := handler.c
+	if handler.dstkey != nil {
+		zrangeResultFinalizeStore(handler)
+		return
+	}
+	//RESP3下每个元素和score组成一个数组，RESP2下则平铺为一个数组
+	if handler.withscores && c.resp == 2 {
+		addReplyMultiBulkLen(c, int64(len(handler.members)*2))
+	} else {
+		addReplyMultiBulkLen(c, int64(len(handler.members)))
+	}
+	for i, member := range handler.members {
+		if handler.withscores && c.resp > 2 {
+			addReplyMultiBulkLen(c, 2)
+		}
+		addReplyBulk(c, member)
+		if handler.withscores {
+			addReplyDouble(c, handler.scores[i])
+		}
+	}
+}
+
+// 将结果存储为一个新的有序集合，结果为空则删除目标key
+func zrangeResultFinalizeStore(handler *zrangeResultHandler) {
+	c := handler.c
+	if len(handler.members) == 0 {
+		addReply(c, shared.czero)
+		if lookupKeyWrite(c.db, handler.dstkey) != nil {
+			dbDelete(c.db, handler.dstkey)
+			signalModifiedKey(c.db, handler.dstkey)
+			server.dirty++
+		}
+		return
+	}
+	zobj := createZsetObject()
+	zs := (*zobj.ptr).(*zset)
+	for i, member := range handler.members {
+		score := handler.scores[i]
+		zslInsert(zs.zsl, score, member)
+		zs.dict[member.String()] = &score
+	}
+	setKey(c.db, handler.dstkey, zobj)
+	addReplyLongLong(c, int64(len(handler.members)))
+	server.dirty++
+}
+
+// 基于排名返回区间内的元素，start和end支持负数索引
+func genericZrangebyrankCommand(handler *zrangeResultHandler, zobj *robj, start int64, end int64, reverse bool) {
+	zsl := (*zobj.ptr).(*zset).zsl
+	llen := zsl.length
+
+	//负数索引转换为正数索引
+	if start < 0 {
+		start = llen + start
+	}
+	if end < 0 {
+		end = llen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	//区间不合法或者超出范围则返回空
+	if start > end || start >= llen {
+		zrangeResultFinalize(handler)
+		return
+	}
+	if end >= llen {
+		end = llen - 1
+	}
+	rangelen := end - start + 1
+
+	//基于跨度直接定位到区间的第一个节点
+	var ln *zskiplistNode
+	if reverse {
+		ln = zslGetElementByRank(zsl, llen-start)
+	} else {
+		ln = zslGetElementByRank(zsl, start+1)
+	}
+	for ; rangelen > 0; rangelen-- {
+		zrangeResultEmit(handler, ln.obj, ln.score)
+		if reverse {
+			ln = ln.backward
+		} else {
+			ln = ln.level[0].forward
+		}
+	}
+	zrangeResultFinalize(handler)
+}
+
+// 基于score区间返回元素，offset和limit对应LIMIT参数，limit为负数代表不限制
+func genericZrangebyscoreCommand(handler *zrangeResultHandler, spec *zrangespec, zobj *robj, offset int64, limit int64, reverse bool) {
+	zsl := (*zobj.ptr).(*zset).zsl
+
+	//offset为负数或者超出有序集合长度，直接返回空
+	if offset < 0 || offset >= zsl.length {
+		zrangeResultFinalize(handler)
+		return
+	}
+	//基于跨度直接跳过offset个元素，定位到第一个要返回的节点
+	var ln *zskiplistNode
+	if reverse {
+		ln = zslNthInRange(zsl, spec, -offset-1)
+	} else {
+		ln = zslNthInRange(zsl, spec, offset)
+	}
+	for ln != nil && limit != 0 {
+		//超出区间则结束遍历
+		if reverse && !zslValueGteMin(ln.score, spec) {
+			break
+		} else if !reverse && !zslValueLteMax(ln.score, spec) {
+			break
+		}
+		zrangeResultEmit(handler, ln.obj, ln.score)
+		limit--
+		if reverse {
+			ln = ln.backward
+		} else {
+			ln = ln.level[0].forward
+		}
+	}
+	zrangeResultFinalize(handler)
+}
+
+// 基于字典序区间返回元素，参数规则与genericZrangebyscoreCommand一致
+func genericZrangebylexCommand(handler *zrangeResultHandler, spec *zlexrangespec, zobj *robj, offset int64, limit int64, reverse bool) {
+	zsl := (*zobj.ptr).(*zset).zsl
+
+	if offset < 0 || offset >= zsl.length {
+		zrangeResultFinalize(handler)
+		return
+	}
+	var ln *zskiplistNode
+	if reverse {
+		ln = zslNthInLexRange(zsl, spec, -offset-1)
+	} else {
+		ln = zslNthInLexRange(zsl, spec, offset)
+	}
+	for ln != nil && limit != 0 {
+		if reverse && !zslLexValueGteMin(ln.obj.String(), spec) {
+			break
+		} else if !reverse && !zslLexValueLteMax(ln.obj.String(), spec) {
+			break
+		}
+		zrangeResultEmit(handler, ln.obj, ln.score)
+		limit--
+		if reverse {
+			ln = ln.backward
+		} else {
+			ln = ln.level[0].forward
+		}
+	}
+	zrangeResultFinalize(handler)
+}
+
+/*
+*
+ZRANGE系列指令的通用实现，argcStart为源key所在的参数位置，
+rangetype和direction为AUTO时由BYSCORE、BYLEX和REV参数决定
+*/
+func zrangeGenericCommand(handler *zrangeResultHandler, argcStart int, store bool, rangetype int, direction int) {
+	c := handler.c
+	key := c.argv[argcStart]
+	minidx := argcStart + 1
+	maxidx := argcStart + 2
+	var offset, limit int64 = 0, -1
+	withscores := false
+
+	//step 1: 跳过key、min、max，解析剩余的可选参数
+	for j := argcStart + 3; j < int(c.argc); j++ {
+		leftargs := int(c.argc) - j - 1
+		opt := c.argv[j].String()
+		if !store && strings.EqualFold(opt, "withscores") {
+			withscores = true
+		} else if strings.EqualFold(opt, "limit") && leftargs >= 2 {
+			if !getLongFromObjectOrReply(c, c.argv[j+1], &offset, nil) ||
+				!getLongFromObjectOrReply(c, c.argv[j+2], &limit, nil) {
+				return
+			}
+			j += 2
+		} else if direction == ZRANGE_DIRECTION_AUTO && strings.EqualFold(opt, "rev") {
+			direction = ZRANGE_DIRECTION_REVERSE
+		} else if rangetype == ZRANGE_AUTO && strings.EqualFold(opt, "bylex") {
+			rangetype = ZRANGE_LEX
+		} else if rangetype == ZRANGE_AUTO && strings.EqualFold(opt, "byscore") {
+			rangetype = ZRANGE_SCORE
+		} else {
+			addReply(c, shared.syntaxerr)
+			return
+		}
+	}
+
+	//未指定则使用默认值
+	if direction == ZRANGE_DIRECTION_AUTO {
+		direction = ZRANGE_DIRECTION_FORWARD
+	}
+	if rangetype == ZRANGE_AUTO {
+		rangetype = ZRANGE_RANK
+	}
+
+	//检查参数冲突
+	if limit != -1 && rangetype == ZRANGE_RANK {
+		errMsg := "syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"
+		addReplyError(c, &errMsg)
+		return
+	}
+	if withscores && rangetype == ZRANGE_LEX {
+		errMsg := "syntax error, WITHSCORES not supported in combination with BYLEX"
+		addReplyError(c, &errMsg)
+		return
+	}
+
+	//逆序的score和字典序区间以max min的顺序给出
+	reverse := direction == ZRANGE_DIRECTION_REVERSE
+	if reverse && (rangetype == ZRANGE_SCORE || rangetype == ZRANGE_LEX) {
+		minidx, maxidx = maxidx, minidx
+	}
+
+	//step 2: 解析区间
+	var start, end int64
+	var spec zrangespec
+	var lexspec zlexrangespec
+	switch rangetype {
+	case ZRANGE_RANK:
+		if !getLongFromObjectOrReply(c, c.argv[minidx], &start, nil) ||
+			!getLongFromObjectOrReply(c, c.argv[maxidx], &end, nil) {
+			return
+		}
+	case ZRANGE_SCORE:
+		if !zslParseRange(c.argv[minidx], c.argv[maxidx], &spec) {
+			errMsg := "min or max is not a float"
+			addReplyError(c, &errMsg)
+			return
+		}
+	case ZRANGE_LEX:
+		if !zslParseLexRange(c.argv[minidx], c.argv[maxidx], &lexspec) {
+			errMsg := "min or max not valid string range item"
+			addReplyError(c, &errMsg)
+			return
+		}
+	}
+	handler.withscores = withscores
+
+	//step 3: 查找有序集合，不存在则返回空
+	zobj := lookupKeyRead(c.db, key)
+	if zobj == nil {
+		if store {
+			zrangeResultFinalize(handler)
+		} else {
+			addReply(c, shared.emptymultibulk)
+		}
+		return
+	}
+	if checkType(c, zobj, REDIS_ZSET) {
+		return
+	}
+
+	//step 4: 根据区间类型获取区间内的元素
+	switch rangetype {
+	case ZRANGE_RANK:
+		genericZrangebyrankCommand(handler, zobj, start, end, reverse)
+	case ZRANGE_SCORE:
+		genericZrangebyscoreCommand(handler, &spec, zobj, offset, limit, reverse)
+	case ZRANGE_LEX:
+		genericZrangebylexCommand(handler, &lexspec, zobj, offset, limit, reverse)
+	}
+}
+
+// ZRANGE key start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func zrangeCommand(c *redisClient) {
+	zrangeGenericCommand(&zrangeResultHandler{c: c}, 1, false, ZRANGE_AUTO, ZRANGE_DIRECTION_AUTO)
+}
+
+// ZRANGESTORE dst src min max [BYSCORE|BYLEX] [REV] [LIMIT offset count]
+func zrangestoreCommand(c *redisClient) {
+	zrangeGenericCommand(&zrangeResultHandler{c: c, dstkey: c.argv[1]}, 2, true, ZRANGE_AUTO, ZRANGE_DIRECTION_AUTO)
+}
+
+// ZREVRANGE key start stop [WITHSCORES]
+func zrevrangeCommand(c *redisClient) {
+	zrangeGenericCommand(&zrangeResultHandler{c: c}, 1, false, ZRANGE_RANK, ZRANGE_DIRECTION_REVERSE)
+}
+
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func zrangebyscoreCommand(c *redisClient) {
+	zrangeGenericCommand(&zrangeResultHandler{c: c}, 1, false, ZRANGE_SCORE, ZRANGE_DIRECTION_FORWARD)
+}
+
+// ZREVRANGEBYSCORE key max min [WITHSCORES] [LIMIT offset count]
+func zrevrangebyscoreCommand(c *redisClient) {
+	zrangeGenericCommand(&zrangeResultHandler{c: c}, 1, false, ZRANGE_SCORE, ZRANGE_DIRECTION_REVERSE)
+}
+
+// ZRANGEBYLEX key min max [LIMIT offset count]
+func zrangebylexCommand(c *redisClient) {
+	zrangeGenericCommand(&zrangeResultHandler{c: c}, 1, false, ZRANGE_LEX, ZRANGE_DIRECTION_FORWARD)
+}
+
+// ZREVRANGEBYLEX key max min [LIMIT offset count]
+func zrevrangebylexCommand(c *redisClient) {
+	zrangeGenericCommand(&zrangeResultHandler{c: c}, 1, false, ZRANGE_LEX, ZRANGE_DIRECTION_REVERSE)
+}
+
+/*
+*
+ZCOUNT key min max
+基于区间第一个和最后一个节点的排名计算元素数，无需遍历区间
+*/
+func zcountCommand(c *redisClient) {
+	var spec zrangespec
+	if !zslParseRange(c.argv[2], c.argv[3], &spec) {
+		errMsg := "min or max is not a float"
+		addReplyError(c, &errMsg)
+		return
+	}
+	zobj := lookupKeyReadOrReply(c, c.argv[1], shared.czero)
+	if zobj == nil || checkType(c, zobj, REDIS_ZSET) {
+		return
+	}
+
+	zsl := (*zobj.ptr).(*zset).zsl
+	var count int64
+	//定位区间内的第一个节点，基于其排名得到大于等于min的元素数
+	if zn := zslFirstInRange(zsl, &spec); zn != nil {
+		rank := zslGetRank(zsl, zn.score, zn.obj)
+		count = zsl.length - (rank - 1)
+		//定位区间内的最后一个节点，减去大于max的元素数
+		if zn = zslLastInRange(zsl, &spec); zn != nil {
+			rank = zslGetRank(zsl, zn.score, zn.obj)
+			count -= zsl.length - rank
+		}
+	}
+	addReplyLongLong(c, count)
+}
+
+// ZLEXCOUNT key min max
+func zlexcountCommand(c *redisClient) {
+	var spec zlexrangespec
+	if !zslParseLexRange(c.argv[2], c.argv[3], &spec) {
+		errMsg := "min or max not valid string range item"
+		addReplyError(c, &errMsg)
+		return
+	}
+	zobj := lookupKeyReadOrReply(c, c.argv[1], shared.czero)
+	if zobj == nil || checkType(c, zobj, REDIS_ZSET) {
+		return
+	}
+
+	zsl := (*zobj.ptr).(*zset).zsl
+	var count int64
+	if zn := zslFirstInLexRange(zsl, &spec); zn != nil {
+		rank := zslGetRank(zsl, zn.score, zn.obj)
+		count = zsl.length - (rank - 1)
+		if zn = zslLastInLexRange(zsl, &spec); zn != nil {
+			rank = zslGetRank(zsl, zn.score, zn.obj)
+			count -= zsl.length - rank
+		}
+	}
+	addReplyLongLong(c, count)
+}
+
+const (
+	REDIS_AGGR_SUM = 1
+	REDIS_AGGR_MIN = 2
+	REDIS_AGGR_MAX = 3
+)
+
+/*
+*
+ZUNION、ZINTER、ZDIFF的输入源，既可以是有序集合也可以是集合，
+集合中的元素score视为1，weight为WEIGHTS选项指定的权重
+*/
+type zsetopsrc struct {
+	subject *robj
+	weight  float64
+}
+
+// 遍历输入源的迭代器，集合基于集合迭代器遍历，有序集合则沿着跳表第0层遍历
+type zsetopIterator struct {
+	src  *zsetopsrc
+	si   *setTypeIterator
+	node *zskiplistNode
+}
+
+// 返回输入源的元素数，key不存在则为0
+func zuiLength(op *zsetopsrc) int64 {
+	if op.subject == nil {
+		return 0
+	}
+	if op.subject.robjType == REDIS_SET {
+		return setTypeSize(op.subject)
+	}
+	return (*op.subject.ptr).(*zset).zsl.length
+}
+
+func zuiInitIterator(op *zsetopsrc) *zsetopIterator {
+	it := &zsetopIterator{src: op}
+	if op.subject == nil {
+		return it
+	}
+	if op.subject.robjType == REDIS_SET {
+		it.si = setTypeInitIterator(op.subject)
+	} else {
+		it.node = (*op.subject.ptr).(*zset).zsl.header.level[0].forward
+	}
+	return it
+}
+
+func zuiReleaseIterator(it *zsetopIterator) {
+	if it.si != nil {
+		setTypeReleaseIterator(it.si)
+	}
+}
+
+// 返回下一个元素及其score，遍历结束时返回false
+func zuiNext(it *zsetopIterator) (*robj, float64, bool) {
+	if it.si != nil {
+		ele := setTypeNextObject(it.si)
+		if ele == nil {
+			return nil, 0, false
+		}
+		return ele, 1.0, true
+	}
+	if it.node == nil {
+		return nil, 0, false
+	}
+	ele, score := it.node.obj, it.node.score
+	it.node = it.node.level[0].forward
+	return ele, score, true
+}
+
+// 查找元素在输入源中的score，集合中的元素score为1
+func zuiFind(op *zsetopsrc, ele *robj) (float64, bool) {
+	if op.subject == nil {
+		return 0, false
+	}
+	if op.subject.robjType == REDIS_SET {
+		return 1.0, setTypeIsMember(op.subject, ele)
+	}
+	score, exists := (*op.subject.ptr).(*zset).dict[ele.String()]
+	if !exists {
+		return 0, false
+	}
+	return *score, true
+}
+
+// 按照AGGREGATE选项将val聚合到target中，inf与-inf相加得到的nan视为0
+func zunionInterAggregate(target *float64, val float64, aggregate int) {
+	switch aggregate {
+	case REDIS_AGGR_SUM:
+		*target = *target + val
+		if math.IsNaN(*target) {
+			*target = 0
+		}
+	case REDIS_AGGR_MIN:
+		if val < *target {
+			*target = val
+		}
+	case REDIS_AGGR_MAX:
+		if val > *target {
+			*target = val
+		}
+	}
+}
+
+/*
+*
+ZUNION/ZINTER/ZDIFF numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]
+ZUNIONSTORE/ZINTERSTORE/ZDIFFSTORE destination numkeys key [key ...] ...
+ZINTERCARD numkeys key [key ...] [LIMIT limit]
+numkeysIndex为numkeys参数的位置，dstkey不为空时将结果存储到dstkey中，
+cardinalityOnly则只返回交集的元素数
+*/
+func zunionInterDiffGenericCommand(c *redisClient, dstkey *robj, numkeysIndex int, op int, cardinalityOnly bool) {
+	var setnum, limit int64
+	if !getLongFromObjectOrReply(c, c.argv[numkeysIndex], &setnum, nil) {
+		return
+	}
+	if setnum < 1 {
+		errMsg := "at least 1 input key is needed for '" + strings.ToLower(c.cmd.name) + "' command"
+		addReplyError(c, &errMsg)
+		return
+	}
+	//numkeys不能超过剩余的参数个数
+	if setnum > int64(c.argc)-int64(numkeysIndex+1) {
+		addReply(c, shared.syntaxerr)
+		return
+	}
+
+	//读取所有的输入源，key不存在视为空集合，类型必须是有序集合或者集合
+	src := make([]*zsetopsrc, setnum)
+	for i := range src {
+		key := c.argv[numkeysIndex+1+i]
+		var obj *robj
+		if dstkey != nil {
+			obj = lookupKeyWrite(c.db, key)
+		} else {
+			obj = lookupKeyRead(c.db, key)
+		}
+		if obj != nil && obj.robjType != REDIS_ZSET && obj.robjType != REDIS_SET {
+			addReply(c, shared.wrongtypeerr)
+			return
+		}
+		src[i] = &zsetopsrc{subject: obj, weight: 1.0}
+	}
+
+	//解析可选参数，ZDIFF不支持WEIGHTS和AGGREGATE，STORE形式不支持WITHSCORES
+	aggregate := REDIS_AGGR_SUM
+	withscores := false
+	for j := numkeysIndex + 1 + int(setnum); j < int(c.argc); j++ {
+		opt := c.argv[j].String()
+		remaining := int(c.argc) - j - 1
+		if op != SET_OP_DIFF && !cardinalityOnly && remaining >= int(setnum) && strings.EqualFold(opt, "weights") {
+			errMsg := "weight value is not a float"
+			for i := range src {
+				j++
+				if !getDoubleFromObjectOrReply(c, c.argv[j], &src[i].weight, &errMsg) {
+					return
+				}
+			}
+		} else if op != SET_OP_DIFF && !cardinalityOnly && remaining >= 1 && strings.EqualFold(opt, "aggregate") {
+			j++
+			aggr := c.argv[j].String()
+			if strings.EqualFold(aggr, "sum") {
+				aggregate = REDIS_AGGR_SUM
+			} else if strings.EqualFold(aggr, "min") {
+				aggregate = REDIS_AGGR_MIN
+			} else if strings.EqualFold(aggr, "max") {
+				aggregate = REDIS_AGGR_MAX
+			} else {
+				addReply(c, shared.syntaxerr)
+				return
+			}
+		} else if dstkey == nil && !cardinalityOnly && strings.EqualFold(opt, "withscores") {
+			withscores = true
+		} else if cardinalityOnly && remaining >= 1 && strings.EqualFold(opt, "limit") {
+			j++
+			errMsg := "LIMIT can't be negative"
+			if !getPositiveLongFromObjectOrReply(c, c.argv[j], &limit, &errMsg) {
+				return
+			}
+		} else {
+			addReply(c, shared.syntaxerr)
+			return
+		}
+	}
+
+	/**
+	结果先累加到字典中，members记录字典中每个元素对应的对象，
+	最后统一插入跳表得到按score排序的有序集合
+	*/
+	dstzset := map[string]*float64{}
+	members := map[string]*robj{}
+	var cardinality int64
+
+	if op == SET_OP_INTER {
+		/**
+		按照元素数从小到大排序，只需遍历最小的输入源，
+		其余输入源只要有一个不包含该元素就可以尽早跳过
+		*/
+		sort.SliceStable(src, func(i, j int) bool {
+			return zuiLength(src[i]) < zuiLength(src[j])
+		})
+		it := zuiInitIterator(src[0])
+		for ele, rawscore, ok := zuiNext(it); ok; ele, rawscore, ok = zuiNext(it) {
+			score := src[0].weight * rawscore
+			if math.IsNaN(score) {
+				score = 0
+			}
+			j := 1
+			for ; j < len(src); j++ {
+				//同一个key出现多次时无需再次查找
+				if src[j].subject == src[0].subject {
+					zunionInterAggregate(&score, src[j].weight*rawscore, aggregate)
+					continue
+				}
+				value, exists := zuiFind(src[j], ele)
+				if !exists {
+					break
+				}
+				zunionInterAggregate(&score, src[j].weight*value, aggregate)
+			}
+			//只有所有输入源都包含该元素才加入结果
+			if j != len(src) {
+				continue
+			}
+			if cardinalityOnly {
+				cardinality++
+				//达到LIMIT后停止查找
+				if limit != 0 && cardinality >= limit {
+					break
+				}
+				continue
+			}
+			value := score
+			dstzset[ele.String()] = &value
+			members[ele.String()] = ele
+		}
+		zuiReleaseIterator(it)
+	} else if op == SET_OP_UNION {
+		//遍历所有的输入源，已存在于结果中的元素按照AGGREGATE选项聚合score
+		for _, s := range src {
+			it := zuiInitIterator(s)
+			for ele, score, ok := zuiNext(it); ok; ele, score, ok = zuiNext(it) {
+				score = s.weight * score
+				if math.IsNaN(score) {
+					score = 0
+				}
+				if existing, exists := dstzset[ele.String()]; exists {
+					zunionInterAggregate(existing, score, aggregate)
+				} else {
+					value := score
+					dstzset[ele.String()] = &value
+					members[ele.String()] = ele
+				}
+			}
+			zuiReleaseIterator(it)
+		}
+	} else {
+		//差集只保留第一个输入源中不存在于其余输入源的元素，score取第一个输入源中的score
+		it := zuiInitIterator(src[0])
+		for ele, score, ok := zuiNext(it); ok; ele, score, ok = zuiNext(it) {
+			j := 1
+			for ; j < len(src); j++ {
+				if _, exists := zuiFind(src[j], ele); exists {
+					break
+				}
+			}
+			if j != len(src) {
+				continue
+			}
+			value := score
+			dstzset[ele.String()] = &value
+			members[ele.String()] = ele
+		}
+		zuiReleaseIterator(it)
+	}
+
+	if cardinalityOnly {
+		addReplyLongLong(c, cardinality)
+		return
+	}
+
+	//基于字典中的结果构建有序集合
+	dstobj := createZsetObject()
+	zs := (*dstobj.ptr).(*zset)
+	for k, score := range dstzset {
+		zslInsert(zs.zsl, *score, members[k])
+		zs.dict[k] = score
+	}
+
+	if dstkey != nil {
+		//结果为空则删除目标key，否则覆盖目标key
+		if zs.zsl.length > 0 {
+			setKey(c.db, dstkey, dstobj)
+			addReplyLongLong(c, zs.zsl.length)
+			server.dirty++
+		} else {
+			addReply(c, shared.czero)
+			if lookupKeyWrite(c.db, dstkey) != nil {
+				dbDelete(c.db, dstkey)
+				signalModifiedKey(c.db, dstkey)
+				server.dirty++
+			}
+		}
+		return
+	}
+
+	//按照score从小到大返回结果
+	handler := &zrangeResultHandler{c: c, withscores: withscores}
+	for x := zs.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		zrangeResultEmit(handler, x.obj, x.score)
+	}
+	zrangeResultFinalize(handler)
+}
+
+func zunionstoreCommand(c *redisClient) {
+	zunionInterDiffGenericCommand(c, c.argv[1], 2, SET_OP_UNION, false)
+}
+
+func zinterstoreCommand(c *redisClient) {
+	zunionInterDiffGenericCommand(c, c.argv[1], 2, SET_OP_INTER, false)
+}
+
+func zdiffstoreCommand(c *redisClient) {
+	zunionInterDiffGenericCommand(c, c.argv[1], 2, SET_OP_DIFF, false)
+}
+
+func zunionCommand(c *redisClient) {
+	zunionInterDiffGenericCommand(c, nil, 1, SET_OP_UNION, false)
+}
+
+func zinterCommand(c *redisClient) {
+	zunionInterDiffGenericCommand(c, nil, 1, SET_OP_INTER, false)
+}
+
+func zintercardCommand(c *redisClient) {
+	zunionInterDiffGenericCommand(c, nil, 1, SET_OP_INTER, true)
+}
+
+func zdiffCommand(c *redisClient) {
+	zunionInterDiffGenericCommand(c, nil, 1, SET_OP_DIFF, false)
+}
+
+/*
+*
+删除跳表中score在区间内的所有节点，同时删除字典中对应的元素，返回删除的元素数。
+先定位每层索引中最后一个小于min的节点，再沿着第0层逐个删除直到超出max
+*/
+func zslDeleteRangeByScore(zsl *zskiplist, spec *zrangespec, dict map[string]*float64) int64 {
+	update := make([]*zskiplistNode, ZSKIPLIST_MAXLEVEL)
+	var removed int64
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !zslValueGteMin(x.level[i].forward.score, spec) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	//当前节点是最后一个小于min的节点，往后删除区间内的节点
+	x = x.level[0].forward
+	for x != nil && zslValueLteMax(x.score, spec) {
+		next := x.level[0].forward
+		zslDeleteNode(zsl, x, update)
+		delete(dict, x.obj.String())
+		removed++
+		x = next
+	}
+	return removed
+}
+
+// 删除跳表中元素在字典序区间内的所有节点，要求所有元素的score相同
+func zslDeleteRangeByLex(zsl *zskiplist, spec *zlexrangespec, dict map[string]*float64) int64 {
+	update := make([]*zskiplistNode, ZSKIPLIST_MAXLEVEL)
+	var removed int64
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !zslLexValueGteMin(x.level[i].forward.obj.String(), spec) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	for x != nil && zslLexValueLteMax(x.obj.String(), spec) {
+		next := x.level[0].forward
+		zslDeleteNode(zsl, x, update)
+		delete(dict, x.obj.String())
+		removed++
+		x = next
+	}
+	return removed
+}
+
+// 删除跳表中排名在[start,end]区间内的所有节点，排名从1开始
+func zslDeleteRangeByRank(zsl *zskiplist, start int64, end int64, dict map[string]*float64) int64 {
+	update := make([]*zskiplistNode, ZSKIPLIST_MAXLEVEL)
+	var traversed, removed int64
+	x := zsl.header
+	//基于跨度定位每层索引中排名小于start的最后一个节点
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span < start {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	traversed++
+	x = x.level[0].forward
+	for x != nil && traversed <= end {
+		next := x.level[0].forward
+		zslDeleteNode(zsl, x, update)
+		delete(dict, x.obj.String())
+		removed++
+		traversed++
+		x = next
+	}
+	return removed
+}
+
+/*
+*
+ZREMRANGEBYRANK key start stop
+ZREMRANGEBYSCORE key min max
+ZREMRANGEBYLEX key min max
+*/
+func zremrangeGenericCommand(c *redisClient, rangetype int) {
+	key := c.argv[1]
+	var start, end int64
+	var spec zrangespec
+	var lexspec zlexrangespec
+
+	//解析区间参数
+	if rangetype == ZRANGE_RANK {
+		if !getLongFromObjectOrReply(c, c.argv[2], &start, nil) || !getLongFromObjectOrReply(c, c.argv[3], &end, nil) {
+			return
+		}
+	} else if rangetype == ZRANGE_SCORE {
+		if !zslParseRange(c.argv[2], c.argv[3], &spec) {
+			errMsg := "min or max is not a float"
+			addReplyError(c, &errMsg)
+			return
+		}
+	} else if rangetype == ZRANGE_LEX {
+		if !zslParseLexRange(c.argv[2], c.argv[3], &lexspec) {
+			errMsg := "min or max not valid string range item"
+			addReplyError(c, &errMsg)
+			return
+		}
+	}
+
+	zobj := lookupKeyWriteOrReply(c, key, shared.czero)
+	if zobj == nil || checkType(c, zobj, REDIS_ZSET) {
+		return
+	}
+	zs := (*zobj.ptr).(*zset)
+
+	if rangetype == ZRANGE_RANK {
+		//负数索引从尾部开始计算
+		llen := zs.zsl.length
+		if start < 0 {
+			start = llen + start
+		}
+		if end < 0 {
+			end = llen + end
+		}
+		if start < 0 {
+			start = 0
+		}
+		//start大于等于0，所以end小于0时区间也为空
+		if start > end || start >= llen {
+			addReply(c, shared.czero)
+			return
+		}
+		if end >= llen {
+			end = llen - 1
+		}
+	}
+
+	var deleted int64
+	switch rangetype {
+	case ZRANGE_RANK:
+		deleted = zslDeleteRangeByRank(zs.zsl, start+1, end+1, zs.dict)
+	case ZRANGE_SCORE:
+		deleted = zslDeleteRangeByScore(zs.zsl, &spec, zs.dict)
+	case ZRANGE_LEX:
+		deleted = zslDeleteRangeByLex(zs.zsl, &lexspec, zs.dict)
+	}
+	//有序集合没有元素了则将其从数据库中删除
+	if len(zs.dict) == 0 {
+		dbDelete(c.db, key)
+	}
+	if deleted > 0 {
+		signalModifiedKey(c.db, key)
+	}
+	server.dirty += deleted
+	addReplyLongLong(c, deleted)
+}
+
+func zremrangebyrankCommand(c *redisClient) {
+	zremrangeGenericCommand(c, ZRANGE_RANK)
+}
+
+func zremrangebyscoreCommand(c *redisClient) {
+	zremrangeGenericCommand(c, ZRANGE_SCORE)
+}
+
+func zremrangebylexCommand(c *redisClient) {
+	zremrangeGenericCommand(c, ZRANGE_LEX)
+}
+
+const (
+	//弹出score最小或者最大的元素
+	ZSET_MIN = 0
+	ZSET_MAX = 1
+)
+
+/*
+*
+从keys中第一个非空的有序集合弹出最多count个score最小或者最大的元素，count为-1代表未指定COUNT参数只弹出一个。
+emitkey表示回复中带上key，用于BZPOPMIN、ZMPOP等多key指令，useNestedArray表示每个元素和score组成一个数组，
+replyNilWhenEmpty表示没有元素可以弹出时回复空数组还是nil
+*/
+func genericZpopCommand(c *redisClient, keys []*robj, where int, emitkey bool, count int64, useNestedArray bool, replyNilWhenEmpty bool) {
+	//COUNT为0时无需查找有序集合
+	if count == 0 {
+		if replyNilWhenEmpty {
+			addReplyNullArray(c)
+		} else {
+			addReply(c, shared.emptymultibulk)
+		}
+		return
+	}
+
+	//找到第一个非空的有序集合
+	var key, zobj *robj
+	for _, k := range keys {
+		o := lookupKeyWrite(c.db, k)
+		if o == nil {
+			continue
+		}
+		if checkType(c, o, REDIS_ZSET) {
+			return
+		}
+		key, zobj = k, o
+		break
+	}
+	if zobj == nil {
+		if replyNilWhenEmpty {
+			addReplyNullArray(c)
+		} else {
+			addReply(c, shared.emptymultibulk)
+		}
+		return
+	}
+
+	zs := (*zobj.ptr).(*zset)
+	if count < 0 {
+		count = 1
+	}
+	rangelen := count
+	if rangelen > zs.zsl.length {
+		rangelen = zs.zsl.length
+	}
+
+	//根据是否需要带上key以及是否嵌套数组确定回复的格式
+	if useNestedArray && emitkey {
+		addReplyMultiBulkLen(c, 2)
+		addReplyBulk(c, key)
+		addReplyMultiBulkLen(c, rangelen)
+	} else if useNestedArray {
+		addReplyMultiBulkLen(c, rangelen)
+	} else if emitkey {
+		addReplyMultiBulkLen(c, rangelen*2+1)
+		addReplyBulk(c, key)
+	} else {
+		addReplyMultiBulkLen(c, rangelen*2)
+	}
+
+	//依次从跳表的头部或者尾部弹出元素
+	for j := int64(0); j < rangelen; j++ {
+		var x *zskiplistNode
+		if where == ZSET_MIN {
+			x = zs.zsl.header.level[0].forward
+		} else {
+			x = zs.zsl.tail
+		}
+		ele, score := x.obj, x.score
+		zslDelete(zs.zsl, score, ele)
+		delete(zs.dict, ele.String())
+
+		if useNestedArray {
+			addReplyMultiBulkLen(c, 2)
+		}
+		addReplyBulk(c, ele)
+		addReplyDouble(c, score)
+	}
+
+	//有序集合没有元素了则将其从数据库中删除
+	if zs.zsl.length == 0 {
+		dbDelete(c.db, key)
+	}
+	signalModifiedKey(c.db, key)
+	server.dirty += rangelen
+
+	//多key的指令以ZPOPMIN/ZPOPMAX key count的形式传播
+	if emitkey {
+		countObj := createStringObjectFromLongLong(rangelen)
+		if where == ZSET_MAX {
+			rewriteClientCommandVector(c, shared.zpopmax, key, countObj)
+		} else {
+			rewriteClientCommandVector(c, shared.zpopmin, key, countObj)
+		}
+	}
+}
+
+// ZPOPMIN/ZPOPMAX key [count]
+func zpopMinMaxCommand(c *redisClient, where int) {
+	if c.argc > 3 {
+		addReply(c, shared.syntaxerr)
+		return
+	}
+	count := int64(-1)
+	if c.argc == 3 && !getPositiveLongFromObjectOrReply(c, c.argv[2], &count, nil) {
+		return
+	}
+	//RESP3下指定了count则每个元素和score组成一个数组
+	useNestedArray := c.resp > 2 && count != -1
+	genericZpopCommand(c, c.argv[1:2], where, false, count, useNestedArray, false)
+}
+
+func zpopminCommand(c *redisClient) {
+	zpopMinMaxCommand(c, ZSET_MIN)
+}
+
+func zpopmaxCommand(c *redisClient) {
+	zpopMinMaxCommand(c, ZSET_MAX)
+}
+
+/*
+*
+BZPOPMIN、BZPOPMAX和BZMPOP的阻塞弹出，有序集合都为空时阻塞客户端，
+直到有序集合被创建或者超时，count为-1代表BZPOPMIN和BZPOPMAX只弹出一个元素
+*/
+func blockingGenericZpopCommand(c *redisClient, keys []*robj, where int, timeoutIdx int, count int64, useNestedArray bool, replyNilWhenEmpty bool) {
+	var timeout int64
+	if getTimeoutFromObjectOrReply(c, c.argv[timeoutIdx], &timeout, UNIT_SECONDS) != REDIS_OK {
+		return
+	}
+	for _, key := range keys {
+		o := lookupKeyWrite(c.db, key)
+		if o == nil {
+			continue
+		}
+		if checkType(c, o, REDIS_ZSET) {
+			return
+		}
+		//非空的有序集合，等同于非阻塞的弹出
+		genericZpopCommand(c, []*robj{key}, where, true, count, useNestedArray, replyNilWhenEmpty)
+		return
+	}
+
+	//事务中不能阻塞，只能当做超时处理
+	if c.flags&REDIS_MULTI > 0 {
+		addReplyNullArray(c)
+		return
+	}
+	//所有的有序集合都为空则阻塞客户端
+	blockForKeys(c, REDIS_BLOCKED_ZSET, keys, timeout)
+}
+
+// BZPOPMIN key [key ...] timeout
+func bzpopminCommand(c *redisClient) {
+	blockingGenericZpopCommand(c, c.argv[1:c.argc-1], ZSET_MIN, int(c.argc-1), -1, false, false)
+}
+
+// BZPOPMAX key [key ...] timeout
+func bzpopmaxCommand(c *redisClient) {
+	blockingGenericZpopCommand(c, c.argv[1:c.argc-1], ZSET_MAX, int(c.argc-1), -1, false, false)
+}
+
+/*
+*
+解析ZMPOP和BZMPOP的参数: numkeys key [key ...] MIN|MAX [COUNT count]，
+numkeysIdx为numkeys参数的位置，然后从第一个非空的有序集合弹出元素
+*/
+func zmpopGenericCommand(c *redisClient, numkeysIdx int, isBlock bool) {
+	var numkeys int64
+	var where int
+	count := int64(-1)
+	errMsg := "numkeys should be greater than 0"
+	if !getRangeLongFromObjectOrReply(c, c.argv[numkeysIdx], 1, math.MaxInt64, &numkeys, &errMsg) {
+		return
+	}
+	//whereIdx为MIN|MAX参数的位置
+	whereIdx := numkeysIdx + 1 + int(numkeys)
+	if numkeys >= int64(c.argc) || whereIdx >= int(c.argc) {
+		addReply(c, shared.syntaxerr)
+		return
+	}
+	opt := c.argv[whereIdx].String()
+	if strings.EqualFold(opt, "min") {
+		where = ZSET_MIN
+	} else if strings.EqualFold(opt, "max") {
+		where = ZSET_MAX
+	} else {
+		addReply(c, shared.syntaxerr)
+		return
+	}
+	//解析可选参数COUNT
+	for j := whereIdx + 1; j < int(c.argc); j++ {
+		opt := c.argv[j].String()
+		moreargs := int(c.argc) - 1 - j
+		if count == -1 && strings.EqualFold(opt, "count") && moreargs > 0 {
+			j++
+			errMsg := "count should be greater than 0"
+			if !getRangeLongFromObjectOrReply(c, c.argv[j], 1, math.MaxInt64, &count, &errMsg) {
+				return
+			}
+		} else {
+			addReply(c, shared.syntaxerr)
+			return
+		}
+	}
+	if count == -1 {
+		count = 1
+	}
+
+	keys := c.argv[numkeysIdx+1 : whereIdx]
+	if isBlock {
+		blockingGenericZpopCommand(c, keys, where, 1, count, true, true)
+	} else {
+		genericZpopCommand(c, keys, where, true, count, true, true)
+	}
+}
+
+// ZMPOP numkeys key [key ...] MIN|MAX [COUNT count]
+func zmpopCommand(c *redisClient) {
+	zmpopGenericCommand(c, 1, false)
+}
+
+// BZMPOP timeout numkeys key [key ...] MIN|MAX [COUNT count]
+func bzmpopCommand(c *redisClient) {
+	zmpopGenericCommand(c, 2, true)
+}
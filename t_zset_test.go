@@ -2,7 +2,9 @@ package main
 
 import (
 	"log"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestCreateZskipList(t *testing.T) {
@@ -83,3 +85,438 @@ func printZskipListNode(zsl *zskiplist) {
 		log.Println("*********** level", i, " end ***********")
 	}
 }
+
+func TestZslDup(t *testing.T) {
+	zsl := zslCreate()
+	for i := 0; i < 1000; i++ {
+		s := "m" + strconv.Itoa(i)
+		zslInsert(zsl, float64(i%100), createStringObject(&s, len(s)))
+	}
+	copied := zslDup(zsl)
+	if copied.length != zsl.length || copied.level != zsl.level || copied.tail.obj != zsl.tail.obj {
+		t.Fatal("跳表复制后长度、层高或尾节点不一致")
+	}
+	//每个节点的层高、跨度和后退指针都与原跳表一致
+	x, y := zsl.header, copied.header
+	for x != nil {
+		if y == nil || len(x.level) != len(y.level) || x.score != y.score || x.obj != y.obj ||
+			(x.backward == nil) != (y.backward == nil) || (x.backward != nil && x.backward.obj != y.backward.obj) {
+			t.Fatal("复制的节点与原节点不一致")
+		}
+		for i := range x.level {
+			if x.level[i].span != y.level[i].span {
+				t.Fatal("复制的节点跨度不一致")
+			}
+		}
+		x, y = x.level[0].forward, y.level[0].forward
+	}
+	for x = zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		if zslGetRank(copied, x.score, x.obj) != zslGetRank(zsl, x.score, x.obj) {
+			t.Fatal("复制后的排名不一致")
+		}
+	}
+
+	//修改副本不影响原跳表
+	zslDelete(copied, zsl.tail.score, zsl.tail.obj)
+	s := "new"
+	zslInsert(copied, -1, createStringObject(&s, len(s)))
+	if zsl.length != 1000 || zsl.header.level[0].forward.obj.String() == "new" || copied.tail.obj == zsl.tail.obj {
+		t.Error("修改副本影响了原跳表")
+	}
+	if zslGetRank(copied, -1, createStringObject(&s, len(s))) != 1 || zslGetElementByRank(copied, 1000).obj.String() != copied.tail.obj.String() {
+		t.Error("副本的排名不正确")
+	}
+}
+
+func TestZslRangeSeek(t *testing.T) {
+	zsl := zslCreate()
+	for i := 1; i <= 100; i++ {
+		zslInsert(zsl, float64(i), testStringObject("m"+strconv.Itoa(i)))
+	}
+
+	//基于排名定位节点
+	if x := zslGetElementByRank(zsl, 42); x == nil || x.score != 42 {
+		t.Fatal("zslGetElementByRank定位节点错误")
+	}
+	if zslGetElementByRank(zsl, 101) != nil {
+		t.Fatal("超出范围的排名不应返回节点")
+	}
+
+	//(10,20]区间的第一个、最后一个以及第n个节点
+	spec := &zrangespec{min: 10, max: 20, minex: true}
+	if x := zslFirstInRange(zsl, spec); x == nil || x.score != 11 {
+		t.Fatal("zslFirstInRange定位节点错误")
+	}
+	if x := zslLastInRange(zsl, spec); x == nil || x.score != 20 {
+		t.Fatal("zslLastInRange定位节点错误")
+	}
+	if x := zslNthInRange(zsl, spec, 3); x == nil || x.score != 14 {
+		t.Fatal("zslNthInRange定位节点错误")
+	}
+	if x := zslNthInRange(zsl, spec, -2); x == nil || x.score != 19 {
+		t.Fatal("zslNthInRange逆序定位节点错误")
+	}
+	if zslNthInRange(zsl, spec, 10) != nil || zslNthInRange(zsl, spec, -11) != nil {
+		t.Fatal("超出区间的节点不应返回")
+	}
+	for _, empty := range []*zrangespec{{min: 5, max: 5, maxex: true}, {min: 20, max: 10}, {min: 100, max: 200, minex: true}, {min: 10.2, max: 10.8}} {
+		if zslFirstInRange(zsl, empty) != nil || zslLastInRange(zsl, empty) != nil {
+			t.Fatalf("空区间%v不应返回节点", *empty)
+		}
+	}
+
+	//score相同的元素按照字典序排列
+	lex := zslCreate()
+	for _, member := range []string{"a", "b", "c", "d", "e"} {
+		zslInsert(lex, 0, testStringObject(member))
+	}
+	lexspec := &zlexrangespec{min: "b", max: "d", maxex: true}
+	if x := zslFirstInLexRange(lex, lexspec); x == nil || x.obj.String() != "b" {
+		t.Fatal("zslFirstInLexRange定位节点错误")
+	}
+	if x := zslLastInLexRange(lex, lexspec); x == nil || x.obj.String() != "c" {
+		t.Fatal("zslLastInLexRange定位节点错误")
+	}
+	unbounded := &zlexrangespec{minInf: -1, maxInf: 1, minex: true, maxex: true}
+	if x := zslNthInLexRange(lex, unbounded, -1); x == nil || x.obj.String() != "e" {
+		t.Fatal("zslNthInLexRange定位节点错误")
+	}
+	if zslFirstInLexRange(lex, &zlexrangespec{minInf: 1, maxInf: 1, minex: true, maxex: true}) != nil {
+		t.Fatal("空区间不应返回节点")
+	}
+}
+
+func TestZrangeCommands(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+
+	run("ZADD z 1 a 2 b 3 c 4 d 5 e")
+	for command, expected := range map[string]string{
+		"ZRANGE z 0 -1":                            "*5\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\ne\r\n",
+		"ZRANGE z -2 100 WITHSCORES":               "*4\r\n$1\r\nd\r\n$1\r\n4\r\n$1\r\ne\r\n$1\r\n5\r\n",
+		"ZRANGE z 1 2 REV":                         "*2\r\n$1\r\nd\r\n$1\r\nc\r\n",
+		"ZREVRANGE z 0 0 WITHSCORES":               "*2\r\n$1\r\ne\r\n$1\r\n5\r\n",
+		"ZRANGE z 3 1":                             "*0\r\n",
+		"ZRANGE z (1 3 BYSCORE":                    "*2\r\n$1\r\nb\r\n$1\r\nc\r\n",
+		"ZRANGE z +inf -inf BYSCORE REV LIMIT 1 2": "*2\r\n$1\r\nd\r\n$1\r\nc\r\n",
+		"ZRANGEBYSCORE z -inf +inf LIMIT 3 -1":     "*2\r\n$1\r\nd\r\n$1\r\ne\r\n",
+		"ZRANGEBYSCORE z 2 4 WITHSCORES LIMIT 1 1": "*2\r\n$1\r\nc\r\n$1\r\n3\r\n",
+		"ZRANGEBYSCORE z 2 4 LIMIT -1 1":           "*0\r\n",
+		"ZRANGEBYSCORE z 6 10":                     "*0\r\n",
+		"ZREVRANGEBYSCORE z 4 (2":                  "*2\r\n$1\r\nd\r\n$1\r\nc\r\n",
+		"ZREVRANGEBYSCORE z 4 2 LIMIT 2 5":         "*1\r\n$1\r\nb\r\n",
+		"ZRANGE missing 0 -1":                      "*0\r\n",
+		"ZRANGE z 0 -1 LIMIT 0 1":                  "-ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX\r\n",
+		"ZRANGE z - + BYLEX WITHSCORES":            "-ERR syntax error, WITHSCORES not supported in combination with BYLEX\r\n",
+		"ZRANGEBYSCORE z 1 2 REV":                  "-ERR syntax error\r\n",
+		"ZRANGEBYSCORE z a 2":                      "-ERR min or max is not a float\r\n",
+		"ZRANGEBYSCORE z nan 2":                    "-ERR min or max is not a float\r\n",
+		"ZRANGE z a 2":                             "-ERR value is not an integer or out of range\r\n",
+		"ZCOUNT z (1 4":                            ":3\r\n",
+		"ZCOUNT z -inf +inf":                       ":5\r\n",
+		"ZCOUNT z 4 1":                             ":0\r\n",
+		"ZCOUNT missing 1 2":                       ":0\r\n",
+	} {
+		if reply := run(command); reply != expected {
+			t.Errorf("%s: unexpected reply %q", command, reply)
+		}
+	}
+
+	//RESP3下每个元素和score组成一个数组
+	c.resp = 3
+	if reply := run("ZRANGE z 0 0 WITHSCORES"); reply != "*1\r\n*2\r\n$1\r\na\r\n,1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	c.resp = 2
+
+	run("ZADD l 0 a 0 b 0 c 0 d 0 e")
+	for command, expected := range map[string]string{
+		"ZRANGEBYLEX l [b (d":              "*2\r\n$1\r\nb\r\n$1\r\nc\r\n",
+		"ZRANGEBYLEX l - + LIMIT 1 2":      "*2\r\n$1\r\nb\r\n$1\r\nc\r\n",
+		"ZREVRANGEBYLEX l + [c":            "*3\r\n$1\r\ne\r\n$1\r\nd\r\n$1\r\nc\r\n",
+		"ZRANGE l (d + BYLEX":              "*1\r\n$1\r\ne\r\n",
+		"ZRANGE l + - BYLEX REV LIMIT 0 1": "*1\r\n$1\r\ne\r\n",
+		"ZRANGEBYLEX l + -":                "*0\r\n",
+		"ZRANGEBYLEX l b d":                "-ERR min or max not valid string range item\r\n",
+		"ZLEXCOUNT l - +":                  ":5\r\n",
+		"ZLEXCOUNT l [b [b":                ":1\r\n",
+		"ZLEXCOUNT l (b (b":                ":0\r\n",
+		"ZLEXCOUNT l (a [c":                ":2\r\n",
+	} {
+		if reply := run(command); reply != expected {
+			t.Errorf("%s: unexpected reply %q", command, reply)
+		}
+	}
+
+	//ZRANGESTORE将结果存储为新的有序集合，结果为空则删除目标key
+	if reply := run("ZRANGESTORE dst z 2 +inf BYSCORE LIMIT 1 10"); reply != ":3\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("ZRANGE dst 0 -1 WITHSCORES"); reply != "*6\r\n$1\r\nc\r\n$1\r\n3\r\n$1\r\nd\r\n$1\r\n4\r\n$1\r\ne\r\n$1\r\n5\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("ZRANGESTORE dst l [b [c BYLEX"); reply != ":2\r\n" || run("ZCARD dst") != ":2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("ZRANGESTORE dst z 0 -1 WITHSCORES"); reply != "-ERR syntax error\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("ZRANGESTORE dst missing 0 -1"); reply != ":0\r\n" || lookupKey(c.db, testStringObject("dst")) != nil {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestZaddOptions(t *testing.T) {
+	setupTestServer()
+	_, run := newTestClient(t)
+
+	//按顺序执行，后续的用例依赖前面指令修改后的score
+	for _, tc := range []struct{ command, expected string }{
+		{"ZADD z XX 1 a", ":0\r\n"},
+		{"ZCARD z", ":0\r\n"},
+		{"ZADD z XX INCR 1 a", "$-1\r\n"},
+		{"ZADD z 1 a 2 b", ":2\r\n"},
+		{"ZADD z NX 5 a 3 c", ":1\r\n"},
+		{"ZSCORE z a", "$1\r\n1\r\n"},
+		{"ZADD z XX 5 a 4 d", ":0\r\n"},
+		{"ZSCORE z a", "$1\r\n5\r\n"},
+		{"ZSCORE z d", "$-1\r\n"},
+		{"ZADD z CH 6 a 2 b 7 e", ":2\r\n"},
+		{"ZADD z GT CH 1 a 8 b", ":1\r\n"},
+		{"ZRANGE z 0 -1 WITHSCORES", "*8\r\n$1\r\nc\r\n$1\r\n3\r\n$1\r\na\r\n$1\r\n6\r\n$1\r\ne\r\n$1\r\n7\r\n$1\r\nb\r\n$1\r\n8\r\n"},
+		{"ZADD z LT CH 9 a 2 b 0 f", ":2\r\n"},
+		{"ZADD z XX GT CH 10 f 1 c", ":1\r\n"},
+		{"ZADD z INCR 2.5 a", "$3\r\n8.5\r\n"},
+		{"ZADD z GT INCR -1 a", "$-1\r\n"},
+		{"ZADD z NX INCR 1 a", "$-1\r\n"},
+		{"ZINCRBY z 1 g", "$1\r\n1\r\n"},
+		{"ZINCRBY z -0.5 g", "$3\r\n0.5\r\n"},
+		{"ZINCRBY z +inf g", "$3\r\ninf\r\n"},
+		{"ZINCRBY z -inf g", "-ERR resulting score is not a number (NaN)\r\n"},
+		{"ZSCORE z g", "$3\r\ninf\r\n"},
+		{"ZINCRBY z abc g", "-ERR value is not a valid float\r\n"},
+		{"ZADD z nan a", "-ERR value is not a valid float\r\n"},
+		{"ZADD z NX XX 1 a", "-ERR XX and NX options at the same time are not compatible\r\n"},
+		{"ZADD z GT LT 1 a", "-ERR GT, LT, and/or NX options at the same time are not compatible\r\n"},
+		{"ZADD z NX GT 1 a", "-ERR GT, LT, and/or NX options at the same time are not compatible\r\n"},
+		{"ZADD z INCR 1 a 2 b", "-ERR INCR option supports a single increment-element pair\r\n"},
+		{"ZADD z NX CH", "-ERR syntax error\r\n"},
+		{"ZADD z 1 a 2", "-ERR syntax error\r\n"},
+		{"ZCARD z", ":6\r\n"},
+	} {
+		if reply := run(tc.command); reply != tc.expected {
+			t.Errorf("%s: unexpected reply %q", tc.command, reply)
+		}
+	}
+
+}
+
+func TestZsetAggregation(t *testing.T) {
+	setupTestServer()
+	_, run := newTestClient(t)
+
+	run("ZADD z1 1 a 2 b 3 c")
+	run("ZADD z2 10 b 20 c 30 d")
+	//集合作为输入源时元素的score为1
+	run("SADD s c d e")
+	run("SET str x")
+	for command, expected := range map[string]string{
+		"ZUNION 2 z1 z2":                          "*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n",
+		"ZUNION 2 z1 z2 WITHSCORES":               "*8\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$2\r\n12\r\n$1\r\nc\r\n$2\r\n23\r\n$1\r\nd\r\n$2\r\n30\r\n",
+		"ZUNION 2 z1 z2 WEIGHTS 2 0.5 WITHSCORES": "*8\r\n$1\r\na\r\n$1\r\n2\r\n$1\r\nb\r\n$1\r\n9\r\n$1\r\nd\r\n$2\r\n15\r\n$1\r\nc\r\n$2\r\n16\r\n",
+		"ZUNION 2 z1 z2 AGGREGATE MIN WITHSCORES": "*8\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n$1\r\nc\r\n$1\r\n3\r\n$1\r\nd\r\n$2\r\n30\r\n",
+		"ZUNION 3 z1 s missing AGGREGATE max":     "*5\r\n$1\r\na\r\n$1\r\nd\r\n$1\r\ne\r\n$1\r\nb\r\n$1\r\nc\r\n",
+		"ZINTER 2 z1 z2 WITHSCORES":               "*4\r\n$1\r\nb\r\n$2\r\n12\r\n$1\r\nc\r\n$2\r\n23\r\n",
+		"ZINTER 2 z2 z1 AGGREGATE MAX WITHSCORES": "*4\r\n$1\r\nb\r\n$2\r\n10\r\n$1\r\nc\r\n$2\r\n20\r\n",
+		"ZINTER 3 z1 z2 s WITHSCORES":             "*2\r\n$1\r\nc\r\n$2\r\n24\r\n",
+		"ZINTER 2 z1 z1 WEIGHTS 1 3 WITHSCORES":   "*6\r\n$1\r\na\r\n$1\r\n4\r\n$1\r\nb\r\n$1\r\n8\r\n$1\r\nc\r\n$2\r\n12\r\n",
+		"ZINTER 2 z1 missing":                     "*0\r\n",
+		"ZDIFF 2 z1 z2 WITHSCORES":                "*2\r\n$1\r\na\r\n$1\r\n1\r\n",
+		"ZDIFF 2 s z2":                            "*1\r\n$1\r\ne\r\n",
+		"ZDIFF 1 missing":                         "*0\r\n",
+		"ZINTERCARD 2 z1 z2":                      ":2\r\n",
+		"ZINTERCARD 2 z1 z2 LIMIT 1":              ":1\r\n",
+		"ZINTERCARD 2 z1 s LIMIT 0":               ":1\r\n",
+		"ZINTERCARD 0 z1":                         "-ERR at least 1 input key is needed for 'zintercard' command\r\n",
+		"ZINTERCARD 1 z1 LIMIT -1":                "-ERR LIMIT can't be negative\r\n",
+		"ZINTERCARD 2 z1 z2 WITHSCORES":           "-ERR syntax error\r\n",
+		"ZUNION 0 z1":                             "-ERR at least 1 input key is needed for 'zunion' command\r\n",
+		"ZUNION 3 z1 z2":                          "-ERR syntax error\r\n",
+		"ZUNION 2 z1 z2 WEIGHTS 1":                "-ERR syntax error\r\n",
+		"ZUNION 2 z1 z2 WEIGHTS 1 x":              "-ERR weight value is not a float\r\n",
+		"ZUNION 2 z1 z2 AGGREGATE AVG":            "-ERR syntax error\r\n",
+		"ZDIFF 2 z1 z2 WEIGHTS 1 1":               "-ERR syntax error\r\n",
+		"ZUNIONSTORE dst 2 z1 z2 WITHSCORES":      "-ERR syntax error\r\n",
+		"ZUNION 2 z1 str":                         "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+	} {
+		if reply := run(command); reply != expected {
+			t.Errorf("%s: unexpected reply %q", command, reply)
+		}
+	}
+
+	//STORE形式覆盖目标key，结果为空时删除目标key
+	for _, tc := range []struct{ command, expected string }{
+		{"ZUNIONSTORE dst 2 z1 z2 WEIGHTS 1 -1", ":4\r\n"},
+		{"ZRANGE dst 0 -1 WITHSCORES", "*8\r\n$1\r\nd\r\n$3\r\n-30\r\n$1\r\nc\r\n$3\r\n-17\r\n$1\r\nb\r\n$2\r\n-8\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		{"ZINTERSTORE dst 2 z1 s", ":1\r\n"},
+		{"ZSCORE dst c", "$1\r\n4\r\n"},
+		{"ZDIFFSTORE s 1 z1", ":3\r\n"},
+		{"ZCARD s", ":3\r\n"},
+		{"ZDIFFSTORE dst 2 z1 z1", ":0\r\n"},
+		{"ZCARD dst", ":0\r\n"},
+	} {
+		if reply := run(tc.command); reply != tc.expected {
+			t.Errorf("%s: unexpected reply %q", tc.command, reply)
+		}
+	}
+}
+
+func TestZremrangeCommands(t *testing.T) {
+	setupTestServer()
+	_, run := newTestClient(t)
+
+	//按顺序执行，每次删除后基于剩余的元素校验
+	for _, tc := range []struct{ command, expected string }{
+		{"ZADD z 1 a 2 b 3 c 4 d 5 e 6 f 7 g", ":7\r\n"},
+		{"ZREMRANGEBYRANK z 5 3", ":0\r\n"},
+		{"ZREMRANGEBYRANK z 10 20", ":0\r\n"},
+		{"ZREMRANGEBYRANK z -2 100", ":2\r\n"},
+		{"ZREMRANGEBYRANK z 0 0", ":1\r\n"},
+		{"ZRANGE z 0 -1", "*4\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\ne\r\n"},
+		{"ZREMRANGEBYSCORE z (2 4", ":2\r\n"},
+		{"ZREMRANGEBYSCORE z 10 +inf", ":0\r\n"},
+		{"ZRANGE z 0 -1", "*2\r\n$1\r\nb\r\n$1\r\ne\r\n"},
+		{"ZREMRANGEBYSCORE z -inf +inf", ":2\r\n"},
+		{"ZCARD z", ":0\r\n"},
+		{"ZADD l 0 a 0 b 0 c 0 d 0 e", ":5\r\n"},
+		{"ZREMRANGEBYLEX l (a [c", ":2\r\n"},
+		{"ZREMRANGEBYLEX l [x +", ":0\r\n"},
+		{"ZRANGE l 0 -1", "*3\r\n$1\r\na\r\n$1\r\nd\r\n$1\r\ne\r\n"},
+		{"ZREMRANGEBYLEX l - +", ":3\r\n"},
+		{"ZCARD l", ":0\r\n"},
+		{"ZREMRANGEBYRANK missing 0 -1", ":0\r\n"},
+		{"ZREMRANGEBYRANK z a 1", "-ERR value is not an integer or out of range\r\n"},
+		{"ZREMRANGEBYSCORE z a 1", "-ERR min or max is not a float\r\n"},
+		{"ZREMRANGEBYLEX z a b", "-ERR min or max not valid string range item\r\n"},
+	} {
+		if reply := run(tc.command); reply != tc.expected {
+			t.Errorf("%s: unexpected reply %q", tc.command, reply)
+		}
+	}
+
+	//大量元素时基于跨度定位区间，删除后跳表依旧有序且排名正确
+	for i := 0; i < 200; i++ {
+		run("ZADD big " + strconv.Itoa(i) + " m" + strconv.Itoa(i))
+	}
+	if reply := run("ZREMRANGEBYRANK big 50 149"); reply != ":100\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("ZRANGE big 49 50 WITHSCORES"); reply != "*4\r\n$3\r\nm49\r\n$2\r\n49\r\n$4\r\nm150\r\n$3\r\n150\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("ZCOUNT big 0 199"); reply != ":100\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestZsetPop(t *testing.T) {
+	setupTestServer()
+	c, run := newTestClient(t)
+
+	run("ZADD z 1 a 2 b 3 c 4 d")
+	for _, tc := range []struct{ command, expected string }{
+		{"ZPOPMIN z", "*2\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		{"ZPOPMAX z 2", "*4\r\n$1\r\nd\r\n$1\r\n4\r\n$1\r\nc\r\n$1\r\n3\r\n"},
+		{"ZPOPMIN z 0", "*0\r\n"},
+		{"ZPOPMIN z -1", "-ERR value is out of range, must be positive\r\n"},
+		{"ZPOPMIN z 1 2", "-ERR syntax error\r\n"},
+		{"ZPOPMIN z 10", "*2\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{"ZCARD z", ":0\r\n"},
+		{"ZPOPMIN z", "*0\r\n"},
+		{"ZMPOP 2 z y MIN", "*-1\r\n"},
+		{"ZADD y 1 a 2 b 3 c", ":3\r\n"},
+		{"ZMPOP 2 z y MAX COUNT 2", "*2\r\n$1\r\ny\r\n*2\r\n*2\r\n$1\r\nc\r\n$1\r\n3\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{"ZMPOP 0 y MIN", "-ERR numkeys should be greater than 0\r\n"},
+		{"ZMPOP 1 y AVG", "-ERR syntax error\r\n"},
+		{"ZMPOP 2 y MIN", "-ERR syntax error\r\n"},
+		{"ZMPOP 1 y MIN COUNT 0", "-ERR count should be greater than 0\r\n"},
+	} {
+		if reply := run(tc.command); reply != tc.expected {
+			t.Errorf("%s: unexpected reply %q", tc.command, reply)
+		}
+	}
+
+	//ZMPOP以ZPOPMIN/ZPOPMAX key count的形式传播
+	if reply := run("ZMPOP 1 y MIN COUNT 5"); reply != "*2\r\n$1\r\ny\r\n*1\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if c.cmd.name != "ZPOPMIN" || c.argc != 3 || c.argv[2].String() != "1" {
+		t.Errorf("unexpected propagated command %s", c.cmd.name)
+	}
+
+	//RESP3下指定了count则每个元素和score组成一个数组
+	c.resp = 3
+	run("ZADD z 1 a 2 b")
+	if reply := run("ZPOPMIN z 1"); reply != "*1\r\n*2\r\n$1\r\na\r\n,1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := run("ZPOPMIN z"); reply != "*2\r\n$1\r\nb\r\n,2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestBlockingZpop(t *testing.T) {
+	setupTestServer()
+	c1, run1 := newTestClient(t)
+	c2, run2 := newTestClient(t)
+	_, push := newTestClient(t)
+
+	//有序集合不为空时直接弹出元素
+	push("ZADD b 1 x 2 y")
+	if reply := run1("BZPOPMAX a b 0"); reply != "*3\r\n$1\r\nb\r\n$1\r\ny\r\n$1\r\n2\r\n" || c1.flags&REDIS_BLOCKED > 0 {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if c1.cmd.name != "ZPOPMAX" {
+		t.Errorf("unexpected propagated command %s", c1.cmd.name)
+	}
+	push("ZPOPMIN b")
+
+	//有序集合都为空时按照阻塞的顺序唤醒客户端
+	if reply := run1("BZPOPMIN a b 0"); reply != "" || c1.flags&REDIS_BLOCKED == 0 {
+		t.Fatalf("the client did not block, reply %q", reply)
+	}
+	if reply := run2("BZMPOP 0 1 b MAX COUNT 5"); reply != "" || c2.flags&REDIS_BLOCKED == 0 {
+		t.Fatalf("the client did not block, reply %q", reply)
+	}
+	//其他类型的key不会唤醒客户端
+	push("RPUSH b x")
+	if c1.flags&REDIS_BLOCKED == 0 {
+		t.Fatal("the client was served by a list")
+	}
+	push("DEL b")
+	push("ZADD b 1 m 2 n 3 o")
+	if reply := testBlockedReply(t, c1); reply != "*3\r\n$1\r\nb\r\n$1\r\nm\r\n$1\r\n1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if reply := testBlockedReply(t, c2); reply != "*2\r\n$1\r\nb\r\n*2\r\n*2\r\n$1\r\no\r\n$1\r\n3\r\n*2\r\n$1\r\nn\r\n$1\r\n2\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if lookupKey(c1.db, testStringObject("b")) != nil || len(c1.db.blockingKeys) != 0 {
+		t.Error("the served keys were not cleaned up")
+	}
+
+	//超时后回复空数组
+	run1("BZPOPMIN a 0.01")
+	time.Sleep(20 * time.Millisecond)
+	clientsCronHandleTimeout(c1, time.Now().UnixMilli())
+	if reply := testBlockedReply(t, c1); reply != "*-1\r\n" || len(c1.db.blockingKeys) != 0 {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	//事务中不会阻塞
+	run1("MULTI")
+	run1("BZPOPMIN a 0")
+	if reply := run1("EXEC"); reply != "*1\r\n*-1\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"math"
 	"strconv"
+	"strings"
 )
 
 func string2l(s *string, len int, lval *int64) bool {
@@ -17,3 +21,286 @@ func string2l(s *string, len int, lval *int64) bool {
 	*lval = llval
 	return true
 }
+
+/*
+*
+split a line into arguments, where every argument can be in the
+following programming-language REPL-alike form:
+
+	foo bar "newline are supported\n" and "\xff\x00otherstuff"
+
+the number of arguments is returned by the slice length, the second return
+value is false if the input contains unbalanced quotes or closed quotes
+followed by non space characters as in: "foo"bar or "foo'.
+*/
+func sdssplitargs(line string) ([]string, bool) {
+	args := make([]string, 0)
+	p := 0
+	for {
+		//skip blanks
+		for p < len(line) && isspace(line[p]) {
+			p++
+		}
+		if p == len(line) {
+			return args, true
+		}
+
+		inq := false  //set to true if we are in "quotes"
+		insq := false //set to true if we are in 'single quotes'
+		done := false
+		current := make([]byte, 0)
+
+		for !done {
+			if inq {
+				if p == len(line) {
+					//unterminated quotes
+					return nil, false
+				}
+				if line[p] == '\\' && p+3 < len(line) && line[p+1] == 'x' &&
+					isHexDigit(line[p+2]) && isHexDigit(line[p+3]) {
+					current = append(current, hexDigitToInt(line[p+2])*16+hexDigitToInt(line[p+3]))
+					p += 3
+				} else if line[p] == '\\' && p+1 < len(line) {
+					p++
+					switch line[p] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[p])
+					}
+				} else if line[p] == '"' {
+					//closing quote must be followed by a space or nothing at all.
+					if p+1 < len(line) && !isspace(line[p+1]) {
+						return nil, false
+					}
+					done = true
+				} else {
+					current = append(current, line[p])
+				}
+			} else if insq {
+				if p == len(line) {
+					//unterminated quotes
+					return nil, false
+				}
+				if line[p] == '\\' && p+1 < len(line) && line[p+1] == '\'' {
+					p++
+					current = append(current, '\'')
+				} else if line[p] == '\'' {
+					//closing quote must be followed by a space or nothing at all.
+					if p+1 < len(line) && !isspace(line[p+1]) {
+						return nil, false
+					}
+					done = true
+				} else {
+					current = append(current, line[p])
+				}
+			} else {
+				if p == len(line) {
+					done = true
+					break
+				}
+				switch line[p] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					current = append(current, line[p])
+				}
+			}
+			if p < len(line) {
+				p++
+			}
+		}
+		//add the token to the arguments slice
+		args = append(args, string(current))
+	}
+}
+
+func isspace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitToInt(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10
+	}
+	return 0
+}
+
+/*
+*
+return a quoted representation of the string, that can be parsed back by sdssplitargs,
+non printable characters are escaped as "\n", "\r", "\t", "\a", "\b" or "\x<hex-number>".
+*/
+func sdscatrepr(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case '\t':
+			b.WriteString("\\t")
+		case '\a':
+			b.WriteString("\\a")
+		case '\b':
+			b.WriteString("\\b")
+		default:
+			if c >= ' ' && c <= '~' {
+				b.WriteByte(c)
+			} else {
+				b.WriteString(fmt.Sprintf("\\x%02x", c))
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// glob-style pattern matching.
+func stringmatchlen(pattern string, str string, nocase bool) bool {
+	p := 0
+	s := 0
+	for p < len(pattern) && s < len(str) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true //match
+			}
+			for s < len(str) {
+				if stringmatchlen(pattern[p+1:], str[s:], nocase) {
+					return true //match
+				}
+				s++
+			}
+			return false //no match
+		case '?':
+			s++
+		case '[':
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			match := false
+			for {
+				if p < len(pattern) && pattern[p] == '\\' && p+1 < len(pattern) {
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				} else if p >= len(pattern) || pattern[p] == ']' {
+					break
+				} else if p+2 < len(pattern) && pattern[p+1] == '-' {
+					start := pattern[p]
+					end := pattern[p+2]
+					c := str[s]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start = toLower(start)
+						end = toLower(end)
+						c = toLower(c)
+					}
+					p += 2
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if nocase {
+					if toLower(pattern[p]) == toLower(str[s]) {
+						match = true
+					}
+				} else if pattern[p] == str[s] {
+					match = true
+				}
+				p++
+			}
+			if p >= len(pattern) {
+				//the pattern ended without ']', the last character was consumed as part of the set.
+				p--
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false //no match
+			}
+			s++
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+		default:
+			if nocase {
+				if toLower(pattern[p]) != toLower(str[s]) {
+					return false //no match
+				}
+			} else if pattern[p] != str[s] {
+				return false //no match
+			}
+			s++
+		}
+		p++
+	}
+	if s == len(str) {
+		for p < len(pattern) && pattern[p] == '*' {
+			p++
+		}
+	}
+	return p == len(pattern) && s == len(str)
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+// convert a bool into the 0 or 1 reported by INFO.
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// generate a random string of len hex characters, used for the replication IDs.
+func getRandomHexChars(len int) string {
+	buf := make([]byte, (len+1)/2)
+	if _, err := rand.Read(buf); err != nil {
+		panic("unable to read random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(buf)[:len]
+}
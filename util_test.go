@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSdssplitargs(t *testing.T) {
+	cases := []struct {
+		line string
+		args []string
+	}{
+		{"", []string{}},
+		{"  PING  ", []string{"PING"}},
+		{"SET key value", []string{"SET", "key", "value"}},
+		{"SET key \"hello world\"", []string{"SET", "key", "hello world"}},
+		{"SET key \"a\\nb\\x41\"", []string{"SET", "key", "a\nbA"}},
+		{"SET key 'it\\'s'", []string{"SET", "key", "it's"}},
+		{"SET key \"\"", []string{"SET", "key", ""}},
+	}
+
+	for _, tc := range cases {
+		args, ok := sdssplitargs(tc.line)
+		if !ok {
+			t.Errorf("failed to split %q", tc.line)
+			continue
+		}
+		if !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("split %q got %q, expected %q", tc.line, args, tc.args)
+		}
+	}
+
+	for _, line := range []string{"SET key \"value", "SET key 'value", "SET key \"a\"b"} {
+		if _, ok := sdssplitargs(line); ok {
+			t.Errorf("unbalanced quotes accepted: %q", line)
+		}
+	}
+}
+
+func TestStringmatchlen(t *testing.T) {
+	cases := []struct {
+		pattern string
+		str     string
+		nocase  bool
+		match   bool
+	}{
+		{"*", "anything", false, true},
+		{"*", "", false, true},
+		{"max*", "maxmemory", false, true},
+		{"*memory", "maxmemory", false, true},
+		{"h?llo", "hello", false, true},
+		{"h?llo", "hllo", false, false},
+		{"h[ae]llo", "hallo", false, true},
+		{"h[ae]llo", "hillo", false, false},
+		{"h[^e]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"h[a-b]llo", "hbllo", false, true},
+		{"h\\*llo", "h*llo", false, true},
+		{"h\\*llo", "hello", false, false},
+		{"PORT", "port", true, true},
+		{"PORT", "port", false, false},
+		{"news.*", "news.sport", false, true},
+		{"news.*", "weather.sport", false, false},
+	}
+	for _, tc := range cases {
+		if stringmatchlen(tc.pattern, tc.str, tc.nocase) != tc.match {
+			t.Errorf("stringmatchlen(%q, %q, %v) expected %v", tc.pattern, tc.str, tc.nocase, tc.match)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+/*
+*
+ziplist, the compact encoding of the small lists, hashes and sorted sets saved in
+the RDB files by redis before the version 10. ziplists are never created, they are
+only decoded when such a file is loaded:
+
+	<zlbytes:4> <zltail:4> <zllen:2> <entry> ... <entry> <zlend:0xFF>
+
+every entry is made of the length of the previous entry, the encoding and the data.
+the lengths of the strings are stored big endian, the integers little endian.
+*/
+const (
+	ZIPLIST_HEADER_SIZE = 10
+	ZIP_END             = 0xFF
+	ZIP_BIG_PREVLEN     = 0xFE
+
+	ZIP_STR_MASK    = 0xC0
+	ZIP_STR_06B     = 0 << 6
+	ZIP_STR_14B     = 1 << 6
+	ZIP_STR_32B     = 2 << 6
+	ZIP_INT_16B     = 0xC0 | 0<<4
+	ZIP_INT_32B     = 0xC0 | 1<<4
+	ZIP_INT_64B     = 0xC0 | 2<<4
+	ZIP_INT_24B     = 0xC0 | 3<<4
+	ZIP_INT_8B      = 0xFE
+	ZIP_INT_IMM_MIN = 0xF1 /* 11110001 */
+	ZIP_INT_IMM_MAX = 0xFD /* 11111101 */
+)
+
+/*
+*
+return the elements of the ziplist, the integers are converted to strings.
+false is returned if the ziplist is corrupted, no byte out of its bounds is read.
+*/
+func ziplistElements(zl []byte) ([]string, bool) {
+	if len(zl) < ZIPLIST_HEADER_SIZE+1 || int(binary.LittleEndian.Uint32(zl[0:4])) != len(zl) || zl[len(zl)-1] != ZIP_END {
+		return nil, false
+	}
+	end := len(zl) - 1
+	elements := make([]string, 0)
+	p := ZIPLIST_HEADER_SIZE
+	for zl[p] != ZIP_END {
+		//skip the length of the previous entry.
+		if zl[p] == ZIP_BIG_PREVLEN {
+			p += 5
+		} else {
+			p++
+		}
+		if p >= end {
+			return nil, false
+		}
+		enc := zl[p]
+		hdrlen, datalen := 1, 0
+		switch {
+		case enc&ZIP_STR_MASK == ZIP_STR_06B:
+			datalen = int(enc & 0x3F)
+		case enc&ZIP_STR_MASK == ZIP_STR_14B:
+			hdrlen = 2
+			if p+hdrlen > end {
+				return nil, false
+			}
+			datalen = int(enc&0x3F)<<8 | int(zl[p+1])
+		case enc&ZIP_STR_MASK == ZIP_STR_32B:
+			hdrlen = 5
+			if p+hdrlen > end {
+				return nil, false
+			}
+			datalen = int(binary.BigEndian.Uint32(zl[p+1 : p+5]))
+		case enc == ZIP_INT_8B:
+			datalen = 1
+		case enc == ZIP_INT_16B:
+			datalen = 2
+		case enc == ZIP_INT_24B:
+			datalen = 3
+		case enc == ZIP_INT_32B:
+			datalen = 4
+		case enc == ZIP_INT_64B:
+			datalen = 8
+		case enc >= ZIP_INT_IMM_MIN && enc <= ZIP_INT_IMM_MAX:
+		default:
+			return nil, false
+		}
+		if p+hdrlen+datalen > end {
+			return nil, false
+		}
+		data := zl[p+hdrlen : p+hdrlen+datalen]
+		var value int64
+		switch {
+		case enc&ZIP_STR_MASK != 0xC0:
+			elements = append(elements, string(data))
+			p += hdrlen + datalen
+			continue
+		case enc == ZIP_INT_8B:
+			value = int64(int8(data[0]))
+		case enc == ZIP_INT_16B:
+			value = int64(int16(binary.LittleEndian.Uint16(data)))
+		case enc == ZIP_INT_24B:
+			//the 24 bits are shifted in the high bits of an int32, to keep the sign.
+			value = int64(int32(uint32(data[0])<<8|uint32(data[1])<<16|uint32(data[2])<<24) >> 8)
+		case enc == ZIP_INT_32B:
+			value = int64(int32(binary.LittleEndian.Uint32(data)))
+		case enc == ZIP_INT_64B:
+			value = int64(binary.LittleEndian.Uint64(data))
+		default:
+			//the immediate integers from 0 to 12 are stored in the encoding.
+			value = int64(enc&0x0F) - 1
+		}
+		elements = append(elements, strconv.FormatInt(value, 10))
+		p += hdrlen + datalen
+	}
+	//the length in the header is only valid when it fits in 16 bits.
+	if zllen := int(binary.LittleEndian.Uint16(zl[8:10])); zllen != 65535 && zllen != len(elements) {
+		return nil, false
+	}
+	return elements, true
+}